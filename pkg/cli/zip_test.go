@@ -92,6 +92,7 @@ table_name NOT IN (
 	'predefined_comments',
 	'session_trace',
 	'session_variables',
+	'statement_diagnostics_requests_live',
   'table_spans',
 	'tables',
 	'cluster_statement_statistics',
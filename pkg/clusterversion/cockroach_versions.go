@@ -408,6 +408,41 @@ const (
 	// columnar scans in the KV layer.
 	V23_1_KVDirectColumnarScans
 
+	// V23_1AlterSystemStatementDiagnosticsAddBundleURL adds a bundle_url column
+	// to the system.statement_diagnostics table.
+	V23_1AlterSystemStatementDiagnosticsAddBundleURL
+
+	// V23_1AlterSystemStatementDiagnosticsRequestsAddPatternType adds a
+	// pattern_type column to the system.statement_diagnostics_requests table.
+	V23_1AlterSystemStatementDiagnosticsRequestsAddPatternType
+
+	// V23_1AlterSystemStatementDiagnosticsAddCPUProfile adds a
+	// capture_cpu_profile column to the system.statement_diagnostics_requests
+	// table and a cpu_profile column to the system.statement_diagnostics table.
+	V23_1AlterSystemStatementDiagnosticsAddCPUProfile
+
+	// V23_1AlterSystemStatementDiagnosticsRequestsAddMinSpanDuration adds a
+	// min_span_duration column to the system.statement_diagnostics_requests
+	// table.
+	V23_1AlterSystemStatementDiagnosticsRequestsAddMinSpanDuration
+
+	// V23_1AlterSystemStatementDiagnosticsAddErrorMessage adds an
+	// error_message column to the system.statement_diagnostics table.
+	V23_1AlterSystemStatementDiagnosticsAddErrorMessage
+
+	// V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles
+	// adds the capture_on_error and max_bundles columns to the
+	// system.statement_diagnostics_requests table.
+	V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles
+
+	// V23_1AlterSystemStatementDiagnosticsAddBundleSize adds a bundle_size
+	// column to the system.statement_diagnostics table.
+	V23_1AlterSystemStatementDiagnosticsAddBundleSize
+
+	// V23_1AlterSystemStatementDiagnosticsRequestsAddRequestedBy adds a
+	// requested_by column to the system.statement_diagnostics_requests table.
+	V23_1AlterSystemStatementDiagnosticsRequestsAddRequestedBy
+
 	// *************************************************
 	// Step (1): Add new versions here.
 	// Do not add new versions to a patch release.
@@ -702,6 +737,38 @@ var rawVersionsSingleton = keyedVersions{
 		Key:     V23_1_KVDirectColumnarScans,
 		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 34},
 	},
+	{
+		Key:     V23_1AlterSystemStatementDiagnosticsAddBundleURL,
+		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 36},
+	},
+	{
+		Key:     V23_1AlterSystemStatementDiagnosticsRequestsAddPatternType,
+		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 38},
+	},
+	{
+		Key:     V23_1AlterSystemStatementDiagnosticsAddCPUProfile,
+		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 40},
+	},
+	{
+		Key:     V23_1AlterSystemStatementDiagnosticsRequestsAddMinSpanDuration,
+		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 42},
+	},
+	{
+		Key:     V23_1AlterSystemStatementDiagnosticsAddErrorMessage,
+		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 44},
+	},
+	{
+		Key:     V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles,
+		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 46},
+	},
+	{
+		Key:     V23_1AlterSystemStatementDiagnosticsAddBundleSize,
+		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 48},
+	},
+	{
+		Key:     V23_1AlterSystemStatementDiagnosticsRequestsAddRequestedBy,
+		Version: roachpb.Version{Major: 22, Minor: 2, Internal: 50},
+	},
 
 	// *************************************************
 	// Step (2): Add new versions here.
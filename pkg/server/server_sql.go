@@ -82,8 +82,10 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/flowinfra"
 	"github.com/cockroachdb/cockroach/pkg/sql/gcjob/gcjobnotifier"
 	"github.com/cockroachdb/cockroach/pkg/sql/idxusage"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
 	"github.com/cockroachdb/cockroach/pkg/sql/optionalnodeliveness"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire"
+	"github.com/cockroachdb/cockroach/pkg/sql/privilege"
 	"github.com/cockroachdb/cockroach/pkg/sql/querycache"
 	"github.com/cockroachdb/cockroach/pkg/sql/rangeprober"
 	"github.com/cockroachdb/cockroach/pkg/sql/scheduledlogging"
@@ -100,6 +102,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/stats"
 	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/sql/syntheticprivilege"
 	"github.com/cockroachdb/cockroach/pkg/sql/syntheticprivilegecache"
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/fs"
@@ -1142,6 +1145,38 @@ func newSQLServer(ctx context.Context, cfg sqlServerArgs) (*SQLServer, error) {
 		cfg.Settings,
 	)
 	execCfg.StmtDiagnosticsRecorder = stmtDiagnosticsRegistry
+	cfg.registry.AddMetricStruct(stmtDiagnosticsRegistry.Metrics())
+	// Send the collected statement bundles to the sinks configured by the
+	// sql.stmt_diagnostics cluster settings, through the external connections
+	// on which the users that requested them have the USAGE privilege.
+	bundleSinks := stmtdiagnostics.NewBundleSinks(stmtDiagnosticsRegistry,
+		func(ctx context.Context, txn isql.Txn, user username.SQLUsername, name string) error {
+			p, cleanup := sql.NewInternalPlanner(
+				"stmt-diag-bundle-sinks",
+				txn.KV(),
+				user,
+				&sql.MemoryMetrics{},
+				execCfg,
+				sessiondatapb.SessionData{},
+			)
+			defer cleanup()
+			return p.(sql.AuthorizationAccessor).CheckPrivilege(ctx,
+				&syntheticprivilege.ExternalConnectionPrivilege{ConnectionName: name}, privilege.USAGE)
+		},
+		cfg.externalStorageFromURI,
+	)
+	for _, notify := range []func(context.Context, *stmtdiagnostics.Bundle){
+		bundleSinks.NotifySlack,
+		bundleSinks.NotifyMSTeams,
+		bundleSinks.NotifyS3,
+		bundleSinks.NotifyGCS,
+		bundleSinks.NotifyAzureBlob,
+		bundleSinks.NotifyWebDAV,
+		bundleSinks.NotifyEmail,
+		bundleSinks.NotifyPagerDuty,
+	} {
+		stmtDiagnosticsRegistry.OnBundleCollected(notify)
+	}
 
 	var upgradeMgr *upgrademanager.Manager
 	{
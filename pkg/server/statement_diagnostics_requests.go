@@ -17,6 +17,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/clusterversion"
 	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
+	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
@@ -82,12 +83,19 @@ func (s *statusServer) CreateStatementDiagnosticsReport(
 		Report: &serverpb.StatementDiagnosticsReport{},
 	}
 
-	err := s.stmtDiagnosticsRequester.InsertRequest(
+	requestedBy, err := userFromContext(ctx)
+	if err != nil {
+		return nil, serverError(ctx, err)
+	}
+	err = s.stmtDiagnosticsRequester.InsertRequestWithOptions(
 		ctx,
 		req.StatementFingerprint,
-		req.SamplingProbability,
-		req.MinExecutionLatency,
-		req.ExpiresAfter,
+		sql.StmtDiagRequestOptions{
+			MinLatency:   req.MinExecutionLatency,
+			SamplingRate: req.SamplingProbability,
+			ExpiresAfter: req.ExpiresAfter,
+			RequestedBy:  requestedBy,
+		},
 	)
 	if err != nil {
 		return nil, err
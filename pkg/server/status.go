@@ -65,6 +65,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/catconstants"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlinstance"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/insights"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
 	"github.com/cockroachdb/cockroach/pkg/util/grpcutil"
@@ -552,7 +553,9 @@ type StmtDiagnosticsRequester interface {
 	// InsertRequest adds an entry to system.statement_diagnostics_requests for
 	// tracing a query with the given fingerprint. Once this returns, calling
 	// stmtdiagnostics.ShouldCollectDiagnostics() on the current node will
-	// return true depending on the parameters below.
+	// return true depending on the parameters below. There can be multiple
+	// pending requests for the same fingerprint, in which case they are
+	// satisfied from the oldest to the newest.
 	// - samplingProbability controls how likely we are to try and collect a
 	//  diagnostics report for a given execution. The semantics with
 	//  minExecutionLatency are as follows:
@@ -577,10 +580,28 @@ type StmtDiagnosticsRequester interface {
 		minExecutionLatency time.Duration,
 		expiresAfter time.Duration,
 	) error
+	// InsertRequestWithOptions is like InsertRequest, but the request is
+	// described by opts, which also allows matching the fingerprints with a
+	// pattern, capturing a CPU profile, dropping the short spans from the trace,
+	// restricting the request to the executions that fail, and bounding the
+	// number of bundles collected for it.
+	InsertRequestWithOptions(
+		ctx context.Context, stmtFingerprint string, opts sql.StmtDiagRequestOptions,
+	) error
 	// CancelRequest updates an entry in system.statement_diagnostics_requests
 	// for tracing a query with the given fingerprint to be expired (thus,
 	// canceling any new tracing for it).
 	CancelRequest(ctx context.Context, requestID int64) error
+	// DeleteRequest removes an entry from system.statement_diagnostics_requests
+	// along with the bundle collected for it, if any. Requests that are
+	// collecting a bundle on the current node cannot be deleted.
+	DeleteRequest(ctx context.Context, requestID int64) error
+	// ListRequests returns the entries of system.statement_diagnostics_requests
+	// that are either pending and not expired, or completed.
+	ListRequests(ctx context.Context) ([]stmtdiagnostics.StmtDiagRequest, error)
+	// GetDiagnostics returns the entry of system.statement_diagnostics with the
+	// given ID, which a completed request references, along with its bundle.
+	GetDiagnostics(ctx context.Context, id int64) (*stmtdiagnostics.StmtDiagBundle, error)
 }
 
 // newStatusServer allocates and returns a statusServer.
@@ -438,10 +438,16 @@ CREATE TABLE system.statement_diagnostics_requests(
 	min_execution_latency INTERVAL NULL,
 	expires_at TIMESTAMPTZ NULL,
 	sampling_probability FLOAT NULL,
+	pattern_type STRING NULL,
+	capture_cpu_profile BOOL NULL,
+	min_span_duration INTERVAL NULL,
+	capture_on_error BOOL NULL,
+	max_bundles INT8 NULL,
+	requested_by STRING NULL,
 	CONSTRAINT "primary" PRIMARY KEY (id),
 	CONSTRAINT check_sampling_probability CHECK (sampling_probability BETWEEN 0.0 AND 1.0),
-	INDEX completed_idx (completed, id) STORING (statement_fingerprint, min_execution_latency, expires_at, sampling_probability),
-	FAMILY "primary" (id, completed, statement_fingerprint, statement_diagnostics_id, requested_at, min_execution_latency, expires_at, sampling_probability)
+	INDEX completed_idx (completed, id) STORING (statement_fingerprint, min_execution_latency, expires_at, sampling_probability, pattern_type, capture_cpu_profile, min_span_duration, capture_on_error, max_bundles),
+	FAMILY "primary" (id, completed, statement_fingerprint, statement_diagnostics_id, requested_at, min_execution_latency, expires_at, sampling_probability, pattern_type, capture_cpu_profile, min_span_duration, capture_on_error, max_bundles, requested_by)
 );`
 
 	StatementDiagnosticsTableSchema = `
@@ -453,9 +459,13 @@ create table system.statement_diagnostics(
   trace JSONB,
   bundle_chunks INT ARRAY,
 	error STRING,
+	bundle_url STRING,
+	cpu_profile BYTES,
+	error_message STRING,
+	bundle_size INT8,
 	CONSTRAINT "primary" PRIMARY KEY (id),
 
-	FAMILY "primary" (id, statement_fingerprint, statement, collected_at, trace, bundle_chunks, error)
+	FAMILY "primary" (id, statement_fingerprint, statement, collected_at, trace, bundle_chunks, error, bundle_url, cpu_profile, error_message, bundle_size)
 );`
 
 	ScheduledJobsTableSchema = `
@@ -2181,12 +2191,18 @@ var (
 				{Name: "min_execution_latency", ID: 6, Type: types.Interval, Nullable: true},
 				{Name: "expires_at", ID: 7, Type: types.TimestampTZ, Nullable: true},
 				{Name: "sampling_probability", ID: 8, Type: types.Float, Nullable: true},
+				{Name: "pattern_type", ID: 9, Type: types.String, Nullable: true},
+				{Name: "capture_cpu_profile", ID: 10, Type: types.Bool, Nullable: true},
+				{Name: "min_span_duration", ID: 11, Type: types.Interval, Nullable: true},
+				{Name: "capture_on_error", ID: 12, Type: types.Bool, Nullable: true},
+				{Name: "max_bundles", ID: 13, Type: types.Int, Nullable: true},
+				{Name: "requested_by", ID: 14, Type: types.String, Nullable: true},
 			},
 			[]descpb.ColumnFamilyDescriptor{
 				{
 					Name:        "primary",
-					ColumnNames: []string{"id", "completed", "statement_fingerprint", "statement_diagnostics_id", "requested_at", "min_execution_latency", "expires_at", "sampling_probability"},
-					ColumnIDs:   []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7, 8},
+					ColumnNames: []string{"id", "completed", "statement_fingerprint", "statement_diagnostics_id", "requested_at", "min_execution_latency", "expires_at", "sampling_probability", "pattern_type", "capture_cpu_profile", "min_span_duration", "capture_on_error", "max_bundles", "requested_by"},
+					ColumnIDs:   []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14},
 				},
 			},
 			pk("id"),
@@ -2196,10 +2212,10 @@ var (
 				ID:                  2,
 				Unique:              false,
 				KeyColumnNames:      []string{"completed", "id"},
-				StoreColumnNames:    []string{"statement_fingerprint", "min_execution_latency", "expires_at", "sampling_probability"},
+				StoreColumnNames:    []string{"statement_fingerprint", "min_execution_latency", "expires_at", "sampling_probability", "pattern_type", "capture_cpu_profile", "min_span_duration", "capture_on_error", "max_bundles"},
 				KeyColumnIDs:        []descpb.ColumnID{2, 1},
 				KeyColumnDirections: []catenumpb.IndexColumn_Direction{catenumpb.IndexColumn_ASC, catenumpb.IndexColumn_ASC},
-				StoreColumnIDs:      []descpb.ColumnID{3, 6, 7, 8},
+				StoreColumnIDs:      []descpb.ColumnID{3, 6, 7, 8, 9, 10, 11, 12, 13},
 				Version:             descpb.StrictIndexColumnIDGuaranteesVersion,
 			},
 		),
@@ -2226,13 +2242,18 @@ var (
 				{Name: "trace", ID: 5, Type: types.Jsonb, Nullable: true},
 				{Name: "bundle_chunks", ID: 6, Type: types.IntArray, Nullable: true},
 				{Name: "error", ID: 7, Type: types.String, Nullable: true},
+				{Name: "bundle_url", ID: 8, Type: types.String, Nullable: true},
+				{Name: "cpu_profile", ID: 9, Type: types.Bytes, Nullable: true},
+				{Name: "error_message", ID: 10, Type: types.String, Nullable: true},
+				{Name: "bundle_size", ID: 11, Type: types.Int, Nullable: true},
 			},
 			[]descpb.ColumnFamilyDescriptor{
 				{
 					Name: "primary",
 					ColumnNames: []string{"id", "statement_fingerprint", "statement",
-						"collected_at", "trace", "bundle_chunks", "error"},
-					ColumnIDs: []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7},
+						"collected_at", "trace", "bundle_chunks", "error", "bundle_url", "cpu_profile",
+						"error_message", "bundle_size"},
+					ColumnIDs: []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
 				},
 			},
 			pk("id"),
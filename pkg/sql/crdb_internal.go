@@ -138,6 +138,7 @@ var crdbInternal = virtualSchema{
 		catconstants.CrdbInternalCreateTypeStmtsTableID:             crdbInternalCreateTypeStmtsTable,
 		catconstants.CrdbInternalDatabasesTableID:                   crdbInternalDatabasesTable,
 		catconstants.CrdbInternalSuperRegions:                       crdbInternalSuperRegions,
+		catconstants.CrdbInternalStmtDiagnosticsRequestsLiveTableID: crdbInternalStmtDiagnosticsRequestsLiveTable,
 		catconstants.CrdbInternalFeatureUsageID:                     crdbInternalFeatureUsage,
 		catconstants.CrdbInternalForwardDependenciesTableID:         crdbInternalForwardDependenciesTable,
 		catconstants.CrdbInternalGossipNodesTableID:                 crdbInternalGossipNodesTable,
@@ -196,6 +197,94 @@ var crdbInternal = virtualSchema{
 	validWithNoDatabaseContext: true,
 }
 
+var crdbInternalStmtDiagnosticsRequestsLiveTable = virtualSchemaTable{
+	comment: `statement diagnostics requests that are pending or completed, ` +
+		`with their status on the local node (RAM + system table)`,
+	schema: `
+CREATE TABLE crdb_internal.statement_diagnostics_requests_live (
+  id                       INT NOT NULL,
+  statement_fingerprint    STRING NOT NULL,
+  pattern_type             STRING NOT NULL,
+  status                   STRING NOT NULL,
+  statement_diagnostics_id INT,
+  requested_at             TIMESTAMPTZ NOT NULL,
+  min_execution_latency    INTERVAL,
+  expires_at               TIMESTAMPTZ,
+  sampling_probability     FLOAT
+)`,
+	populate: func(ctx context.Context, p *planner, _ catalog.DatabaseDescriptor, addRow func(...tree.Datum) error) error {
+		hasRoleOption, err := p.HasViewActivityOrViewActivityRedactedRole(ctx)
+		if err != nil {
+			return err
+		}
+		if !hasRoleOption {
+			return pgerror.Newf(
+				pgcode.InsufficientPrivilege,
+				"user %s does not have %s or %s privilege",
+				p.User(),
+				roleoption.VIEWACTIVITY,
+				roleoption.VIEWACTIVITYREDACTED,
+			)
+		}
+
+		registry := p.ExecCfg().StmtDiagnosticsRecorder
+		requests, err := registry.ListRequests(ctx)
+		if err != nil {
+			return err
+		}
+		for _, req := range requests {
+			// A pending request is ongoing while this node traces a statement
+			// for it, whether or not the request is conditional (see
+			// Registry.IsOngoing).
+			status := "pending"
+			if req.Completed {
+				status = "completed"
+			} else if registry.IsOngoing(req.ID) {
+				status = "ongoing"
+			}
+			diagnosticsID := tree.DNull
+			if req.DiagnosticsID != 0 {
+				diagnosticsID = tree.NewDInt(tree.DInt(req.DiagnosticsID))
+			}
+			requestedAt, err := tree.MakeDTimestampTZ(req.RequestedAt, time.Microsecond)
+			if err != nil {
+				return err
+			}
+			minExecutionLatency := tree.DNull
+			if req.MinExecutionLatency != 0 {
+				minExecutionLatency = tree.NewDInterval(
+					duration.MakeDuration(req.MinExecutionLatency.Nanoseconds(), 0, 0),
+					types.DefaultIntervalTypeMetadata,
+				)
+			}
+			expiresAt := tree.DNull
+			if !req.ExpiresAt.IsZero() {
+				if expiresAt, err = tree.MakeDTimestampTZ(req.ExpiresAt, time.Microsecond); err != nil {
+					return err
+				}
+			}
+			samplingProbability := tree.DNull
+			if req.SamplingProbability != 0 {
+				samplingProbability = tree.NewDFloat(tree.DFloat(req.SamplingProbability))
+			}
+			if err := addRow(
+				tree.NewDInt(tree.DInt(req.ID)),          // id
+				tree.NewDString(req.Fingerprint),         // statement_fingerprint
+				tree.NewDString(string(req.PatternType)), // pattern_type
+				tree.NewDString(status),                  // status
+				diagnosticsID,                            // statement_diagnostics_id
+				requestedAt,                              // requested_at
+				minExecutionLatency,                      // min_execution_latency
+				expiresAt,                                // expires_at
+				samplingProbability,                      // sampling_probability
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
 var crdbInternalBuildInfoTable = virtualSchemaTable{
 	comment: `detailed identification strings (RAM, local node only)`,
 	schema: `
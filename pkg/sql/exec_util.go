@@ -1377,6 +1377,28 @@ type ExecutorConfig struct {
 	NodeDescs kvcoord.NodeDescStore
 }
 
+// StmtDiagRequestOptions are the options of a statement diagnostics request,
+// as passed to StmtDiagnosticsRecorder.InsertRequestWithOptions.
+type StmtDiagRequestOptions = stmtdiagnostics.StmtDiagRequestOptions
+
+// insertStmtDiagnosticsRequest implements eval.StmtDiagnosticsRequestInsertFunc
+// with the StmtDiagnosticsRecorder.
+func (cfg *ExecutorConfig) insertStmtDiagnosticsRequest(
+	ctx context.Context,
+	stmtFingerprint string,
+	samplingProbability float64,
+	minExecutionLatency time.Duration,
+	expiresAfter time.Duration,
+	requestedBy username.SQLUsername,
+) error {
+	return cfg.StmtDiagnosticsRecorder.InsertRequestWithOptions(ctx, stmtFingerprint, StmtDiagRequestOptions{
+		MinLatency:   minExecutionLatency,
+		SamplingRate: samplingProbability,
+		ExpiresAfter: expiresAfter,
+		RequestedBy:  requestedBy,
+	})
+}
+
 // UpdateVersionSystemSettingHook provides a callback that allows us
 // update the cluster version inside the system.settings table. This hook
 // is aimed at mainly updating tenant pods, which will currently skip over
@@ -149,7 +149,7 @@ func buildStatementBundle(
 	b.addExecPlan(planString)
 	b.addDistSQLDiagrams()
 	b.addExplainVec()
-	b.addTrace()
+	b.addTrace(ctx)
 	b.addEnv(ctx)
 	b.addErrors(queryErr, payloadErr, commErr)
 
@@ -164,7 +164,9 @@ func buildStatementBundle(
 // cases) bundle.collectionErr.
 //
 // diagRequestID should be the ID returned by ShouldCollectDiagnostics, or zero
-// if diagnostics were triggered by EXPLAIN ANALYZE (DEBUG).
+// if diagnostics were triggered by EXPLAIN ANALYZE (DEBUG). cpuProfile is the
+// CPU profile captured for the request, if any. execErr is the error returned
+// by the statement, if it failed.
 func (bundle *diagnosticsBundle) insert(
 	ctx context.Context,
 	fingerprint string,
@@ -172,6 +174,8 @@ func (bundle *diagnosticsBundle) insert(
 	stmtDiagRecorder *stmtdiagnostics.Registry,
 	diagRequestID stmtdiagnostics.RequestID,
 	req stmtdiagnostics.Request,
+	cpuProfile []byte,
+	execErr error,
 ) {
 	var err error
 	bundle.diagID, err = stmtDiagRecorder.InsertStatementDiagnostics(
@@ -181,6 +185,8 @@ func (bundle *diagnosticsBundle) insert(
 		fingerprint,
 		tree.AsString(ast),
 		bundle.zip,
+		cpuProfile,
+		execErr,
 		bundle.collectionErr,
 	)
 	if err != nil {
@@ -366,15 +372,93 @@ func (b *stmtBundleBuilder) addExplainVec() {
 	}
 }
 
+// Optional formats of the trace of statement bundles, which can be listed in
+// sql.stmt_diagnostics.trace_formats.
+const (
+	// bundleTraceFormatZipkin adds the trace in the Zipkin v2 JSON format, as
+	// trace-zipkin.json.
+	bundleTraceFormatZipkin = "zipkin"
+	// bundleTraceFormatWavefront adds the spans of the trace in the Wavefront
+	// span format, as trace.wavefront.
+	bundleTraceFormatWavefront = "wavefront"
+	// bundleTraceFormatNetTrace adds the trace in the format of Go's
+	// golang.org/x/net/trace package, as trace.net.
+	bundleTraceFormatNetTrace = "net"
+	// bundleTraceFormatYAML adds an editable YAML representation of the trace,
+	// as trace.yaml.
+	bundleTraceFormatYAML = "yaml"
+	// bundleTraceFormatOTLP adds the trace as an OpenTelemetry (OTLP/JSON)
+	// ExportTraceServiceRequest, as trace-otlp.json.
+	bundleTraceFormatOTLP = "otlp"
+)
+
+var bundleOptionalTraceFormats = []string{
+	bundleTraceFormatZipkin,
+	bundleTraceFormatWavefront,
+	bundleTraceFormatNetTrace,
+	bundleTraceFormatYAML,
+	bundleTraceFormatOTLP,
+}
+
+// bundleTraceFormats lists the formats in which statement bundles include the
+// trace, in addition to the ones that are always included.
+var bundleTraceFormats = settings.RegisterValidatedStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.trace_formats",
+	"comma-separated list of additional formats in which statement bundles "+
+		"include the trace: zipkin (trace-zipkin.json, which can be uploaded to "+
+		"a Zipkin server), wavefront (trace.wavefront), net (the format of the "+
+		"golang.org/x/net/trace package, trace.net), yaml (an editable YAML "+
+		"representation, trace.yaml) and otlp (an OpenTelemetry "+
+		"ExportTraceServiceRequest in the OTLP/JSON format, trace-otlp.json, "+
+		"which can be imported by most tracing backends)",
+	"", /* defaultValue */
+	func(_ *settings.Values, val string) error {
+		_, err := parseBundleTraceFormats(val)
+		return err
+	},
+)
+
+// parseBundleTraceFormats returns the set of formats listed in a value of
+// sql.stmt_diagnostics.trace_formats.
+func parseBundleTraceFormats(val string) (map[string]bool, error) {
+	formats := make(map[string]bool)
+	for _, f := range strings.Split(val, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		var known bool
+		for _, o := range bundleOptionalTraceFormats {
+			if f == o {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, errors.Newf(
+				"unknown trace format %q, expected one of: %s",
+				f, strings.Join(bundleOptionalTraceFormats, ", "),
+			)
+		}
+		formats[f] = true
+	}
+	return formats, nil
+}
+
 // addTrace adds three files to the bundle: two are a json representation of the
 // trace (the default and the jaeger formats), the third one is a human-readable
-// representation.
-func (b *stmtBundleBuilder) addTrace() {
+// representation. It also adds the trace in the formats listed in
+// sql.stmt_diagnostics.trace_formats.
+func (b *stmtBundleBuilder) addTrace(ctx context.Context) {
 	if b.flags.RedactValues {
 		return
 	}
 
-	traceJSONStr, err := tracing.TraceToJSON(b.trace)
+	traceJSONStr, cycles, err := tracing.TraceToJSON(b.trace)
+	if len(cycles) > 0 {
+		log.Warningf(ctx, "statement trace has parent-child cycles at spans %v", cycles)
+	}
 	if err != nil {
 		b.z.AddFile("trace.json", err.Error())
 	} else {
@@ -396,6 +480,41 @@ The UI can then be accessed at http://localhost:16686/search`, b.stmt)
 	} else {
 		b.z.AddFile("trace-jaeger.json", jaegerJSON)
 	}
+
+	// The value was validated when it was set.
+	formats, _ := parseBundleTraceFormats(bundleTraceFormats.Get(b.sv))
+	if formats[bundleTraceFormatZipkin] {
+		if zipkinJSON, err := stmtdiagnostics.TraceToZipkin(b.trace); err != nil {
+			b.z.AddFile("trace-zipkin.txt", err.Error())
+		} else {
+			b.z.AddFile("trace-zipkin.json", string(zipkinJSON))
+		}
+	}
+
+	if formats[bundleTraceFormatYAML] {
+		if traceYAML, err := stmtdiagnostics.TraceToYAML(b.trace); err != nil {
+			b.z.AddFile("trace-yaml.txt", err.Error())
+		} else {
+			b.z.AddFile("trace.yaml", string(traceYAML))
+		}
+	}
+
+	if formats[bundleTraceFormatWavefront] {
+		b.z.AddFile("trace.wavefront", stmtdiagnostics.TraceToWavefront(
+			b.trace, "cockroachdb" /* source */, "cockroachdb", /* application */
+		))
+	}
+	if formats[bundleTraceFormatNetTrace] {
+		b.z.AddFile("trace.net", stmtdiagnostics.TraceToNetTrace(b.trace))
+	}
+
+	if formats[bundleTraceFormatOTLP] {
+		if otlpJSON, err := tracing.TraceToOTLPJSON(b.trace); err != nil {
+			b.z.AddFile("trace-otlp.txt", err.Error())
+		} else {
+			b.z.AddFile("trace-otlp.json", otlpJSON)
+		}
+	}
 }
 
 func (b *stmtBundleBuilder) addEnv(ctx context.Context) {
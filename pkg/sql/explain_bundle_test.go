@@ -14,6 +14,7 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
@@ -32,6 +33,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/errors"
 	"github.com/lib/pq"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 func TestExplainAnalyzeDebug(t *testing.T) {
@@ -172,6 +175,72 @@ CREATE TABLE users(id UUID DEFAULT gen_random_uuid() PRIMARY KEY, promo_id INT R
 		)
 	})
 
+	t.Run("zipkin trace", func(t *testing.T) {
+		r.Exec(t, "SET CLUSTER SETTING sql.stmt_diagnostics.trace_formats = 'zipkin'")
+		defer r.Exec(t, "RESET CLUSTER SETTING sql.stmt_diagnostics.trace_formats")
+		rows := r.QueryStr(t, "EXPLAIN ANALYZE (DEBUG) SELECT * FROM abc WHERE c=1")
+		checkBundle(
+			t, fmt.Sprint(rows), "public.abc", func(name, contents string) error {
+				if name != "trace-zipkin.json" {
+					return nil
+				}
+				var spans []struct {
+					TraceID string `json:"traceId"`
+					ID      string `json:"id"`
+					Name    string `json:"name"`
+				}
+				if err := json.Unmarshal([]byte(contents), &spans); err != nil {
+					return err
+				}
+				if len(spans) == 0 || spans[0].TraceID == "" || spans[0].ID == "" || spans[0].Name == "" {
+					return errors.Newf("unexpected Zipkin spans:\n%s", contents)
+				}
+				return nil
+			},
+			base, plans, "trace-zipkin.json stats-defaultdb.public.abc.sql distsql.html vec.txt vec-v.txt",
+		)
+	})
+
+	t.Run("optional trace files", func(t *testing.T) {
+		r.ExpectErr(
+			t, "unknown trace format \"jaeger\"",
+			"SET CLUSTER SETTING sql.stmt_diagnostics.trace_formats = 'zipkin,jaeger'",
+		)
+		r.Exec(t, "SET CLUSTER SETTING sql.stmt_diagnostics.trace_formats = 'wavefront, net,YAML'")
+		defer r.Exec(t, "RESET CLUSTER SETTING sql.stmt_diagnostics.trace_formats")
+		rows := r.QueryStr(t, "EXPLAIN ANALYZE (DEBUG) SELECT * FROM abc WHERE c=1")
+		checkBundle(
+			t, fmt.Sprint(rows), "public.abc", nil, base, plans,
+			"trace.wavefront trace.net trace.yaml stats-defaultdb.public.abc.sql distsql.html vec.txt vec-v.txt",
+		)
+	})
+
+	t.Run("otlp trace", func(t *testing.T) {
+		r.Exec(t, "SET CLUSTER SETTING sql.stmt_diagnostics.trace_formats = 'otlp'")
+		defer r.Exec(t, "RESET CLUSTER SETTING sql.stmt_diagnostics.trace_formats")
+		rows := r.QueryStr(t, "EXPLAIN ANALYZE (DEBUG) SELECT * FROM abc WHERE c=1")
+		checkBundle(
+			t, fmt.Sprint(rows), "public.abc", func(name, contents string) error {
+				if name != "trace-otlp.json" {
+					return nil
+				}
+				var req coltracepb.ExportTraceServiceRequest
+				if err := protojson.Unmarshal([]byte(contents), &req); err != nil {
+					return err
+				}
+				if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].InstrumentationLibrarySpans) != 1 {
+					return errors.Newf("unexpected OTLP request:\n%s", contents)
+				}
+				spans := req.ResourceSpans[0].InstrumentationLibrarySpans[0].Spans
+				if len(spans) == 0 || len(spans[0].TraceId) != 16 || len(spans[0].SpanId) != 8 || spans[0].Name == "" {
+					return errors.Newf("unexpected OTLP spans:\n%s", contents)
+				}
+				return nil
+			},
+			base, plans, "trace-otlp.json stats-defaultdb.public.abc.sql distsql.html vec.txt vec-v.txt",
+		)
+	})
+
 	t.Run("session-settings", func(t *testing.T) {
 		testcases := []struct {
 			sessionVar, value string
@@ -45,6 +45,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/grunning"
 	"github.com/cockroachdb/cockroach/pkg/util/intsets"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
 	"github.com/cockroachdb/errors"
@@ -111,6 +112,10 @@ type instrumentationHelper struct {
 	stmtDiagnosticsRecorder *stmtdiagnostics.Registry
 	withStatementTrace      func(trace tracingpb.Recording, stmt string)
 
+	// cpuProfile is the CPU profile captured while the statement executes, if
+	// the diagnostics request asked for one.
+	cpuProfile *stmtdiagnostics.CPUProfile
+
 	// sp is always populated by the instrumentationHelper Setup method, except in
 	// the scenario where we do not need tracing information. This scenario occurs
 	// with the confluence of:
@@ -278,6 +283,9 @@ func (ih *instrumentationHelper) Setup(
 	default:
 		ih.collectBundle, ih.diagRequestID, ih.diagRequest =
 			stmtDiagnosticsRecorder.ShouldCollectDiagnostics(ctx, fingerprint)
+		if ih.collectBundle && ih.diagRequest.CaptureCPUProfile() {
+			ih.cpuProfile = stmtDiagnosticsRecorder.StartCPUProfile(ctx)
+		}
 	}
 
 	ih.stmtDiagnosticsRecorder = stmtDiagnosticsRecorder
@@ -368,6 +376,9 @@ func (ih *instrumentationHelper) Finish(
 	retErr error,
 ) error {
 	ctx := ih.origCtx
+	// Stop the CPU profile first, so that it doesn't include the collection of
+	// the bundle.
+	cpuProfile := ih.cpuProfile.Stop()
 	if _, ok := ih.Tracing(); !ok {
 		return retErr
 	}
@@ -403,25 +414,63 @@ func (ih *instrumentationHelper) Finish(
 		)
 		phaseTimes := statsCollector.PhaseTimes()
 		execLatency := phaseTimes.GetServiceLatencyNoOverhead()
-		if ih.stmtDiagnosticsRecorder.IsConditionSatisfied(ih.diagRequest, execLatency) {
+		var payloadErr error
+		if pwe, ok := retPayload.(payloadWithError); ok {
+			payloadErr = pwe.errorCause()
+		}
+		// The error of the statement may only be found in the payload of the
+		// transaction event, rather than in its result.
+		execErr := res.Err()
+		if execErr == nil {
+			execErr = payloadErr
+		}
+		if ih.stmtDiagnosticsRecorder.IsConditionSatisfied(ih.diagRequest, execLatency, execErr) {
 			placeholders := p.extendedEvalCtx.Placeholders
 			ob := ih.emitExplainAnalyzePlanToOutputBuilder(ih.explainFlags, phaseTimes, queryLevelStats)
 			warnings = ob.GetWarnings()
-			var payloadErr error
-			if pwe, ok := retPayload.(payloadWithError); ok {
-				payloadErr = pwe.errorCause()
+			planString := ob.BuildString()
+			bundleTrace := trace
+			if d := ih.diagRequest.MinSpanDuration(); d > 0 {
+				// Only keep the spans the request asked for, so that the bundles of
+				// statements with a high fan-out don't grow too large.
+				bundleTrace = trace.FilterByMinDuration(d)
 			}
 			bundle = buildStatementBundle(
 				ctx, ih.explainFlags, cfg.DB, ie.(*InternalExecutor), stmtRawSQL, &p.curPlan,
-				ob.BuildString(), trace, placeholders, res.Err(), payloadErr, retErr,
+				planString, bundleTrace, placeholders, res.Err(), payloadErr, retErr,
 				&p.extendedEvalCtx.Settings.SV,
 			)
 			bundle.insert(
 				ctx, ih.fingerprint, ast, cfg.StmtDiagnosticsRecorder, ih.diagRequestID, ih.diagRequest,
+				cpuProfile, execErr,
 			)
+			// The hooks are only run for the bundles collected for a diagnostics
+			// request, not for the ones of EXPLAIN ANALYZE (DEBUG), which the
+			// user gets directly.
+			if bundle.diagID != 0 && ih.diagRequestID != 0 {
+				b := &stmtdiagnostics.Bundle{
+					ID:          bundle.diagID,
+					RequestID:   ih.diagRequestID,
+					Fingerprint: ih.fingerprint,
+					Statement:   tree.AsString(ast),
+					InstanceID:  cfg.NodeInfo.NodeID.SQLInstanceID(),
+					CollectedAt: timeutil.Now(),
+					Duration:    execLatency,
+					Err:         execErr,
+					Plan:        planString,
+					Trace:       bundleTrace,
+					Zip:         bundle.zip,
+					CPUProfile:  cpuProfile,
+				}
+				// Non-system tenants can't directly access the DB Console.
+				if cfg.Codec.ForSystemTenant() {
+					b.AdminURL = cfg.NodeInfo.AdminURL().String()
+				}
+				cfg.StmtDiagnosticsRecorder.BundleCollected(ctx, b)
+			}
 			telemetry.Inc(sqltelemetry.StatementDiagnosticsCollectedCounter)
 		}
-		ih.stmtDiagnosticsRecorder.MaybeRemoveRequest(ih.diagRequestID, ih.diagRequest, execLatency)
+		ih.stmtDiagnosticsRecorder.MaybeRemoveRequest(ih.diagRequestID, ih.diagRequest, execLatency, execErr)
 	}
 
 	// If there was a communication error already, no point in setting any
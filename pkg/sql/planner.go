@@ -477,7 +477,7 @@ func internalExtendedEvalCtx(
 			SchemaTelemetryController:      schemaTelemetryController,
 			IndexUsageStatsController:      indexUsageStatsController,
 			ConsistencyChecker:             execCfg.ConsistencyChecker,
-			StmtDiagnosticsRequestInserter: execCfg.StmtDiagnosticsRecorder.InsertRequest,
+			StmtDiagnosticsRequestInserter: execCfg.insertStmtDiagnosticsRequest,
 			RangeStatsFetcher:              execCfg.RangeStatsFetcher,
 		},
 		Tracing:         &SessionTracing{},
@@ -7451,6 +7451,7 @@ specified store on the node it's run from. One of 'mvccGC', 'merge', 'split',
 					samplingProbability,
 					minExecutionLatency,
 					expiresAfter,
+					evalCtx.SessionData().User(),
 				); err != nil {
 					return nil, err
 				}
@@ -610,14 +610,15 @@ type IndexUsageStatsController interface {
 }
 
 // StmtDiagnosticsRequestInsertFunc is an interface embedded in EvalCtx that can
-// be used by the builtins to insert a statement diagnostics request. This
-// interface is introduced to avoid circular dependency.
+// be used by the builtins to insert a statement diagnostics request on behalf
+// of requestedBy. This interface is introduced to avoid circular dependency.
 type StmtDiagnosticsRequestInsertFunc func(
 	ctx context.Context,
 	stmtFingerprint string,
 	samplingProbability float64,
 	minExecutionLatency time.Duration,
 	expiresAfter time.Duration,
+	requestedBy username.SQLUsername,
 ) error
 
 // AsOfSystemTime represents the result from the evaluation of AS OF SYSTEM TIME
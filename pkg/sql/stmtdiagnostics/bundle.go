@@ -0,0 +1,94 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+)
+
+// Bundle is a statement diagnostics bundle that has been collected and stored
+// in system.statement_diagnostics, along with the metadata that the
+// integrations with external systems (ticketing, alerting, storage, etc.)
+// report.
+type Bundle struct {
+	// ID is the ID of the bundle in system.statement_diagnostics.
+	ID CollectedInstanceID
+	// RequestID is the ID of the request for which the bundle was collected.
+	RequestID RequestID
+	// Fingerprint is the fingerprint of the statement.
+	Fingerprint string
+	// Statement is the statement, with its constants.
+	Statement string
+	// InstanceID is the ID of the SQL instance (the node, for the system
+	// tenant) that executed the statement and collected the bundle.
+	InstanceID base.SQLInstanceID
+	// CollectedAt is the time at which the bundle was collected.
+	CollectedAt time.Time
+	// Duration is the service latency of the statement.
+	Duration time.Duration
+	// Err is the error with which the statement failed, if any.
+	Err error
+	// Plan is the EXPLAIN plan of the statement.
+	Plan string
+	// Trace is the trace of the statement.
+	Trace tracingpb.Recording
+	// Zip is the bundle itself, a zip file.
+	Zip []byte
+	// CPUProfile is the CPU profile captured while the statement executed, if
+	// the request asked for one.
+	CPUProfile []byte
+	// AdminURL is the URL of the DB Console of the node that collected the
+	// bundle. It is empty if the DB Console is not available, which is the case
+	// for secondary tenants.
+	AdminURL string
+}
+
+// URL returns the link to download the bundle from the DB Console, or an empty
+// string if the DB Console is not available.
+func (b *Bundle) URL() string {
+	if b.AdminURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/_admin/v1/stmtbundle/%d", strings.TrimSuffix(b.AdminURL, "/"), b.ID)
+}
+
+// Summary returns a plain text summary of the bundle, with one line per
+// property.
+func (b *Bundle) Summary() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "Statement diagnostics bundle %d\n", b.ID)
+	fmt.Fprintf(&buf, "Fingerprint: %s\n", b.Fingerprint)
+	fmt.Fprintf(&buf, "Collected at: %s on node %d\n",
+		b.CollectedAt.UTC().Format(time.RFC3339), b.InstanceID)
+	fmt.Fprintf(&buf, "Duration: %s\n", b.Duration)
+	if b.Err != nil {
+		fmt.Fprintf(&buf, "Error: %v\n", b.Err)
+	}
+	if u := b.URL(); u != "" {
+		fmt.Fprintf(&buf, "Download: %s\n", u)
+	}
+	return buf.String()
+}
+
+// FingerprintHash returns a 64-bit FNV-1a hash of the fingerprint of the
+// statement, as a 16 character hex string. The alerting integrations use it
+// as the deduplication key, so that the bundles of a statement are grouped.
+func (b *Bundle) FingerprintHash() string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(b.Fingerprint))
+	return HexID(h.Sum64())
+}
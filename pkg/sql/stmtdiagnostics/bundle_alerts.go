@@ -0,0 +1,1021 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// This file contains integrations that notify on-call engineers and alerting
+// systems of collected bundles.
+
+// slowestOperationsText returns one line per operation among the n slowest
+// ones of the trace of the bundle, with the duration of its longest span.
+func slowestOperationsText(b *Bundle, n int) string {
+	stats := ComputeRecordingStats(b.Trace)
+	var lines []string
+	for _, op := range stats.Slowest(n) {
+		line := fmt.Sprintf("%s: %s", op.Operation, op.Max)
+		if op.Count > 1 {
+			line += fmt.Sprintf(" (%d spans, %s total)", op.Count, op.Total)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type slackAttachment struct {
+	Fallback  string       `json:"fallback"`
+	Color     string       `json:"color"`
+	Title     string       `json:"title"`
+	TitleLink string       `json:"title_link,omitempty"`
+	Fields    []slackField `json:"fields"`
+	Footer    string       `json:"footer"`
+	Timestamp int64        `json:"ts"`
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// TraceToSlack posts a message about the bundle to a Slack incoming webhook.
+// If channel is not empty, it overrides the default channel of the webhook.
+// The message has an attachment with the fingerprint of the statement, the
+// collection time, the duration of the statement, the 5 slowest operations of
+// the trace (see RecordingStats) and, if available, the link to download the
+// bundle from the DB Console. The attachment is red if the statement failed.
+//
+// BundleSinks.NotifySlack calls TraceToSlack for every collected bundle when
+// sql.stmt_diagnostics.slack.external_connection is set.
+func TraceToSlack(ctx context.Context, b *Bundle, webhookURL, channel string) error {
+	title := fmt.Sprintf("Statement diagnostics bundle %d", b.ID)
+	color := "warning"
+	if b.Err != nil {
+		color = "danger"
+	}
+	fields := []slackField{
+		{Title: "Fingerprint", Value: "```" + b.Fingerprint + "```"},
+		{Title: "Collected at", Value: fmt.Sprintf("%s on node %d",
+			b.CollectedAt.UTC().Format(time.RFC3339), b.InstanceID), Short: true},
+		{Title: "Duration", Value: b.Duration.String(), Short: true},
+	}
+	if b.Err != nil {
+		fields = append(fields, slackField{Title: "Error", Value: b.Err.Error()})
+	}
+	if ops := slowestOperationsText(b, 5); ops != "" {
+		fields = append(fields, slackField{Title: "Slowest operations", Value: ops})
+	}
+	msg := slackMessage{
+		Channel: channel,
+		Text:    fmt.Sprintf("Collected statement diagnostics bundle %d", b.ID),
+		Attachments: []slackAttachment{{
+			Fallback:  fmt.Sprintf("%s: %s (%s)", title, b.Fingerprint, b.Duration),
+			Color:     color,
+			Title:     title,
+			TitleLink: b.URL(),
+			Fields:    fields,
+			Footer:    "CockroachDB",
+			Timestamp: b.CollectedAt.Unix(),
+		}},
+	}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, webhookURL, nil /* header */, msg, nil /* resp */),
+		"posting to Slack")
+}
+
+// msTeamsCard returns the Adaptive Card (schema version 1.5) posted to
+// Microsoft Teams for the bundle.
+func msTeamsCard(b *Bundle) map[string]interface{} {
+	status := "Succeeded"
+	if b.Err != nil {
+		status = fmt.Sprintf("Failed: %v", b.Err)
+	}
+	fact := func(title, value string) map[string]string {
+		return map[string]string{"title": title, "value": value}
+	}
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.5",
+		"body": []interface{}{
+			map[string]interface{}{
+				"type":   "TextBlock",
+				"text":   fmt.Sprintf("Statement diagnostics bundle %d", b.ID),
+				"size":   "Large",
+				"weight": "Bolder",
+				"wrap":   true,
+			},
+			map[string]interface{}{
+				"type":     "TextBlock",
+				"text":     b.Fingerprint,
+				"fontType": "Monospace",
+				"wrap":     true,
+			},
+			map[string]interface{}{
+				"type": "FactSet",
+				"facts": []interface{}{
+					fact("Duration", b.Duration.String()),
+					fact("Status", status),
+					fact("Collected at", fmt.Sprintf("%s on node %d",
+						b.CollectedAt.UTC().Format(time.RFC3339), b.InstanceID)),
+				},
+			},
+		},
+	}
+	if u := b.URL(); u != "" {
+		card["actions"] = []interface{}{map[string]string{
+			"type":  "Action.OpenUrl",
+			"title": "Download bundle",
+			"url":   u,
+		}}
+	}
+	return card
+}
+
+// TraceToMSTeams posts an Adaptive Card about the bundle to a Microsoft Teams
+// incoming webhook. The card contains the fingerprint of the statement, its
+// duration, whether it failed and, if available, a button linking to the
+// bundle in the DB Console.
+//
+// BundleSinks.NotifyMSTeams calls TraceToMSTeams for every collected bundle
+// when sql.stmt_diagnostics.msteams.external_connection is set.
+func TraceToMSTeams(ctx context.Context, b *Bundle, webhookURL string) error {
+	msg := map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{map[string]interface{}{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content":     msTeamsCard(b),
+		}},
+	}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, webhookURL, nil /* header */, msg, nil /* resp */),
+		"posting to Microsoft Teams")
+}
+
+// opsGenieAPIURL is the base URL of the OpsGenie API. It is overridden in
+// tests.
+var opsGenieAPIURL = "https://api.opsgenie.com"
+
+// opsGenieMaxMessageLength is the maximum length of the message of an alert.
+const opsGenieMaxMessageLength = 130
+
+// OpsGenieOption customizes the alerts created by TraceToOpsGenie.
+type OpsGenieOption func(alert map[string]interface{})
+
+// WithOpsGeniePriority sets the priority of the alert, from P1 (critical) to
+// P5 (informational). The default is P3.
+func WithOpsGeniePriority(priority string) OpsGenieOption {
+	return func(alert map[string]interface{}) {
+		alert["priority"] = priority
+	}
+}
+
+// TraceToOpsGenie creates an alert about the bundle with the OpsGenie Alerts
+// API, assigned to the given responder team, and returns the ID of the alert.
+// The alert has the entity "statement-diagnostics" and priority P3 unless
+// overridden with WithOpsGeniePriority. Its details contain the fingerprint of
+// the statement, the ID of the bundle and the 3 slowest operations.
+//
+// The alias of the alert, which OpsGenie uses to deduplicate open alerts, is a
+// hash of the fingerprint, so that the bundles collected for a statement are
+// grouped under one alert.
+func TraceToOpsGenie(
+	ctx context.Context, b *Bundle, apiKey, responderTeam string, opts ...OpsGenieOption,
+) (alertID string, _ error) {
+	message := fmt.Sprintf("Slow statement: %s", b.Fingerprint)
+	if len(message) > opsGenieMaxMessageLength {
+		message = strings.ToValidUTF8(message[:opsGenieMaxMessageLength-3], "") + "..."
+	}
+	details := map[string]string{
+		"fingerprint": b.Fingerprint,
+		"bundle_id":   fmt.Sprint(b.ID),
+		"node_id":     fmt.Sprint(b.InstanceID),
+		"duration":    b.Duration.String(),
+	}
+	if u := b.URL(); u != "" {
+		details["bundle_url"] = u
+	}
+	stats := ComputeRecordingStats(b.Trace)
+	for i, op := range stats.Slowest(3) {
+		details[fmt.Sprintf("slowest_operation_%d", i+1)] = fmt.Sprintf("%s: %s", op.Operation, op.Max)
+	}
+	alert := map[string]interface{}{
+		"message":     message,
+		"alias":       b.FingerprintHash(),
+		"description": b.Summary(),
+		"responders":  []map[string]string{{"name": responderTeam, "type": "team"}},
+		"entity":      "statement-diagnostics",
+		"source":      "CockroachDB",
+		"priority":    "P3",
+		"details":     details,
+	}
+	for _, opt := range opts {
+		opt(alert)
+	}
+
+	header := http.Header{"Authorization": {"GenieKey " + apiKey}}
+	var created struct {
+		RequestID string `json:"requestId"`
+	}
+	if err := DoJSONRequest(
+		ctx, http.MethodPost, opsGenieAPIURL+"/v2/alerts", header, alert, &created,
+	); err != nil {
+		return "", errors.Wrap(err, "creating OpsGenie alert")
+	}
+
+	// Alerts are created asynchronously; the ID of the alert is obtained from
+	// the status of the request once it has been processed.
+	var err error
+	for r := retry.StartWithCtx(ctx, retry.Options{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		MaxRetries:     10,
+	}); r.Next(); {
+		var status struct {
+			Data struct {
+				Success bool   `json:"success"`
+				Status  string `json:"status"`
+				AlertID string `json:"alertId"`
+			} `json:"data"`
+		}
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet,
+			opsGenieAPIURL+"/v2/alerts/requests/"+url.PathEscape(created.RequestID), nil /* body */)
+		if reqErr != nil {
+			return "", reqErr
+		}
+		req.Header = header.Clone()
+		// The status of the request is not found until it is processed.
+		if err = DoRequest(req, &status); err != nil {
+			continue
+		}
+		if !status.Data.Success {
+			return "", errors.Newf("creating OpsGenie alert: %s", status.Data.Status)
+		}
+		return status.Data.AlertID, nil
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return "", errors.Wrap(err, "getting the ID of the OpsGenie alert")
+}
+
+// TraceToVictorOps creates a CRITICAL incident about the bundle in VictorOps
+// (Splunk On-Call) with its REST endpoint integration. restEndpointURL is the
+// URL of the integration, including the API key (e.g.
+// https://alert.victorops.com/integrations/generic/20131114/alert/<api-key>),
+// to which the routing key is appended.
+//
+// The entity ID of the incident, which VictorOps uses to correlate the
+// messages about an incident, is a hash of the fingerprint of the statement.
+// The state message mentions the slowest operation of the trace and its
+// duration. If available, the link to download the bundle from the DB Console
+// is annotated on the incident.
+func TraceToVictorOps(ctx context.Context, b *Bundle, restEndpointURL, routingKey string) error {
+	stateMessage := fmt.Sprintf("Statement %s took %s", b.Fingerprint, b.Duration)
+	stats := ComputeRecordingStats(b.Trace)
+	if slowest := stats.Slowest(1); len(slowest) > 0 {
+		stateMessage += fmt.Sprintf("; slowest operation: %s (%s)",
+			slowest[0].Operation, slowest[0].Max)
+	}
+	incident := map[string]interface{}{
+		"message_type":        "CRITICAL",
+		"entity_id":           b.FingerprintHash(),
+		"entity_display_name": fmt.Sprintf("Slow statement: %s", b.Fingerprint),
+		"state_message":       stateMessage,
+		"state_start_time":    b.CollectedAt.Unix(),
+		"monitoring_tool":     "CockroachDB",
+		"fingerprint":         b.Fingerprint,
+		"bundle_id":           b.ID,
+		"node_id":             b.InstanceID,
+	}
+	if u := b.URL(); u != "" {
+		incident["vo_annotate.u.Statement diagnostics bundle"] = u
+	}
+	u := strings.TrimSuffix(restEndpointURL, "/") + "/" + url.PathEscape(routingKey)
+	var resp struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+	}
+	if err := DoJSONRequest(ctx, http.MethodPost, u, nil /* header */, incident, &resp); err != nil {
+		return errors.Wrap(err, "creating VictorOps incident")
+	}
+	if resp.Result != "success" {
+		return errors.Newf("creating VictorOps incident: %s", resp.Message)
+	}
+	return nil
+}
+
+// SMTPConfig configures the SMTP server through which TraceToEmail sends
+// emails.
+type SMTPConfig struct {
+	// Host and Port are the address of the SMTP server. On port 465, TLS is
+	// used from the start of the connection (SMTPS). On other ports, the
+	// connection is upgraded with STARTTLS if the server supports it.
+	Host string
+	Port int
+	// Username and Password, if Username is set, are the credentials with which
+	// the client authenticates with the PLAIN mechanism. Go refuses to send them
+	// over an unencrypted connection, unless the server is on localhost.
+	Username string
+	Password string
+	// From is the address of the sender, e.g. "CockroachDB <crdb@example.com>".
+	From string
+}
+
+var emailTemplate = template.Must(template.New("email").Parse(`<html>
+<body style="font-family: sans-serif">
+<h2>Statement diagnostics bundle {{.ID}}</h2>
+<table cellpadding="4">
+<tr><th align="left">Fingerprint</th><td><code>{{.Fingerprint}}</code></td></tr>
+<tr><th align="left">Collected at</th><td>{{.CollectedAt}} on node {{.InstanceID}}</td></tr>
+<tr><th align="left">Duration</th><td>{{.Duration}}</td></tr>
+{{- if .Err}}
+<tr><th align="left">Error</th><td><code>{{.Err}}</code></td></tr>
+{{- end}}
+</table>
+{{- if .Operations}}
+<h3>Slowest operations</h3>
+<table cellpadding="4">
+<tr><th align="left">Operation</th><th align="right">Spans</th><th align="right">Longest</th><th align="right">Total</th></tr>
+{{- range .Operations}}
+<tr><td>{{.Operation}}</td><td align="right">{{.Count}}</td><td align="right">{{.Max}}</td><td align="right">{{.Total}}</td></tr>
+{{- end}}
+</table>
+<h3>Flame chart</h3>
+{{.FlameChart}}
+{{- end}}
+<p>The bundle is attached.
+{{- if .URL}} It can also be <a href="{{.URL}}">downloaded from the DB Console</a>.{{end}}</p>
+</body>
+</html>
+`))
+
+// emailHTML returns the HTML body of the email sent by TraceToEmail.
+func emailHTML(b *Bundle) (string, error) {
+	stats := ComputeRecordingStats(b.Trace)
+	data := struct {
+		ID          CollectedInstanceID
+		Fingerprint string
+		CollectedAt string
+		InstanceID  base.SQLInstanceID
+		Duration    time.Duration
+		Err         error
+		Operations  []OperationStats
+		FlameChart  template.HTML
+		URL         string
+	}{
+		ID:          b.ID,
+		Fingerprint: b.Fingerprint,
+		CollectedAt: b.CollectedAt.UTC().Format(time.RFC3339),
+		InstanceID:  b.InstanceID,
+		Duration:    b.Duration,
+		Err:         b.Err,
+		Operations:  stats.Slowest(10),
+		URL:         b.URL(),
+	}
+	if len(b.Trace) > 0 {
+		// The operations are escaped in the SVG, so it is safe to embed it.
+		data.FlameChart = template.HTML(TraceToFlameChartSVG(b.Trace))
+	}
+	var buf strings.Builder
+	if err := emailTemplate.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// emailMessage returns the email sent by TraceToEmail, in the Internet Message
+// Format (RFC 5322): a multipart/mixed MIME message with the HTML body and the
+// bundle zip as an attachment.
+func emailMessage(b *Bundle, from string, to []string) ([]byte, error) {
+	body, err := emailHTML(b)
+	if err != nil {
+		return nil, err
+	}
+	subject := fmt.Sprintf("Statement diagnostics bundle %d: %s", b.ID, b.Fingerprint)
+	if len(subject) > 120 {
+		subject = strings.ToValidUTF8(subject[:117], "") + "..."
+	}
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", timeutil.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qw := quotedprintable.NewWriter(pw)
+	if _, err := qw.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := qw.Close(); err != nil {
+		return nil, err
+	}
+
+	filename := bundleFilename(b)
+	pw, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType("application/zip", map[string]string{"name": filename})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The lines of base64-encoded parts are at most 76 characters long (RFC
+	// 2045).
+	enc := base64.StdEncoding.EncodeToString(b.Zip)
+	for len(enc) > 76 {
+		if _, err := io.WriteString(pw, enc[:76]+"\r\n"); err != nil {
+			return nil, err
+		}
+		enc = enc[76:]
+	}
+	if _, err := io.WriteString(pw, enc+"\r\n"); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendMail sends msg to the recipients through the SMTP server of cfg.
+func sendMail(ctx context.Context, cfg SMTPConfig, to []string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	implicitTLS := cfg.Port == 465
+	if implicitTLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: cfg.Host})
+	}
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+	if hostname, err := os.Hostname(); err == nil {
+		if err := c.Hello(hostname); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && !implicitTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.Host}); err != nil {
+			return errors.Wrap(err, "starting TLS")
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return errors.Wrap(err, "authenticating")
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return errors.Wrapf(err, "adding recipient %s", rcpt)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// TraceToEmail emails the bundle to the given recipients through an SMTP
+// server. The HTML body of the email contains the fingerprint, collection
+// time, duration and error of the statement, the statistics of the 10 slowest
+// operations of the trace (see RecordingStats), the flame chart of the trace
+// (see TraceToFlameChartSVG) and, if available, the link to download the
+// bundle from the DB Console. The bundle zip is attached.
+//
+// The recipients are plain addresses (e.g. oncall@example.com), while
+// cfg.From can have a display name.
+//
+// BundleSinks.NotifyEmail calls TraceToEmail for collected bundles when
+// sql.stmt_diagnostics.email.smtp_host and sql.stmt_diagnostics.email.to are
+// set, at most once every sql.stmt_diagnostics.email.min_interval per node.
+func TraceToEmail(ctx context.Context, b *Bundle, cfg SMTPConfig, to []string) error {
+	if len(to) == 0 {
+		return errors.New("no recipients")
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return errors.Wrapf(err, "parsing sender %q", cfg.From)
+	}
+	msg, err := emailMessage(b, from.String(), to)
+	if err != nil {
+		return err
+	}
+	cfg.From = from.Address
+	return errors.Wrap(sendMail(ctx, cfg, to, msg), "sending email")
+}
+
+// twilioAPIURL is the base URL of the Twilio REST API. It is overridden in
+// tests.
+var twilioAPIURL = "https://api.twilio.com"
+
+// smsMaxLength is the number of characters that fit in a single SMS segment.
+const smsMaxLength = 160
+
+// smsText returns the text of the SMS about the bundle, truncated to
+// smsMaxLength characters.
+func smsText(b *Bundle) string {
+	fingerprint := b.Fingerprint
+	if len(fingerprint) > 40 {
+		fingerprint = strings.ToValidUTF8(fingerprint[:40], "")
+	}
+	text := fmt.Sprintf("CockroachDB slow query: %s %dms on node %d.",
+		fingerprint, b.Duration.Milliseconds(), b.InstanceID)
+	if u := b.URL(); u != "" {
+		text += " Bundle: " + u
+	}
+	if len(text) > smsMaxLength {
+		text = strings.ToValidUTF8(text[:smsMaxLength], "")
+	}
+	return text
+}
+
+// TraceToSMS sends an SMS about the bundle from the phone number from to the
+// phone number to (both in E.164 format, e.g. +14155550100) with the Twilio
+// Messages API, authenticating with the SID and auth token of the Twilio
+// account. The message fits in a single SMS and reads:
+//
+//	CockroachDB slow query: <fingerprint> <duration>ms on node <id>. Bundle: <url>
+//
+// The fingerprint is truncated to 40 characters, and the link to download the
+// bundle from the DB Console is omitted if it is not available. It is meant as
+// a last-resort alerting path for on-call engineers.
+func TraceToSMS(ctx context.Context, b *Bundle, accountSID, authToken, from, to string) error {
+	form := url.Values{
+		"From": {from},
+		"To":   {to},
+		"Body": {smsText(b)},
+	}
+	u := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json",
+		twilioAPIURL, url.PathEscape(accountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(accountSID, authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return errors.Wrap(DoRequest(req, nil /* resp */), "sending SMS with Twilio")
+}
+
+// telegramAPIURL is the base URL of the Telegram Bot API. It is overridden in
+// tests.
+var telegramAPIURL = "https://api.telegram.org"
+
+// telegramEscaper escapes the characters that are reserved in the text of
+// Telegram messages formatted with MarkdownV2.
+var telegramEscaper = func() *strings.Replacer {
+	var oldnew []string
+	for _, c := range `\_*[]()~` + "`" + `>#+-=|{}.!` {
+		oldnew = append(oldnew, string(c), `\`+string(c))
+	}
+	return strings.NewReplacer(oldnew...)
+}()
+
+// telegramCodeEscaper escapes the characters that are reserved in code
+// entities of Telegram messages formatted with MarkdownV2.
+var telegramCodeEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+
+// telegramURLEscaper escapes the characters that are reserved in the URLs of
+// inline links of Telegram messages formatted with MarkdownV2.
+var telegramURLEscaper = strings.NewReplacer(`\`, `\\`, `)`, `\)`)
+
+// telegramText returns the text of the Telegram message about the bundle, in
+// MarkdownV2.
+func telegramText(b *Bundle) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "*%s*\n", telegramEscaper.Replace(
+		fmt.Sprintf("Statement diagnostics bundle %d", b.ID)))
+	fmt.Fprintf(&buf, "Fingerprint: `%s`\n", telegramCodeEscaper.Replace(b.Fingerprint))
+	fmt.Fprintf(&buf, "%s\n", telegramEscaper.Replace(fmt.Sprintf("Collected at: %s on node %d",
+		b.CollectedAt.UTC().Format(time.RFC3339), b.InstanceID)))
+	fmt.Fprintf(&buf, "%s\n", telegramEscaper.Replace(fmt.Sprintf("Duration: %s", b.Duration)))
+	if b.Err != nil {
+		fmt.Fprintf(&buf, "Error: `%s`\n", telegramCodeEscaper.Replace(b.Err.Error()))
+	}
+	if slowest := slowestOperationsText(b, 3); slowest != "" {
+		fmt.Fprintf(&buf, "Slowest operations:\n```\n%s\n```\n", telegramCodeEscaper.Replace(slowest))
+	}
+	if u := b.URL(); u != "" {
+		fmt.Fprintf(&buf, "[Download the bundle](%s)\n", telegramURLEscaper.Replace(u))
+	}
+	return buf.String()
+}
+
+// telegramResponse is the envelope of the responses of the Telegram Bot API.
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Result      struct {
+		MessageID int64 `json:"message_id"`
+	} `json:"result"`
+}
+
+// TraceToTelegram sends a message about the bundle to a Telegram chat (or
+// channel, e.g. @oncall) with the Telegram Bot API, as the bot with the given
+// token. The message, formatted with MarkdownV2, has the fingerprint,
+// collection time, duration and error of the statement, its 3 slowest
+// operations and, if available, the link to download the bundle from the DB
+// Console.
+//
+// The flame chart of the trace (see TraceToFlameChartSVG) is sent in reply to
+// the message. Telegram only accepts raster images as photos, so the SVG is
+// sent as a document, which Telegram clients can open in a browser.
+func TraceToTelegram(ctx context.Context, b *Bundle, botToken, chatID string) error {
+	baseURL := fmt.Sprintf("%s/bot%s", telegramAPIURL, botToken)
+	var msg telegramResponse
+	if err := DoJSONRequest(ctx, http.MethodPost, baseURL+"/sendMessage", nil /* header */, map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     telegramText(b),
+		"parse_mode":               "MarkdownV2",
+		"disable_web_page_preview": true,
+	}, &msg); err != nil {
+		// The bot token is part of the URL; only report the response.
+		return errors.Wrap(redactTelegramToken(err, botToken), "sending Telegram message")
+	}
+	if !msg.OK {
+		return errors.Newf("sending Telegram message: %s", msg.Description)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fields := [][2]string{
+		{"chat_id", chatID},
+		{"reply_to_message_id", strconv.FormatInt(msg.Result.MessageID, 10)},
+		{"caption", fmt.Sprintf("Flame chart of statement diagnostics bundle %d", b.ID)},
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	fw, err := mw.CreateFormFile("document", fmt.Sprintf("stmt-bundle-%d-flame-chart.svg", b.ID))
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(TraceToFlameChartSVG(b.Trace)); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/sendDocument", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var doc telegramResponse
+	if err := DoRequest(req, &doc); err != nil {
+		return errors.Wrap(redactTelegramToken(err, botToken), "sending Telegram flame chart")
+	}
+	if !doc.OK {
+		return errors.Newf("sending Telegram flame chart: %s", doc.Description)
+	}
+	return nil
+}
+
+// redactTelegramToken returns err with the occurrences of the bot token, which
+// the URLs of the Telegram Bot API contain, replaced.
+func redactTelegramToken(err error, botToken string) error {
+	if botToken == "" || !strings.Contains(err.Error(), botToken) {
+		return err
+	}
+	return errors.Newf("%s", strings.ReplaceAll(err.Error(), botToken, "<token>"))
+}
+
+// pagerDutyEventsURL is the URL of the PagerDuty Events API v2. It is
+// overridden in tests.
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutyMaxSummaryLength is the maximum length of the summary of an event.
+const pagerDutyMaxSummaryLength = 1024
+
+// pagerDutySeverities are the severities that TraceToPagerDuty accepts.
+var pagerDutySeverities = map[string]bool{"critical": true, "warning": true, "info": true}
+
+// sendPagerDutyEvent sends an event to the PagerDuty Events API v2 and returns
+// its deduplication key.
+func sendPagerDutyEvent(ctx context.Context, event map[string]interface{}) (string, error) {
+	var resp struct {
+		Status   string `json:"status"`
+		Message  string `json:"message"`
+		DedupKey string `json:"dedup_key"`
+	}
+	if err := DoJSONRequest(
+		ctx, http.MethodPost, pagerDutyEventsURL, nil /* header */, event, &resp,
+	); err != nil {
+		return "", err
+	}
+	if resp.Status != "success" {
+		return "", errors.Newf("%s: %s", resp.Status, resp.Message)
+	}
+	return resp.DedupKey, nil
+}
+
+// TraceToPagerDuty triggers an alert about the bundle with the PagerDuty Events
+// API v2, for the service integration with the given routing key, and returns
+// the deduplication key of the alert. The severity is one of critical, warning
+// and info. The custom details of the alert contain the fingerprint of the
+// statement, the ID of the bundle and the 5 slowest operations of the trace
+// (see RecordingStats).
+//
+// The deduplication key is a hash of the fingerprint, so that PagerDuty groups
+// the bundles collected for a statement under one alert, which
+// ResolvePagerDuty resolves.
+func TraceToPagerDuty(
+	ctx context.Context, b *Bundle, routingKey, severity string,
+) (dedupKey string, err error) {
+	if !pagerDutySeverities[severity] {
+		return "", errors.Newf("invalid PagerDuty severity %q", severity)
+	}
+	summary := fmt.Sprintf("Slow statement (%s): %s", b.Duration, b.Fingerprint)
+	if len(summary) > pagerDutyMaxSummaryLength {
+		summary = strings.ToValidUTF8(summary[:pagerDutyMaxSummaryLength-3], "") + "..."
+	}
+	details := map[string]interface{}{
+		"fingerprint": b.Fingerprint,
+		"bundle_id":   b.ID,
+		"duration":    b.Duration.String(),
+	}
+	if b.Err != nil {
+		details["error"] = b.Err.Error()
+	}
+	stats := ComputeRecordingStats(b.Trace)
+	var slowest []map[string]interface{}
+	for _, op := range stats.Slowest(5) {
+		slowest = append(slowest, map[string]interface{}{
+			"operation": op.Operation,
+			"count":     op.Count,
+			"total":     op.Total.String(),
+			"max":       op.Max.String(),
+		})
+	}
+	details["slowest_operations"] = slowest
+	event := map[string]interface{}{
+		"routing_key":  routingKey,
+		"event_action": "trigger",
+		"dedup_key":    b.FingerprintHash(),
+		"payload": map[string]interface{}{
+			"summary":        summary,
+			"source":         fmt.Sprintf("node %d", b.InstanceID),
+			"severity":       severity,
+			"timestamp":      b.CollectedAt.UTC().Format(time.RFC3339),
+			"component":      "sql",
+			"group":          "statement-diagnostics",
+			"class":          "slow statement",
+			"custom_details": details,
+		},
+		"client": "CockroachDB",
+	}
+	if u := b.URL(); u != "" {
+		event["client_url"] = u
+		event["links"] = []map[string]string{{"href": u, "text": "Statement diagnostics bundle"}}
+	}
+	dedupKey, err = sendPagerDutyEvent(ctx, event)
+	return dedupKey, errors.Wrap(err, "triggering PagerDuty alert")
+}
+
+// ResolvePagerDuty resolves the PagerDuty alert with the given deduplication
+// key, as returned by TraceToPagerDuty.
+func ResolvePagerDuty(ctx context.Context, routingKey, dedupKey string) error {
+	_, err := sendPagerDutyEvent(ctx, map[string]interface{}{
+		"routing_key":  routingKey,
+		"event_action": "resolve",
+		"dedup_key":    dedupKey,
+	})
+	return errors.Wrap(err, "resolving PagerDuty alert")
+}
+
+// dynatraceMaxPropertyLength is the maximum length of the value of a property
+// of a Dynatrace event.
+const dynatraceMaxPropertyLength = 4096
+
+// TraceToDynatrace reports a custom alert about the bundle to the Dynatrace
+// environment at apiURL (e.g. https://abc12345.live.dynatrace.com) with the
+// Events API v2, which opens a problem for it. The API token must have the
+// events.ingest scope.
+//
+// The title of the problem contains the fingerprint of the statement and the
+// latency of its slowest operation. The description is the summary of the
+// bundle (see Bundle.Summary) followed by the flame graph of the trace in the
+// collapsed stack format (see TraceToFlamegraphCollapsed), as Dynatrace
+// doesn't render images in problems.
+//
+// Dynatrace creates problems asynchronously and doesn't return their ID, so
+// the returned problemID is the correlation ID of the event, which is listed
+// as the event ID of the problem in the Problems API.
+func TraceToDynatrace(
+	ctx context.Context, b *Bundle, apiURL, apiToken string,
+) (problemID string, err error) {
+	latency := b.Duration
+	stats := ComputeRecordingStats(b.Trace)
+	if slowest := stats.Slowest(1); len(slowest) > 0 {
+		latency = slowest[0].Max
+	}
+	description := b.Summary() + "\nFlame graph (collapsed stacks, in microseconds):\n" +
+		TraceToFlamegraphCollapsed(b.Trace)
+	if len(description) > dynatraceMaxPropertyLength {
+		description = strings.ToValidUTF8(description[:dynatraceMaxPropertyLength-3], "") + "..."
+	}
+	properties := map[string]string{
+		"dt.event.description": description,
+		"fingerprint":          b.Fingerprint,
+		"bundle_id":            fmt.Sprint(b.ID),
+		"node_id":              fmt.Sprint(b.InstanceID),
+		"duration":             b.Duration.String(),
+	}
+	if u := b.URL(); u != "" {
+		properties["bundle_url"] = u
+	}
+	event := map[string]interface{}{
+		"eventType":  "CUSTOM_ALERT",
+		"title":      fmt.Sprintf("Slow statement (%s): %s", latency, b.Fingerprint),
+		"startTime":  b.CollectedAt.UnixMilli(),
+		"properties": properties,
+	}
+
+	header := http.Header{"Authorization": {"Api-Token " + apiToken}}
+	var resp struct {
+		EventIngestResults []struct {
+			CorrelationID string `json:"correlationId"`
+			Status        string `json:"status"`
+		} `json:"eventIngestResults"`
+	}
+	if err := DoJSONRequest(ctx, http.MethodPost,
+		strings.TrimSuffix(apiURL, "/")+"/api/v2/events/ingest", header, event, &resp,
+	); err != nil {
+		return "", errors.Wrap(err, "reporting Dynatrace problem")
+	}
+	if len(resp.EventIngestResults) != 1 {
+		return "", errors.Newf("reporting Dynatrace problem: expected 1 result, got %d",
+			len(resp.EventIngestResults))
+	}
+	if res := resp.EventIngestResults[0]; res.Status != "OK" {
+		return "", errors.Newf("reporting Dynatrace problem: %s", res.Status)
+	}
+	return resp.EventIngestResults[0].CorrelationID, nil
+}
+
+// TraceToPrometheusAlertmanager fires an alert about the bundle with the API of
+// the Prometheus Alertmanager at the given URL. The alert has the labels
+// alertname=CockroachDBSlowQuery, severity=warning and fingerprint, a hash of
+// the fingerprint of the statement, so that Alertmanager groups the alerts
+// about the bundles of a statement. Its summary annotation names the statement
+// and its description annotation contains the summary of the bundle and the 5
+// slowest operations of the trace.
+//
+// The alert has no end time, so Alertmanager resolves it after its
+// resolve_timeout unless another bundle of the statement fires it again.
+func TraceToPrometheusAlertmanager(
+	ctx context.Context, b *Bundle, alertmanagerURL string,
+) error {
+	alert := map[string]interface{}{
+		"labels": map[string]string{
+			"alertname":   "CockroachDBSlowQuery",
+			"fingerprint": b.FingerprintHash(),
+			"severity":    "warning",
+		},
+		"annotations": map[string]string{
+			"summary": fmt.Sprintf("Slow statement (%s): %s", b.Duration, b.Fingerprint),
+			"description": b.Summary() + "\nSlowest operations:\n" +
+				slowestOperationsText(b, 5),
+		},
+		"startsAt": b.CollectedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if u := b.URL(); u != "" {
+		alert["generatorURL"] = u
+	}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, strings.TrimSuffix(alertmanagerURL, "/")+"/api/v2/alerts",
+			nil /* header */, []interface{}{alert}, nil /* resp */),
+		"firing Prometheus Alertmanager alert")
+}
+
+// TraceToGrafanaAlert reports the bundle to the Grafana instance at grafanaURL
+// as an alerting state change of the Grafana-managed alert rule with the given
+// UID. The rule is looked up with the alerting provisioning API, and the
+// bundle is recorded as a region annotation, spanning the execution of the
+// statement, on the dashboard panel the rule is linked to (or as an
+// organization-wide annotation if the rule isn't linked to a panel). The
+// annotation is tagged with the rule UID, "alerting" and a hash of the
+// fingerprint of the statement, and its text contains the summary of the
+// bundle and the 5 slowest operations of the trace.
+//
+// Grafana doesn't accept alerts for its own rules from outside, so the rule
+// has to be evaluated by Grafana for notifications to be sent; it can, for
+// instance, query the annotations of the panel.
+func TraceToGrafanaAlert(ctx context.Context, b *Bundle, grafanaURL, apiKey, ruleUID string) error {
+	grafanaURL = strings.TrimSuffix(grafanaURL, "/")
+	header := http.Header{"Authorization": {"Bearer " + apiKey}}
+
+	var rule struct {
+		Title       string            `json:"title"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		grafanaURL+"/api/v1/provisioning/alert-rules/"+url.PathEscape(ruleUID), nil /* body */)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	if err := DoRequest(req, &rule); err != nil {
+		return errors.Wrapf(err, "looking up Grafana alert rule %s", ruleUID)
+	}
+
+	annotation := map[string]interface{}{
+		"time":    b.CollectedAt.Add(-b.Duration).UnixMilli(),
+		"timeEnd": b.CollectedAt.UnixMilli(),
+		"tags": []string{
+			"cockroachdb", "statement-diagnostics", "alerting",
+			"rule:" + ruleUID, "fingerprint:" + b.FingerprintHash(),
+		},
+		"text": fmt.Sprintf("%s: slow statement (%s)\n", rule.Title, b.Duration) +
+			b.Summary() + "\nSlowest operations:\n" + slowestOperationsText(b, 5),
+		"data": map[string]string{
+			"ruleUID":     ruleUID,
+			"ruleTitle":   rule.Title,
+			"newState":    "Alerting",
+			"fingerprint": b.Fingerprint,
+			"bundleID":    strconv.FormatInt(int64(b.ID), 10),
+		},
+	}
+	if dashboardUID := rule.Annotations["__dashboardUid__"]; dashboardUID != "" {
+		annotation["dashboardUID"] = dashboardUID
+		if panelID, err := strconv.ParseInt(rule.Annotations["__panelId__"], 10, 64); err == nil {
+			annotation["panelId"] = panelID
+		}
+	}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, grafanaURL+"/api/annotations", header, annotation, nil /* resp */),
+		"annotating Grafana dashboard")
+}
@@ -0,0 +1,742 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonRecorder returns a test server that decodes the JSON body of every
+// request into a new element of *bodies.
+func jsonRecorder(t *testing.T, bodies *[]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		*bodies = append(*bodies, body)
+	}))
+}
+
+func TestTraceToSlack(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var bodies []map[string]interface{}
+	srv := jsonRecorder(t, &bodies)
+	defer srv.Close()
+
+	b := makeTestBundle("https://node1:8080")
+	require.NoError(t, stmtdiagnostics.TraceToSlack(context.Background(), b, srv.URL, "#oncall"))
+	require.Len(t, bodies, 1)
+	msg := bodies[0]
+	require.Equal(t, "#oncall", msg["channel"])
+	require.Equal(t, "Collected statement diagnostics bundle 42", msg["text"])
+	att := msg["attachments"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "danger", att["color"])
+	require.Equal(t, "https://node1:8080/_admin/v1/stmtbundle/42", att["title_link"])
+	require.Equal(t, float64(b.CollectedAt.Unix()), att["ts"])
+	fields := make(map[string]string)
+	for _, f := range att["fields"].([]interface{}) {
+		f := f.(map[string]interface{})
+		fields[f["title"].(string)] = f["value"].(string)
+	}
+	require.Equal(t, map[string]string{
+		"Fingerprint":        "```SELECT * FROM t WHERE k = _```",
+		"Collected at":       "2023-01-02T03:04:05Z on node 1",
+		"Duration":           "10ms",
+		"Error":              "boom",
+		"Slowest operations": "sql query: 10ms\nflow: 5ms\nkv.Get: 2ms",
+	}, fields)
+
+	// Without a channel and a DB Console, the defaults of the webhook are used
+	// and there is no link.
+	bodies = nil
+	b = makeTestBundle("")
+	b.Err = nil
+	require.NoError(t, stmtdiagnostics.TraceToSlack(context.Background(), b, srv.URL, ""))
+	require.NotContains(t, bodies[0], "channel")
+	att = bodies[0]["attachments"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "warning", att["color"])
+	require.NotContains(t, att, "title_link")
+}
+
+func TestTraceToMSTeams(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var bodies []map[string]interface{}
+	srv := jsonRecorder(t, &bodies)
+	defer srv.Close()
+
+	b := makeTestBundle("https://node1:8080")
+	require.NoError(t, stmtdiagnostics.TraceToMSTeams(context.Background(), b, srv.URL))
+	require.Len(t, bodies, 1)
+	require.Equal(t, "message", bodies[0]["type"])
+	att := bodies[0]["attachments"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "application/vnd.microsoft.card.adaptive", att["contentType"])
+	card := att["content"].(map[string]interface{})
+	require.Equal(t, "AdaptiveCard", card["type"])
+	require.Equal(t, "1.5", card["version"])
+	body := card["body"].([]interface{})
+	require.Equal(t, "Statement diagnostics bundle 42", body[0].(map[string]interface{})["text"])
+	require.Equal(t, b.Fingerprint, body[1].(map[string]interface{})["text"])
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"title": "Duration", "value": "10ms"},
+		map[string]interface{}{"title": "Status", "value": "Failed: boom"},
+		map[string]interface{}{"title": "Collected at", "value": "2023-01-02T03:04:05Z on node 1"},
+	}, body[2].(map[string]interface{})["facts"])
+	require.Equal(t, []interface{}{map[string]interface{}{
+		"type":  "Action.OpenUrl",
+		"title": "Download bundle",
+		"url":   "https://node1:8080/_admin/v1/stmtbundle/42",
+	}}, card["actions"])
+
+	// Without a DB Console, there is no button.
+	bodies = nil
+	require.NoError(t, stmtdiagnostics.TraceToMSTeams(context.Background(), makeTestBundle(""), srv.URL))
+	att = bodies[0]["attachments"].([]interface{})[0].(map[string]interface{})
+	require.NotContains(t, att["content"], "actions")
+}
+
+// fingerprintHash is the hash of the fingerprint of a bundle used by the
+// alerting integrations to deduplicate alerts.
+func fingerprintHash(b *stmtdiagnostics.Bundle) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(b.Fingerprint))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func TestTraceToOpsGenie(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var alerts []map[string]interface{}
+	statusRequests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/alerts", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "GenieKey key", r.Header.Get("Authorization"))
+		var alert map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts = append(alerts, alert)
+		w.WriteHeader(http.StatusAccepted)
+		_, err := fmt.Fprintf(w, `{"result":"Request will be processed","requestId":"req%d"}`, len(alerts))
+		require.NoError(t, err)
+	})
+	mux.HandleFunc("/v2/alerts/requests/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "GenieKey key", r.Header.Get("Authorization"))
+		// The first request isn't processed yet.
+		statusRequests++
+		if statusRequests == 1 {
+			http.Error(w, `{"message":"Request not found"}`, http.StatusNotFound)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/v2/alerts/requests/")
+		_, err := fmt.Fprintf(w, `{"data":{"success":true,"status":"Created alert","alertId":"alert-%s"}}`, id)
+		require.NoError(t, err)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetOpsGenieAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("")
+	alertID, err := stmtdiagnostics.TraceToOpsGenie(ctx, b, "key", "dba")
+	require.NoError(t, err)
+	require.Equal(t, "alert-req1", alertID)
+	require.Equal(t, 2, statusRequests)
+	alert := alerts[0]
+	require.Equal(t, "Slow statement: SELECT * FROM t WHERE k = _", alert["message"])
+	require.Equal(t, fingerprintHash(b), alert["alias"])
+	require.Equal(t, "statement-diagnostics", alert["entity"])
+	require.Equal(t, "P3", alert["priority"])
+	require.Equal(t, []interface{}{map[string]interface{}{"name": "dba", "type": "team"}}, alert["responders"])
+	require.Equal(t, map[string]interface{}{
+		"fingerprint":         "SELECT * FROM t WHERE k = _",
+		"bundle_id":           "42",
+		"node_id":             "1",
+		"duration":            "10ms",
+		"slowest_operation_1": "sql query: 10ms",
+		"slowest_operation_2": "flow: 5ms",
+		"slowest_operation_3": "kv.Get: 2ms",
+	}, alert["details"])
+
+	// Another bundle for the same statement is deduplicated with the same
+	// alias, and the priority can be overridden.
+	b.ID++
+	alertID, err = stmtdiagnostics.TraceToOpsGenie(
+		ctx, b, "key", "dba", stmtdiagnostics.WithOpsGeniePriority("P1"),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "alert-req2", alertID)
+	require.Equal(t, alerts[0]["alias"], alerts[1]["alias"])
+	require.Equal(t, "P1", alerts[1]["priority"])
+}
+
+func TestTraceToVictorOps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var path string
+	var incident map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&incident))
+		_, err := w.Write([]byte(`{"result":"success","entity_id":"x"}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	b := makeTestBundle("https://node1:8080")
+	require.NoError(t, stmtdiagnostics.TraceToVictorOps(
+		context.Background(), b, srv.URL+"/integrations/generic/20131114/alert/apikey/", "database",
+	))
+	require.Equal(t, "/integrations/generic/20131114/alert/apikey/database", path)
+	require.Equal(t, map[string]interface{}{
+		"message_type":        "CRITICAL",
+		"entity_id":           fingerprintHash(b),
+		"entity_display_name": "Slow statement: SELECT * FROM t WHERE k = _",
+		"state_message": "Statement SELECT * FROM t WHERE k = _ took 10ms; " +
+			"slowest operation: sql query (10ms)",
+		"state_start_time": float64(b.CollectedAt.Unix()),
+		"monitoring_tool":  "CockroachDB",
+		"fingerprint":      "SELECT * FROM t WHERE k = _",
+		"bundle_id":        float64(42),
+		"node_id":          float64(1),
+		"vo_annotate.u.Statement diagnostics bundle": "https://node1:8080/_admin/v1/stmtbundle/42",
+	}, incident)
+}
+
+func TestTraceToVictorOpsFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(`{"result":"failure","message":"Missing fields"}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	err := stmtdiagnostics.TraceToVictorOps(context.Background(), makeTestBundle(""), srv.URL, "database")
+	require.Regexp(t, "creating VictorOps incident: Missing fields", err)
+}
+
+// smtpEnvelope is an email received by fakeSMTP.
+type smtpEnvelope struct {
+	auth string
+	from string
+	to   []string
+	data []byte
+}
+
+// fakeSMTP runs an SMTP server that accepts a single connection, supports the
+// PLAIN authentication mechanism and rejects the recipients at
+// bounce@example.com. The email received on the connection is sent on the
+// returned channel.
+func fakeSMTP(t *testing.T) (addr string, _ <-chan smtpEnvelope) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	ch := make(chan smtpEnvelope, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		var env smtpEnvelope
+		reply := func(line string) bool {
+			return tc.PrintfLine("%s", line) == nil
+		}
+		if !reply("220 fake ESMTP") {
+			return
+		}
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			var ok bool
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				ok = reply("250-fake") && reply("250 AUTH PLAIN")
+			case "AUTH":
+				env.auth = arg
+				ok = reply("235 2.7.0 Authentication successful")
+			case "MAIL":
+				env.from = arg
+				ok = reply("250 OK")
+			case "RCPT":
+				if strings.Contains(arg, "bounce@example.com") {
+					ok = reply("550 5.1.1 No such user")
+					break
+				}
+				env.to = append(env.to, arg)
+				ok = reply("250 OK")
+			case "DATA":
+				if !reply("354 Go ahead") {
+					return
+				}
+				if env.data, err = tc.ReadDotBytes(); err != nil {
+					return
+				}
+				ch <- env
+				ok = reply("250 OK")
+			case "QUIT":
+				_ = reply("221 Bye")
+				return
+			default:
+				ok = reply("502 Unsupported")
+			}
+			if !ok {
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestTraceToEmail(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	addr, envs := fakeSMTP(t)
+	host, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	cfg := stmtdiagnostics.SMTPConfig{
+		Host:     host,
+		Port:     port,
+		Username: "alice",
+		Password: "secret",
+		From:     "CockroachDB <crdb@example.com>",
+	}
+	to := []string{"oncall@example.com", "dba@example.com"}
+	require.NoError(t, stmtdiagnostics.TraceToEmail(ctx, b, cfg, to))
+
+	env := <-envs
+	require.Equal(t, "PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), env.auth)
+	require.Equal(t, "FROM:<crdb@example.com>", env.from)
+	require.Equal(t, []string{"TO:<oncall@example.com>", "TO:<dba@example.com>"}, env.to)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(env.data))
+	require.NoError(t, err)
+	require.Equal(t, `"CockroachDB" <crdb@example.com>`, msg.Header.Get("From"))
+	require.Equal(t, "oncall@example.com, dba@example.com", msg.Header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "Statement diagnostics bundle 42: SELECT * FROM t WHERE k = _", subject)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	require.Equal(t, "text/html; charset=utf-8", part.Header.Get("Content-Type"))
+	// The reader decodes the quoted-printable encoding.
+	html, err := io.ReadAll(part)
+	require.NoError(t, err)
+	for _, s := range []string{
+		"<h2>Statement diagnostics bundle 42</h2>",
+		"<code>SELECT * FROM t WHERE k = _</code>",
+		"2023-01-02T03:04:05Z on node 1",
+		"<code>boom</code>",
+		"<tr><td>sql query</td><td align=\"right\">1</td><td align=\"right\">10ms</td>",
+		"<svg ",
+		`<a href="https://node1:8080/_admin/v1/stmtbundle/42">`,
+	} {
+		require.Contains(t, string(html), s)
+	}
+
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	require.Equal(t, "stmt-bundle-42.zip", part.FileName())
+	require.Equal(t, "base64", part.Header.Get("Content-Transfer-Encoding"))
+	zip, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+	require.NoError(t, err)
+	require.Equal(t, b.Zip, zip)
+	_, err = mr.NextPart()
+	require.Equal(t, io.EOF, err)
+
+	// A rejected recipient fails the email.
+	addr, _ = fakeSMTP(t)
+	_, portStr, err = net.SplitHostPort(addr)
+	require.NoError(t, err)
+	cfg.Port, err = strconv.Atoi(portStr)
+	require.NoError(t, err)
+	err = stmtdiagnostics.TraceToEmail(ctx, b, cfg, []string{"oncall@example.com", "bounce@example.com"})
+	require.ErrorContains(t, err, `adding recipient bounce@example.com: 550 "5.1.1 No such user"`)
+
+	require.EqualError(t, stmtdiagnostics.TraceToEmail(ctx, b, cfg, nil), "no recipients")
+}
+
+func TestTraceToSMS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var path, user, password string
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		user, password, _ = r.BasicAuth()
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		if form.Get("To") == "+15005550001" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, err := w.Write([]byte(`{"code":21211,"message":"The 'To' number is not a valid phone number."}`))
+			require.NoError(t, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"sid":"SM123","status":"queued"}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetTwilioAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	require.NoError(t, stmtdiagnostics.TraceToSMS(ctx, b, "AC123", "token", "+15005550006", "+14155550100"))
+	require.Equal(t, "/2010-04-01/Accounts/AC123/Messages.json", path)
+	require.Equal(t, "AC123", user)
+	require.Equal(t, "token", password)
+	require.Equal(t, url.Values{
+		"From": {"+15005550006"},
+		"To":   {"+14155550100"},
+		"Body": {"CockroachDB slow query: SELECT * FROM t WHERE k = _ 10ms on node 1. " +
+			"Bundle: https://node1:8080/_admin/v1/stmtbundle/42"},
+	}, form)
+
+	// The fingerprint is truncated to 40 characters and the message to 160.
+	b.Fingerprint = "SELECT a, b, c, d, e, f, g, h FROM t WHERE k = _"
+	b.AdminURL = "https://" + strings.Repeat("a", 100) + ".example.com"
+	require.NoError(t, stmtdiagnostics.TraceToSMS(ctx, b, "AC123", "token", "+15005550006", "+14155550100"))
+	body := form.Get("Body")
+	require.Len(t, body, 160)
+	require.True(t, strings.HasPrefix(body,
+		"CockroachDB slow query: SELECT a, b, c, d, e, f, g, h FROM t WHE 10ms on node 1. Bundle: https://aaa"),
+		body)
+
+	err := stmtdiagnostics.TraceToSMS(ctx, b, "AC123", "token", "+15005550006", "+15005550001")
+	require.ErrorContains(t, err, "sending SMS with Twilio")
+	require.ErrorContains(t, err, "not a valid phone number")
+}
+
+func TestTraceToTelegram(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var message map[string]interface{}
+	var document url.Values
+	var svg []byte
+	var svgName string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bot123:secret/sendMessage":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+			if message["chat_id"] == "@unknown" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, err := w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+				require.NoError(t, err)
+				return
+			}
+			_, err := w.Write([]byte(`{"ok":true,"result":{"message_id":7}}`))
+			require.NoError(t, err)
+		case "/bot123:secret/sendDocument":
+			require.NoError(t, r.ParseMultipartForm(1<<20))
+			document = r.MultipartForm.Value
+			f, h, err := r.FormFile("document")
+			require.NoError(t, err)
+			svgName = h.Filename
+			svg, err = io.ReadAll(f)
+			require.NoError(t, err)
+			_, err = w.Write([]byte(`{"ok":true,"result":{"message_id":8}}`))
+			require.NoError(t, err)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetTelegramAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	require.NoError(t, stmtdiagnostics.TraceToTelegram(ctx, b, "123:secret", "@oncall"))
+	require.Equal(t, map[string]interface{}{
+		"chat_id": "@oncall",
+		"text": "*Statement diagnostics bundle 42*\n" +
+			"Fingerprint: `SELECT * FROM t WHERE k = _`\n" +
+			"Collected at: 2023\\-01\\-02T03:04:05Z on node 1\n" +
+			"Duration: 10ms\n" +
+			"Error: `boom`\n" +
+			"Slowest operations:\n```\nsql query: 10ms\nflow: 5ms\nkv.Get: 2ms\n```\n" +
+			"[Download the bundle](https://node1:8080/_admin/v1/stmtbundle/42)\n",
+		"parse_mode":               "MarkdownV2",
+		"disable_web_page_preview": true,
+	}, message)
+	require.Equal(t, url.Values{
+		"chat_id":             {"@oncall"},
+		"reply_to_message_id": {"7"},
+		"caption":             {"Flame chart of statement diagnostics bundle 42"},
+	}, document)
+	require.Equal(t, "stmt-bundle-42-flame-chart.svg", svgName)
+	require.Equal(t, stmtdiagnostics.TraceToFlameChartSVG(b.Trace), svg)
+
+	// Failures don't leak the bot token.
+	err := stmtdiagnostics.TraceToTelegram(ctx, b, "123:secret", "@unknown")
+	require.ErrorContains(t, err, "sending Telegram message")
+	require.ErrorContains(t, err, "chat not found")
+	require.NotContains(t, err.Error(), "secret")
+}
+
+func TestTraceToPagerDuty(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var events []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+		if event["routing_key"] == "invalid" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, err := w.Write([]byte(`{"status":"invalid event","message":"Event object is invalid"}`))
+			require.NoError(t, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, err := fmt.Fprintf(w, `{"status":"success","message":"Event processed","dedup_key":%q}`,
+			event["dedup_key"])
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetPagerDutyEventsURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	dedupKey, err := stmtdiagnostics.TraceToPagerDuty(ctx, b, "key", "critical")
+	require.NoError(t, err)
+	require.Equal(t, fingerprintHash(b), dedupKey)
+	require.NoError(t, stmtdiagnostics.ResolvePagerDuty(ctx, "key", dedupKey))
+	require.Equal(t, []map[string]interface{}{{
+		"routing_key":  "key",
+		"event_action": "trigger",
+		"dedup_key":    dedupKey,
+		"payload": map[string]interface{}{
+			"summary":   "Slow statement (10ms): SELECT * FROM t WHERE k = _",
+			"source":    "node 1",
+			"severity":  "critical",
+			"timestamp": "2023-01-02T03:04:05Z",
+			"component": "sql",
+			"group":     "statement-diagnostics",
+			"class":     "slow statement",
+			"custom_details": map[string]interface{}{
+				"fingerprint": "SELECT * FROM t WHERE k = _",
+				"bundle_id":   float64(42),
+				"duration":    "10ms",
+				"error":       "boom",
+				"slowest_operations": []interface{}{
+					map[string]interface{}{"operation": "sql query", "count": float64(1), "total": "10ms", "max": "10ms"},
+					map[string]interface{}{"operation": "flow", "count": float64(1), "total": "5ms", "max": "5ms"},
+					map[string]interface{}{"operation": "kv.Get", "count": float64(1), "total": "2ms", "max": "2ms"},
+				},
+			},
+		},
+		"client":     "CockroachDB",
+		"client_url": "https://node1:8080/_admin/v1/stmtbundle/42",
+		"links": []interface{}{map[string]interface{}{
+			"href": "https://node1:8080/_admin/v1/stmtbundle/42",
+			"text": "Statement diagnostics bundle",
+		}},
+	}, {
+		"routing_key":  "key",
+		"event_action": "resolve",
+		"dedup_key":    dedupKey,
+	}}, events)
+
+	_, err = stmtdiagnostics.TraceToPagerDuty(ctx, b, "key", "error")
+	require.EqualError(t, err, `invalid PagerDuty severity "error"`)
+	_, err = stmtdiagnostics.TraceToPagerDuty(ctx, b, "invalid", "info")
+	require.ErrorContains(t, err, "triggering PagerDuty alert")
+	require.ErrorContains(t, err, "Event object is invalid")
+}
+
+func TestTraceToDynatrace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var event map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v2/events/ingest", r.URL.Path)
+		if r.Header.Get("Authorization") != "Api-Token token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, err := w.Write([]byte(`{"error":{"code":401,"message":"Missing authorization parameter."}}`))
+			require.NoError(t, err)
+			return
+		}
+		event = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(
+			`{"reportCount":1,"eventIngestResults":[{"correlationId":"c0ffee","status":"OK"}]}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	problemID, err := stmtdiagnostics.TraceToDynatrace(ctx, b, srv.URL+"/", "token")
+	require.NoError(t, err)
+	require.Equal(t, "c0ffee", problemID)
+	require.Equal(t, map[string]interface{}{
+		"eventType": "CUSTOM_ALERT",
+		"title":     "Slow statement (10ms): SELECT * FROM t WHERE k = _",
+		"startTime": float64(b.CollectedAt.UnixMilli()),
+		"properties": map[string]interface{}{
+			"dt.event.description": b.Summary() +
+				"\nFlame graph (collapsed stacks, in microseconds):\n" +
+				"sql query 5000\nsql query;flow 3000\nsql query;flow;kv.Get 2000\n",
+			"fingerprint": "SELECT * FROM t WHERE k = _",
+			"bundle_id":   "42",
+			"node_id":     "1",
+			"duration":    "10ms",
+			"bundle_url":  "https://node1:8080/_admin/v1/stmtbundle/42",
+		},
+	}, event)
+
+	_, err = stmtdiagnostics.TraceToDynatrace(ctx, b, srv.URL, "invalid")
+	require.ErrorContains(t, err, "reporting Dynatrace problem")
+	require.ErrorContains(t, err, "Missing authorization parameter.")
+}
+
+func TestTraceToPrometheusAlertmanager(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var alerts []interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/api/v2/alerts", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alerts))
+	}))
+	defer srv.Close()
+
+	b := makeTestBundle("https://node1:8080")
+	require.NoError(t, stmtdiagnostics.TraceToPrometheusAlertmanager(context.Background(), b, srv.URL+"/"))
+	require.Equal(t, []interface{}{map[string]interface{}{
+		"labels": map[string]interface{}{
+			"alertname":   "CockroachDBSlowQuery",
+			"fingerprint": fingerprintHash(b),
+			"severity":    "warning",
+		},
+		"annotations": map[string]interface{}{
+			"summary": "Slow statement (10ms): SELECT * FROM t WHERE k = _",
+			"description": b.Summary() + "\nSlowest operations:\n" +
+				"sql query: 10ms\nflow: 5ms\nkv.Get: 2ms",
+		},
+		"startsAt":     "2023-01-02T03:04:05Z",
+		"generatorURL": "https://node1:8080/_admin/v1/stmtbundle/42",
+	}}, alerts)
+}
+
+func TestTraceToGrafanaAlert(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var annotations []map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/provisioning/alert-rules/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodGet, r.Method)
+		require.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		switch strings.TrimPrefix(r.URL.Path, "/api/v1/provisioning/alert-rules/") {
+		case "linked":
+			_, err := w.Write([]byte(`{"uid":"linked","title":"Slow queries",` +
+				`"annotations":{"__dashboardUid__":"dash","__panelId__":"3"}}`))
+			require.NoError(t, err)
+		case "unlinked":
+			_, err := w.Write([]byte(`{"uid":"unlinked","title":"Slow queries"}`))
+			require.NoError(t, err)
+		default:
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+		}
+	})
+	mux.HandleFunc("/api/annotations", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		var annotation map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&annotation))
+		annotations = append(annotations, annotation)
+		_, err := w.Write([]byte(`{"message":"Annotation added","id":1}`))
+		require.NoError(t, err)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	require.NoError(t, stmtdiagnostics.TraceToGrafanaAlert(ctx, b, srv.URL+"/", "key", "linked"))
+	require.Equal(t, map[string]interface{}{
+		"time":    float64(b.CollectedAt.Add(-10 * time.Millisecond).UnixMilli()),
+		"timeEnd": float64(b.CollectedAt.UnixMilli()),
+		"tags": []interface{}{
+			"cockroachdb", "statement-diagnostics", "alerting",
+			"rule:linked", "fingerprint:" + fingerprintHash(b),
+		},
+		"text": "Slow queries: slow statement (10ms)\n" + b.Summary() +
+			"\nSlowest operations:\nsql query: 10ms\nflow: 5ms\nkv.Get: 2ms",
+		"data": map[string]interface{}{
+			"ruleUID":     "linked",
+			"ruleTitle":   "Slow queries",
+			"newState":    "Alerting",
+			"fingerprint": "SELECT * FROM t WHERE k = _",
+			"bundleID":    "42",
+		},
+		"dashboardUID": "dash",
+		"panelId":      float64(3),
+	}, annotations[0])
+
+	require.NoError(t, stmtdiagnostics.TraceToGrafanaAlert(ctx, b, srv.URL, "key", "unlinked"))
+	require.Len(t, annotations, 2)
+	require.NotContains(t, annotations[1], "dashboardUID")
+	require.NotContains(t, annotations[1], "panelId")
+
+	err := stmtdiagnostics.TraceToGrafanaAlert(ctx, b, srv.URL, "key", "missing")
+	require.ErrorContains(t, err, "looking up Grafana alert rule missing")
+	require.Len(t, annotations, 2)
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// This file contains integrations with product analytics and session replay
+// tools, which record collected bundles as events so that slow statements can
+// be correlated with what the users of an application were doing.
+
+// slowQueryEventType is the type of the events recorded for collected bundles.
+const slowQueryEventType = "crdb_slow_query"
+
+// slowQueryEventProperties returns the properties of the event recorded for the
+// bundle.
+func slowQueryEventProperties(b *Bundle) map[string]interface{} {
+	return map[string]interface{}{
+		"fingerprint": b.Fingerprint,
+		"duration_ms": float64(b.Duration.Microseconds()) / 1000,
+		"bundle_id":   int64(b.ID),
+	}
+}
+
+// logRocketAPIURL is the base URL of the LogRocket API. It is overridden in
+// tests.
+var logRocketAPIURL = "https://api.logrocket.com"
+
+// TraceToLogRocket adds a crdb_slow_query custom event about the bundle to the
+// given session recording of a LogRocket app, so that the session replay shows
+// when the statement was collected. appID is of the form "org/app", as in the
+// LogRocket SDK. The properties of the event are the fingerprint of the
+// statement, its duration in milliseconds and the ID of the bundle.
+func TraceToLogRocket(ctx context.Context, b *Bundle, appID, apiKey, sessionID string) error {
+	event := map[string]interface{}{
+		"type":       slowQueryEventType,
+		"timestamp":  b.CollectedAt.UnixMilli(),
+		"properties": slowQueryEventProperties(b),
+	}
+	header := http.Header{"Authorization": {"Token " + apiKey}}
+	u := fmt.Sprintf("%s/v1/apps/%s/sessions/%s/events",
+		logRocketAPIURL, appID, url.PathEscape(sessionID))
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, u, header, event, nil /* resp */),
+		"adding LogRocket event")
+}
+
+// mixpanelAPIURL is the base URL of the Mixpanel ingestion API. It is
+// overridden in tests.
+var mixpanelAPIURL = "https://api.mixpanel.com"
+
+// TraceToMixpanel tracks a "CockroachDB Slow Query" event about the bundle in
+// the Mixpanel project with the given token, attributed to the given distinct
+// ID. The properties of the event are the fingerprint of the statement, its
+// duration in milliseconds, the node that collected the bundle and whether the
+// statement failed. The ID of the bundle is the insert ID of the event, so that
+// Mixpanel deduplicates retried calls.
+func TraceToMixpanel(ctx context.Context, b *Bundle, projectToken, distinctID string) error {
+	events := []interface{}{
+		map[string]interface{}{
+			"event": "CockroachDB Slow Query",
+			"properties": map[string]interface{}{
+				"token":       projectToken,
+				"distinct_id": distinctID,
+				"time":        b.CollectedAt.UnixMilli(),
+				"$insert_id":  strconv.FormatInt(int64(b.ID), 10),
+				"Fingerprint": b.Fingerprint,
+				"DurationMs":  float64(b.Duration.Microseconds()) / 1000,
+				"NodeID":      int64(b.InstanceID),
+				"HasError":    b.Err != nil,
+			},
+		},
+	}
+	// With verbose=1, Mixpanel describes the events it rejects rather than
+	// only returning 0.
+	var resp struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := DoJSONRequest(ctx, http.MethodPost, mixpanelAPIURL+"/track?verbose=1",
+		nil /* header */, events, &resp); err != nil {
+		return errors.Wrap(err, "tracking Mixpanel event")
+	}
+	if resp.Status != 1 {
+		return errors.Newf("tracking Mixpanel event: %s", resp.Error)
+	}
+	return nil
+}
+
+// amplitudeAPIURL is the base URL of the Amplitude HTTP API v2. It is
+// overridden in tests.
+var amplitudeAPIURL = "https://api2.amplitude.com"
+
+// TraceToAmplitude tracks a slow_query_bundle_collected event about the bundle,
+// attributed to the given user, in the Amplitude project with the given API
+// key. The properties of the event are the fingerprint of the statement, its
+// duration in milliseconds, the node that collected the bundle and whether the
+// statement failed. The insert ID of the event is derived from the ID of the
+// bundle, so that Amplitude deduplicates retried calls.
+func TraceToAmplitude(ctx context.Context, b *Bundle, apiKey, userID string) error {
+	req := map[string]interface{}{
+		"api_key": apiKey,
+		"events": []interface{}{
+			map[string]interface{}{
+				"user_id":    userID,
+				"event_type": "slow_query_bundle_collected",
+				"time":       b.CollectedAt.UnixMilli(),
+				"insert_id":  fmt.Sprintf("crdb-stmt-bundle-%d", b.ID),
+				"event_properties": map[string]interface{}{
+					"fingerprint": b.Fingerprint,
+					"duration_ms": float64(b.Duration.Microseconds()) / 1000,
+					"node_id":     int64(b.InstanceID),
+					"has_error":   b.Err != nil,
+				},
+			},
+		},
+	}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, amplitudeAPIURL+"/2/httpapi", nil /* header */, req, nil /* resp */),
+		"tracking Amplitude event")
+}
+
+// heapAPIURL is the base URL of the Heap server-side API. It is overridden in
+// tests.
+var heapAPIURL = "https://heapanalytics.com"
+
+// TraceToHeap tracks a crdb_slow_query server-side event about the bundle for
+// the user with the given identity in the Heap environment with the given app
+// ID. Since Heap analyzes events retroactively, slow statements can then be
+// correlated with the past behavior of the user. The properties of the event
+// are the fingerprint of the statement, its duration in milliseconds and the ID
+// of the bundle. The idempotency key of the event is derived from the ID of the
+// bundle, so that Heap deduplicates retried calls.
+func TraceToHeap(ctx context.Context, b *Bundle, appID, userID string) error {
+	event := map[string]interface{}{
+		"app_id":          appID,
+		"identity":        userID,
+		"event":           slowQueryEventType,
+		"timestamp":       b.CollectedAt.UTC().Format(time.RFC3339Nano),
+		"idempotency_key": fmt.Sprintf("crdb-stmt-bundle-%d", b.ID),
+		"properties":      slowQueryEventProperties(b),
+	}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, heapAPIURL+"/api/track", nil /* header */, event, nil /* resp */),
+		"tracking Heap event")
+}
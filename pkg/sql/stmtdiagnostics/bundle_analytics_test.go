@@ -0,0 +1,197 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToLogRocket(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var events []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/v1/apps/org/app/sessions/s 1/events", r.URL.Path)
+		if r.Header.Get("Authorization") != "Token key" {
+			http.Error(w, `{"error":"invalid api key"}`, http.StatusUnauthorized)
+			return
+		}
+		var event map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetLogRocketAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("")
+	require.NoError(t, stmtdiagnostics.TraceToLogRocket(ctx, b, "org/app", "key", "s 1"))
+	require.Equal(t, []map[string]interface{}{{
+		"type":      "crdb_slow_query",
+		"timestamp": float64(1672628645000),
+		"properties": map[string]interface{}{
+			"fingerprint": "SELECT * FROM t WHERE k = _",
+			"duration_ms": float64(10),
+			"bundle_id":   float64(42),
+		},
+	}}, events)
+
+	err := stmtdiagnostics.TraceToLogRocket(ctx, b, "org/app", "invalid", "s 1")
+	require.ErrorContains(t, err, "adding LogRocket event")
+	require.ErrorContains(t, err, "invalid api key")
+}
+
+func TestTraceToMixpanel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var events []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/track", r.URL.Path)
+		require.Equal(t, "1", r.URL.Query().Get("verbose"))
+		var req []map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		for _, e := range req {
+			if e["properties"].(map[string]interface{})["token"] != "token" {
+				_, err := w.Write([]byte(`{"status":0,"error":"token, missing or empty"}`))
+				require.NoError(t, err)
+				return
+			}
+		}
+		events = append(events, req...)
+		_, err := w.Write([]byte(`{"status":1,"error":null}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetMixpanelAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("")
+	require.NoError(t, stmtdiagnostics.TraceToMixpanel(ctx, b, "token", "user-1"))
+	require.Equal(t, []map[string]interface{}{{
+		"event": "CockroachDB Slow Query",
+		"properties": map[string]interface{}{
+			"token":       "token",
+			"distinct_id": "user-1",
+			"time":        float64(1672628645000),
+			"$insert_id":  "42",
+			"Fingerprint": "SELECT * FROM t WHERE k = _",
+			"DurationMs":  float64(10),
+			"NodeID":      float64(1),
+			"HasError":    true,
+		},
+	}}, events)
+
+	err := stmtdiagnostics.TraceToMixpanel(ctx, b, "invalid", "user-1")
+	require.ErrorContains(t, err, "tracking Mixpanel event")
+	require.ErrorContains(t, err, "token, missing or empty")
+}
+
+func TestTraceToAmplitude(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var events []interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/2/httpapi", r.URL.Path)
+		var req struct {
+			APIKey string        `json:"api_key"`
+			Events []interface{} `json:"events"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.APIKey != "key" {
+			http.Error(w, `{"code":400,"error":"Invalid API key: invalid"}`, http.StatusBadRequest)
+			return
+		}
+		events = append(events, req.Events...)
+		_, err := w.Write([]byte(`{"code":200,"events_ingested":1}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetAmplitudeAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("")
+	b.Err = nil
+	require.NoError(t, stmtdiagnostics.TraceToAmplitude(ctx, b, "key", "user-1"))
+	require.Equal(t, []interface{}{
+		map[string]interface{}{
+			"user_id":    "user-1",
+			"event_type": "slow_query_bundle_collected",
+			"time":       float64(1672628645000),
+			"insert_id":  "crdb-stmt-bundle-42",
+			"event_properties": map[string]interface{}{
+				"fingerprint": "SELECT * FROM t WHERE k = _",
+				"duration_ms": float64(10),
+				"node_id":     float64(1),
+				"has_error":   false,
+			},
+		},
+	}, events)
+
+	err := stmtdiagnostics.TraceToAmplitude(ctx, b, "invalid", "user-1")
+	require.ErrorContains(t, err, "tracking Amplitude event")
+	require.ErrorContains(t, err, "Invalid API key")
+}
+
+func TestTraceToHeap(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var events []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/api/track", r.URL.Path)
+		var event map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		if event["app_id"] != "app" {
+			http.Error(w, `{"error":"Invalid app_id"}`, http.StatusBadRequest)
+			return
+		}
+		events = append(events, event)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetHeapAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("")
+	require.NoError(t, stmtdiagnostics.TraceToHeap(ctx, b, "app", "user@example.com"))
+	require.Equal(t, []map[string]interface{}{{
+		"app_id":          "app",
+		"identity":        "user@example.com",
+		"event":           "crdb_slow_query",
+		"timestamp":       "2023-01-02T03:04:05Z",
+		"idempotency_key": "crdb-stmt-bundle-42",
+		"properties": map[string]interface{}{
+			"fingerprint": "SELECT * FROM t WHERE k = _",
+			"duration_ms": float64(10),
+			"bundle_id":   float64(42),
+		},
+	}}, events)
+
+	err := stmtdiagnostics.TraceToHeap(ctx, b, "invalid", "user@example.com")
+	require.ErrorContains(t, err, "tracking Heap event")
+	require.ErrorContains(t, err, "Invalid app_id")
+}
@@ -0,0 +1,368 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/redact"
+)
+
+// SpansByStartTime returns the spans of the recording sorted by start time.
+func SpansByStartTime(r tracingpb.Recording) []*tracingpb.RecordedSpan {
+	spans := make([]*tracingpb.RecordedSpan, len(r))
+	for i := range r {
+		spans[i] = &r[i]
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].StartTime.Before(spans[j].StartTime)
+	})
+	return spans
+}
+
+// RedactedError returns the message of the error of a bundle with its
+// sensitive details, e.g. the values of the statement, replaced by ×. Error
+// trackers only receive this message, and the fingerprint of the statement
+// instead of its text.
+func RedactedError(err error) string {
+	return redact.Sprint(err).Redact().StripMarkers()
+}
+
+// errorSpan returns the span of the trace in which the error of the bundle was
+// logged: the last span, in the order in which they started, with a log
+// message containing the error. If there is none, it returns the root span,
+// or nil if the trace is empty.
+func errorSpan(b *Bundle) *tracingpb.RecordedSpan {
+	spans := SpansByStartTime(b.Trace)
+	if b.Err != nil {
+		errMsg := b.Err.Error()
+		for i := len(spans) - 1; i >= 0; i-- {
+			for _, l := range spans[i].Logs {
+				if strings.Contains(l.Msg().StripMarkers(), errMsg) {
+					return spans[i]
+				}
+			}
+		}
+	}
+	if len(b.Trace) == 0 {
+		return nil
+	}
+	return &b.Trace[0]
+}
+
+// backtraceFrame is a frame of the backtrace that the error trackers report
+// for the error of a bundle: a log message of the span in which the error was
+// logged.
+type backtraceFrame struct {
+	operation string
+	message   string
+	// time is the time of the log message, in RFC 3339 format.
+	time string
+}
+
+// errorBacktrace returns the log messages of the span in which the error of the
+// bundle was logged (see errorSpan), from the most recent one, redacted like
+// the error (see RedactedError).
+func errorBacktrace(b *Bundle) []backtraceFrame {
+	sp := errorSpan(b)
+	if sp == nil {
+		return nil
+	}
+	frames := make([]backtraceFrame, 0, len(sp.Logs))
+	for i := len(sp.Logs) - 1; i >= 0; i-- {
+		frames = append(frames, backtraceFrame{
+			operation: sp.Operation,
+			message:   sp.Logs[i].Msg().Redact().StripMarkers(),
+			time:      sp.Logs[i].Time.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	return frames
+}
+
+// raygunAPIURL is the base URL of the Raygun API. It is overridden in tests.
+var raygunAPIURL = "https://api.raygun.com"
+
+// TraceToRaygun posts a crash report about the bundle to Raygun if the
+// statement failed, and does nothing otherwise. The message of the error is
+// the redacted error of the statement, and its stack trace has a frame for
+// each log message of the span in which the error was logged (see errorSpan),
+// from the most recent one. The custom data of the report contains the metadata of the
+// bundle and the 5 slowest operations of the trace, and the reports about the
+// bundles of a statement are grouped together. appVersion is reported as the
+// version of the application, if not empty.
+func TraceToRaygun(ctx context.Context, b *Bundle, apiKey, appVersion string) error {
+	if b.Err == nil {
+		return nil
+	}
+	var stackTrace []map[string]interface{}
+	for _, f := range errorBacktrace(b) {
+		stackTrace = append(stackTrace, map[string]interface{}{
+			"className":  f.operation,
+			"methodName": f.message,
+			"fileName":   f.time,
+			"lineNumber": 0,
+		})
+	}
+	customData := map[string]string{
+		"fingerprint":  b.Fingerprint,
+		"bundle_id":    strconv.FormatInt(int64(b.ID), 10),
+		"node_id":      strconv.Itoa(int(b.InstanceID)),
+		"duration":     b.Duration.String(),
+		"span_count":   strconv.Itoa(len(b.Trace)),
+		"span_summary": slowestOperationsText(b, 5),
+	}
+	if u := b.URL(); u != "" {
+		customData["bundle_url"] = u
+	}
+	details := map[string]interface{}{
+		"machineName": fmt.Sprintf("node %d", b.InstanceID),
+		"groupingKey": b.FingerprintHash(),
+		"error": map[string]interface{}{
+			"className":  "SQLError",
+			"message":    RedactedError(b.Err),
+			"stackTrace": stackTrace,
+		},
+		"tags":           []string{"cockroachdb", "statement-diagnostics"},
+		"userCustomData": customData,
+		"client": map[string]string{
+			"name": "CockroachDB",
+		},
+	}
+	if appVersion != "" {
+		details["version"] = appVersion
+	}
+	entry := map[string]interface{}{
+		"occurredOn": b.CollectedAt.UTC().Format(time.RFC3339),
+		"details":    details,
+	}
+	header := http.Header{"X-ApiKey": {apiKey}}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, raygunAPIURL+"/entries", header, entry, nil /* resp */),
+		"posting Raygun crash report")
+}
+
+// honeybadgerAPIURL is the base URL of the Honeybadger API. It is overridden in
+// tests.
+var honeybadgerAPIURL = "https://api.honeybadger.io"
+
+// TraceToHoneybadger reports the error of the statement of the bundle as a
+// notice to Honeybadger, and does nothing if the statement succeeded. The class
+// of the error is its SQLSTATE code and its backtrace has a frame for each log
+// message of the span in which the error was logged (see errorSpan), from the
+// most recent one. The context of the notice carries the fingerprint of the
+// statement, its duration and the node that collected the bundle, and the
+// notices about the bundles of a statement are grouped together.
+func TraceToHoneybadger(ctx context.Context, b *Bundle, apiKey string) error {
+	if b.Err == nil {
+		return nil
+	}
+	backtrace := []map[string]string{}
+	for _, f := range errorBacktrace(b) {
+		backtrace = append(backtrace, map[string]string{
+			"number": "0",
+			"file":   f.time,
+			"method": f.operation + ": " + f.message,
+		})
+	}
+	noticeContext := map[string]string{
+		"fingerprint": b.Fingerprint,
+		"duration":    b.Duration.String(),
+		"node_id":     strconv.Itoa(int(b.InstanceID)),
+		"bundle_id":   strconv.FormatInt(int64(b.ID), 10),
+	}
+	if u := b.URL(); u != "" {
+		noticeContext["bundle_url"] = u
+	}
+	notice := map[string]interface{}{
+		"notifier": map[string]string{
+			"name": "CockroachDB",
+			"url":  "https://www.cockroachlabs.com",
+		},
+		"error": map[string]interface{}{
+			"class":       pgerror.GetPGCode(b.Err).String(),
+			"message":     RedactedError(b.Err),
+			"backtrace":   backtrace,
+			"fingerprint": b.FingerprintHash(),
+			"tags":        []string{"cockroachdb", "statement-diagnostics"},
+		},
+		"request": map[string]interface{}{
+			"context": noticeContext,
+		},
+		"server": map[string]string{
+			"hostname": fmt.Sprintf("node %d", b.InstanceID),
+		},
+	}
+	header := http.Header{
+		"X-API-Key": {apiKey},
+		"Accept":    {"application/json"},
+	}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, honeybadgerAPIURL+"/v1/notices", header, notice, nil /* resp */),
+		"reporting Honeybadger notice")
+}
+
+// rollbarAPIURL is the base URL of the Rollbar API. It is overridden in tests.
+var rollbarAPIURL = "https://api.rollbar.com"
+
+// TraceToRollbar reports the error of the statement of the bundle as an item of
+// the "error" level to Rollbar, and returns the UUID of the item. It does
+// nothing, and returns an empty UUID, if the statement succeeded. The class of
+// the exception is the SQLSTATE code of the error, and the trace has a frame
+// for each log message of the span in which the error was logged (see
+// errorSpan). The custom data of the item contains the metadata of the bundle,
+// and the items about the bundles of a statement are grouped by a hash of its
+// fingerprint.
+func TraceToRollbar(
+	ctx context.Context, b *Bundle, accessToken, environment string,
+) (uuid string, err error) {
+	if b.Err == nil {
+		return "", nil
+	}
+	backtrace := errorBacktrace(b)
+	// Rollbar expects the most recent frame last.
+	frames := make([]map[string]string, 0, len(backtrace))
+	for i := len(backtrace) - 1; i >= 0; i-- {
+		frames = append(frames, map[string]string{
+			"filename": backtrace[i].operation,
+			"method":   backtrace[i].message,
+		})
+	}
+	custom := map[string]string{
+		"fingerprint":  b.Fingerprint,
+		"bundle_id":    strconv.FormatInt(int64(b.ID), 10),
+		"node_id":      strconv.Itoa(int(b.InstanceID)),
+		"duration":     b.Duration.String(),
+		"collected_at": b.CollectedAt.UTC().Format(time.RFC3339),
+	}
+	if u := b.URL(); u != "" {
+		custom["bundle_url"] = u
+	}
+	item := map[string]interface{}{
+		"data": map[string]interface{}{
+			"environment": environment,
+			"level":       "error",
+			"timestamp":   b.CollectedAt.Unix(),
+			"title":       b.Fingerprint + ": " + RedactedError(b.Err),
+			"fingerprint": b.FingerprintHash(),
+			"body": map[string]interface{}{
+				"trace": map[string]interface{}{
+					"frames": frames,
+					"exception": map[string]string{
+						"class":   pgerror.GetPGCode(b.Err).String(),
+						"message": RedactedError(b.Err),
+					},
+				},
+			},
+			"server": map[string]string{
+				"host": fmt.Sprintf("node %d", b.InstanceID),
+			},
+			"custom": custom,
+			"notifier": map[string]string{
+				"name": "cockroachdb-stmtdiagnostics",
+			},
+		},
+	}
+	var resp struct {
+		Err     int    `json:"err"`
+		Message string `json:"message"`
+		Result  struct {
+			UUID string `json:"uuid"`
+		} `json:"result"`
+	}
+	header := http.Header{"X-Rollbar-Access-Token": {accessToken}}
+	if err := DoJSONRequest(
+		ctx, http.MethodPost, rollbarAPIURL+"/api/1/item/", header, item, &resp,
+	); err != nil {
+		return "", errors.Wrap(err, "reporting Rollbar item")
+	}
+	if resp.Err != 0 {
+		return "", errors.Newf("reporting Rollbar item: %s", resp.Message)
+	}
+	return resp.Result.UUID, nil
+}
+
+// airbrakeAPIURL is the base URL of the Airbrake API. It is overridden in tests.
+var airbrakeAPIURL = "https://api.airbrake.io"
+
+// airbrakeSeverity returns the severity of the Airbrake notice about the given
+// error. Canceled statements and transaction rollbacks, which clients are
+// expected to retry, are warnings, and the other errors are errors.
+func airbrakeSeverity(err error) string {
+	code := pgerror.GetPGCode(err)
+	if code == pgcode.QueryCanceled || strings.HasPrefix(code.String(), "40") {
+		return "warning"
+	}
+	return "error"
+}
+
+// TraceToAirbrake reports the error of the statement of the bundle as a notice
+// to the given Airbrake project, and does nothing if the statement succeeded.
+// The type of the error is its SQLSTATE code and its backtrace has a frame for
+// each log message of the span in which the error was logged (see errorSpan),
+// from the most recent one. The severity of the notice depends on the error
+// (see airbrakeSeverity), and its params carry the metadata of the bundle.
+func TraceToAirbrake(ctx context.Context, b *Bundle, projectID int64, projectKey string) error {
+	if b.Err == nil {
+		return nil
+	}
+	backtrace := []map[string]interface{}{}
+	for _, f := range errorBacktrace(b) {
+		backtrace = append(backtrace, map[string]interface{}{
+			"file":     f.operation,
+			"function": f.message,
+			"line":     0,
+		})
+	}
+	params := map[string]string{
+		"fingerprint":  b.Fingerprint,
+		"bundle_id":    strconv.FormatInt(int64(b.ID), 10),
+		"duration":     b.Duration.String(),
+		"collected_at": b.CollectedAt.UTC().Format(time.RFC3339),
+	}
+	if u := b.URL(); u != "" {
+		params["bundle_url"] = u
+	}
+	notice := map[string]interface{}{
+		"errors": []interface{}{
+			map[string]interface{}{
+				"type":      pgerror.GetPGCode(b.Err).String(),
+				"message":   RedactedError(b.Err),
+				"backtrace": backtrace,
+			},
+		},
+		"context": map[string]interface{}{
+			"notifier": map[string]string{
+				"name": "cockroachdb-stmtdiagnostics",
+				"url":  "https://www.cockroachlabs.com",
+			},
+			"severity":  airbrakeSeverity(b.Err),
+			"component": "stmtdiagnostics",
+			"action":    b.Fingerprint,
+			"hostname":  fmt.Sprintf("node %d", b.InstanceID),
+		},
+		"params": params,
+	}
+	header := http.Header{"Authorization": {"Bearer " + projectKey}}
+	url := fmt.Sprintf("%s/api/v3/projects/%d/notices", airbrakeAPIURL, projectID)
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, url, header, notice, nil /* resp */),
+		"reporting Airbrake notice")
+}
@@ -0,0 +1,343 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToRaygun(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var entries []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/entries", r.URL.Path)
+		if r.Header.Get("X-ApiKey") != "key" {
+			http.Error(w, "Invalid API key", http.StatusForbidden)
+			return
+		}
+		var entry map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&entry))
+		entries = append(entries, entry)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetRaygunAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	// The error is logged in the kv.Get span.
+	b.Trace[2].Logs = []tracingpb.LogRecord{
+		{Time: b.Trace[2].StartTime, Message: "sending request to ‹n2›"},
+		{Time: b.Trace[2].StartTime.Add(time.Millisecond), Message: "error: boom"},
+	}
+	require.NoError(t, stmtdiagnostics.TraceToRaygun(ctx, b, "key", "v23.1.0"))
+	require.Len(t, entries, 1)
+	require.Equal(t, map[string]interface{}{
+		"occurredOn": "2023-01-02T03:04:05Z",
+		"details": map[string]interface{}{
+			"machineName": "node 1",
+			"version":     "v23.1.0",
+			"groupingKey": fingerprintHash(b),
+			"error": map[string]interface{}{
+				"className": "SQLError",
+				"message":   "boom",
+				"stackTrace": []interface{}{
+					map[string]interface{}{
+						"className":  "kv.Get",
+						"methodName": "error: boom",
+						"fileName":   "2023-01-02T03:04:05.004Z",
+						"lineNumber": float64(0),
+					},
+					map[string]interface{}{
+						"className":  "kv.Get",
+						"methodName": "sending request to ×",
+						"fileName":   "2023-01-02T03:04:05.003Z",
+						"lineNumber": float64(0),
+					},
+				},
+			},
+			"tags": []interface{}{"cockroachdb", "statement-diagnostics"},
+			"userCustomData": map[string]interface{}{
+				"fingerprint":  "SELECT * FROM t WHERE k = _",
+				"bundle_id":    "42",
+				"node_id":      "1",
+				"duration":     "10ms",
+				"span_count":   "3",
+				"span_summary": "sql query: 10ms\nflow: 5ms\nkv.Get: 2ms",
+				"bundle_url":   "https://node1:8080/_admin/v1/stmtbundle/42",
+			},
+			"client": map[string]interface{}{"name": "CockroachDB"},
+		},
+	}, entries[0])
+
+	// Without a log message containing the error, the stack trace comes from
+	// the root span.
+	b = makeTestBundle("")
+	require.NoError(t, stmtdiagnostics.TraceToRaygun(ctx, b, "key", ""))
+	require.Len(t, entries, 2)
+	details := entries[1]["details"].(map[string]interface{})
+	require.NotContains(t, details, "version")
+	require.Equal(t, []interface{}{map[string]interface{}{
+		"className":  "sql query",
+		"methodName": "planning",
+		"fileName":   "2023-01-02T03:04:05.001Z",
+		"lineNumber": float64(0),
+	}}, details["error"].(map[string]interface{})["stackTrace"])
+
+	// Bundles of successful statements aren't reported.
+	b.Err = nil
+	require.NoError(t, stmtdiagnostics.TraceToRaygun(ctx, b, "key", ""))
+	require.Len(t, entries, 2)
+
+	b = makeTestBundle("")
+	err := stmtdiagnostics.TraceToRaygun(ctx, b, "invalid", "")
+	require.ErrorContains(t, err, "posting Raygun crash report")
+	require.ErrorContains(t, err, "Invalid API key")
+}
+
+func TestTraceToHoneybadger(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var notices []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/v1/notices", r.URL.Path)
+		if r.Header.Get("X-API-Key") != "key" {
+			http.Error(w, `{"error":"Invalid API key"}`, http.StatusForbidden)
+			return
+		}
+		var notice map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&notice))
+		notices = append(notices, notice)
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"id":"7b4c7ed5-8a8f-4e5b-a2e1-0e9b0d3c7a1f"}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetHoneybadgerAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	b.Err = pgerror.New(pgcode.QueryCanceled, "query execution canceled")
+	require.NoError(t, stmtdiagnostics.TraceToHoneybadger(ctx, b, "key"))
+	require.Len(t, notices, 1)
+	notice := notices[0]
+	require.Equal(t, map[string]interface{}{
+		"class":   "57014",
+		"message": "query execution canceled",
+		"backtrace": []interface{}{map[string]interface{}{
+			"number": "0",
+			"file":   "2023-01-02T03:04:05.001Z",
+			"method": "sql query: planning",
+		}},
+		"fingerprint": fingerprintHash(b),
+		"tags":        []interface{}{"cockroachdb", "statement-diagnostics"},
+	}, notice["error"])
+	require.Equal(t, map[string]interface{}{
+		"context": map[string]interface{}{
+			"fingerprint": "SELECT * FROM t WHERE k = _",
+			"duration":    "10ms",
+			"node_id":     "1",
+			"bundle_id":   "42",
+			"bundle_url":  "https://node1:8080/_admin/v1/stmtbundle/42",
+		},
+	}, notice["request"])
+	require.Equal(t, map[string]interface{}{"hostname": "node 1"}, notice["server"])
+
+	// Errors without a SQLSTATE code are uncategorized.
+	b = makeTestBundle("")
+	require.NoError(t, stmtdiagnostics.TraceToHoneybadger(ctx, b, "key"))
+	require.Equal(t, "XXUUU", notices[1]["error"].(map[string]interface{})["class"])
+
+	// Bundles of successful statements aren't reported.
+	b.Err = nil
+	require.NoError(t, stmtdiagnostics.TraceToHoneybadger(ctx, b, "key"))
+	require.Len(t, notices, 2)
+
+	b = makeTestBundle("")
+	err := stmtdiagnostics.TraceToHoneybadger(ctx, b, "invalid")
+	require.ErrorContains(t, err, "reporting Honeybadger notice")
+	require.ErrorContains(t, err, "Invalid API key")
+}
+
+func TestTraceToRollbar(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var items []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/api/1/item/", r.URL.Path)
+		if r.Header.Get("X-Rollbar-Access-Token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, err := w.Write([]byte(`{"err":1,"message":"invalid access token"}`))
+			require.NoError(t, err)
+			return
+		}
+		var item map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&item))
+		items = append(items, item)
+		_, err := w.Write([]byte(`{"err":0,"result":{"id":null,"uuid":"d4c7acef55bf4c9ea95e4fe9428a8287"}}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetRollbarAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	b.Err = pgerror.New(pgcode.QueryCanceled, "query execution canceled")
+	b.Trace[2].Logs = []tracingpb.LogRecord{
+		{Time: b.Trace[2].StartTime, Message: "sending request"},
+		{Time: b.Trace[2].StartTime.Add(time.Millisecond), Message: "query execution canceled"},
+	}
+	uuid, err := stmtdiagnostics.TraceToRollbar(ctx, b, "token", "production")
+	require.NoError(t, err)
+	require.Equal(t, "d4c7acef55bf4c9ea95e4fe9428a8287", uuid)
+	require.Len(t, items, 1)
+	require.Equal(t, map[string]interface{}{
+		"environment": "production",
+		"level":       "error",
+		"timestamp":   float64(b.CollectedAt.Unix()),
+		"title":       "SELECT * FROM t WHERE k = _: query execution canceled",
+		"fingerprint": fingerprintHash(b),
+		"body": map[string]interface{}{
+			"trace": map[string]interface{}{
+				"frames": []interface{}{
+					map[string]interface{}{"filename": "kv.Get", "method": "sending request"},
+					map[string]interface{}{"filename": "kv.Get", "method": "query execution canceled"},
+				},
+				"exception": map[string]interface{}{
+					"class":   "57014",
+					"message": "query execution canceled",
+				},
+			},
+		},
+		"server": map[string]interface{}{"host": "node 1"},
+		"custom": map[string]interface{}{
+			"fingerprint":  "SELECT * FROM t WHERE k = _",
+			"bundle_id":    "42",
+			"node_id":      "1",
+			"duration":     "10ms",
+			"collected_at": "2023-01-02T03:04:05Z",
+			"bundle_url":   "https://node1:8080/_admin/v1/stmtbundle/42",
+		},
+		"notifier": map[string]interface{}{"name": "cockroachdb-stmtdiagnostics"},
+	}, items[0]["data"])
+
+	// Bundles of successful statements aren't reported.
+	b.Err = nil
+	uuid, err = stmtdiagnostics.TraceToRollbar(ctx, b, "token", "production")
+	require.NoError(t, err)
+	require.Empty(t, uuid)
+	require.Len(t, items, 1)
+
+	b = makeTestBundle("")
+	_, err = stmtdiagnostics.TraceToRollbar(ctx, b, "invalid", "production")
+	require.ErrorContains(t, err, "reporting Rollbar item")
+	require.ErrorContains(t, err, "invalid access token")
+}
+
+func TestTraceToAirbrake(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var notices []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/api/v3/projects/123/notices", r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, err := w.Write([]byte(`{"message":"invalid project key"}`))
+			require.NoError(t, err)
+			return
+		}
+		var notice map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&notice))
+		notices = append(notices, notice)
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"id":"1","url":"https://airbrake.io/locate/1"}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetAirbrakeAPIURL(srv.URL)()
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	b.Err = pgerror.New(pgcode.Uncategorized, "boom")
+	b.Trace[2].Logs = []tracingpb.LogRecord{
+		{Time: b.Trace[2].StartTime, Message: "sending request"},
+		{Time: b.Trace[2].StartTime.Add(time.Millisecond), Message: "boom"},
+	}
+	require.NoError(t, stmtdiagnostics.TraceToAirbrake(ctx, b, 123, "key"))
+	require.Len(t, notices, 1)
+	require.Equal(t, map[string]interface{}{
+		"errors": []interface{}{
+			map[string]interface{}{
+				"type":    "XXUUU",
+				"message": "boom",
+				"backtrace": []interface{}{
+					map[string]interface{}{"file": "kv.Get", "function": "boom", "line": float64(0)},
+					map[string]interface{}{"file": "kv.Get", "function": "sending request", "line": float64(0)},
+				},
+			},
+		},
+		"context": map[string]interface{}{
+			"notifier": map[string]interface{}{
+				"name": "cockroachdb-stmtdiagnostics",
+				"url":  "https://www.cockroachlabs.com",
+			},
+			"severity":  "error",
+			"component": "stmtdiagnostics",
+			"action":    "SELECT * FROM t WHERE k = _",
+			"hostname":  "node 1",
+		},
+		"params": map[string]interface{}{
+			"fingerprint":  "SELECT * FROM t WHERE k = _",
+			"bundle_id":    "42",
+			"duration":     "10ms",
+			"collected_at": "2023-01-02T03:04:05Z",
+			"bundle_url":   "https://node1:8080/_admin/v1/stmtbundle/42",
+		},
+	}, notices[0])
+
+	// Canceled statements are reported as warnings.
+	b.Err = pgerror.New(pgcode.QueryCanceled, "query execution canceled")
+	require.NoError(t, stmtdiagnostics.TraceToAirbrake(ctx, b, 123, "key"))
+	require.Len(t, notices, 2)
+	require.Equal(t, "warning", notices[1]["context"].(map[string]interface{})["severity"])
+
+	// Bundles of successful statements aren't reported.
+	b.Err = nil
+	require.NoError(t, stmtdiagnostics.TraceToAirbrake(ctx, b, 123, "key"))
+	require.Len(t, notices, 2)
+
+	b = makeTestBundle("")
+	err := stmtdiagnostics.TraceToAirbrake(ctx, b, 123, "invalid")
+	require.ErrorContains(t, err, "reporting Airbrake notice")
+	require.ErrorContains(t, err, "invalid project key")
+}
@@ -0,0 +1,535 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud"
+	"github.com/cockroachdb/cockroach/pkg/cloud/externalconn"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// This file contains the sinks to which collected bundles are sent, as
+// configured by the cluster settings below. The sinks are registered with
+// Registry.OnBundleCollected by the server.
+//
+// The credentials of the sinks are not stored in cluster settings: they are
+// part of the URI of an external connection (see CREATE EXTERNAL CONNECTION).
+// The bundles of a request are only sent to the external connections on which
+// the user that inserted the request has the USAGE privilege. The sinks that
+// don't use an external connection, and so can't be checked this way, are
+// configured by system-only settings.
+
+// slackExternalConnection and slackChannel configure the notification of
+// collected bundles in Slack (see TraceToSlack).
+var slackExternalConnection = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.slack.external_connection",
+	"name of the external connection whose URI is the URL of a Slack incoming "+
+		"webhook, to which a message is posted for every collected statement "+
+		"bundle; empty to disable",
+	"",
+)
+
+var slackChannel = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.slack.channel",
+	"Slack channel to which the messages about collected statement bundles are "+
+		"posted; empty to use the default channel of the webhook",
+	"",
+)
+
+// msTeamsExternalConnection configures the notification of collected bundles
+// in Microsoft Teams (see TraceToMSTeams).
+var msTeamsExternalConnection = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.msteams.external_connection",
+	"name of the external connection whose URI is the URL of a Microsoft Teams "+
+		"incoming webhook, to which a card is posted for every collected "+
+		"statement bundle; empty to disable",
+	"",
+)
+
+// s3ExternalConnection configures the copy of collected bundles to S3 (see
+// TraceToExternalStorage).
+var s3ExternalConnection = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.s3.external_connection",
+	"name of the external connection, with an s3://<bucket>/<prefix> URI, to "+
+		"which every collected statement bundle is uploaded; empty to disable",
+	"",
+)
+
+// gcsExternalConnection configures the copy of collected bundles to Google
+// Cloud Storage (see TraceToExternalStorage).
+var gcsExternalConnection = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.gcs.external_connection",
+	"name of the external connection, with a gs://<bucket>/<prefix> URI, to "+
+		"which every collected statement bundle is uploaded; empty to disable",
+	"",
+)
+
+// azureExternalConnection configures the copy of collected bundles to Azure
+// Blob Storage (see TraceToExternalStorage).
+var azureExternalConnection = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.azure.external_connection",
+	"name of the external connection, with an azure-blob://<container>/<prefix> "+
+		"URI, to which every collected statement bundle is uploaded; empty to "+
+		"disable",
+	"",
+)
+
+// webDAVExternalConnection configures the copy of collected bundles to a
+// WebDAV server (see TraceToWebDAV).
+var webDAVExternalConnection = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.webdav.external_connection",
+	"name of the external connection whose URI is the URL of the WebDAV "+
+		"collection to which every collected statement bundle is written, with "+
+		"the user name and password, if any; empty to disable",
+	"",
+)
+
+// emailSMTPHost, emailSMTPPort, emailFrom, emailTo and emailMinInterval
+// configure the emailing of collected bundles (see TraceToEmail). There is no
+// kind of external connection for SMTP servers, so the emails are sent without
+// authentication, through a server that relays the emails of the nodes.
+var emailSMTPHost = settings.RegisterStringSetting(
+	settings.SystemOnly,
+	"sql.stmt_diagnostics.email.smtp_host",
+	"host of the SMTP server through which collected statement bundles are "+
+		"emailed, without authentication; empty to disable",
+	"",
+)
+
+var emailSMTPPort = settings.RegisterIntSetting(
+	settings.SystemOnly,
+	"sql.stmt_diagnostics.email.smtp_port",
+	"port of the SMTP server configured by sql.stmt_diagnostics.email.smtp_host; "+
+		"TLS is used from the start of the connection on port 465, and with "+
+		"STARTTLS on other ports if the server supports it",
+	587,
+	func(v int64) error {
+		if v < 1 || v > 65535 {
+			return errors.Newf("invalid port %d", v)
+		}
+		return nil
+	},
+)
+
+var emailFrom = settings.RegisterStringSetting(
+	settings.SystemOnly,
+	"sql.stmt_diagnostics.email.from",
+	"sender of the emails about collected statement bundles",
+	"CockroachDB <noreply@localhost>",
+)
+
+var emailTo = settings.RegisterStringSetting(
+	settings.SystemOnly,
+	"sql.stmt_diagnostics.email.to",
+	"comma-separated list of the addresses to which collected statement "+
+		"bundles are emailed; empty to disable",
+	"",
+)
+
+var emailMinInterval = settings.RegisterDurationSetting(
+	settings.SystemOnly,
+	"sql.stmt_diagnostics.email.min_interval",
+	"minimum interval between two emails about collected statement bundles "+
+		"sent by a node; the bundles collected in between are not emailed",
+	5*time.Minute,
+	settings.NonNegativeDuration,
+)
+
+// pagerDutyExternalConnection and pagerDutySeverity configure the PagerDuty
+// alerts about collected bundles (see TraceToPagerDuty).
+var pagerDutyExternalConnection = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.pagerduty.external_connection",
+	"name of the external connection whose URI is the URL of the PagerDuty "+
+		"Events API, https://events.pagerduty.com/v2/enqueue, with the "+
+		"integration key of a service in a routing_key parameter; an alert is "+
+		"triggered in the service for every collected statement bundle, and "+
+		"resolved once a later bundle of the statement shows an improved "+
+		"latency; empty to disable",
+	"",
+)
+
+var pagerDutySeverity = settings.RegisterEnumSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.pagerduty.severity",
+	"severity of the PagerDuty alerts about collected statement bundles",
+	"warning",
+	map[int64]string{
+		0: "critical",
+		1: "warning",
+		2: "info",
+	},
+)
+
+// BundleSinks sends the bundles collected by a Registry to the sinks
+// configured by the cluster settings above. Each of its Notify methods is
+// meant to be registered with Registry.OnBundleCollected, and does nothing
+// unless its sink is configured.
+type BundleSinks struct {
+	db isql.DB
+	st *cluster.Settings
+	// registry is the Registry whose bundles are sent, in which the URLs of the
+	// copies of the bundles are recorded.
+	registry *Registry
+	// checkUsage checks the USAGE privilege of users on external connections.
+	checkUsage ExternalConnectionUsageChecker
+	// externalStorageFromURI opens the external storage of external
+	// connections, as external://<name> URIs.
+	externalStorageFromURI cloud.ExternalStorageFromURIFactory
+
+	// pagerDutyAlerts maps the deduplication keys of the PagerDuty alerts that
+	// NotifyPagerDuty triggered, and that haven't been resolved, to the latency
+	// of the statement in the last bundle that triggered them.
+	pagerDutyAlerts struct {
+		syncutil.Mutex
+		m map[string]time.Duration
+	}
+
+	// lastEmail is the time at which NotifyEmail last sent an email, which
+	// rate limits the emails per sql.stmt_diagnostics.email.min_interval.
+	lastEmail struct {
+		syncutil.Mutex
+		time time.Time
+	}
+}
+
+// ExternalConnectionUsageChecker returns an error unless the user has the
+// USAGE privilege on the external connection with the given name. The server
+// implements it, as privileges can't be checked without a planner.
+type ExternalConnectionUsageChecker func(
+	ctx context.Context, txn isql.Txn, user username.SQLUsername, name string,
+) error
+
+// NewBundleSinks creates the sinks of the bundles collected by registry.
+func NewBundleSinks(
+	registry *Registry,
+	checkUsage ExternalConnectionUsageChecker,
+	externalStorageFromURI cloud.ExternalStorageFromURIFactory,
+) *BundleSinks {
+	return &BundleSinks{
+		db:                     registry.db,
+		st:                     registry.st,
+		registry:               registry,
+		checkUsage:             checkUsage,
+		externalStorageFromURI: externalStorageFromURI,
+	}
+}
+
+// NotifySlack posts a message about the bundle to the Slack webhook of the
+// external connection named by sql.stmt_diagnostics.slack.external_connection,
+// if any.
+func (s *BundleSinks) NotifySlack(ctx context.Context, b *Bundle) {
+	name := slackExternalConnection.Get(&s.st.SV)
+	if name == "" {
+		return
+	}
+	webhookURL, err := s.externalConnectionURI(ctx, b, name, "https", "http")
+	if err == nil {
+		err = TraceToSlack(ctx, b, webhookURL.String(), slackChannel.Get(&s.st.SV))
+	}
+	if err != nil {
+		log.Warningf(ctx, "failed to post statement bundle %d to Slack: %v", b.ID, err)
+	}
+}
+
+// NotifyMSTeams posts a card about the bundle to the Microsoft Teams webhook of
+// the external connection named by
+// sql.stmt_diagnostics.msteams.external_connection, if any.
+func (s *BundleSinks) NotifyMSTeams(ctx context.Context, b *Bundle) {
+	name := msTeamsExternalConnection.Get(&s.st.SV)
+	if name == "" {
+		return
+	}
+	webhookURL, err := s.externalConnectionURI(ctx, b, name, "https", "http")
+	if err == nil {
+		err = TraceToMSTeams(ctx, b, webhookURL.String())
+	}
+	if err != nil {
+		log.Warningf(ctx, "failed to post statement bundle %d to Microsoft Teams: %v", b.ID, err)
+	}
+}
+
+// NotifyS3 copies the bundle to the S3 bucket of the external connection named
+// by sql.stmt_diagnostics.s3.external_connection, if any, and records the URL
+// of the copy.
+func (s *BundleSinks) NotifyS3(ctx context.Context, b *Bundle) {
+	name := s3ExternalConnection.Get(&s.st.SV)
+	if name == "" {
+		return
+	}
+	u, err := s.copyToExternalStorage(ctx, b, name, "s3")
+	s.recordBundleCopy(ctx, b, "S3", u, err)
+}
+
+// NotifyGCS copies the bundle to the Cloud Storage bucket of the external
+// connection named by sql.stmt_diagnostics.gcs.external_connection, if any, and
+// records the URL of the copy.
+func (s *BundleSinks) NotifyGCS(ctx context.Context, b *Bundle) {
+	name := gcsExternalConnection.Get(&s.st.SV)
+	if name == "" {
+		return
+	}
+	u, err := s.copyToExternalStorage(ctx, b, name, "gs")
+	s.recordBundleCopy(ctx, b, "Cloud Storage", u, err)
+}
+
+// NotifyAzureBlob copies the bundle to the Azure Blob Storage container of the
+// external connection named by sql.stmt_diagnostics.azure.external_connection,
+// if any, and records the URL of the copy.
+func (s *BundleSinks) NotifyAzureBlob(ctx context.Context, b *Bundle) {
+	name := azureExternalConnection.Get(&s.st.SV)
+	if name == "" {
+		return
+	}
+	u, err := s.copyToExternalStorage(ctx, b, name, "azure-blob", "azure-storage", "azure")
+	s.recordBundleCopy(ctx, b, "Azure Blob Storage", u, err)
+}
+
+// NotifyWebDAV writes the bundle to the WebDAV collection of the external
+// connection named by sql.stmt_diagnostics.webdav.external_connection, if any,
+// and records the URL of the copy. The user name and password are taken from
+// the URI of the connection.
+func (s *BundleSinks) NotifyWebDAV(ctx context.Context, b *Bundle) {
+	name := webDAVExternalConnection.Get(&s.st.SV)
+	if name == "" {
+		return
+	}
+	fileURL, err := func() (string, error) {
+		u, err := s.externalConnectionURI(ctx, b, name, "https", "http")
+		if err != nil {
+			return "", err
+		}
+		var username, password string
+		if u.User != nil {
+			username = u.User.Username()
+			password, _ = u.User.Password()
+		}
+		u.User = nil
+		collection := u.String()
+		return webDAVBundleURL(b, collection), TraceToWebDAV(ctx, b, collection, username, password)
+	}()
+	s.recordBundleCopy(ctx, b, "WebDAV", fileURL, err)
+}
+
+// NotifyEmail emails the bundle through the SMTP server configured by
+// sql.stmt_diagnostics.email.smtp_host to sql.stmt_diagnostics.email.to, if
+// both are set, unless another bundle was emailed less than
+// sql.stmt_diagnostics.email.min_interval ago.
+func (s *BundleSinks) NotifyEmail(ctx context.Context, b *Bundle) {
+	host, toList := emailSMTPHost.Get(&s.st.SV), emailTo.Get(&s.st.SV)
+	if host == "" || toList == "" {
+		return
+	}
+	if !s.reserveEmail(timeutil.Now()) {
+		log.Infof(ctx, "not emailing statement bundle %d: another bundle was emailed "+
+			"less than sql.stmt_diagnostics.email.min_interval ago", b.ID)
+		return
+	}
+	var to []string
+	for _, addr := range strings.Split(toList, ",") {
+		to = append(to, strings.TrimSpace(addr))
+	}
+	if err := TraceToEmail(ctx, b, SMTPConfig{
+		Host: host,
+		Port: int(emailSMTPPort.Get(&s.st.SV)),
+		From: emailFrom.Get(&s.st.SV),
+	}, to); err != nil {
+		log.Warningf(ctx, "failed to email statement bundle %d: %v", b.ID, err)
+	}
+}
+
+// reserveEmail returns whether an email can be sent at time now according to
+// sql.stmt_diagnostics.email.min_interval, in which case it is accounted for.
+func (s *BundleSinks) reserveEmail(now time.Time) bool {
+	s.lastEmail.Lock()
+	defer s.lastEmail.Unlock()
+	if !s.lastEmail.time.IsZero() && now.Sub(s.lastEmail.time) < emailMinInterval.Get(&s.st.SV) {
+		return false
+	}
+	s.lastEmail.time = now
+	return true
+}
+
+// NotifyPagerDuty triggers a PagerDuty alert about the bundle or, if this node
+// already triggered one for the statement and the latency of the statement
+// has improved since then, resolves it. The routing key is taken from the URI
+// of the external connection named by
+// sql.stmt_diagnostics.pagerduty.external_connection, if any.
+func (s *BundleSinks) NotifyPagerDuty(ctx context.Context, b *Bundle) {
+	name := pagerDutyExternalConnection.Get(&s.st.SV)
+	if name == "" {
+		return
+	}
+	routingKey, err := s.pagerDutyRoutingKey(ctx, b, name)
+	if err != nil {
+		log.Warningf(ctx, "failed to trigger PagerDuty alert for statement bundle %d: %v", b.ID, err)
+		return
+	}
+	key := b.FingerprintHash()
+	s.pagerDutyAlerts.Lock()
+	triggeredLatency, triggered := s.pagerDutyAlerts.m[key]
+	s.pagerDutyAlerts.Unlock()
+	if triggered && b.Duration < triggeredLatency {
+		if err = ResolvePagerDuty(ctx, routingKey, key); err != nil {
+			log.Warningf(ctx, "failed to resolve PagerDuty alert for statement bundle %d: %v", b.ID, err)
+			return
+		}
+		s.pagerDutyAlerts.Lock()
+		delete(s.pagerDutyAlerts.m, key)
+		s.pagerDutyAlerts.Unlock()
+		return
+	}
+	dedupKey, err := TraceToPagerDuty(ctx, b, routingKey, pagerDutySeverity.String(&s.st.SV))
+	if err != nil {
+		log.Warningf(ctx, "failed to trigger PagerDuty alert for statement bundle %d: %v", b.ID, err)
+		return
+	}
+	s.pagerDutyAlerts.Lock()
+	defer s.pagerDutyAlerts.Unlock()
+	if s.pagerDutyAlerts.m == nil {
+		s.pagerDutyAlerts.m = make(map[string]time.Duration)
+	}
+	s.pagerDutyAlerts.m[dedupKey] = b.Duration
+}
+
+// pagerDutyRoutingKey returns the routing key in the URI of the external
+// connection with the given name, which must otherwise be the URL of the
+// PagerDuty Events API.
+func (s *BundleSinks) pagerDutyRoutingKey(
+	ctx context.Context, b *Bundle, name string,
+) (string, error) {
+	u, err := s.externalConnectionURI(ctx, b, name, "https", "http")
+	if err != nil {
+		return "", err
+	}
+	routingKey := u.Query().Get("routing_key")
+	if routingKey == "" {
+		return "", errors.Newf("the URI of external connection %s has no routing_key parameter", name)
+	}
+	u.RawQuery = ""
+	if u.String() != pagerDutyEventsURL {
+		return "", errors.Newf("the URI of external connection %s must be %s?routing_key=<integration key>",
+			name, pagerDutyEventsURL)
+	}
+	return routingKey, nil
+}
+
+// copyToExternalStorage copies the bundle to the external storage of the
+// external connection with the given name, whose URI must have one of the
+// given schemes, and returns the URL of the copy:
+// external://<name>/<bundle ID>.zip. The storage is opened on behalf of the
+// user that inserted the request of the bundle.
+func (s *BundleSinks) copyToExternalStorage(
+	ctx context.Context, b *Bundle, name string, schemes ...string,
+) (string, error) {
+	user, _, err := s.loadExternalConnection(ctx, b, name, schemes...)
+	if err != nil {
+		return "", err
+	}
+	uri := (&url.URL{Scheme: "external", Host: name}).String()
+	es, err := s.externalStorageFromURI(ctx, uri, user)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = es.Close() }()
+	file, err := TraceToExternalStorage(ctx, b, es)
+	if err != nil {
+		return "", err
+	}
+	return uri + "/" + file, nil
+}
+
+// recordBundleCopy records u, the URL of the copy of the bundle in the given
+// external storage, in system.statement_diagnostics. If err is set, the copy
+// failed, and it is logged instead.
+func (s *BundleSinks) recordBundleCopy(
+	ctx context.Context, b *Bundle, storage string, u string, err error,
+) {
+	if err != nil {
+		log.Warningf(ctx, "failed to upload statement bundle %d to %s: %v", b.ID, storage, err)
+		return
+	}
+	if err := s.registry.setBundleURL(ctx, b.ID, u); err != nil {
+		log.Warningf(ctx, "failed to record the URL of statement bundle %d: %v", b.ID, err)
+	}
+}
+
+// externalConnectionURI returns the URI of the external connection with the
+// given name, including the credentials that it contains, after checking that
+// the user that inserted the request of the bundle has the USAGE privilege on
+// the connection, and that its scheme is one of the given ones.
+func (s *BundleSinks) externalConnectionURI(
+	ctx context.Context, b *Bundle, name string, schemes ...string,
+) (*url.URL, error) {
+	_, u, err := s.loadExternalConnection(ctx, b, name, schemes...)
+	return u, err
+}
+
+// loadExternalConnection is like externalConnectionURI, but also returns the
+// user that inserted the request of the bundle.
+func (s *BundleSinks) loadExternalConnection(
+	ctx context.Context, b *Bundle, name string, schemes ...string,
+) (username.SQLUsername, *url.URL, error) {
+	user, err := s.registry.requestedBy(ctx, b.RequestID)
+	if err != nil {
+		return user, nil, err
+	}
+	if user.Undefined() {
+		return user, nil, errors.Newf("the request of the bundle wasn't inserted by a user, "+
+			"whose USAGE privilege on external connection %s could be checked", name)
+	}
+	var uri string
+	if err := s.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		if err := s.checkUsage(ctx, txn, user, name); err != nil {
+			return err
+		}
+		ec, err := externalconn.LoadExternalConnection(ctx, name, txn)
+		if err != nil {
+			return err
+		}
+		uri = ec.ConnectionProto().UnredactedURI()
+		return nil
+	}); err != nil {
+		return user, nil, err
+	}
+	// The URI contains secrets, so the parsing error, which contains it, isn't
+	// returned.
+	u, err := url.Parse(uri)
+	if err != nil {
+		return user, nil, errors.Newf("invalid URI for external connection %s", name)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return user, u, nil
+		}
+	}
+	return user, nil, errors.Newf("the URI of external connection %s must have one of the schemes %s",
+		name, strings.Join(schemes, ", "))
+}
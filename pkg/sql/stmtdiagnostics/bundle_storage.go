@@ -0,0 +1,43 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud"
+	"github.com/cockroachdb/errors"
+)
+
+// This file contains integrations that copy collected bundles to external
+// object storage, for archival. The location of the copy is recorded in the
+// bundle_url column of system.statement_diagnostics.
+
+// TraceToExternalStorage writes the bundle zip to <bundle ID>.zip in the given
+// external storage, and returns the name of the file.
+//
+// BundleSinks.NotifyS3, NotifyGCS and NotifyAzureBlob call
+// TraceToExternalStorage for every collected bundle with the storage of the
+// external connection named by the corresponding
+// sql.stmt_diagnostics.*.external_connection setting, if any, and store the
+// URL of the file, external://<connection>/<bundle ID>.zip, in the bundle_url
+// column of system.statement_diagnostics.
+func TraceToExternalStorage(
+	ctx context.Context, b *Bundle, es cloud.ExternalStorage,
+) (file string, _ error) {
+	file = fmt.Sprintf("%d.zip", b.ID)
+	if err := cloud.WriteFile(ctx, es, file, bytes.NewReader(b.Zip)); err != nil {
+		return "", errors.Wrapf(err, "writing %s", file)
+	}
+	return file, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	gosql "database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/cloud/externalconn"
+	"github.com/cockroachdb/cockroach/pkg/cloud/externalconn/connectionpb"
+	_ "github.com/cockroachdb/cockroach/pkg/cloud/impl" // register cloud storage providers
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/sql"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an httptest server standing in for the path-style S3 API. It
+// stores the objects uploaded with PUT, and reports us-west-2 as the region of
+// every bucket.
+type fakeS3 struct {
+	*httptest.Server
+	mu struct {
+		syncutil.Mutex
+		objects map[string][]byte
+	}
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	s := &fakeS3{}
+	s.mu.objects = make(map[string][]byte)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("X-Amz-Bucket-Region", "us-west-2")
+		case http.MethodPut:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.mu.objects[r.URL.Path] = body
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	return s
+}
+
+func (s *fakeS3) object(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.mu.objects[path]
+	return o, ok
+}
+
+// TestBundleURL ensures that the bundles collected for a request are copied to
+// the S3 bucket of the external connection named by
+// sql.stmt_diagnostics.s3.external_connection, and that the URL of the copy is
+// recorded in system.statement_diagnostics.
+func TestBundleURL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	s3 := newFakeS3(t)
+	defer s3.Close()
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	execCfg := s.ExecutorConfig().(sql.ExecutorConfig)
+
+	// CREATE EXTERNAL CONNECTION reads back a file from the storage, which the
+	// fake S3 server doesn't support, so the connection is created directly.
+	ec := externalconn.NewMutableExternalConnection()
+	ec.SetConnectionName("bundles")
+	ec.SetConnectionType(connectionpb.TypeStorage)
+	ec.SetConnectionDetails(connectionpb.ConnectionDetails{
+		Provider: connectionpb.ConnectionProvider_s3,
+		Details: &connectionpb.ConnectionDetails_SimpleURI{
+			SimpleURI: &connectionpb.SimpleURI{URI: fmt.Sprintf(
+				"s3://bundles/stmts?AWS_ENDPOINT=%s&AWS_ACCESS_KEY_ID=key&AWS_SECRET_ACCESS_KEY=secret&AWS_REGION=us-west-2",
+				url.QueryEscape(s3.URL),
+			)},
+		},
+	})
+	ec.SetOwner(username.RootUserName())
+	require.NoError(t, execCfg.InternalDB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		return ec.Create(ctx, txn, username.RootUserName())
+	}))
+
+	runner := sqlutils.MakeSQLRunner(db)
+	runner.Exec(t, "CREATE TABLE test (x int PRIMARY KEY)")
+	runner.Exec(t, "SET CLUSTER SETTING sql.stmt_diagnostics.s3.external_connection = 'bundles'")
+	_, err := execCfg.StmtDiagnosticsRecorder.InsertRequestWithOptionsInternal(ctx,
+		"SELECT * FROM test WHERE x = _",
+		stmtdiagnostics.StmtDiagRequestOptions{RequestedBy: username.RootUserName()})
+	require.NoError(t, err)
+	runner.Exec(t, "SELECT * FROM test WHERE x = 1")
+
+	var id int64
+	testutils.SucceedsSoon(t, func() error {
+		var u gosql.NullString
+		if err := db.QueryRow(
+			"SELECT id, bundle_url FROM system.statement_diagnostics",
+		).Scan(&id, &u); err != nil {
+			return err
+		}
+		if !u.Valid {
+			return errors.New("bundle_url not set")
+		}
+		require.Equal(t, fmt.Sprintf("external://bundles/%d.zip", id), u.String)
+		return nil
+	})
+	_, ok := s3.object(fmt.Sprintf("/bundles/stmts/%d.zip", id))
+	require.True(t, ok)
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestBundle returns a bundle whose trace is makeTestRecording. The DB
+// Console is served at adminURL.
+func makeTestBundle(adminURL string) *stmtdiagnostics.Bundle {
+	return &stmtdiagnostics.Bundle{
+		ID:          42,
+		RequestID:   7,
+		Fingerprint: "SELECT * FROM t WHERE k = _",
+		Statement:   "SELECT * FROM t WHERE k = 1",
+		InstanceID:  1,
+		CollectedAt: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:    10 * time.Millisecond,
+		Err:         errors.New("boom"),
+		Plan:        "• scan\n  table: t@t_pkey",
+		Trace:       makeTestRecording(),
+		Zip:         []byte("PK\x03\x04bundle"),
+		AdminURL:    adminURL,
+	}
+}
+
+func TestBundleSummary(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	b := makeTestBundle("https://node1:8080/")
+	require.Equal(t, "https://node1:8080/_admin/v1/stmtbundle/42", b.URL())
+	require.Equal(t, `Statement diagnostics bundle 42
+Fingerprint: SELECT * FROM t WHERE k = _
+Collected at: 2023-01-02T03:04:05Z on node 1
+Duration: 10ms
+Error: boom
+Download: https://node1:8080/_admin/v1/stmtbundle/42
+`, b.Summary())
+
+	b = makeTestBundle("")
+	b.Err = nil
+	require.Empty(t, b.URL())
+	require.Equal(t, `Statement diagnostics bundle 42
+Fingerprint: SELECT * FROM t WHERE k = _
+Collected at: 2023-01-02T03:04:05Z on node 1
+Duration: 10ms
+`, b.Summary())
+}
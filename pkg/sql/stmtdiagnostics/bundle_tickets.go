@@ -0,0 +1,268 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// This file contains integrations that file tickets in issue trackers for
+// collected bundles.
+
+// linearAPIURL is the URL of the Linear GraphQL API. It is overridden in
+// tests.
+var linearAPIURL = "https://api.linear.app/graphql"
+
+// linearDescription returns the description, in Markdown, of the Linear issue
+// filed for the bundle.
+func linearDescription(b *Bundle) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "Statement diagnostics bundle %d was collected on node %d at %s.\n\n",
+		b.ID, b.InstanceID, b.CollectedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "**Fingerprint:**\n\n```sql\n%s\n```\n\n", b.Fingerprint)
+	fmt.Fprintf(&buf, "**Duration:** %s\n\n", b.Duration)
+	if b.Err != nil {
+		fmt.Fprintf(&buf, "**Error:** `%v`\n\n", b.Err)
+	}
+	if u := b.URL(); u != "" {
+		fmt.Fprintf(&buf, "[Download the bundle](%s)\n", u)
+	}
+	return buf.String()
+}
+
+// TraceToLinearIssue files an issue for the bundle in the given Linear team,
+// and returns the URL of the issue. The description of the issue is generated
+// from the fingerprint, duration and error of the statement. The flame chart
+// of the trace (see TraceToFlameChartSVG), the plan and, if available, the
+// link to download the bundle from the DB Console are attached to the issue.
+//
+// apiKey is a personal API key of the Linear user filing the issue.
+func TraceToLinearIssue(
+	ctx context.Context, b *Bundle, apiKey, teamID, title string,
+) (issueURL string, _ error) {
+	header := http.Header{"Authorization": {apiKey}}
+
+	var created struct {
+		IssueCreate struct {
+			Success bool `json:"success"`
+			Issue   struct {
+				ID  string `json:"id"`
+				URL string `json:"url"`
+			} `json:"issue"`
+		} `json:"issueCreate"`
+	}
+	if err := doGraphQL(ctx, linearAPIURL, header, `
+mutation IssueCreate($input: IssueCreateInput!) {
+  issueCreate(input: $input) { success issue { id url } }
+}`, map[string]interface{}{"input": map[string]interface{}{
+		"teamId":      teamID,
+		"title":       title,
+		"description": linearDescription(b),
+	}}, &created); err != nil {
+		return "", errors.Wrap(err, "creating Linear issue")
+	}
+	if !created.IssueCreate.Success {
+		return "", errors.New("creating Linear issue: unsuccessful")
+	}
+	issue := created.IssueCreate.Issue
+
+	attach := func(title, url string) error {
+		var resp struct {
+			AttachmentCreate struct {
+				Success bool `json:"success"`
+			} `json:"attachmentCreate"`
+		}
+		if err := doGraphQL(ctx, linearAPIURL, header, `
+mutation AttachmentCreate($input: AttachmentCreateInput!) {
+  attachmentCreate(input: $input) { success }
+}`, map[string]interface{}{"input": map[string]interface{}{
+			"issueId": issue.ID,
+			"title":   title,
+			"url":     url,
+		}}, &resp); err != nil {
+			return errors.Wrapf(err, "attaching %s to Linear issue", title)
+		}
+		if !resp.AttachmentCreate.Success {
+			return errors.Newf("attaching %s to Linear issue: unsuccessful", title)
+		}
+		return nil
+	}
+
+	// Files are uploaded to Linear's storage with a signed URL requested
+	// from the API, and then attached by the URL of the uploaded file.
+	upload := func(filename, contentType string, data []byte) error {
+		var resp struct {
+			FileUpload struct {
+				Success    bool `json:"success"`
+				UploadFile struct {
+					UploadURL string `json:"uploadUrl"`
+					AssetURL  string `json:"assetUrl"`
+					Headers   []struct {
+						Key   string `json:"key"`
+						Value string `json:"value"`
+					} `json:"headers"`
+				} `json:"uploadFile"`
+			} `json:"fileUpload"`
+		}
+		if err := doGraphQL(ctx, linearAPIURL, header, `
+mutation FileUpload($contentType: String!, $filename: String!, $size: Int!) {
+  fileUpload(contentType: $contentType, filename: $filename, size: $size) {
+    success uploadFile { uploadUrl assetUrl headers { key value } }
+  }
+}`, map[string]interface{}{
+			"contentType": contentType,
+			"filename":    filename,
+			"size":        len(data),
+		}, &resp); err != nil {
+			return errors.Wrapf(err, "uploading %s to Linear", filename)
+		}
+		if !resp.FileUpload.Success {
+			return errors.Newf("uploading %s to Linear: unsuccessful", filename)
+		}
+		f := resp.FileUpload.UploadFile
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, f.UploadURL, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Cache-Control", "public, max-age=31536000")
+		for _, h := range f.Headers {
+			req.Header.Set(h.Key, h.Value)
+		}
+		if err := DoRequest(req, nil /* resp */); err != nil {
+			return errors.Wrapf(err, "uploading %s to Linear", filename)
+		}
+		return attach(filename, f.AssetURL)
+	}
+
+	if err := upload("flamechart.svg", "image/svg+xml", TraceToFlameChartSVG(b.Trace)); err != nil {
+		return "", err
+	}
+	if err := upload("plan.txt", "text/plain", []byte(b.Plan)); err != nil {
+		return "", err
+	}
+	if u := b.URL(); u != "" {
+		if err := attach("Statement diagnostics bundle", u); err != nil {
+			return "", err
+		}
+	}
+	return issue.URL, nil
+}
+
+// jiraMaxSummaryLength is the maximum length of the summary of a Jira issue.
+const jiraMaxSummaryLength = 255
+
+// bundleFilename returns the name of the zip file of the bundle, matching the
+// name used when downloading it with \statement-diag download.
+func bundleFilename(b *Bundle) string {
+	return fmt.Sprintf("stmt-bundle-%d.zip", b.ID)
+}
+
+// TraceToJiraIssue creates an issue of the given type in the given project of
+// the Jira Cloud site at baseURL (e.g. https://example.atlassian.net) using
+// the REST API v3, and returns the key of the issue. The summary of the issue
+// contains the fingerprint of the statement, its description is the summary
+// of the bundle (see Bundle.Summary) and the bundle zip is attached to it.
+//
+// The requests are authenticated with the email of the Jira user and one of
+// their API tokens.
+func TraceToJiraIssue(
+	ctx context.Context, b *Bundle, baseURL, email, apiToken, project, issueType string,
+) (issueKey string, _ error) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	summary := fmt.Sprintf("Statement diagnostics: %s", b.Fingerprint)
+	if len(summary) > jiraMaxSummaryLength {
+		summary = strings.ToValidUTF8(summary[:jiraMaxSummaryLength-3], "") + "..."
+	}
+	// The description is an Atlassian Document Format document with one
+	// paragraph per line of the summary of the bundle.
+	var paragraphs []interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.Summary()), "\n") {
+		paragraphs = append(paragraphs, map[string]interface{}{
+			"type":    "paragraph",
+			"content": []interface{}{map[string]string{"type": "text", "text": line}},
+		})
+	}
+	issue := map[string]interface{}{"fields": map[string]interface{}{
+		"project":   map[string]string{"key": project},
+		"issuetype": map[string]string{"name": issueType},
+		"summary":   summary,
+		"description": map[string]interface{}{
+			"type":    "doc",
+			"version": 1,
+			"content": paragraphs,
+		},
+	}}
+
+	// newRequest returns a request authenticated with the API token.
+	newRequest := func(method, u string, body []byte) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(email, apiToken)
+		req.Header.Set("Accept", "application/json")
+		return req, nil
+	}
+
+	body, err := json.Marshal(issue)
+	if err != nil {
+		return "", err
+	}
+	req, err := newRequest(http.MethodPost, baseURL+"/rest/api/3/issue", body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := DoRequest(req, &created); err != nil {
+		return "", errors.Wrap(err, "creating Jira issue")
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", bundleFilename(b))
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(b.Zip); err != nil {
+		return "", err
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	req, err = newRequest(http.MethodPost,
+		fmt.Sprintf("%s/rest/api/3/issue/%s/attachments", baseURL, url.PathEscape(created.Key)),
+		buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	// Attachments are rejected without this header, which protects against
+	// XSRF attacks.
+	req.Header.Set("X-Atlassian-Token", "no-check")
+	if err := DoRequest(req, nil /* resp */); err != nil {
+		return "", errors.Wrapf(err, "attaching bundle to Jira issue %s", created.Key)
+	}
+	return created.Key, nil
+}
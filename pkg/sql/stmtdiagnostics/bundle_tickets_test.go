@@ -0,0 +1,191 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToLinearIssue(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var srvURL string
+	var description string
+	uploads := make(map[string]string)
+	var attachments [][2]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "key", r.Header.Get("Authorization"))
+		var req struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		var data interface{}
+		switch {
+		case strings.Contains(req.Query, "issueCreate"):
+			input := req.Variables["input"].(map[string]interface{})
+			require.Equal(t, "team1", input["teamId"])
+			require.Equal(t, "Slow query", input["title"])
+			description = input["description"].(string)
+			data = map[string]interface{}{"issueCreate": map[string]interface{}{
+				"success": true,
+				"issue":   map[string]interface{}{"id": "issue1", "url": "https://linear.app/t/issue/T-1"},
+			}}
+		case strings.Contains(req.Query, "fileUpload"):
+			name := req.Variables["filename"].(string)
+			data = map[string]interface{}{"fileUpload": map[string]interface{}{
+				"success": true,
+				"uploadFile": map[string]interface{}{
+					"uploadUrl": srvURL + "/upload/" + name,
+					"assetUrl":  "https://uploads.linear.app/" + name,
+					"headers":   []map[string]string{{"key": "x-goog-meta-test", "value": "1"}},
+				},
+			}}
+		case strings.Contains(req.Query, "attachmentCreate"):
+			input := req.Variables["input"].(map[string]interface{})
+			require.Equal(t, "issue1", input["issueId"])
+			attachments = append(attachments, [2]string{input["title"].(string), input["url"].(string)})
+			data = map[string]interface{}{"attachmentCreate": map[string]interface{}{"success": true}}
+		default:
+			t.Errorf("unexpected query %s", req.Query)
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"data": data}))
+	})
+	mux.HandleFunc("/upload/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPut, r.Method)
+		require.Equal(t, "1", r.Header.Get("x-goog-meta-test"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		uploads[strings.TrimPrefix(r.URL.Path, "/upload/")] = string(body)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	srvURL = srv.URL
+	defer stmtdiagnostics.TestingSetLinearAPIURL(srv.URL + "/graphql")()
+
+	b := makeTestBundle("https://node1:8080")
+	issueURL, err := stmtdiagnostics.TraceToLinearIssue(
+		context.Background(), b, "key", "team1", "Slow query",
+	)
+	require.NoError(t, err)
+	require.Equal(t, "https://linear.app/t/issue/T-1", issueURL)
+	require.Contains(t, description, "```sql\nSELECT * FROM t WHERE k = _\n```")
+	require.Contains(t, description, "**Duration:** 10ms")
+	require.Contains(t, description, "**Error:** `boom`")
+	require.Equal(t, map[string]string{
+		"flamechart.svg": string(stmtdiagnostics.TraceToFlameChartSVG(b.Trace)),
+		"plan.txt":       b.Plan,
+	}, uploads)
+	require.Equal(t, [][2]string{
+		{"flamechart.svg", "https://uploads.linear.app/flamechart.svg"},
+		{"plan.txt", "https://uploads.linear.app/plan.txt"},
+		{"Statement diagnostics bundle", "https://node1:8080/_admin/v1/stmtbundle/42"},
+	}, attachments)
+}
+
+func TestTraceToLinearIssueError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := fmt.Fprint(w, `{"data":null,"errors":[{"message":"Entity not found: Team"}]}`)
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetLinearAPIURL(srv.URL)()
+
+	_, err := stmtdiagnostics.TraceToLinearIssue(
+		context.Background(), makeTestBundle(""), "key", "team1", "Slow query",
+	)
+	require.Regexp(t, "creating Linear issue: GraphQL errors: Entity not found: Team", err)
+}
+
+func TestTraceToJiraIssue(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var issue struct {
+		Fields struct {
+			Project     map[string]string `json:"project"`
+			IssueType   map[string]string `json:"issuetype"`
+			Summary     string            `json:"summary"`
+			Description struct {
+				Type    string `json:"type"`
+				Content []struct {
+					Content []struct {
+						Text string `json:"text"`
+					} `json:"content"`
+				} `json:"content"`
+			} `json:"description"`
+		} `json:"fields"`
+	}
+	var attachment []byte
+	var filename string
+	mux := http.NewServeMux()
+	checkAuth := func(r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "me@example.com", user)
+		require.Equal(t, "token", pass)
+	}
+	mux.HandleFunc("/rest/api/3/issue", func(w http.ResponseWriter, r *http.Request) {
+		checkAuth(r)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&issue))
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"id":"10000","key":"DB-1"}`))
+		require.NoError(t, err)
+	})
+	mux.HandleFunc("/rest/api/3/issue/DB-1/attachments", func(w http.ResponseWriter, r *http.Request) {
+		checkAuth(r)
+		require.Equal(t, "no-check", r.Header.Get("X-Atlassian-Token"))
+		f, h, err := r.FormFile("file")
+		require.NoError(t, err)
+		filename = h.Filename
+		attachment, err = io.ReadAll(f)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(`[]`))
+		require.NoError(t, err)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	b := makeTestBundle("")
+	key, err := stmtdiagnostics.TraceToJiraIssue(
+		context.Background(), b, srv.URL+"/", "me@example.com", "token", "DB", "Bug",
+	)
+	require.NoError(t, err)
+	require.Equal(t, "DB-1", key)
+	require.Equal(t, map[string]string{"key": "DB"}, issue.Fields.Project)
+	require.Equal(t, map[string]string{"name": "Bug"}, issue.Fields.IssueType)
+	require.Equal(t, "Statement diagnostics: SELECT * FROM t WHERE k = _", issue.Fields.Summary)
+	require.Equal(t, "doc", issue.Fields.Description.Type)
+	var lines []string
+	for _, p := range issue.Fields.Description.Content {
+		lines = append(lines, p.Content[0].Text)
+	}
+	require.Equal(t, strings.TrimSpace(b.Summary()), strings.Join(lines, "\n"))
+	require.Equal(t, "stmt-bundle-42.zip", filename)
+	require.Equal(t, b.Zip, attachment)
+}
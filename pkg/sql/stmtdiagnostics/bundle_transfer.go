@@ -0,0 +1,406 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/errors"
+)
+
+// This file contains integrations that transfer collected bundles to file
+// servers, as opposed to the object stores of bundle_storage.go.
+
+// webDAVBundleURL returns the URL of the file to which TraceToWebDAV writes the
+// bundle in the given collection.
+func webDAVBundleURL(b *Bundle, webDAVURL string) string {
+	return fmt.Sprintf("%s/%d.zip", strings.TrimSuffix(webDAVURL, "/"), b.ID)
+}
+
+// TraceToWebDAV writes the bundle zip to the file <bundle ID>.zip of the
+// WebDAV collection at webDAVURL (e.g. a share of a NAS, or a SharePoint
+// document library), with a PUT request. The collection must exist.
+//
+// If username is set, the request is authenticated with the scheme that the
+// server asks for: Basic or Digest (RFC 7616, with the MD5 or SHA-256
+// algorithm). The credentials are only sent once the server has rejected the
+// unauthenticated request, which means that the bundle is sent twice.
+//
+// BundleSinks.NotifyWebDAV calls TraceToWebDAV for every collected bundle when
+// sql.stmt_diagnostics.webdav.external_connection is set, and stores the URL
+// of the file in the bundle_url column of system.statement_diagnostics.
+func TraceToWebDAV(ctx context.Context, b *Bundle, webDAVURL, username, password string) error {
+	u := webDAVBundleURL(b, webDAVURL)
+	// put sends the PUT request, after authenticating it with authenticate, if
+	// set.
+	put := func(authenticate func(*http.Request) error) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(b.Zip))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/zip")
+		if authenticate != nil {
+			if err := authenticate(req); err != nil {
+				return nil, err
+			}
+		}
+		return exportClient.Do(req)
+	}
+
+	resp, err := put(nil /* authenticate */)
+	if err != nil {
+		return errors.Wrapf(err, "writing %s", u)
+	}
+	if resp.StatusCode == http.StatusUnauthorized && username != "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+		scheme, params := parseAuthChallenge(challenge)
+		switch strings.ToLower(scheme) {
+		case "basic":
+			resp, err = put(func(req *http.Request) error {
+				req.SetBasicAuth(username, password)
+				return nil
+			})
+		case "digest":
+			resp, err = put(func(req *http.Request) error {
+				auth, err := digestAuthorization(req, params, username, password)
+				req.Header.Set("Authorization", auth)
+				return err
+			})
+		default:
+			return errors.Newf("writing %s: unsupported authentication scheme %q", u, scheme)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "writing %s", u)
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Newf("writing %s: unexpected status %s: %s",
+			u, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// parseAuthChallenge parses the value of a WWW-Authenticate header with a
+// single challenge, e.g.:
+//
+//	Digest realm="dav", qop="auth", nonce="abc", algorithm=MD5
+//
+// into its scheme and its parameters.
+func parseAuthChallenge(challenge string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params = make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		var k string
+		k, rest, _ = strings.Cut(rest, "=")
+		k = strings.ToLower(strings.TrimSpace(k))
+		rest = strings.TrimSpace(rest)
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			// A quoted string, in which a backslash escapes the next character.
+			var buf strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				buf.WriteByte(rest[i])
+			}
+			v = buf.String()
+			if i < len(rest) {
+				i++ // Skip the closing quote.
+			}
+			rest = rest[i:]
+		} else {
+			v, rest, _ = strings.Cut(rest, ",")
+			v = strings.TrimSpace(v)
+		}
+		params[k] = v
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return scheme, params
+}
+
+// digestAuthorization returns the value of the Authorization header that
+// answers the Digest challenge with the given parameters for the request.
+func digestAuthorization(
+	req *http.Request, challenge map[string]string, username, password string,
+) (string, error) {
+	var newHash func() hash.Hash
+	algorithm := challenge["algorithm"]
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", errors.Newf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(s string) string {
+		hh := newHash()
+		_, _ = io.WriteString(hh, s)
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	realm, nonce, uri := challenge["realm"], challenge["nonce"], req.URL.RequestURI()
+	ha1 := h(username + ":" + realm + ":" + password)
+	ha2 := h(req.Method + ":" + uri)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, `Digest username=%q, realm=%q, nonce=%q, uri=%q`, username, realm, nonce, uri)
+	if algorithm != "" {
+		fmt.Fprintf(&buf, `, algorithm=%s`, algorithm)
+	}
+	if qop := challenge["qop"]; qop == "" {
+		fmt.Fprintf(&buf, `, response="%s"`, h(ha1+":"+nonce+":"+ha2))
+	} else {
+		// The server can offer several qop values; only auth (as opposed to
+		// auth-int) is supported.
+		var supported bool
+		for _, q := range strings.Split(qop, ",") {
+			supported = supported || strings.TrimSpace(q) == "auth"
+		}
+		if !supported {
+			return "", errors.Newf("unsupported digest qop %q", qop)
+		}
+		var c [8]byte
+		if _, err := rand.Read(c[:]); err != nil {
+			return "", err
+		}
+		cnonce, nc := hex.EncodeToString(c[:]), "00000001"
+		fmt.Fprintf(&buf, `, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+			nc, cnonce, h(ha1+":"+nonce+":"+nc+":"+cnonce+":auth:"+ha2))
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		fmt.Fprintf(&buf, `, opaque=%q`, opaque)
+	}
+	return buf.String(), nil
+}
+
+// HTTPOptions are the options of TraceToHTTP.
+type HTTPOptions struct {
+	// Timeout bounds every attempt, including the time spent reading the
+	// response body. It defaults to 10s.
+	Timeout time.Duration
+	// MaxRetries is the number of times that the request is retried after a
+	// network error, a 429 or a 5xx response, with an exponential backoff.
+	MaxRetries int
+	// InsecureSkipVerify disables the verification of the certificate of the
+	// server. It is meant for endpoints with self-signed certificates.
+	InsecureSkipVerify bool
+}
+
+// httpBundleForm returns the multipart/form-data body that TraceToHTTP sends,
+// and its content type. The form contains the metadata of the bundle as
+// fields, and the bundle zip as the file "bundle".
+func httpBundleForm(b *Bundle) (body []byte, contentType string, _ error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fields := [][2]string{
+		{"id", strconv.FormatInt(int64(b.ID), 10)},
+		{"fingerprint", b.Fingerprint},
+		{"statement", b.Statement},
+		{"instance_id", strconv.Itoa(int(b.InstanceID))},
+		{"collected_at", b.CollectedAt.UTC().Format(time.RFC3339Nano)},
+		{"duration_ms", strconv.FormatInt(b.Duration.Milliseconds(), 10)},
+	}
+	if b.Err != nil {
+		fields = append(fields, [2]string{"error", b.Err.Error()})
+	}
+	if u := b.URL(); u != "" {
+		fields = append(fields, [2]string{"url", u})
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return nil, "", err
+		}
+	}
+	fw, err := mw.CreateFormFile("bundle", bundleFilename(b))
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fw.Write(b.Zip); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
+}
+
+// TraceToHTTP POSTs the bundle to webhookURL as a multipart/form-data body
+// (see httpBundleForm), with the given additional headers (e.g.
+// Authorization). It is meant for the systems that none of the other
+// integrations cover.
+//
+// The request is retried according to opts. A response with a status other
+// than 2xx is an error; otherwise the response is returned, and the caller must
+// close its body.
+func TraceToHTTP(
+	ctx context.Context, b *Bundle, webhookURL string, headers map[string]string, opts HTTPOptions,
+) (*http.Response, error) {
+	body, contentType, err := httpBundleForm(b)
+	if err != nil {
+		return nil, err
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = exportTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	// The transport is not reused once the caller has closed the body of the
+	// response, so its connection must not be kept alive.
+	transport.DisableKeepAlives = true
+	client := &http.Client{Transport: transport, Timeout: timeout}
+
+	var lastErr error
+	for r := retry.StartWithCtx(ctx, retry.Options{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+	}); r.Next(); {
+		var resp *http.Response
+		var retryable bool
+		resp, retryable, lastErr = postHTTP(ctx, client, webhookURL, headers, body, contentType)
+		if lastErr == nil {
+			return resp, nil
+		}
+		// A MaxRetries of zero means no retries here, but infinite retries for
+		// package retry.
+		if !retryable || r.CurrentAttempt() >= opts.MaxRetries {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, errors.Wrap(lastErr, "posting bundle")
+}
+
+// postHTTP sends a single request of TraceToHTTP. If it fails, it returns
+// whether it can be retried, i.e. whether the failure is a network error, a
+// 429 or a 5xx response.
+func postHTTP(
+	ctx context.Context,
+	client *http.Client,
+	webhookURL string,
+	headers map[string]string,
+	body []byte,
+	contentType string,
+) (_ *http.Response, retryable bool, _ error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, false, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return nil, retryable, errors.Newf("POST %s: unexpected status %s: %s",
+		req.URL.Redacted(), resp.Status, bytes.TrimSpace(msg))
+}
+
+// graphQLVariableRE matches the declarations of the variables of a GraphQL
+// operation, e.g. "$fingerprint: String!".
+var graphQLVariableRE = regexp.MustCompile(`\$(\w+)\s*:`)
+
+// graphQLBundleVariables returns the variables with which TraceToGraphQL
+// executes mutations, limited to the ones that the mutation declares: some
+// servers, like Hasura, reject variables that are not declared.
+func graphQLBundleVariables(b *Bundle, mutation string) map[string]interface{} {
+	all := map[string]interface{}{
+		// Bundle IDs don't fit in the 32 bits of the GraphQL Int type.
+		"bundle_id":    strconv.FormatInt(int64(b.ID), 10),
+		"fingerprint":  b.Fingerprint,
+		"statement":    b.Statement,
+		"instance_id":  int(b.InstanceID),
+		"collected_at": b.CollectedAt.UTC().Format(time.RFC3339Nano),
+		"duration":     b.Duration.String(),
+		"duration_ms":  float64(b.Duration) / float64(time.Millisecond),
+		"error":        nil,
+		"url":          nil,
+	}
+	if b.Err != nil {
+		all["error"] = b.Err.Error()
+	}
+	if u := b.URL(); u != "" {
+		all["url"] = u
+	}
+	vars := make(map[string]interface{})
+	for _, m := range graphQLVariableRE.FindAllStringSubmatch(mutation, -1) {
+		if v, ok := all[m[1]]; ok {
+			vars[m[1]] = v
+		}
+	}
+	return vars
+}
+
+// TraceToGraphQL executes the given GraphQL mutation at endpoint, e.g. to
+// insert the metadata of the bundle in a table exposed by Hasura. The mutation
+// can declare any of the following variables, which are set from the bundle:
+//
+//   - $bundle_id: the ID of the bundle, as a string (e.g. a String or ID).
+//   - $fingerprint and $statement: the fingerprint and the statement (String).
+//   - $instance_id: the ID of the node that collected the bundle (Int).
+//   - $collected_at: the time of the collection, in RFC 3339 format (String).
+//   - $duration: the duration of the statement, e.g. "1.5s" (String), and
+//     $duration_ms, the duration in milliseconds (Float).
+//   - $error and $url: the error of the statement and the link to download the
+//     bundle from the DB Console (String), which are null if unknown.
+//
+// For example:
+//
+//	mutation ($bundle_id: String!, $fingerprint: String!, $duration_ms: Float!) {
+//	  insert_bundles_one(object: {
+//	    id: $bundle_id, fingerprint: $fingerprint, duration_ms: $duration_ms
+//	  }) { id }
+//	}
+//
+// If authToken is set, it is sent as a bearer token. Errors in the response
+// of the server are returned.
+func TraceToGraphQL(ctx context.Context, b *Bundle, endpoint, mutation, authToken string) error {
+	var header http.Header
+	if authToken != "" {
+		header = http.Header{"Authorization": {"Bearer " + authToken}}
+	}
+	return errors.Wrap(
+		doGraphQL(ctx, endpoint, header, mutation, graphQLBundleVariables(b, mutation), nil /* resp */),
+		"executing GraphQL mutation",
+	)
+}
@@ -0,0 +1,261 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToWebDAV(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	b := makeTestBundle("")
+	md5Hex := func(s string) string {
+		h := md5.Sum([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	digestParamRE := regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+	// checkAuth returns whether the request is authorized. If not, the server
+	// responds with challenge.
+	var checkAuth func(r *http.Request) bool
+	var challenge string
+	var files []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPut, r.Method)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, b.Zip, body)
+		if !checkAuth(r) {
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		files = append(files, r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	t.Run("anonymous", func(t *testing.T) {
+		files = nil
+		checkAuth = func(r *http.Request) bool {
+			require.Empty(t, r.Header.Get("Authorization"))
+			return true
+		}
+		require.NoError(t, stmtdiagnostics.TraceToWebDAV(ctx, b, srv.URL+"/dav/", "", ""))
+		require.Equal(t, []string{"/dav/42.zip"}, files)
+	})
+
+	t.Run("basic", func(t *testing.T) {
+		files = nil
+		challenge = `Basic realm="dav"`
+		checkAuth = func(r *http.Request) bool {
+			user, pass, ok := r.BasicAuth()
+			return ok && user == "alice" && pass == "secret"
+		}
+		require.NoError(t, stmtdiagnostics.TraceToWebDAV(ctx, b, srv.URL+"/dav", "alice", "secret"))
+		require.Equal(t, []string{"/dav/42.zip"}, files)
+
+		err := stmtdiagnostics.TraceToWebDAV(ctx, b, srv.URL+"/dav", "alice", "wrong")
+		require.ErrorContains(t, err, "401 Unauthorized")
+		err = stmtdiagnostics.TraceToWebDAV(ctx, b, srv.URL+"/dav", "", "")
+		require.ErrorContains(t, err, "401 Unauthorized")
+	})
+
+	t.Run("digest", func(t *testing.T) {
+		files = nil
+		challenge = `Digest realm="dav", qop="auth,auth-int", nonce="n0nce", opaque="0paque", algorithm=MD5`
+		checkAuth = func(r *http.Request) bool {
+			auth := r.Header.Get("Authorization")
+			if auth == "" {
+				return false
+			}
+			require.Regexp(t, "^Digest ", auth)
+			p := make(map[string]string)
+			for _, m := range digestParamRE.FindAllStringSubmatch(auth, -1) {
+				p[m[1]] = m[2] + m[3]
+			}
+			require.Equal(t, "alice", p["username"])
+			require.Equal(t, "dav", p["realm"])
+			require.Equal(t, "n0nce", p["nonce"])
+			require.Equal(t, "0paque", p["opaque"])
+			require.Equal(t, "/dav/42.zip", p["uri"])
+			require.Equal(t, "MD5", p["algorithm"])
+			require.Equal(t, "auth", p["qop"])
+			ha1 := md5Hex("alice:dav:secret")
+			ha2 := md5Hex("PUT:/dav/42.zip")
+			require.Equal(t,
+				md5Hex(fmt.Sprintf("%s:n0nce:%s:%s:auth:%s", ha1, p["nc"], p["cnonce"], ha2)),
+				p["response"])
+			return true
+		}
+		require.NoError(t, stmtdiagnostics.TraceToWebDAV(ctx, b, srv.URL+"/dav", "alice", "secret"))
+		require.Equal(t, []string{"/dav/42.zip"}, files)
+	})
+}
+
+func TestTraceToHTTP(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	// The server responds to the first failures requests with status.
+	var failures, requests, status int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "Bearer t0ken", r.Header.Get("Authorization"))
+		require.Equal(t, "crdb", r.Header.Get("X-Source"))
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		require.Equal(t, map[string][]string{
+			"id":           {"42"},
+			"fingerprint":  {b.Fingerprint},
+			"statement":    {b.Statement},
+			"instance_id":  {"1"},
+			"collected_at": {"2023-01-02T03:04:05Z"},
+			"duration_ms":  {"10"},
+			"error":        {"boom"},
+			"url":          {"https://node1:8080/_admin/v1/stmtbundle/42"},
+		}, r.MultipartForm.Value)
+		f, fh, err := r.FormFile("bundle")
+		require.NoError(t, err)
+		defer f.Close()
+		require.Equal(t, "stmt-bundle-42.zip", fh.Filename)
+		zip, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, b.Zip, zip)
+		if requests <= failures {
+			http.Error(w, "try again", status)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	headers := map[string]string{"Authorization": "Bearer t0ken", "X-Source": "crdb"}
+	opts := stmtdiagnostics.HTTPOptions{MaxRetries: 2, InsecureSkipVerify: true}
+	for _, tc := range []struct {
+		name     string
+		failures int
+		status   int
+		requests int
+		err      string
+	}{
+		{name: "ok", requests: 1},
+		{name: "retried", failures: 2, status: http.StatusServiceUnavailable, requests: 3},
+		{name: "throttled", failures: 1, status: http.StatusTooManyRequests, requests: 2},
+		{name: "retries exhausted", failures: 3, status: http.StatusBadGateway, requests: 3,
+			err: "502 Bad Gateway: try again"},
+		{name: "not retried", failures: 1, status: http.StatusForbidden, requests: 1,
+			err: "403 Forbidden: try again"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			failures, status, requests = tc.failures, tc.status, 0
+			resp, err := stmtdiagnostics.TraceToHTTP(ctx, b, srv.URL+"/hook", headers, opts)
+			require.Equal(t, tc.requests, requests)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				require.Nil(t, resp)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, "ok", string(body))
+		})
+	}
+
+	t.Run("certificate", func(t *testing.T) {
+		failures, requests = 0, 0
+		_, err := stmtdiagnostics.TraceToHTTP(ctx, b, srv.URL, headers, stmtdiagnostics.HTTPOptions{})
+		require.ErrorContains(t, err, "certificate")
+		require.Zero(t, requests)
+	})
+}
+
+func TestTraceToGraphQL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	b := makeTestBundle("")
+	var req struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		auth = r.Header.Get("Authorization")
+		req.Variables = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if strings.Contains(req.Query, "missing_table") {
+			_, _ = w.Write([]byte(`{"errors":[{"message":"field 'insert_missing_table' not found"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"insert_bundles_one":{"id":"42"}}}`))
+	}))
+	defer srv.Close()
+
+	const mutation = `mutation Insert(
+  $bundle_id: String!, $fingerprint: String!, $duration_ms: Float!, $error: String, $url: String
+) {
+  insert_bundles_one(object: {
+    id: $bundle_id, fingerprint: $fingerprint, duration_ms: $duration_ms, error: $error, url: $url
+  }) { id }
+}`
+	require.NoError(t, stmtdiagnostics.TraceToGraphQL(ctx, b, srv.URL, mutation, "t0ken"))
+	require.Equal(t, "Bearer t0ken", auth)
+	require.Equal(t, mutation, req.Query)
+	// Only the declared variables are sent.
+	require.Equal(t, map[string]interface{}{
+		"bundle_id":   "42",
+		"fingerprint": b.Fingerprint,
+		"duration_ms": 10.0,
+		"error":       "boom",
+		"url":         nil,
+	}, req.Variables)
+
+	require.NoError(t, stmtdiagnostics.TraceToGraphQL(ctx, b, srv.URL,
+		`mutation ($duration: String!, $instance_id: Int!, $collected_at: String!) {
+  insert_bundles_one(object: {duration: $duration, node: $instance_id, at: $collected_at}) { id }
+}`, ""))
+	require.Empty(t, auth)
+	require.Equal(t, map[string]interface{}{
+		"duration":     "10ms",
+		"instance_id":  1.0,
+		"collected_at": "2023-01-02T03:04:05Z",
+	}, req.Variables)
+
+	err := stmtdiagnostics.TraceToGraphQL(ctx, b, srv.URL,
+		`mutation { insert_missing_table_one(object: {}) { id } }`, "")
+	require.EqualError(t, err,
+		"executing GraphQL mutation: GraphQL errors: field 'insert_missing_table' not found")
+}
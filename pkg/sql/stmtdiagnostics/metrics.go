@@ -0,0 +1,91 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import "github.com/cockroachdb/cockroach/pkg/util/metric"
+
+var (
+	metaRequestsPending = metric.Metadata{
+		Name:        "sql.stmt_diag.requests_pending",
+		Help:        "Number of statement diagnostics requests this node is waiting to satisfy",
+		Measurement: "Requests",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaRequestsTotal = metric.Metadata{
+		Name:        "sql.stmt_diag.requests_total",
+		Help:        "Number of statement diagnostics requests inserted through this node",
+		Measurement: "Requests",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaBundlesCollected = metric.Metadata{
+		Name:        "sql.stmt_diag.bundles_collected",
+		Help:        "Number of statement diagnostics bundles collected by this node",
+		Measurement: "Bundles",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaCollectionErrors = metric.Metadata{
+		Name:        "sql.stmt_diag.collection_errors",
+		Help:        "Number of statement diagnostics bundles that this node failed to save or that were generated with an error",
+		Measurement: "Bundles",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaBundleRetries = metric.Metadata{
+		Name:        "sql.stmt_diag.bundle_retries",
+		Help:        "Number of times this node retried the insertion of a statement diagnostics bundle",
+		Measurement: "Retries",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaPollIterations = metric.Metadata{
+		Name:        "sql.stmt_diag.poll_iterations",
+		Help:        "Number of times this node polled system.statement_diagnostics_requests",
+		Measurement: "Polls",
+		Unit:        metric.Unit_COUNT,
+	}
+)
+
+var _ metric.Struct = (*Metrics)(nil)
+
+// Metrics are the metrics of a Registry.
+type Metrics struct {
+	RequestsPending  *metric.Gauge
+	RequestsTotal    *metric.Counter
+	BundlesCollected *metric.Counter
+	CollectionErrors *metric.Counter
+	BundleRetries    *metric.Counter
+	PollIterations   *metric.Counter
+}
+
+// MetricStruct makes Metrics a metric.Struct.
+func (m *Metrics) MetricStruct() {}
+
+func (r *Registry) makeMetrics() Metrics {
+	return Metrics{
+		RequestsPending:  metric.NewFunctionalGauge(metaRequestsPending, r.numPendingRequests),
+		RequestsTotal:    metric.NewCounter(metaRequestsTotal),
+		BundlesCollected: metric.NewCounter(metaBundlesCollected),
+		CollectionErrors: metric.NewCounter(metaCollectionErrors),
+		BundleRetries:    metric.NewCounter(metaBundleRetries),
+		PollIterations:   metric.NewCounter(metaPollIterations),
+	}
+}
+
+// Metrics returns the metrics of the registry.
+func (r *Registry) Metrics() *Metrics {
+	return &r.metrics
+}
+
+// numPendingRequests returns the number of requests that this node is waiting
+// to satisfy.
+func (r *Registry) numPendingRequests() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(len(r.mu.requestFingerprints))
+}
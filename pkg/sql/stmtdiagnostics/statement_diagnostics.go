@@ -11,25 +11,36 @@
 package stmtdiagnostics
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"math/rand"
+	"regexp"
+	"runtime/pprof"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/clusterversion"
 	"github.com/cockroachdb/cockroach/pkg/multitenant"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/intsets"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/logtags"
 )
 
 var pollingInterval = settings.RegisterDurationSetting(
@@ -38,6 +49,18 @@ var pollingInterval = settings.RegisterDurationSetting(
 	"rate at which the stmtdiagnostics.Registry polls for requests, set to zero to disable",
 	10*time.Second)
 
+// pollTimeout bounds each query that pollRequests runs, so that a slow read of
+// system.statement_diagnostics_requests doesn't delay the next polls
+// indefinitely.
+var pollTimeout = settings.RegisterDurationSetting(
+	settings.TenantReadOnly,
+	"sql.stmt_diagnostics.poll_timeout",
+	"maximum duration of a read of the statement diagnostics requests by "+
+		"stmtdiagnostics.Registry, set to zero to disable",
+	30*time.Second,
+	settings.NonNegativeDuration,
+)
+
 var bundleChunkSize = settings.RegisterByteSizeSetting(
 	settings.TenantWritable,
 	"sql.stmt_diagnostics.bundle_chunk_size",
@@ -80,6 +103,53 @@ var collectUntilExpiration = settings.RegisterBoolSetting(
 		"expiration and a sampling probability set)",
 	false)
 
+// maxBundlesPerNodePerRequest bounds the number of bundles that a node collects
+// for a request. It only matters for the requests that collect bundles
+// continuously (see collectUntilExpiration), since the other requests are
+// completed by their first bundle.
+var maxBundlesPerNodePerRequest = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.max_bundles_per_node_per_request",
+	"maximum number of statement bundles that a node collects for a "+
+		"diagnostics request",
+	1,
+	func(v int64) error {
+		if v < 1 || v > 100 {
+			return errors.Newf("expected a number of bundles in range [1, 100], got %d", v)
+		}
+		return nil
+	},
+)
+
+// bundleInsertMaxRetries bounds the number of times InsertStatementDiagnostics
+// retries the insertion of a bundle that failed with a retryable error (see
+// isRetryableBundleInsertError).
+var bundleInsertMaxRetries = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.bundle_insert_max_retries",
+	"maximum number of times the insertion of a statement bundle is retried "+
+		"after a retryable error",
+	3,
+	func(v int64) error {
+		if v < 0 || v > 10 {
+			return errors.Newf("expected a number of retries in range [0, 10], got %d", v)
+		}
+		return nil
+	},
+)
+
+// maxTotalBundleSize bounds the space taken by the collected bundles. The
+// limit is enforced in the transaction that inserts a bundle, which deletes
+// the oldest bundles once the total goes over it (see deleteOldestBundlesTxn).
+var maxTotalBundleSize = settings.RegisterByteSizeSetting(
+	settings.TenantWritable,
+	"sql.stmt_diagnostics.max_total_bundle_size",
+	"maximum total size of the collected statement bundles, above which the "+
+		"oldest bundles are deleted when a new one is collected; 0 to disable",
+	0,
+	settings.NonNegativeInt,
+)
+
 // Registry maintains a view on the statement fingerprints
 // on which data is to be collected (i.e. system.statement_diagnostics_requests)
 // and provides utilities for checking a query against this list and satisfying
@@ -96,6 +166,15 @@ type Registry struct {
 		// ids of unconditional requests that this node is in the process of
 		// servicing.
 		unconditionalOngoing map[RequestID]Request
+		// collecting counts the executions that this node is tracing for each
+		// request, conditional or not, i.e. the ones for which
+		// ShouldCollectDiagnostics returned true and MaybeRemoveRequest wasn't
+		// called yet.
+		collecting map[RequestID]int
+		// collectedBundles counts the bundles that this node collected for each
+		// request, which sql.stmt_diagnostics.max_bundles_per_node_per_request
+		// bounds.
+		collectedBundles map[RequestID]int
 
 		// epoch is observed before reading system.statement_diagnostics_requests, and then
 		// checked again before loading the tables contents. If the value changed in
@@ -106,6 +185,79 @@ type Registry struct {
 	}
 	st *cluster.Settings
 	db isql.DB
+	// stopper is set by Start.
+	stopper *stop.Stopper
+	metrics Metrics
+
+	// testingBeforeBundleInsert, if set, is called before every attempt at
+	// inserting a bundle, which fails with the error it returns, if any.
+	testingBeforeBundleInsert func() error
+	// testingAfterRequestInsert, if set, is called after every committed
+	// attempt at inserting a request, which fails with the error it returns, if
+	// any.
+	testingAfterRequestInsert func() error
+	// testingAfterBundleInsert, if set, is called after every committed attempt
+	// at inserting a bundle, which fails with the error it returns, if any.
+	testingAfterBundleInsert func() error
+
+	// bundleHooks are the functions registered with OnBundleCollected.
+	bundleHooks struct {
+		syncutil.Mutex
+		hooks []func(context.Context, *Bundle)
+	}
+}
+
+// PatternType determines how the fingerprint of a request is matched against
+// the fingerprints of executed statements.
+type PatternType string
+
+const (
+	// PatternExact matches statements whose fingerprint is equal to the one of
+	// the request.
+	PatternExact PatternType = "exact"
+	// PatternGlob matches statements whose whole fingerprint matches the glob of
+	// the request, in which '*' matches any sequence of characters and '?' any
+	// single character.
+	PatternGlob PatternType = "glob"
+	// PatternRegexp matches statements whose fingerprint contains a match of the
+	// regular expression of the request.
+	PatternRegexp PatternType = "regexp"
+)
+
+// compilePattern compiles the pattern of a glob or regexp request into the
+// regular expression that fingerprints are matched against. It returns nil for
+// exact requests.
+//
+// Globs are translated rather than matched with filepath.Match, whose '*'
+// doesn't match '/', which is the division operator in fingerprints.
+func compilePattern(pattern string, patternType PatternType) (*regexp.Regexp, error) {
+	switch patternType {
+	case PatternExact, "":
+		return nil, nil
+	case PatternGlob:
+		var sb strings.Builder
+		sb.WriteString("^")
+		for _, c := range pattern {
+			switch c {
+			case '*':
+				sb.WriteString(".*")
+			case '?':
+				sb.WriteString(".")
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		sb.WriteString("$")
+		return regexp.Compile(sb.String())
+	case PatternRegexp:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid fingerprint regexp %q", pattern)
+		}
+		return re, nil
+	default:
+		return nil, errors.Newf("unknown pattern type %q", patternType)
+	}
 }
 
 // Request describes a statement diagnostics request along with some conditional
@@ -115,6 +267,39 @@ type Request struct {
 	samplingProbability float64
 	minExecutionLatency time.Duration
 	expiresAt           time.Time
+	// pattern is the compiled fingerprint of glob and regexp requests. It is
+	// compiled when the request is added to the registry, so that statements
+	// aren't matched against a freshly compiled pattern on every execution.
+	pattern           *regexp.Regexp
+	captureCPUProfile bool
+	minSpanDuration   time.Duration
+	// captureOnError restricts the request to the executions that fail.
+	captureOnError bool
+	// maxBundles, if non-zero, overrides
+	// sql.stmt_diagnostics.max_bundles_per_node_per_request for the request.
+	maxBundles int
+}
+
+// CaptureCPUProfile returns whether a CPU profile of the process is to be
+// captured while the statement executes, and stored along with its bundle.
+func (r *Request) CaptureCPUProfile() bool {
+	return r.captureCPUProfile
+}
+
+// MinSpanDuration returns the duration of the shortest spans kept in the trace
+// of the bundle; shorter spans are dropped unless they have longer
+// descendants. Zero means that the whole trace is kept.
+func (r *Request) MinSpanDuration() time.Duration {
+	return r.minSpanDuration
+}
+
+// matches returns whether the request applies to statements with the given
+// fingerprint.
+func (r *Request) matches(fingerprint string) bool {
+	if r.pattern != nil {
+		return r.pattern.MatchString(fingerprint)
+	}
+	return r.fingerprint == fingerprint
 }
 
 func (r *Request) isExpired(now time.Time) bool {
@@ -122,7 +307,16 @@ func (r *Request) isExpired(now time.Time) bool {
 }
 
 func (r *Request) isConditional() bool {
-	return r.minExecutionLatency != 0
+	return r.minExecutionLatency != 0 || r.captureOnError
+}
+
+// maxBundlesPerNode returns the number of bundles that a node collects at most
+// for the request.
+func (r *Request) maxBundlesPerNode(st *cluster.Settings) int64 {
+	if r.maxBundles > 0 {
+		return int64(r.maxBundles)
+	}
+	return maxBundlesPerNodePerRequest.Get(&st.SV)
 }
 
 // continueCollecting returns true if we want to continue collecting bundles for
@@ -140,11 +334,13 @@ func NewRegistry(db isql.DB, st *cluster.Settings) *Registry {
 		st: st,
 	}
 	r.mu.rand = rand.New(rand.NewSource(timeutil.Now().UnixNano()))
+	r.metrics = r.makeMetrics()
 	return r
 }
 
 // Start will start the polling loop for the Registry.
 func (r *Registry) Start(ctx context.Context, stopper *stop.Stopper) {
+	r.stopper = stopper
 	ctx, _ = stopper.WithCancelOnQuiesce(ctx)
 
 	// Since background statement diagnostics collection is not under user
@@ -160,6 +356,7 @@ func (r *Registry) poll(ctx context.Context) {
 	var (
 		timer               timeutil.Timer
 		lastPoll            time.Time
+		lastCleanup         time.Time
 		deadline            time.Time
 		pollIntervalChanged = make(chan struct{}, 1)
 		maybeResetTimer     = func() {
@@ -182,6 +379,12 @@ func (r *Registry) poll(ctx context.Context) {
 				log.Warningf(ctx, "error polling for statement diagnostics requests: %s", err)
 			}
 			lastPoll = timeutil.Now()
+			if lastPoll.Sub(lastCleanup) >= expiredRequestsRetention {
+				if err := r.deleteExpiredRequests(ctx); err != nil && ctx.Err() == nil {
+					log.Warningf(ctx, "error deleting expired statement diagnostics requests: %s", err)
+				}
+				lastCleanup = lastPoll
+			}
 		}
 	)
 	pollingInterval.SetOnChange(&r.st.SV, func(ctx context.Context) {
@@ -204,6 +407,35 @@ func (r *Registry) poll(ctx context.Context) {
 	}
 }
 
+// expiredRequestsRetention is how long the requests that expired without
+// collecting any bundle are kept in system.statement_diagnostics_requests
+// before deleteExpiredRequests deletes them. It is also the interval at which
+// every node runs deleteExpiredRequests.
+//
+// The retention lets statements that were being traced when their request
+// expired (or was canceled) write their bundle. If the request is deleted
+// first, the bundle is dropped (see InsertStatementDiagnostics).
+const expiredRequestsRetention = time.Hour
+
+// deleteExpiredRequests deletes the requests that expired more than
+// expiredRequestsRetention ago without collecting any bundle. Without it, the
+// requests for fingerprints that are never executed would accumulate. The
+// requests that collected bundles are kept, since they link the bundles to the
+// requests.
+func (r *Registry) deleteExpiredRequests(ctx context.Context) error {
+	n, err := r.db.Executor().ExecEx(ctx, "stmt-diag-delete-expired", nil, /* txn */
+		sessiondata.RootUserSessionDataOverride,
+		"DELETE FROM system.statement_diagnostics_requests "+
+			"WHERE completed = false AND statement_diagnostics_id IS NULL "+
+			"AND expires_at < now() - $1::INTERVAL",
+		expiredRequestsRetention,
+	)
+	if err == nil && n > 0 {
+		log.Infof(ctx, "deleted %d expired statement diagnostics requests", n)
+	}
+	return err
+}
+
 // RequestID is the ID of a diagnostics request, corresponding to the id
 // column in statement_diagnostics_requests.
 // A zero ID is invalid.
@@ -219,14 +451,26 @@ func (r *Registry) addRequestInternalLocked(
 	ctx context.Context,
 	id RequestID,
 	queryFingerprint string,
+	patternType PatternType,
+	captureCPUProfile bool,
 	samplingProbability float64,
 	minExecutionLatency time.Duration,
+	minSpanDuration time.Duration,
+	captureOnError bool,
+	maxBundles int,
 	expiresAt time.Time,
 ) {
 	if r.findRequestLocked(id) {
 		// Request already exists.
 		return
 	}
+	pattern, err := compilePattern(queryFingerprint, patternType)
+	if err != nil {
+		// The pattern was validated when the request was inserted, so this can
+		// only happen if the row was modified by hand.
+		log.Warningf(ctx, "ignoring statement diagnostics request %d: %v", id, err)
+		return
+	}
 	if r.mu.requestFingerprints == nil {
 		r.mu.requestFingerprints = make(map[RequestID]Request)
 	}
@@ -235,6 +479,11 @@ func (r *Registry) addRequestInternalLocked(
 		samplingProbability: samplingProbability,
 		minExecutionLatency: minExecutionLatency,
 		expiresAt:           expiresAt,
+		pattern:             pattern,
+		captureCPUProfile:   captureCPUProfile,
+		minSpanDuration:     minSpanDuration,
+		captureOnError:      captureOnError,
+		maxBundles:          maxBundles,
 	}
 }
 
@@ -254,6 +503,16 @@ func (r *Registry) findRequestLocked(requestID RequestID) bool {
 	return ok
 }
 
+// IsOngoing returns whether this node is collecting a bundle for the request
+// with the given ID, i.e. whether it is tracing a statement for it. This holds
+// for conditional requests too, even though the bundle is only kept if the
+// execution turns out to satisfy the condition.
+func (r *Registry) IsOngoing(requestID RequestID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.collecting[requestID] > 0
+}
+
 // cancelRequest removes the request with the given RequestID from the Registry
 // if present.
 func (r *Registry) cancelRequest(requestID RequestID) {
@@ -261,6 +520,111 @@ func (r *Registry) cancelRequest(requestID RequestID) {
 	defer r.mu.Unlock()
 	delete(r.mu.requestFingerprints, requestID)
 	delete(r.mu.unconditionalOngoing, requestID)
+	delete(r.mu.collectedBundles, requestID)
+}
+
+// reserveBundle reserves the collection of a bundle for the request with the
+// given ID on this node. It returns false if the node already collected the
+// maximum number of bundles for it (see Request.maxBundlesPerNode). The
+// reservation is undone with releaseBundle if the bundle can't be inserted.
+func (r *Registry) reserveBundle(requestID RequestID, req Request) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if int64(r.mu.collectedBundles[requestID]) >= req.maxBundlesPerNode(r.st) {
+		return false
+	}
+	if r.mu.collectedBundles == nil {
+		r.mu.collectedBundles = make(map[RequestID]int)
+	}
+	r.mu.collectedBundles[requestID]++
+	return true
+}
+
+// releaseBundle undoes a reservation made with reserveBundle.
+func (r *Registry) releaseBundle(requestID RequestID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.collectedBundles[requestID] > 0 {
+		r.mu.collectedBundles[requestID]--
+	}
+}
+
+// CPUProfile is a CPU profile of the process, captured while a statement
+// executes for a request with CaptureCPUProfile set.
+type CPUProfile struct {
+	st  *cluster.Settings
+	buf bytes.Buffer
+}
+
+// StartCPUProfile starts capturing a CPU profile of the process. The profile
+// is taken with pprof labels, which attribute the samples to statements. It
+// returns nil if the profile can't be started, which is the case if the process
+// is already being profiled, e.g. through the /debug/pprof/profile endpoint.
+func (r *Registry) StartCPUProfile(ctx context.Context) *CPUProfile {
+	if err := r.st.SetCPUProfiling(cluster.CPUProfileWithLabels); err != nil {
+		// This is expected when several executions of the statement overlap, so
+		// it isn't worth a warning.
+		log.VEventf(ctx, 1, "not capturing CPU profile for statement diagnostics: %v", err)
+		return nil
+	}
+	p := &CPUProfile{st: r.st}
+	if err := pprof.StartCPUProfile(&p.buf); err != nil {
+		_ = r.st.SetCPUProfiling(cluster.CPUProfileNone)
+		log.Warningf(ctx, "not capturing CPU profile for statement diagnostics: %v", err)
+		return nil
+	}
+	return p
+}
+
+// Stop stops the profile and returns it, in the gzipped protobuf format of
+// pprof. It returns nil if p is nil.
+func (p *CPUProfile) Stop() []byte {
+	if p == nil {
+		return nil
+	}
+	pprof.StopCPUProfile()
+	_ = p.st.SetCPUProfiling(cluster.CPUProfileNone)
+	return p.buf.Bytes()
+}
+
+// StmtDiagRequestOptions are the options of a statement diagnostics request,
+// as inserted by InsertRequestWithOptions. The zero value requests a bundle for
+// the next execution of the statement.
+type StmtDiagRequestOptions struct {
+	// PatternType determines how the fingerprint of the request is matched
+	// against the fingerprints of the statements. The zero value is
+	// PatternExact.
+	PatternType PatternType
+	// MinLatency, if non-zero, is the minimum execution latency of the
+	// executions that satisfy the request.
+	MinLatency time.Duration
+	// SamplingRate, if non-zero, is the probability with which an execution is
+	// traced. It requires MinLatency to be set.
+	SamplingRate float64
+	// ExpiresAfter, if non-zero, indicates for how long the request stays
+	// active.
+	ExpiresAfter time.Duration
+	// CaptureCPUProfile is set if a CPU profile of the process is captured while
+	// the statement executes, and stored in the cpu_profile column of
+	// system.statement_diagnostics. Since profiling a statement slows down all
+	// the others, at most one such request can be pending at a time.
+	CaptureCPUProfile bool
+	// CaptureOnError is set if only the executions that return an error satisfy
+	// the request.
+	CaptureOnError bool
+	// MaxBundles, if non-zero, is the maximum number of bundles that a node
+	// collects for the request, in place of
+	// sql.stmt_diagnostics.max_bundles_per_node_per_request.
+	MaxBundles int
+	// MinSpanDuration, if non-zero, is the duration of the shortest spans kept
+	// in the trace of the bundle, along with their ancestors. This keeps the
+	// bundles of statements with a high fan-out, whose traces contain many
+	// short spans, to a manageable size.
+	MinSpanDuration time.Duration
+	// RequestedBy, if set, is the user that inserted the request. The sinks
+	// that access external connections (see BundleSinks) send the bundles of
+	// the request only if this user has the USAGE privilege on them.
+	RequestedBy username.SQLUsername
 }
 
 // InsertRequest is part of the StmtDiagnosticsRequester interface.
@@ -271,17 +635,67 @@ func (r *Registry) InsertRequest(
 	minExecutionLatency time.Duration,
 	expiresAfter time.Duration,
 ) error {
-	_, err := r.insertRequestInternal(ctx, stmtFingerprint, samplingProbability, minExecutionLatency, expiresAfter)
+	return r.InsertRequestWithOptions(ctx, stmtFingerprint, StmtDiagRequestOptions{
+		MinLatency:   minExecutionLatency,
+		SamplingRate: samplingProbability,
+		ExpiresAfter: expiresAfter,
+	})
+}
+
+// InsertRequestWithOptions is part of the StmtDiagnosticsRequester interface.
+func (r *Registry) InsertRequestWithOptions(
+	ctx context.Context, stmtFingerprint string, opts StmtDiagRequestOptions,
+) error {
+	_, err := r.insertRequestInternal(ctx, stmtFingerprint, opts)
 	return err
 }
 
 func (r *Registry) insertRequestInternal(
-	ctx context.Context,
-	stmtFingerprint string,
-	samplingProbability float64,
-	minExecutionLatency time.Duration,
-	expiresAfter time.Duration,
+	ctx context.Context, stmtFingerprint string, opts StmtDiagRequestOptions,
 ) (RequestID, error) {
+	patternType := opts.PatternType
+	if patternType == "" {
+		patternType = PatternExact
+	}
+	captureCPUProfile := opts.CaptureCPUProfile
+	samplingProbability := opts.SamplingRate
+	minExecutionLatency := opts.MinLatency
+	minSpanDuration := opts.MinSpanDuration
+	expiresAfter := opts.ExpiresAfter
+	if patternType != PatternExact {
+		if !r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddPatternType) {
+			return 0, errors.New(
+				"fingerprint patterns only supported after 23.1 version migrations have completed",
+			)
+		}
+		if _, err := compilePattern(stmtFingerprint, patternType); err != nil {
+			return 0, err
+		}
+	}
+	if captureCPUProfile &&
+		!r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsAddCPUProfile) {
+		return 0, errors.New(
+			"CPU profile capture only supported after 23.1 version migrations have completed",
+		)
+	}
+	if minSpanDuration < 0 {
+		return 0, errors.Newf("expected non-negative min span duration, got %s", minSpanDuration)
+	}
+	if minSpanDuration != 0 &&
+		!r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddMinSpanDuration) {
+		return 0, errors.New(
+			"min span duration only supported after 23.1 version migrations have completed",
+		)
+	}
+	if opts.MaxBundles < 0 || opts.MaxBundles > 100 {
+		return 0, errors.Newf("expected a number of bundles in range [0, 100], got %d", opts.MaxBundles)
+	}
+	if (opts.CaptureOnError || opts.MaxBundles != 0) &&
+		!r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles) {
+		return 0, errors.New(
+			"capture on error and max bundles only supported after 23.1 version migrations have completed",
+		)
+	}
 	isSamplingProbabilitySupported := r.st.Version.IsActive(ctx, clusterversion.V22_2SampledStmtDiagReqs)
 	if !isSamplingProbabilitySupported && samplingProbability != 0 {
 		return 0, errors.New(
@@ -301,37 +715,36 @@ func (r *Registry) insertRequestInternal(
 		}
 	}
 
-	var reqID RequestID
+	// The ID of the request is chosen before inserting it, so that the attempts
+	// that follow an ambiguous commit find the row inserted by the previous
+	// attempt rather than inserting a duplicate. This only deduplicates the
+	// retries made here: a caller that calls InsertRequest again after an error
+	// gets a new request.
+	row, err := r.db.Executor().QueryRowEx(ctx, "stmt-diag-new-request-id", nil, /* txn */
+		sessiondata.RootUserSessionDataOverride, "SELECT unique_rowid()")
+	if err != nil {
+		return 0, err
+	}
+	if row == nil {
+		return 0, errors.New("failed to generate statement diagnostics request ID")
+	}
+	reqID := RequestID(*row[0].(*tree.DInt))
 	var expiresAt time.Time
-	err := r.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
-		// Check if there's already a pending request for this fingerprint.
-		row, err := txn.QueryRowEx(ctx, "stmt-diag-check-pending", txn.KV(),
-			sessiondata.RootUserSessionDataOverride,
-			`SELECT count(1) FROM system.statement_diagnostics_requests
-				WHERE
-					completed = false AND
-					statement_fingerprint = $1 AND
-					(expires_at IS NULL OR expires_at > now())`,
-			stmtFingerprint)
-		if err != nil {
-			return err
-		}
-		if row == nil {
-			return errors.New("failed to check pending statement diagnostics")
+	now := timeutil.Now()
+	insert := func(ctx context.Context, txn isql.Txn) error {
+		insertColumns := "id, statement_fingerprint, requested_at"
+		qargs := make([]interface{}, 3, 12)
+		qargs[0] = reqID           // id
+		qargs[1] = stmtFingerprint // statement_fingerprint
+		qargs[2] = now             // requested_at
+		if patternType != PatternExact {
+			insertColumns += ", pattern_type"
+			qargs = append(qargs, string(patternType)) // pattern_type
 		}
-		count := int(*row[0].(*tree.DInt))
-		if count != 0 {
-			return errors.New(
-				"A pending request for the requested fingerprint already exists. " +
-					"Cancel the existing request first and try again.",
-			)
+		if captureCPUProfile {
+			insertColumns += ", capture_cpu_profile"
+			qargs = append(qargs, true) // capture_cpu_profile
 		}
-
-		now := timeutil.Now()
-		insertColumns := "statement_fingerprint, requested_at"
-		qargs := make([]interface{}, 2, 5)
-		qargs[0] = stmtFingerprint // statement_fingerprint
-		qargs[1] = now             // requested_at
 		if samplingProbability != 0 {
 			insertColumns += ", sampling_probability"
 			qargs = append(qargs, samplingProbability) // sampling_probability
@@ -340,31 +753,86 @@ func (r *Registry) insertRequestInternal(
 			insertColumns += ", min_execution_latency"
 			qargs = append(qargs, minExecutionLatency) // min_execution_latency
 		}
+		if minSpanDuration != 0 {
+			insertColumns += ", min_span_duration"
+			qargs = append(qargs, minSpanDuration) // min_span_duration
+		}
+		if opts.CaptureOnError {
+			insertColumns += ", capture_on_error"
+			qargs = append(qargs, true) // capture_on_error
+		}
+		if opts.MaxBundles != 0 {
+			insertColumns += ", max_bundles"
+			qargs = append(qargs, opts.MaxBundles) // max_bundles
+		}
+		if !opts.RequestedBy.Undefined() &&
+			r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddRequestedBy) {
+			insertColumns += ", requested_by"
+			qargs = append(qargs, opts.RequestedBy.Normalized()) // requested_by
+		}
 		if expiresAfter != 0 {
 			insertColumns += ", expires_at"
 			expiresAt = now.Add(expiresAfter)
 			qargs = append(qargs, expiresAt) // expires_at
 		}
-		valuesClause := "$1, $2"
-		for i := range qargs[2:] {
-			valuesClause += fmt.Sprintf(", $%d", i+3)
+		valuesClause := "$1, $2, $3"
+		for i := range qargs[3:] {
+			valuesClause += fmt.Sprintf(", $%d", i+4)
 		}
-		stmt := "INSERT INTO system.statement_diagnostics_requests (" +
-			insertColumns + ") VALUES (" + valuesClause + ") RETURNING id;"
-		row, err = txn.QueryRowEx(
+		n, err := txn.ExecEx(
 			ctx, "stmt-diag-insert-request", txn.KV(),
 			sessiondata.RootUserSessionDataOverride,
-			stmt, qargs...,
+			"INSERT INTO system.statement_diagnostics_requests ("+
+				insertColumns+") VALUES ("+valuesClause+") ON CONFLICT (id) DO NOTHING",
+			qargs...,
 		)
 		if err != nil {
 			return err
 		}
-		if row == nil {
-			return errors.New("failed to insert statement diagnostics request")
+		if n == 0 {
+			// A previous attempt inserted the request, and the checks below passed
+			// back then.
+			return nil
+		}
+
+		// At most one request capturing a CPU profile can be pending, so look for
+		// the ones other than the request that was just inserted.
+		if captureCPUProfile {
+			row, err := txn.QueryRowEx(ctx, "stmt-diag-check-cpu-profile", txn.KV(),
+				sessiondata.RootUserSessionDataOverride,
+				"SELECT count(1) FROM system.statement_diagnostics_requests "+
+					"WHERE capture_cpu_profile AND completed = false AND id != $1 "+
+					"AND (expires_at IS NULL OR expires_at > now())",
+				reqID,
+			)
+			if err != nil {
+				return err
+			}
+			if row == nil {
+				return errors.New("failed to check pending CPU profiling requests")
+			}
+			if cnt := int(*row[0].(*tree.DInt)); cnt > 0 {
+				return errors.New(
+					"another statement diagnostics request capturing a CPU profile is already pending",
+				)
+			}
 		}
-		reqID = RequestID(*row[0].(*tree.DInt))
 		return nil
-	})
+	}
+	for attempt := retry.StartWithCtx(ctx, retry.Options{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+		MaxRetries:     requestInsertMaxRetries,
+	}); attempt.Next(); {
+		if err = r.db.Txn(ctx, insert); err == nil && r.testingAfterRequestInsert != nil {
+			err = r.testingAfterRequestInsert()
+		}
+		if !errors.HasType(err, (*roachpb.AmbiguousResultError)(nil)) {
+			break
+		}
+		log.Warningf(ctx, "retrying the insertion of statement diagnostics request after error: %v", err)
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -376,8 +844,9 @@ func (r *Registry) insertRequestInternal(
 		r.mu.Lock()
 		defer r.mu.Unlock()
 		r.mu.epoch++
-		r.addRequestInternalLocked(ctx, reqID, stmtFingerprint, samplingProbability, minExecutionLatency, expiresAt)
+		r.addRequestInternalLocked(ctx, reqID, stmtFingerprint, patternType, captureCPUProfile, samplingProbability, minExecutionLatency, minSpanDuration, opts.CaptureOnError, opts.MaxBundles, expiresAt)
 	}()
+	r.metrics.RequestsTotal.Inc(1)
 
 	return reqID, nil
 }
@@ -387,10 +856,11 @@ func (r *Registry) CancelRequest(ctx context.Context, requestID int64) error {
 	row, err := r.db.Executor().QueryRowEx(ctx, "stmt-diag-cancel-request", nil, /* txn */
 		sessiondata.RootUserSessionDataOverride,
 		// Rather than deleting the row from the table, we choose to mark the
-		// request as "expired" by setting `expires_at` into the past. This will
-		// allow any queries that are currently being traced for this request to
-		// write their collected bundles.
-		"UPDATE system.statement_diagnostics_requests SET expires_at = '1970-01-01' "+
+		// request as "expired" by setting `expires_at` to the current time. This
+		// will allow any queries that are currently being traced for this request
+		// to write their collected bundles, since deleteExpiredRequests only
+		// deletes the request once expiredRequestsRetention has passed.
+		"UPDATE system.statement_diagnostics_requests SET expires_at = now() "+
 			"WHERE completed = false AND id = $1 "+
 			"AND (expires_at IS NULL OR expires_at > now()) RETURNING id;",
 		requestID,
@@ -400,8 +870,8 @@ func (r *Registry) CancelRequest(ctx context.Context, requestID int64) error {
 	}
 
 	if row == nil {
-		// There is no pending diagnostics request with the given fingerprint.
-		return errors.Newf("no pending request found for the fingerprint: %s", requestID)
+		// There is no pending diagnostics request with the given ID.
+		return errors.Newf("no pending request found with id %d", requestID)
 	}
 
 	reqID := RequestID(requestID)
@@ -410,23 +880,334 @@ func (r *Registry) CancelRequest(ctx context.Context, requestID int64) error {
 	return nil
 }
 
+// RequestOngoingError is returned by DeleteRequest when the request is
+// currently collecting a bundle on this node (see Registry.IsOngoing).
+type RequestOngoingError struct {
+	RequestID RequestID
+}
+
+func (e *RequestOngoingError) Error() string {
+	return fmt.Sprintf("request %d is collecting a bundle and cannot be deleted", e.RequestID)
+}
+
+// DeleteRequest is part of the server.StmtDiagnosticsRequester interface. It
+// removes the request with the given ID from
+// system.statement_diagnostics_requests along with the bundle linked to it, if
+// any. Requests that are collecting a bundle on this node are refused with a
+// *RequestOngoingError. Other nodes drop the request the next time they poll
+// the table, and a bundle they were collecting for it is discarded since
+// InsertStatementDiagnostics no longer finds the request.
+func (r *Registry) DeleteRequest(ctx context.Context, requestID int64) error {
+	reqID := RequestID(requestID)
+	if r.IsOngoing(reqID) {
+		return &RequestOngoingError{RequestID: reqID}
+	}
+
+	if err := r.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		row, err := txn.QueryRowEx(ctx, "stmt-diag-delete-request", txn.KV(),
+			sessiondata.RootUserSessionDataOverride,
+			"DELETE FROM system.statement_diagnostics_requests WHERE id = $1 "+
+				"RETURNING statement_diagnostics_id",
+			requestID,
+		)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return errors.Newf("no request found with id %d", requestID)
+		}
+		if row[0] == tree.DNull {
+			return nil
+		}
+		diagID := row[0]
+		if _, err := txn.ExecEx(ctx, "stmt-diag-delete-request-bundle-chunks", txn.KV(),
+			sessiondata.RootUserSessionDataOverride,
+			"DELETE FROM system.statement_bundle_chunks WHERE id IN ("+
+				"SELECT unnest(bundle_chunks) FROM system.statement_diagnostics WHERE id = $1)",
+			diagID,
+		); err != nil {
+			return err
+		}
+		_, err = txn.ExecEx(ctx, "stmt-diag-delete-request-bundle", txn.KV(),
+			sessiondata.RootUserSessionDataOverride,
+			"DELETE FROM system.statement_diagnostics WHERE id = $1",
+			diagID,
+		)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	r.cancelRequest(reqID)
+	return nil
+}
+
+// StmtDiagRequest describes a row of system.statement_diagnostics_requests, as
+// returned by ListRequests.
+type StmtDiagRequest struct {
+	ID          RequestID
+	Fingerprint string
+	// PatternType determines how Fingerprint is matched against the
+	// fingerprints of statements.
+	PatternType PatternType
+	// CaptureCPUProfile is set if a CPU profile is captured along with the
+	// bundle.
+	CaptureCPUProfile bool
+	Completed         bool
+	// DiagnosticsID is the ID of the bundle collected for the request in
+	// system.statement_diagnostics, or zero if none has been collected yet.
+	DiagnosticsID CollectedInstanceID
+	RequestedAt   time.Time
+	// Zero value indicates that we're sampling every execution.
+	SamplingProbability float64
+	// Zero value indicates that there is no minimum latency set on the request.
+	MinExecutionLatency time.Duration
+	// Zero value indicates that the whole trace is kept in the bundle.
+	MinSpanDuration time.Duration
+	// CaptureOnError is set if only the executions that fail satisfy the
+	// request.
+	CaptureOnError bool
+	// Zero value indicates that
+	// sql.stmt_diagnostics.max_bundles_per_node_per_request applies.
+	MaxBundles int
+	// Zero value indicates that the request never expires.
+	ExpiresAt time.Time
+}
+
+// StmtDiagBundle describes a row of system.statement_diagnostics along with
+// the bundle stored in system.statement_bundle_chunks, as returned by
+// GetDiagnostics.
+type StmtDiagBundle struct {
+	ID          CollectedInstanceID
+	Fingerprint string
+	Statement   string
+	CollectedAt time.Time
+	// Error is the error that occurred while collecting the bundle, if any.
+	Error string
+	// ExecError is the error returned by the statement, along with its SQLSTATE
+	// code, if the statement failed (see formatExecError).
+	ExecError string
+	// Zip is the bundle, which contains the trace and the plans of the
+	// statement. It is nil if no bundle could be collected.
+	Zip []byte
+	// CPUProfile is the CPU profile captured while the statement executed, in
+	// the gzipped protobuf format of pprof. It is nil if the request didn't ask
+	// for one.
+	CPUProfile []byte
+}
+
+// optionalColumn is a column of a statement diagnostics system table that was
+// added by an upgrade, and can only be read once the version of that upgrade
+// is active.
+type optionalColumn struct {
+	name    string
+	version clusterversion.Key
+}
+
+// optionalRequestColumns are the optional columns of
+// system.statement_diagnostics_requests.
+var optionalRequestColumns = []optionalColumn{
+	{"sampling_probability", clusterversion.V22_2SampledStmtDiagReqs},
+	{"pattern_type", clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddPatternType},
+	{"capture_cpu_profile", clusterversion.V23_1AlterSystemStatementDiagnosticsAddCPUProfile},
+	{"min_span_duration", clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddMinSpanDuration},
+	{"capture_on_error", clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles},
+	{"max_bundles", clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles},
+}
+
+// optionalDiagnosticsColumns are the optional columns of
+// system.statement_diagnostics.
+var optionalDiagnosticsColumns = []optionalColumn{
+	{"cpu_profile", clusterversion.V23_1AlterSystemStatementDiagnosticsAddCPUProfile},
+	{"error_message", clusterversion.V23_1AlterSystemStatementDiagnosticsAddErrorMessage},
+}
+
+// optionalColumns returns the list of the columns among cols that can be read
+// at the active cluster version, to be appended to the numFixedColumns columns
+// of a SELECT, along with the position of each of them in the resulting rows.
+func (r *Registry) optionalColumns(
+	ctx context.Context, cols []optionalColumn, numFixedColumns int,
+) (extraColumns string, colIdx map[string]int) {
+	colIdx = make(map[string]int, len(cols))
+	for _, c := range cols {
+		if r.st.Version.IsActive(ctx, c.version) {
+			colIdx[c.name] = numFixedColumns + len(colIdx)
+			extraColumns += ", " + c.name
+		}
+	}
+	return extraColumns, colIdx
+}
+
+// ListRequests is part of the server.StmtDiagnosticsRequester interface. It
+// returns the pending requests that haven't expired and the completed
+// requests, ordered by ID.
+//
+// The system tables are read outside of any transaction, so that the reads
+// don't hold up the collection of bundles.
+func (r *Registry) ListRequests(ctx context.Context) ([]StmtDiagRequest, error) {
+	extraColumns, colIdx := r.optionalColumns(ctx, optionalRequestColumns, 7 /* numFixedColumns */)
+	it, err := r.db.Executor().QueryIteratorEx(ctx, "stmt-diag-list-requests", nil, /* txn */
+		sessiondata.RootUserSessionDataOverride,
+		fmt.Sprintf(`SELECT id, statement_fingerprint, completed, statement_diagnostics_id,
+				requested_at, min_execution_latency, expires_at%s
+			FROM system.statement_diagnostics_requests
+			WHERE completed OR expires_at IS NULL OR expires_at > now()
+			ORDER BY id`, extraColumns),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var requests []StmtDiagRequest
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		req := StmtDiagRequest{
+			ID:          RequestID(*row[0].(*tree.DInt)),
+			Fingerprint: string(*row[1].(*tree.DString)),
+			PatternType: PatternExact,
+			Completed:   bool(*row[2].(*tree.DBool)),
+		}
+		if diagID, ok := row[3].(*tree.DInt); ok {
+			req.DiagnosticsID = CollectedInstanceID(*diagID)
+		}
+		if requestedAt, ok := row[4].(*tree.DTimestampTZ); ok {
+			req.RequestedAt = requestedAt.Time
+		}
+		if minExecLatency, ok := row[5].(*tree.DInterval); ok {
+			req.MinExecutionLatency = time.Duration(minExecLatency.Nanos())
+		}
+		if expiresAt, ok := row[6].(*tree.DTimestampTZ); ok {
+			req.ExpiresAt = expiresAt.Time
+		}
+		if i, ok := colIdx["sampling_probability"]; ok {
+			if prob, ok := row[i].(*tree.DFloat); ok {
+				req.SamplingProbability = float64(*prob)
+			}
+		}
+		if i, ok := colIdx["pattern_type"]; ok {
+			if patternType, ok := row[i].(*tree.DString); ok {
+				req.PatternType = PatternType(*patternType)
+			}
+		}
+		if i, ok := colIdx["capture_cpu_profile"]; ok {
+			if capture, ok := row[i].(*tree.DBool); ok {
+				req.CaptureCPUProfile = bool(*capture)
+			}
+		}
+		if i, ok := colIdx["min_span_duration"]; ok {
+			if d, ok := row[i].(*tree.DInterval); ok {
+				req.MinSpanDuration = time.Duration(d.Nanos())
+			}
+		}
+		if i, ok := colIdx["capture_on_error"]; ok {
+			if capture, ok := row[i].(*tree.DBool); ok {
+				req.CaptureOnError = bool(*capture)
+			}
+		}
+		if i, ok := colIdx["max_bundles"]; ok {
+			if n, ok := row[i].(*tree.DInt); ok {
+				req.MaxBundles = int(*n)
+			}
+		}
+		requests = append(requests, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// GetDiagnostics is part of the server.StmtDiagnosticsRequester interface. It
+// returns the bundle with the given ID in system.statement_diagnostics (the
+// DiagnosticsID of a completed request), with its zip reassembled from
+// system.statement_bundle_chunks.
+//
+// Like ListRequests, the system tables are read outside of any transaction.
+func (r *Registry) GetDiagnostics(ctx context.Context, id int64) (*StmtDiagBundle, error) {
+	extraColumns, colIdx := r.optionalColumns(ctx, optionalDiagnosticsColumns, 5 /* numFixedColumns */)
+	row, err := r.db.Executor().QueryRowEx(ctx, "stmt-diag-get-diagnostics", nil, /* txn */
+		sessiondata.RootUserSessionDataOverride,
+		fmt.Sprintf(`SELECT statement_fingerprint, statement, collected_at, error, bundle_chunks%s
+			FROM system.statement_diagnostics WHERE id = $1`, extraColumns),
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, errors.Newf("no statement diagnostics found with id %d", id)
+	}
+	b := &StmtDiagBundle{
+		ID:          CollectedInstanceID(id),
+		Fingerprint: string(*row[0].(*tree.DString)),
+		Statement:   string(*row[1].(*tree.DString)),
+		CollectedAt: row[2].(*tree.DTimestampTZ).Time,
+	}
+	if collectionErr, ok := row[3].(*tree.DString); ok {
+		b.Error = string(*collectionErr)
+	}
+	if i, ok := colIdx["cpu_profile"]; ok {
+		if cpuProfile, ok := row[i].(*tree.DBytes); ok {
+			b.CPUProfile = []byte(*cpuProfile)
+		}
+	}
+	if i, ok := colIdx["error_message"]; ok {
+		if execErr, ok := row[i].(*tree.DString); ok {
+			b.ExecError = string(*execErr)
+		}
+	}
+	chunkIDs, ok := row[4].(*tree.DArray)
+	if !ok {
+		return b, nil
+	}
+	var zip bytes.Buffer
+	for _, chunkID := range chunkIDs.Array {
+		chunkRow, err := r.db.Executor().QueryRowEx(ctx, "stmt-diag-get-bundle-chunk", nil, /* txn */
+			sessiondata.RootUserSessionDataOverride,
+			"SELECT data FROM system.statement_bundle_chunks WHERE id = $1",
+			chunkID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if chunkRow == nil {
+			return nil, errors.Newf("bundle chunk %s of statement diagnostics %d not found", chunkID, id)
+		}
+		zip.WriteString(string(*chunkRow[0].(*tree.DBytes)))
+	}
+	if zip.Len() > 0 {
+		b.Zip = zip.Bytes()
+	}
+	return b, nil
+}
+
 // IsConditionSatisfied returns whether the completed request satisfies its
-// condition.
-func (r *Registry) IsConditionSatisfied(req Request, execLatency time.Duration) bool {
-	return req.minExecutionLatency <= execLatency
+// condition. execErr is the error returned by the statement, if any.
+func (r *Registry) IsConditionSatisfied(
+	req Request, execLatency time.Duration, execErr error,
+) bool {
+	return req.minExecutionLatency <= execLatency && (!req.captureOnError || execErr != nil)
 }
 
 // MaybeRemoveRequest checks whether the request needs to be removed from the
 // local Registry and removes it if so. Note that the registries on other nodes
 // will learn about it via polling of the system table.
-func (r *Registry) MaybeRemoveRequest(requestID RequestID, req Request, execLatency time.Duration) {
+func (r *Registry) MaybeRemoveRequest(
+	requestID RequestID, req Request, execLatency time.Duration, execErr error,
+) {
+	if requestID == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.collecting[requestID]--; r.mu.collecting[requestID] <= 0 {
+		delete(r.mu.collecting, requestID)
+	}
 	// We should remove the request from the registry if its condition is
 	// satisfied unless we want to continue collecting bundles for this request.
-	shouldRemove := r.IsConditionSatisfied(req, execLatency) && !req.continueCollecting(r.st)
+	shouldRemove := r.IsConditionSatisfied(req, execLatency, execErr) && !req.continueCollecting(r.st)
 	// Always remove the expired requests.
 	if shouldRemove || req.isExpired(timeutil.Now()) {
-		r.mu.Lock()
-		defer r.mu.Unlock()
 		if req.isConditional() {
 			delete(r.mu.requestFingerprints, requestID)
 		} else {
@@ -453,15 +1234,24 @@ func (r *Registry) ShouldCollectDiagnostics(
 		return false, 0, req
 	}
 
+	// There can be multiple requests for the fingerprint. The unconditional
+	// ones are serviced first: any execution satisfies them, whereas a
+	// conditional request may stay pending for a long time and would hold them
+	// back. Among the requests of the same kind, the oldest one, i.e. the one
+	// with the lowest ID, is serviced first.
+	now := timeutil.Now()
 	for id, f := range r.mu.requestFingerprints {
-		if f.fingerprint == fingerprint {
-			if f.isExpired(timeutil.Now()) {
-				delete(r.mu.requestFingerprints, id)
-				return false, 0, req
-			}
+		if !f.matches(fingerprint) {
+			continue
+		}
+		if f.isExpired(now) {
+			delete(r.mu.requestFingerprints, id)
+			continue
+		}
+		if reqID == 0 || (!f.isConditional() && req.isConditional()) ||
+			(f.isConditional() == req.isConditional() && id < reqID) {
 			reqID = id
 			req = f
-			break
 		}
 	}
 
@@ -478,11 +1268,23 @@ func (r *Registry) ShouldCollectDiagnostics(
 	}
 
 	if req.samplingProbability == 0 || r.mu.rand.Float64() < req.samplingProbability {
+		if r.mu.collecting == nil {
+			r.mu.collecting = make(map[RequestID]int)
+		}
+		r.mu.collecting[reqID]++
 		return true, reqID, req
 	}
 	return false, 0, Request{}
 }
 
+// formatExecError returns the representation of the error returned by a
+// statement that is stored in the error_message column of
+// system.statement_diagnostics: the message of the error, followed by its hint
+// and detail if any, and its SQLSTATE code.
+func formatExecError(err error) string {
+	return fmt.Sprintf("%s\nSQLSTATE: %s", pgerror.FullError(err), pgerror.GetPGCode(err))
+}
+
 // InsertStatementDiagnostics inserts a trace into system.statement_diagnostics.
 //
 // traceJSON is either DNull (when collectionErr should not be nil) or a *DJSON.
@@ -491,6 +1293,13 @@ func (r *Registry) ShouldCollectDiagnostics(
 // system.statement_diagnostics_requests. If requestID is zero, a new entry is
 // inserted.
 //
+// cpuProfile is the CPU profile captured while the statement executed, if the
+// request asked for one (see CPUProfile), or nil.
+//
+// execErr is the error returned by the statement, if it failed. It is stored in
+// the error_message column along with its SQLSTATE code, so that the bundles
+// of failed statements can be told apart without downloading them.
+//
 // collectionErr should be any error generated during the collection or
 // generation of the bundle/trace.
 func (r *Registry) InsertStatementDiagnostics(
@@ -500,6 +1309,8 @@ func (r *Registry) InsertStatementDiagnostics(
 	stmtFingerprint string,
 	stmt string,
 	bundle []byte,
+	cpuProfile []byte,
+	execErr error,
 	collectionErr error,
 ) (CollectedInstanceID, error) {
 	var diagID CollectedInstanceID
@@ -520,12 +1331,45 @@ func (r *Registry) InsertStatementDiagnostics(
 		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second) // nolint:context
 		defer cancel()
 	}
-	err := r.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+	// The limit of bundles per node is enforced with an in-memory count, since
+	// system.statement_diagnostics doesn't record which node collected a
+	// bundle. The bundle is reserved before the transaction, which may be
+	// retried.
+	if requestID != 0 {
+		if !r.reserveBundle(requestID, req) {
+			log.Infof(ctx, "not collecting statement bundle for request %d: "+
+				"node already collected %d bundles for it", requestID,
+				req.maxBundlesPerNode(r.st))
+			return 0, nil
+		}
+	}
+	// The ID of the bundle is chosen before inserting it, so that the attempts
+	// that follow an ambiguous commit find the row inserted by the previous
+	// attempt rather than inserting a duplicate bundle.
+	row, err := r.db.Executor().QueryRowEx(ctx, "stmt-diag-new-bundle-id", nil, /* txn */
+		sessiondata.RootUserSessionDataOverride, "SELECT unique_rowid()")
+	if err == nil && row == nil {
+		err = errors.New("failed to generate statement diagnostics ID")
+	}
+	if err != nil {
+		if requestID != 0 {
+			r.releaseBundle(requestID)
+		}
+		r.metrics.CollectionErrors.Inc(1)
+		return 0, err
+	}
+	newDiagID := CollectedInstanceID(*row[0].(*tree.DInt))
+	insert := func(ctx context.Context, txn isql.Txn) error {
+		diagID = 0
 		if requestID != 0 {
+			// The request may already be linked to the bundle if a previous
+			// attempt committed, in which case the insertion of the bundle below
+			// finds it.
 			row, err := txn.QueryRowEx(ctx, "stmt-diag-check-completed", txn.KV(),
 				sessiondata.RootUserSessionDataOverride,
-				"SELECT count(1) FROM system.statement_diagnostics_requests WHERE id = $1 AND completed = false",
-				requestID)
+				"SELECT count(1) FROM system.statement_diagnostics_requests "+
+					"WHERE id = $1 AND (completed = false OR statement_diagnostics_id = $2)",
+				requestID, newDiagID)
 			if err != nil {
 				return err
 			}
@@ -548,13 +1392,13 @@ func (r *Registry) InsertStatementDiagnostics(
 		}
 
 		bundleChunksVal := tree.NewDArray(types.Int)
-		for len(bundle) > 0 {
+		for remaining := bundle; len(remaining) > 0; {
 			chunkSize := int(bundleChunkSize.Get(&r.st.SV))
-			chunk := bundle
+			chunk := remaining
 			if len(chunk) > chunkSize {
 				chunk = chunk[:chunkSize]
 			}
-			bundle = bundle[len(chunk):]
+			remaining = remaining[len(chunk):]
 
 			// Insert the chunk into system.statement_bundle_chunks.
 			row, err := txn.QueryRowEx(
@@ -579,21 +1423,47 @@ func (r *Registry) InsertStatementDiagnostics(
 		collectionTime := timeutil.Now()
 
 		// Insert the collection metadata into system.statement_diagnostics.
-		row, err := txn.QueryRowEx(
+		insertColumns := "id, statement_fingerprint, statement, collected_at, bundle_chunks, error"
+		valuesClause := "$1, $2, $3, $4, $5, $6"
+		qargs := []interface{}{newDiagID, stmtFingerprint, stmt, collectionTime, bundleChunksVal, errorVal}
+		if len(cpuProfile) > 0 {
+			insertColumns += ", cpu_profile"
+			valuesClause += ", $7"
+			qargs = append(qargs, tree.NewDBytes(tree.DBytes(cpuProfile)))
+		}
+		if execErr != nil &&
+			r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsAddErrorMessage) {
+			insertColumns += ", error_message"
+			qargs = append(qargs, formatExecError(execErr))
+			valuesClause += fmt.Sprintf(", $%d", len(qargs))
+		}
+		trackSize := r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsAddBundleSize)
+		if trackSize {
+			insertColumns += ", bundle_size"
+			qargs = append(qargs, len(bundle))
+			valuesClause += fmt.Sprintf(", $%d", len(qargs))
+		}
+		n, err := txn.ExecEx(
 			ctx, "stmt-diag-insert", txn.KV(),
 			sessiondata.RootUserSessionDataOverride,
-			"INSERT INTO system.statement_diagnostics "+
-				"(statement_fingerprint, statement, collected_at, bundle_chunks, error) "+
-				"VALUES ($1, $2, $3, $4, $5) RETURNING id",
-			stmtFingerprint, stmt, collectionTime, bundleChunksVal, errorVal,
+			"INSERT INTO system.statement_diagnostics ("+insertColumns+") "+
+				"VALUES ("+valuesClause+") ON CONFLICT (id) DO NOTHING",
+			qargs...,
 		)
 		if err != nil {
 			return err
 		}
-		if row == nil {
-			return errors.New("failed to insert statement diagnostics")
+		if n == 0 {
+			// A previous attempt inserted the bundle. The chunks inserted above are
+			// rolled back along with the transaction.
+			return errBundleAlreadyInserted
+		}
+		diagID = newDiagID
+		if maxSize := maxTotalBundleSize.Get(&r.st.SV); trackSize && maxSize > 0 {
+			if err := deleteOldestBundlesTxn(ctx, txn, maxSize, diagID); err != nil {
+				return err
+			}
 		}
-		diagID = CollectedInstanceID(*row[0].(*tree.DInt))
 
 		if requestID != 0 {
 			// Link the request from system.statement_diagnostics_request to the
@@ -636,18 +1506,234 @@ func (r *Registry) InsertStatementDiagnostics(
 			}
 		}
 		return nil
-	})
+	}
+	// The transaction retries the serialization failures that it can handle on
+	// its own. The errors that escape it are retried with a backoff.
+	maxRetries := int(bundleInsertMaxRetries.Get(&r.st.SV))
+	for attempt := retry.StartWithCtx(ctx, retry.Options{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+	}); attempt.Next(); {
+		if attempt.CurrentAttempt() > 0 {
+			r.metrics.BundleRetries.Inc(1)
+			log.Warningf(ctx, "retrying the insertion of statement bundle after error: %v", err)
+		}
+		err = nil
+		if r.testingBeforeBundleInsert != nil {
+			err = r.testingBeforeBundleInsert()
+		}
+		if err == nil {
+			if err = r.db.Txn(ctx, insert); err == nil && r.testingAfterBundleInsert != nil {
+				err = r.testingAfterBundleInsert()
+			}
+		}
+		if errors.Is(err, errBundleAlreadyInserted) {
+			diagID, err = newDiagID, nil
+		}
+		if err == nil || attempt.CurrentAttempt() >= maxRetries ||
+			!isRetryableBundleInsertError(err) {
+			break
+		}
+	}
 	if err != nil {
+		if requestID != 0 {
+			r.releaseBundle(requestID)
+		}
+		r.metrics.CollectionErrors.Inc(1)
 		return 0, err
 	}
+	if diagID != 0 {
+		r.metrics.BundlesCollected.Inc(1)
+		if collectionErr != nil {
+			r.metrics.CollectionErrors.Inc(1)
+		}
+	} else if requestID != 0 {
+		// The request was already completed, so no bundle was inserted for it.
+		r.releaseBundle(requestID)
+	}
 	return diagID, nil
 }
 
+// requestInsertMaxRetries bounds the number of times insertRequestInternal
+// retries the insertion of a request whose commit was ambiguous.
+const requestInsertMaxRetries = 3
+
+// errBundleAlreadyInserted is returned by an attempt at inserting a bundle
+// that finds the bundle inserted by a previous attempt whose commit was
+// ambiguous.
+var errBundleAlreadyInserted = errors.New("statement bundle already inserted")
+
+// isRetryableBundleInsertError returns whether the insertion of a bundle that
+// failed with the given error should be retried. Serialization failures and
+// ambiguous results are retried: the ID of the bundle is chosen before the
+// first attempt, so the retry of an attempt that committed doesn't insert the
+// bundle again.
+func isRetryableBundleInsertError(err error) bool {
+	return errors.HasType(err, (*roachpb.TransactionRetryWithProtoRefreshError)(nil)) ||
+		pgerror.GetPGCode(err) == pgcode.SerializationFailure ||
+		errors.HasType(err, (*roachpb.AmbiguousResultError)(nil))
+}
+
+// deleteOldestBundlesTxn deletes the oldest bundles, other than the bundle
+// being inserted (newest), until the bundles take at most maxSize bytes. The
+// total is kept by the bundle_size column of system.statement_diagnostics,
+// which records the size of every bundle when it's inserted, so that the
+// bundles themselves aren't read; the bundles inserted before the column was
+// added don't count towards it. The completed requests that collected the
+// deleted bundles are deleted along with them, like `cockroach statement-diag
+// delete` does, while the pending ones are kept but no longer link to them.
+func deleteOldestBundlesTxn(
+	ctx context.Context, txn isql.Txn, maxSize int64, newest CollectedInstanceID,
+) error {
+	row, err := txn.QueryRowEx(ctx, "stmt-diag-total-bundle-size", txn.KV(),
+		sessiondata.RootUserSessionDataOverride,
+		"SELECT COALESCE(sum(bundle_size), 0)::INT8 FROM system.statement_diagnostics",
+	)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return errors.New("failed to compute the size of statement bundles")
+	}
+	excess := int64(*row[0].(*tree.DInt)) - maxSize
+	if excess <= 0 {
+		return nil
+	}
+
+	it, err := txn.QueryIteratorEx(ctx, "stmt-diag-bundle-sizes", txn.KV(),
+		sessiondata.RootUserSessionDataOverride,
+		`SELECT id, COALESCE(bundle_size, 0) FROM system.statement_diagnostics
+			WHERE id != $1 ORDER BY collected_at, id`,
+		newest,
+	)
+	if err != nil {
+		return err
+	}
+	ids := tree.NewDArray(types.Int)
+	var ok bool
+	for ok, err = it.Next(ctx); ok && excess > 0; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		if err := ids.Append(row[0]); err != nil {
+			_ = it.Close()
+			return err
+		}
+		excess -= int64(*row[1].(*tree.DInt))
+	}
+	if closeErr := it.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if ids.Len() == 0 {
+		return nil
+	}
+
+	for _, stmt := range []struct {
+		opName string
+		query  string
+	}{
+		{"stmt-diag-delete-completed-requests",
+			"DELETE FROM system.statement_diagnostics_requests " +
+				"WHERE completed AND statement_diagnostics_id = ANY ($1)"},
+		{"stmt-diag-unlink-pending-requests",
+			"UPDATE system.statement_diagnostics_requests SET statement_diagnostics_id = NULL " +
+				"WHERE statement_diagnostics_id = ANY ($1)"},
+		{"stmt-diag-delete-bundle-chunks",
+			"DELETE FROM system.statement_bundle_chunks WHERE id IN (" +
+				"SELECT unnest(bundle_chunks) FROM system.statement_diagnostics WHERE id = ANY ($1))"},
+		{"stmt-diag-delete-bundles",
+			"DELETE FROM system.statement_diagnostics WHERE id = ANY ($1)"},
+	} {
+		if _, err := txn.ExecEx(ctx, stmt.opName, txn.KV(),
+			sessiondata.RootUserSessionDataOverride, stmt.query, ids,
+		); err != nil {
+			return err
+		}
+	}
+	log.Infof(ctx, "deleted %d statement bundles to keep their total size under %s",
+		ids.Len(), humanizeutil.IBytes(maxSize))
+	return nil
+}
+
+// OnBundleCollected registers a function that is called for every bundle
+// collected by this node for a diagnostics request, once it has been stored
+// (see BundleCollected). It isn't called for the bundles of EXPLAIN ANALYZE
+// (DEBUG).
+func (r *Registry) OnBundleCollected(f func(ctx context.Context, b *Bundle)) {
+	r.bundleHooks.Lock()
+	defer r.bundleHooks.Unlock()
+	r.bundleHooks.hooks = append(r.bundleHooks.hooks, f)
+}
+
+// BundleCollected is called once a bundle has been collected and stored. It
+// runs the functions registered with OnBundleCollected, one after the other,
+// in an async task.
+func (r *Registry) BundleCollected(ctx context.Context, b *Bundle) {
+	r.bundleHooks.Lock()
+	hooks := r.bundleHooks.hooks
+	r.bundleHooks.Unlock()
+	if r.stopper == nil {
+		return
+	}
+	// The statement's context is likely to be canceled before the hooks are
+	// done, so we don't inherit its cancellation.
+	ctx = logtags.WithTags(context.Background(), logtags.FromContext(ctx)) // nolint:context
+	if err := r.stopper.RunAsyncTask(ctx, "stmt-diag-bundle-collected", func(ctx context.Context) {
+		ctx, cancel := r.stopper.WithCancelOnQuiesce(ctx)
+		defer cancel()
+		for _, f := range hooks {
+			f(ctx, b)
+		}
+	}); err != nil {
+		log.Warningf(ctx, "failed to run statement bundle hooks: %v", err)
+	}
+}
+
+// setBundleURL records the URL of the copy of a bundle in external storage in
+// the bundle_url column of system.statement_diagnostics.
+func (r *Registry) setBundleURL(ctx context.Context, id CollectedInstanceID, u string) error {
+	if !r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsAddBundleURL) {
+		return errors.New("system.statement_diagnostics.bundle_url is not available " +
+			"until the cluster version upgrade is finalized")
+	}
+	_, err := r.db.Executor().ExecEx(ctx, "stmt-diag-set-bundle-url", nil, /* txn */
+		sessiondata.RootUserSessionDataOverride,
+		"UPDATE system.statement_diagnostics SET bundle_url = $1 WHERE id = $2",
+		u, id,
+	)
+	return err
+}
+
+// requestedBy returns the user that inserted the request with the given ID, as
+// recorded in the requested_by column of system.statement_diagnostics_requests.
+// The user is undefined if the request was inserted by an internal caller or
+// before the column existed.
+func (r *Registry) requestedBy(ctx context.Context, id RequestID) (username.SQLUsername, error) {
+	if !r.st.Version.IsActive(ctx, clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddRequestedBy) {
+		return username.SQLUsername{}, nil
+	}
+	row, err := r.db.Executor().QueryRowEx(ctx, "stmt-diag-get-requested-by", nil, /* txn */
+		sessiondata.RootUserSessionDataOverride,
+		"SELECT requested_by FROM system.statement_diagnostics_requests WHERE id = $1",
+		id,
+	)
+	if err != nil {
+		return username.SQLUsername{}, err
+	}
+	if row == nil || row[0] == tree.DNull {
+		return username.SQLUsername{}, nil
+	}
+	return username.MakeSQLUsernameFromPreNormalizedString(string(tree.MustBeDString(row[0]))), nil
+}
+
 // pollRequests reads the pending rows from system.statement_diagnostics_requests and
 // updates r.mu.requests accordingly.
 func (r *Registry) pollRequests(ctx context.Context) error {
+	r.metrics.PollIterations.Inc(1)
 	var rows []tree.Datums
-	isSamplingProbabilitySupported := r.st.Version.IsActive(ctx, clusterversion.V22_2SampledStmtDiagReqs)
+	extraColumns, colIdx := r.optionalColumns(ctx, optionalRequestColumns, 4 /* numFixedColumns */)
 
 	// Loop until we run the query without straddling an epoch increment.
 	for {
@@ -655,24 +1741,42 @@ func (r *Registry) pollRequests(ctx context.Context) error {
 		epoch := r.mu.epoch
 		r.mu.Unlock()
 
-		var extraColumns string
-		if isSamplingProbabilitySupported {
-			extraColumns = ", sampling_probability"
-		}
-		it, err := r.db.Executor().QueryIteratorEx(ctx, "stmt-diag-poll", nil, /* txn */
-			sessiondata.RootUserSessionDataOverride,
-			fmt.Sprintf(`SELECT id, statement_fingerprint, min_execution_latency, expires_at%s
-				FROM system.statement_diagnostics_requests
-				WHERE completed = false AND (expires_at IS NULL OR expires_at > now())`, extraColumns),
-		)
-		if err != nil {
+		// Every attempt gets its own timeout, so that the retries when the epoch
+		// changes don't run out of time.
+		start := timeutil.Now()
+		timeout := pollTimeout.Get(&r.st.SV)
+		err := func() (err error) {
+			queryCtx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				queryCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			defer func() {
+				if err != nil && queryCtx.Err() != nil && ctx.Err() == nil {
+					// The caller logs the error and polls again after the polling
+					// interval.
+					err = errors.Wrapf(queryCtx.Err(), "reading statement diagnostics "+
+						"requests timed out after %s (sql.stmt_diagnostics.poll_timeout is %s)",
+						timeutil.Since(start), timeout)
+				}
+			}()
+			it, err := r.db.Executor().QueryIteratorEx(queryCtx, "stmt-diag-poll", nil, /* txn */
+				sessiondata.RootUserSessionDataOverride,
+				fmt.Sprintf(`SELECT id, statement_fingerprint, min_execution_latency, expires_at%s
+					FROM system.statement_diagnostics_requests
+					WHERE completed = false AND (expires_at IS NULL OR expires_at > now())`, extraColumns),
+			)
+			if err != nil {
+				return err
+			}
+			rows = rows[:0]
+			var ok bool
+			for ok, err = it.Next(queryCtx); ok; ok, err = it.Next(queryCtx) {
+				rows = append(rows, it.Cur())
+			}
 			return err
-		}
-		rows = rows[:0]
-		var ok bool
-		for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
-			rows = append(rows, it.Cur())
-		}
+		}()
 		if err != nil {
 			return err
 		}
@@ -697,6 +1801,11 @@ func (r *Registry) pollRequests(ctx context.Context) error {
 		var minExecutionLatency time.Duration
 		var expiresAt time.Time
 		var samplingProbability float64
+		patternType := PatternExact
+		var captureCPUProfile bool
+		var minSpanDuration time.Duration
+		var captureOnError bool
+		var maxBundles int
 
 		if minExecLatency, ok := row[2].(*tree.DInterval); ok {
 			minExecutionLatency = time.Duration(minExecLatency.Nanos())
@@ -704,8 +1813,8 @@ func (r *Registry) pollRequests(ctx context.Context) error {
 		if e, ok := row[3].(*tree.DTimestampTZ); ok {
 			expiresAt = e.Time
 		}
-		if isSamplingProbabilitySupported {
-			if prob, ok := row[4].(*tree.DFloat); ok {
+		if i, ok := colIdx["sampling_probability"]; ok {
+			if prob, ok := row[i].(*tree.DFloat); ok {
 				samplingProbability = float64(*prob)
 				if samplingProbability < 0 || samplingProbability > 1 {
 					log.Warningf(ctx, "malformed sampling probability for request %d: %f (expected in range [0, 1]), resetting to 1.0",
@@ -714,8 +1823,33 @@ func (r *Registry) pollRequests(ctx context.Context) error {
 				}
 			}
 		}
+		if i, ok := colIdx["pattern_type"]; ok {
+			if p, ok := row[i].(*tree.DString); ok {
+				patternType = PatternType(*p)
+			}
+		}
+		if i, ok := colIdx["capture_cpu_profile"]; ok {
+			if capture, ok := row[i].(*tree.DBool); ok {
+				captureCPUProfile = bool(*capture)
+			}
+		}
+		if i, ok := colIdx["min_span_duration"]; ok {
+			if d, ok := row[i].(*tree.DInterval); ok {
+				minSpanDuration = time.Duration(d.Nanos())
+			}
+		}
+		if i, ok := colIdx["capture_on_error"]; ok {
+			if capture, ok := row[i].(*tree.DBool); ok {
+				captureOnError = bool(*capture)
+			}
+		}
+		if i, ok := colIdx["max_bundles"]; ok {
+			if n, ok := row[i].(*tree.DInt); ok {
+				maxBundles = int(*n)
+			}
+		}
 		ids.Add(int(id))
-		r.addRequestInternalLocked(ctx, id, stmtFingerprint, samplingProbability, minExecutionLatency, expiresAt)
+		r.addRequestInternalLocked(ctx, id, stmtFingerprint, patternType, captureCPUProfile, samplingProbability, minExecutionLatency, minSpanDuration, captureOnError, maxBundles, expiresAt)
 	}
 
 	// Remove all other requests.
@@ -724,5 +1858,11 @@ func (r *Registry) pollRequests(ctx context.Context) error {
 			delete(r.mu.requestFingerprints, id)
 		}
 	}
+	// Forget the bundles collected for the requests that are no longer pending.
+	for id := range r.mu.collectedBundles {
+		if !ids.Contains(int(id)) {
+			delete(r.mu.collectedBundles, id)
+		}
+	}
 	return nil
 }
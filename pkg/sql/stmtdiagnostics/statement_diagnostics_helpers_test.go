@@ -31,9 +31,195 @@ func (r *Registry) InsertRequestInternal(
 	minExecutionLatency time.Duration,
 	expiresAfter time.Duration,
 ) (int64, error) {
-	id, err := r.insertRequestInternal(ctx, fprint, samplingProbability, minExecutionLatency, expiresAfter)
+	id, err := r.insertRequestInternal(ctx, fprint, StmtDiagRequestOptions{
+		MinLatency:   minExecutionLatency,
+		SamplingRate: samplingProbability,
+		ExpiresAfter: expiresAfter,
+	})
 	return int64(id), err
 }
 
+// InsertRequestWithOptionsInternal is like InsertRequestInternal, for requests
+// described by options.
+func (r *Registry) InsertRequestWithOptionsInternal(
+	ctx context.Context, fprint string, opts StmtDiagRequestOptions,
+) (int64, error) {
+	id, err := r.insertRequestInternal(ctx, fprint, opts)
+	return int64(id), err
+}
+
+// TestingCollectedBundles returns the number of bundles that this node
+// collected for the request.
+func (r *Registry) TestingCollectedBundles(requestID int64) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.collectedBundles[RequestID(requestID)]
+}
+
+// TestingDeleteExpiredRequests exposes deleteExpiredRequests to tests.
+func (r *Registry) TestingDeleteExpiredRequests(ctx context.Context) error {
+	return r.deleteExpiredRequests(ctx)
+}
+
 // PollingInterval is exposed to override in tests.
 var PollingInterval = pollingInterval
+
+// PollTimeout is exposed to override in tests.
+var PollTimeout = pollTimeout
+
+// TestingSetBeforeBundleInsert sets a function that is called before every
+// attempt at inserting a bundle, which fails with the error it returns, if any.
+// It returns a function that unsets it.
+func (r *Registry) TestingSetBeforeBundleInsert(f func() error) func() {
+	r.testingBeforeBundleInsert = f
+	return func() { r.testingBeforeBundleInsert = nil }
+}
+
+// TestingSetAfterBundleInsert sets a function that is called after every
+// committed attempt at inserting a bundle, which fails with the error it
+// returns, if any. It returns a function that unsets it.
+func (r *Registry) TestingSetAfterBundleInsert(f func() error) func() {
+	r.testingAfterBundleInsert = f
+	return func() { r.testingAfterBundleInsert = nil }
+}
+
+// TestingSetAfterRequestInsert sets a function that is called after every
+// committed attempt at inserting a request, which fails with the error it
+// returns, if any. It returns a function that unsets it.
+func (r *Registry) TestingSetAfterRequestInsert(f func() error) func() {
+	r.testingAfterRequestInsert = f
+	return func() { r.testingAfterRequestInsert = nil }
+}
+
+// TestingPollRequests exposes pollRequests to tests.
+func (r *Registry) TestingPollRequests(ctx context.Context) error {
+	return r.pollRequests(ctx)
+}
+
+// TestingSetSheetsAPIURL overrides the base URL of the Google Sheets API. It
+// returns a function that restores the original URL.
+func TestingSetSheetsAPIURL(u string) func() {
+	old := sheetsAPIURL
+	sheetsAPIURL = u
+	return func() { sheetsAPIURL = old }
+}
+
+// TestingSetAirtableAPIURL overrides the base URL of the Airtable API. It
+// returns a function that restores the original URL.
+func TestingSetAirtableAPIURL(u string) func() {
+	old := airtableAPIURL
+	airtableAPIURL = u
+	return func() { airtableAPIURL = old }
+}
+
+// TestingSetNotionAPIURL overrides the base URL of the Notion API. It returns a
+// function that restores the original URL.
+func TestingSetNotionAPIURL(u string) func() {
+	old := notionAPIURL
+	notionAPIURL = u
+	return func() { notionAPIURL = old }
+}
+
+// TestingSetLinearAPIURL overrides the URL of the Linear API. It returns a
+// function that restores the original URL.
+func TestingSetLinearAPIURL(u string) func() {
+	old := linearAPIURL
+	linearAPIURL = u
+	return func() { linearAPIURL = old }
+}
+
+// TestingSetOpsGenieAPIURL overrides the base URL of the OpsGenie API. It
+// returns a function that restores the original URL.
+func TestingSetOpsGenieAPIURL(u string) func() {
+	old := opsGenieAPIURL
+	opsGenieAPIURL = u
+	return func() { opsGenieAPIURL = old }
+}
+
+// TestingSetRaygunAPIURL overrides the base URL of the Raygun API. It returns a
+// function that restores the original URL.
+func TestingSetRaygunAPIURL(u string) func() {
+	old := raygunAPIURL
+	raygunAPIURL = u
+	return func() { raygunAPIURL = old }
+}
+
+// TestingSetHoneybadgerAPIURL overrides the base URL of the Honeybadger API. It
+// returns a function that restores the original URL.
+func TestingSetHoneybadgerAPIURL(u string) func() {
+	old := honeybadgerAPIURL
+	honeybadgerAPIURL = u
+	return func() { honeybadgerAPIURL = old }
+}
+
+// TestingSetRollbarAPIURL overrides the base URL of the Rollbar API. It returns
+// a function that restores the original URL.
+func TestingSetRollbarAPIURL(u string) func() {
+	old := rollbarAPIURL
+	rollbarAPIURL = u
+	return func() { rollbarAPIURL = old }
+}
+
+// TestingSetAirbrakeAPIURL overrides the base URL of the Airbrake API. It
+// returns a function that restores the original URL.
+func TestingSetAirbrakeAPIURL(u string) func() {
+	old := airbrakeAPIURL
+	airbrakeAPIURL = u
+	return func() { airbrakeAPIURL = old }
+}
+
+// TestingSetLogRocketAPIURL overrides the base URL of the LogRocket API. It
+// returns a function that restores the original URL.
+func TestingSetLogRocketAPIURL(u string) func() {
+	old := logRocketAPIURL
+	logRocketAPIURL = u
+	return func() { logRocketAPIURL = old }
+}
+
+// TestingSetMixpanelAPIURL overrides the base URL of the Mixpanel ingestion
+// API. It returns a function that restores the original URL.
+func TestingSetMixpanelAPIURL(u string) func() {
+	old := mixpanelAPIURL
+	mixpanelAPIURL = u
+	return func() { mixpanelAPIURL = old }
+}
+
+// TestingSetAmplitudeAPIURL overrides the base URL of the Amplitude HTTP API.
+// It returns a function that restores the original URL.
+func TestingSetAmplitudeAPIURL(u string) func() {
+	old := amplitudeAPIURL
+	amplitudeAPIURL = u
+	return func() { amplitudeAPIURL = old }
+}
+
+// TestingSetHeapAPIURL overrides the base URL of the Heap server-side API. It
+// returns a function that restores the original URL.
+func TestingSetHeapAPIURL(u string) func() {
+	old := heapAPIURL
+	heapAPIURL = u
+	return func() { heapAPIURL = old }
+}
+
+// TestingSetTwilioAPIURL overrides the base URL of the Twilio REST API. It
+// returns a function that restores the original URL.
+func TestingSetTwilioAPIURL(u string) func() {
+	old := twilioAPIURL
+	twilioAPIURL = u
+	return func() { twilioAPIURL = old }
+}
+
+// TestingSetTelegramAPIURL overrides the base URL of the Telegram Bot API. It
+// returns a function that restores the original URL.
+func TestingSetTelegramAPIURL(u string) func() {
+	old := telegramAPIURL
+	telegramAPIURL = u
+	return func() { telegramAPIURL = old }
+}
+
+// TestingSetPagerDutyEventsURL overrides the URL of the PagerDuty Events API
+// v2. It returns a function that restores the original URL.
+func TestingSetPagerDutyEventsURL(u string) func() {
+	old := pagerDutyEventsURL
+	pagerDutyEventsURL = u
+	return func() { pagerDutyEventsURL = old }
+}
@@ -11,25 +11,35 @@
 package stmtdiagnostics_test
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
 	gosql "database/sql"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/cloud/externalconn"
+	"github.com/cockroachdb/cockroach/pkg/cloud/externalconn/connectionpb"
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/kv/kvserver"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlerrors"
 	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
@@ -97,6 +107,11 @@ func TestDiagnosticsRequest(t *testing.T) {
 			fmt.Sprintf("SET CLUSTER SETTING sql.stmt_diagnostics.poll_interval = '%s'", d))
 		require.NoError(t, err)
 	}
+	setMaxBundlesPerNode := func(n int) {
+		_, err := db.Exec(
+			fmt.Sprintf("SET CLUSTER SETTING sql.stmt_diagnostics.max_bundles_per_node_per_request = %d", n))
+		require.NoError(t, err)
+	}
 
 	var minExecutionLatency, expiresAfter time.Duration
 	var samplingProbability float64
@@ -116,6 +131,36 @@ func TestDiagnosticsRequest(t *testing.T) {
 		checkCompleted(reqID)
 	})
 
+	// Verify that the metrics of the registry track the requests, bundles and
+	// polls.
+	t.Run("metrics", func(t *testing.T) {
+		metrics := registry.Metrics()
+		requestsTotal := metrics.RequestsTotal.Count()
+		bundlesCollected := metrics.BundlesCollected.Count()
+		pending := metrics.RequestsPending.Value()
+
+		reqID, err := registry.InsertRequestInternal(ctx, "SELECT x FROM test WHERE x = _", samplingProbability, minExecutionLatency, expiresAfter)
+		require.NoError(t, err)
+		require.Equal(t, requestsTotal+1, metrics.RequestsTotal.Count())
+		require.Equal(t, pending+1, metrics.RequestsPending.Value())
+
+		_, err = db.Exec("SELECT x FROM test WHERE x = 1")
+		require.NoError(t, err)
+		checkCompleted(reqID)
+		require.Equal(t, bundlesCollected+1, metrics.BundlesCollected.Count())
+		require.Equal(t, pending, metrics.RequestsPending.Value())
+
+		pollIterations := metrics.PollIterations.Count()
+		setPollInterval(10 * time.Millisecond)
+		defer setPollInterval(stmtdiagnostics.PollingInterval.Default())
+		testutils.SucceedsSoon(t, func() error {
+			if metrics.PollIterations.Count() == pollIterations {
+				return errors.New("registry hasn't polled yet")
+			}
+			return nil
+		})
+	})
+
 	// Verify that we can handle multiple requests at the same time.
 	t.Run("multiple", func(t *testing.T) {
 		id1, err := registry.InsertRequestInternal(ctx, "INSERT INTO test VALUES (_)", samplingProbability, minExecutionLatency, expiresAfter)
@@ -139,6 +184,44 @@ func TestDiagnosticsRequest(t *testing.T) {
 		checkCompleted(id1)
 	})
 
+	// Verify that there can be multiple requests for the same fingerprint, and
+	// that they are satisfied from the oldest to the newest.
+	t.Run("multiple for the same fingerprint", func(t *testing.T) {
+		const fprint = "SELECT x FROM test WHERE x < _"
+		var ids []int64
+		for i := 0; i < 3; i++ {
+			id, err := registry.InsertRequestInternal(ctx, fprint, samplingProbability, minExecutionLatency, expiresAfter)
+			require.NoError(t, err)
+			ids = append(ids, id)
+		}
+		for i := range ids {
+			_, err := db.Exec("SELECT x FROM test WHERE x < 1")
+			require.NoError(t, err)
+			for j, id := range ids {
+				if j <= i {
+					checkCompleted(id)
+				} else {
+					checkNotCompleted(id)
+				}
+			}
+		}
+	})
+
+	// Verify that an older conditional request doesn't hold back the
+	// unconditional requests for the same fingerprint.
+	t.Run("conditional and unconditional for the same fingerprint", func(t *testing.T) {
+		const fprint = "SELECT x FROM test WHERE x <= _"
+		conditionalID, err := registry.InsertRequestInternal(ctx, fprint, samplingProbability, time.Hour /* minExecutionLatency */, expiresAfter)
+		require.NoError(t, err)
+		unconditionalID, err := registry.InsertRequestInternal(ctx, fprint, samplingProbability, minExecutionLatency, expiresAfter)
+		require.NoError(t, err)
+		_, err = db.Exec("SELECT x FROM test WHERE x <= 1")
+		require.NoError(t, err)
+		checkCompleted(unconditionalID)
+		checkNotCompleted(conditionalID)
+		require.NoError(t, registry.CancelRequest(ctx, conditionalID))
+	})
+
 	// Verify that EXECUTE triggers diagnostics collection (#66048).
 	t.Run("execute", func(t *testing.T) {
 		id, err := registry.InsertRequestInternal(ctx, "SELECT x + $1 FROM test", samplingProbability, minExecutionLatency, expiresAfter)
@@ -150,6 +233,160 @@ func TestDiagnosticsRequest(t *testing.T) {
 		checkCompleted(id)
 	})
 
+	// Verify that requests can match a family of fingerprints.
+	t.Run("patterns", func(t *testing.T) {
+		globID, err := registry.InsertRequestWithOptionsInternal(
+			ctx, "SELECT x FROM test WHERE x ? *",
+			stmtdiagnostics.StmtDiagRequestOptions{PatternType: stmtdiagnostics.PatternGlob},
+		)
+		require.NoError(t, err)
+		regexpID, err := registry.InsertRequestWithOptionsInternal(
+			ctx, `WHERE x IN \(`,
+			stmtdiagnostics.StmtDiagRequestOptions{PatternType: stmtdiagnostics.PatternRegexp},
+		)
+		require.NoError(t, err)
+
+		// The glob has to match the whole fingerprint.
+		_, err = db.Exec("SELECT x FROM test WHERE x >= 1")
+		require.NoError(t, err)
+		_, err = db.Exec("SELECT x + 1 FROM test WHERE x = 1")
+		require.NoError(t, err)
+		checkNotCompleted(globID)
+		_, err = db.Exec("SELECT x FROM test WHERE x = 1 / 2")
+		require.NoError(t, err)
+		checkCompleted(globID)
+
+		// The regexp only has to match a part of it.
+		checkNotCompleted(regexpID)
+		_, err = db.Exec("SELECT x FROM test WHERE x IN (1, 2)")
+		require.NoError(t, err)
+		checkCompleted(regexpID)
+
+		_, err = registry.InsertRequestWithOptionsInternal(
+			ctx, "SELECT (",
+			stmtdiagnostics.StmtDiagRequestOptions{PatternType: stmtdiagnostics.PatternRegexp},
+		)
+		require.Error(t, err)
+		_, err = registry.InsertRequestWithOptionsInternal(
+			ctx, "SELECT _", stmtdiagnostics.StmtDiagRequestOptions{PatternType: "like"},
+		)
+		require.Error(t, err)
+	})
+
+	// Verify that a CPU profile is captured along with the bundle, and that only
+	// one request capturing a CPU profile can be pending at a time.
+	t.Run("cpu profile", func(t *testing.T) {
+		id, err := registry.InsertRequestWithOptionsInternal(
+			ctx, "SELECT count(*) FROM test",
+			stmtdiagnostics.StmtDiagRequestOptions{CaptureCPUProfile: true},
+		)
+		require.NoError(t, err)
+		_, err = registry.InsertRequestWithOptionsInternal(
+			ctx, "SELECT max(x) FROM test",
+			stmtdiagnostics.StmtDiagRequestOptions{CaptureCPUProfile: true},
+		)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "already pending")
+
+		_, err = db.Exec("SELECT count(*) FROM test")
+		require.NoError(t, err)
+		checkCompleted(id)
+		var cpuProfile []byte
+		require.NoError(t, db.QueryRow(
+			"SELECT cpu_profile FROM system.statement_diagnostics AS d "+
+				"JOIN system.statement_diagnostics_requests AS r ON r.statement_diagnostics_id = d.id "+
+				"WHERE r.id = $1", id,
+		).Scan(&cpuProfile))
+		require.NotEmpty(t, cpuProfile)
+
+		// Now that the request is completed, another one can be inserted.
+		id, err = registry.InsertRequestWithOptionsInternal(
+			ctx, "SELECT max(x) FROM test",
+			stmtdiagnostics.StmtDiagRequestOptions{CaptureCPUProfile: true},
+		)
+		require.NoError(t, err)
+		require.NoError(t, registry.CancelRequest(ctx, id))
+	})
+
+	// Verify that the minimum span duration is persisted along with the request,
+	// and that a bundle is still collected when it drops most of the trace.
+	t.Run("min span duration", func(t *testing.T) {
+		_, err := registry.InsertRequestWithOptionsInternal(
+			ctx, "SELECT x FROM test WHERE x > _",
+			stmtdiagnostics.StmtDiagRequestOptions{MinSpanDuration: -time.Second},
+		)
+		require.Error(t, err)
+		id, err := registry.InsertRequestWithOptionsInternal(
+			ctx, "SELECT x FROM test WHERE x > _",
+			stmtdiagnostics.StmtDiagRequestOptions{MinSpanDuration: time.Hour},
+		)
+		require.NoError(t, err)
+		var minSpanDuration string
+		require.NoError(t, db.QueryRow(
+			"SELECT min_span_duration::STRING FROM system.statement_diagnostics_requests WHERE id = $1", id,
+		).Scan(&minSpanDuration))
+		require.Equal(t, "01:00:00", minSpanDuration)
+
+		_, err = db.Exec("SELECT x FROM test WHERE x > 1")
+		require.NoError(t, err)
+		checkCompleted(id)
+	})
+
+	// Verify that a bundle is collected for a failed statement, and that its
+	// error is stored along with the bundle.
+	t.Run("error message", func(t *testing.T) {
+		id, err := registry.InsertRequestInternal(
+			ctx, "SELECT crdb_internal.force_error('_', '_')",
+			samplingProbability, minExecutionLatency, expiresAfter,
+		)
+		require.NoError(t, err)
+		_, err = db.Exec("SELECT crdb_internal.force_error('22012', 'boom')")
+		require.Error(t, err)
+		checkCompleted(id)
+		var errorMessage string
+		require.NoError(t, db.QueryRow(
+			"SELECT error_message FROM system.statement_diagnostics AS d "+
+				"JOIN system.statement_diagnostics_requests AS r ON r.statement_diagnostics_id = d.id "+
+				"WHERE r.id = $1", id,
+		).Scan(&errorMessage))
+		require.Equal(t, "ERROR: boom\nSQLSTATE: 22012", errorMessage)
+	})
+
+	// Verify that the options of a request are persisted, and that a request
+	// capturing errors is only satisfied by a failed execution.
+	t.Run("options", func(t *testing.T) {
+		_, err := registry.InsertRequestWithOptionsInternal(
+			ctx, "INSERT INTO test VALUES (_)", stmtdiagnostics.StmtDiagRequestOptions{MaxBundles: -1},
+		)
+		require.Error(t, err)
+		id, err := registry.InsertRequestWithOptionsInternal(
+			ctx, "INSERT INTO test VALUES (_)", stmtdiagnostics.StmtDiagRequestOptions{
+				CaptureOnError: true,
+				MaxBundles:     2,
+			},
+		)
+		require.NoError(t, err)
+		reqs, err := registry.ListRequests(ctx)
+		require.NoError(t, err)
+		var found bool
+		for _, req := range reqs {
+			if req.ID == stmtdiagnostics.RequestID(id) {
+				found = true
+				require.True(t, req.CaptureOnError)
+				require.Equal(t, 2, req.MaxBundles)
+			}
+		}
+		require.True(t, found)
+
+		_, err = db.Exec("INSERT INTO test VALUES (12345)")
+		require.NoError(t, err)
+		checkNotCompleted(id)
+		// The second insertion violates the primary key.
+		_, err = db.Exec("INSERT INTO test VALUES (12345)")
+		require.Error(t, err)
+		checkCompleted(id)
+	})
+
 	// Verify that if the traced query times out, the bundle is still saved.
 	t.Run("timeout", func(t *testing.T) {
 		reqID, err := registry.InsertRequestInternal(ctx, "SELECT pg_sleep(_)", samplingProbability, minExecutionLatency, expiresAfter)
@@ -243,7 +480,82 @@ func TestDiagnosticsRequest(t *testing.T) {
 	// Verify that an error is returned when attempting to cancel non-existent
 	// request.
 	t.Run("cancel non-existent request", func(t *testing.T) {
-		require.NotNil(t, registry.CancelRequest(ctx, 123456789))
+		require.EqualError(t, registry.CancelRequest(ctx, 123456789), "no pending request found with id 123456789")
+	})
+
+	// Verify that deleting a request removes it along with its bundle, and that
+	// requests collecting a bundle cannot be deleted.
+	t.Run("delete request", func(t *testing.T) {
+		require.EqualError(t, registry.DeleteRequest(ctx, 123456789), "no request found with id 123456789")
+
+		reqID, err := registry.InsertRequestInternal(ctx, "SELECT pg_sleep(_)", samplingProbability, minExecutionLatency, expiresAfter)
+		require.NoError(t, err)
+		checkNotCompleted(reqID)
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := db.Exec("SELECT pg_sleep(1)")
+			errCh <- err
+		}()
+		testutils.SucceedsSoon(t, func() error {
+			if !registry.IsOngoing(stmtdiagnostics.RequestID(reqID)) {
+				return errors.New("request is not ongoing yet")
+			}
+			return nil
+		})
+		var ongoingErr *stmtdiagnostics.RequestOngoingError
+		require.True(t, errors.As(registry.DeleteRequest(ctx, reqID), &ongoingErr))
+		require.Equal(t, stmtdiagnostics.RequestID(reqID), ongoingErr.RequestID)
+		require.NoError(t, <-errCh)
+		checkCompleted(reqID)
+
+		_, diagnosticsID := isCompleted(reqID)
+		require.NoError(t, registry.DeleteRequest(ctx, reqID))
+		require.False(t, registry.TestingFindRequest(reqID))
+		var count int
+		require.NoError(t, db.QueryRow(
+			"SELECT count(*) FROM system.statement_diagnostics_requests WHERE id = $1", reqID,
+		).Scan(&count))
+		require.Zero(t, count)
+		require.NoError(t, db.QueryRow(
+			"SELECT count(*) FROM system.statement_diagnostics WHERE id = $1", diagnosticsID.Int64,
+		).Scan(&count))
+		require.Zero(t, count)
+	})
+
+	// Verify that a conditional request is ongoing, and cannot be deleted, while
+	// a statement is traced for it, even though the bundle is only kept once
+	// the statement turns out to satisfy the condition.
+	t.Run("delete conditional request", func(t *testing.T) {
+		reqID, err := registry.InsertRequestInternal(ctx, "SELECT pg_sleep(_) AS x",
+			0 /* samplingProbability */, 100*time.Millisecond /* minExecutionLatency */, 0 /* expiresAfter */)
+		require.NoError(t, err)
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := db.Exec("SELECT pg_sleep(1) AS x")
+			errCh <- err
+		}()
+		testutils.SucceedsSoon(t, func() error {
+			if !registry.IsOngoing(stmtdiagnostics.RequestID(reqID)) {
+				return errors.New("request is not ongoing yet")
+			}
+			return nil
+		})
+		liveStatus := func() (status string) {
+			require.NoError(t, db.QueryRow(
+				"SELECT status FROM crdb_internal.statement_diagnostics_requests_live WHERE id = $1", reqID,
+			).Scan(&status))
+			return status
+		}
+		require.Equal(t, "ongoing", liveStatus())
+		var ongoingErr *stmtdiagnostics.RequestOngoingError
+		require.True(t, errors.As(registry.DeleteRequest(ctx, reqID), &ongoingErr))
+		require.NoError(t, <-errCh)
+		checkCompleted(reqID)
+		require.False(t, registry.IsOngoing(stmtdiagnostics.RequestID(reqID)))
+		require.Equal(t, "completed", liveStatus())
+		require.NoError(t, registry.DeleteRequest(ctx, reqID))
 	})
 
 	// Verify that if a request (either conditional or unconditional, w/ or w/o
@@ -414,6 +726,8 @@ func TestDiagnosticsRequest(t *testing.T) {
 
 		setCollectUntilExpiration(true)
 		defer setCollectUntilExpiration(false)
+		setMaxBundlesPerNode(100)
+		defer setMaxBundlesPerNode(1)
 
 		var firstDiagnosticID int64
 		testutils.SucceedsSoon(t, func() error {
@@ -466,6 +780,113 @@ func TestDiagnosticsRequest(t *testing.T) {
 		require.NoError(t, err)
 		checkNotCompleted(reqID)
 	})
+
+	countBundles := func(fingerprint string) (n int) {
+		require.NoError(t, db.QueryRow(
+			"SELECT count(*) FROM system.statement_diagnostics WHERE statement_fingerprint = $1",
+			fingerprint,
+		).Scan(&n))
+		return n
+	}
+
+	t.Run("continuous capture up to the default limit per node", func(t *testing.T) {
+		samplingProbability, minExecutionLatency, expiresAfter := 0.9999, time.Microsecond, time.Hour
+		reqID, err := registry.InsertRequestInternal(
+			ctx, "SELECT pg_sleep(_), _, _", samplingProbability, minExecutionLatency, expiresAfter,
+		)
+		require.NoError(t, err)
+
+		setCollectUntilExpiration(true)
+		defer setCollectUntilExpiration(false)
+
+		testutils.SucceedsSoon(t, func() error {
+			_, err := db.Exec("SELECT pg_sleep(0.01), 1, 2") // run the query
+			require.NoError(t, err)
+			if n := countBundles("SELECT pg_sleep(_), _, _"); n < 1 {
+				return errors.New("waiting to capture a bundle")
+			}
+			return nil
+		})
+		for i := 0; i < 5; i++ {
+			_, err := db.Exec("SELECT pg_sleep(0.01), 1, 2") // run the query
+			require.NoError(t, err)
+		}
+		require.Equal(t, 1, countBundles("SELECT pg_sleep(_), _, _"))
+		completed, _ := isCompleted(reqID)
+		require.False(t, completed)
+
+		require.NoError(t, registry.CancelRequest(ctx, reqID))
+	})
+
+	t.Run("continuous capture up to the limit per node", func(t *testing.T) {
+		samplingProbability, minExecutionLatency, expiresAfter := 0.9999, time.Microsecond, time.Hour
+		reqID, err := registry.InsertRequestInternal(
+			ctx, "SELECT pg_sleep(_), _", samplingProbability, minExecutionLatency, expiresAfter,
+		)
+		require.NoError(t, err)
+
+		setCollectUntilExpiration(true)
+		defer setCollectUntilExpiration(false)
+		setMaxBundlesPerNode(2)
+		defer setMaxBundlesPerNode(1)
+
+		testutils.SucceedsSoon(t, func() error {
+			_, err := db.Exec("SELECT pg_sleep(0.01), 1") // run the query
+			require.NoError(t, err)
+			if n := countBundles("SELECT pg_sleep(_), _"); n < 2 {
+				return errors.Newf("waiting to capture 2 bundles, got %d", n)
+			}
+			return nil
+		})
+		for i := 0; i < 5; i++ {
+			_, err := db.Exec("SELECT pg_sleep(0.01), 1") // run the query
+			require.NoError(t, err)
+		}
+		require.Equal(t, 2, countBundles("SELECT pg_sleep(_), _"))
+		completed, _ := isCompleted(reqID)
+		require.False(t, completed)
+
+		require.NoError(t, registry.CancelRequest(ctx, reqID))
+	})
+
+	t.Run("max total bundle size", func(t *testing.T) {
+		// Every bundle takes the total size over the limit, so inserting a bundle
+		// deletes all the other ones, including the ones collected by the
+		// previous subtests.
+		_, err := db.Exec("SET CLUSTER SETTING sql.stmt_diagnostics.max_total_bundle_size = '1B'")
+		require.NoError(t, err)
+		defer func() {
+			_, err := db.Exec("RESET CLUSTER SETTING sql.stmt_diagnostics.max_total_bundle_size")
+			require.NoError(t, err)
+		}()
+		id1, err := registry.InsertStatementDiagnostics(ctx, 0 /* requestID */, stmtdiagnostics.Request{},
+			"SELECT _", "SELECT 1", []byte("bundle 1"), nil /* cpuProfile */, nil /* execErr */, nil /* collectionErr */)
+		require.NoError(t, err)
+		id2, err := registry.InsertStatementDiagnostics(ctx, 0 /* requestID */, stmtdiagnostics.Request{},
+			"SELECT _", "SELECT 2", []byte("bundle 2"), nil /* cpuProfile */, nil /* execErr */, nil /* collectionErr */)
+		require.NoError(t, err)
+
+		var ids []int64
+		rows, err := db.Query("SELECT id FROM system.statement_diagnostics")
+		require.NoError(t, err)
+		for rows.Next() {
+			var id int64
+			require.NoError(t, rows.Scan(&id))
+			ids = append(ids, id)
+		}
+		require.NoError(t, rows.Err())
+		require.Equal(t, []int64{int64(id2)}, ids)
+		var n int
+		require.NoError(t, db.QueryRow(
+			"SELECT count(*) FROM system.statement_diagnostics_requests WHERE statement_diagnostics_id = $1",
+			id1,
+		).Scan(&n))
+		require.Zero(t, n)
+		require.NoError(t, db.QueryRow(
+			"SELECT count(*) FROM system.statement_bundle_chunks",
+		).Scan(&n))
+		require.Equal(t, 1, n)
+	})
 }
 
 // Test that a different node can service a diagnostics request.
@@ -608,3 +1029,431 @@ func TestChangePollInterval(t *testing.T) {
 	require.NoError(t, err)
 	waitForScans(10) // ensure several scans occur
 }
+
+// TestPollTimeout ensures that sql.stmt_diagnostics.poll_timeout bounds the
+// reads of the requests by the registry.
+func TestPollTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	ctx := context.Background()
+
+	settings := cluster.MakeTestingClusterSettings()
+	// Disable the polling loop so that only the test polls.
+	stmtdiagnostics.PollingInterval.Override(ctx, &settings.SV, 0)
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{Settings: settings})
+	defer s.Stopper().Stop(ctx)
+	registry := s.ExecutorConfig().(sql.ExecutorConfig).StmtDiagnosticsRecorder
+
+	reqID, err := registry.InsertRequestInternal(ctx, "SELECT _", 0 /* samplingProbability */, 0 /* minExecutionLatency */, 0 /* expiresAfter */)
+	require.NoError(t, err)
+
+	stmtdiagnostics.PollTimeout.Override(ctx, &settings.SV, time.Nanosecond)
+	err = registry.TestingPollRequests(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	require.ErrorContains(t, err, "reading statement diagnostics requests timed out")
+	// The requests are left untouched when the poll fails.
+	require.True(t, registry.TestingFindRequest(reqID))
+
+	stmtdiagnostics.PollTimeout.Override(ctx, &settings.SV, 0)
+	require.NoError(t, registry.TestingPollRequests(ctx))
+	require.True(t, registry.TestingFindRequest(reqID))
+}
+
+// TestInsertBundleRetries ensures that the insertion of a bundle is retried
+// after retryable errors, without inserting a duplicate bundle after an
+// ambiguous commit, and that it is given up after other errors.
+func TestInsertBundleRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	registry := s.ExecutorConfig().(sql.ExecutorConfig).StmtDiagnosticsRecorder
+	runner := sqlutils.MakeSQLRunner(db)
+	runner.Exec(t, "CREATE TABLE test (x int PRIMARY KEY)")
+	metrics := registry.Metrics()
+
+	isCompleted := func(reqID int64) bool {
+		var completed bool
+		runner.QueryRow(t,
+			"SELECT completed FROM system.statement_diagnostics_requests WHERE id = $1", reqID,
+		).Scan(&completed)
+		return completed
+	}
+
+	t.Run("retryable", func(t *testing.T) {
+		retries := metrics.BundleRetries.Count()
+		var attempts int
+		defer registry.TestingSetBeforeBundleInsert(func() error {
+			attempts++
+			if attempts <= 2 {
+				return roachpb.NewAmbiguousResultErrorf("injected")
+			}
+			return nil
+		})()
+
+		reqID, err := registry.InsertRequestInternal(ctx, "SELECT x FROM test", 0 /* samplingProbability */, 0 /* minExecutionLatency */, 0 /* expiresAfter */)
+		require.NoError(t, err)
+		runner.Exec(t, "SELECT x FROM test")
+		require.Equal(t, 3, attempts)
+		require.True(t, isCompleted(reqID))
+		require.Equal(t, retries+2, metrics.BundleRetries.Count())
+	})
+
+	countBundles := func(fingerprint string) (n int) {
+		runner.QueryRow(t,
+			"SELECT count(*) FROM system.statement_diagnostics WHERE statement_fingerprint = $1",
+			fingerprint,
+		).Scan(&n)
+		return n
+	}
+
+	t.Run("ambiguous commit", func(t *testing.T) {
+		var attempts int
+		defer registry.TestingSetAfterBundleInsert(func() error {
+			attempts++
+			if attempts == 1 {
+				// The bundle was inserted, but its response was lost.
+				return roachpb.NewAmbiguousResultErrorf("injected")
+			}
+			return nil
+		})()
+
+		// Requests that collect bundles continuously are never marked as
+		// completed, so it's the bundle that must not be inserted again.
+		runner.Exec(t, "SET CLUSTER SETTING sql.stmt_diagnostics.collect_continuously.enabled = true")
+		defer runner.Exec(t, "RESET CLUSTER SETTING sql.stmt_diagnostics.collect_continuously.enabled")
+		reqID, err := registry.InsertRequestInternal(ctx, "SELECT x + _ FROM test",
+			0.9999 /* samplingProbability */, time.Microsecond /* minExecutionLatency */, time.Hour /* expiresAfter */)
+		require.NoError(t, err)
+		runner.Exec(t, "SELECT x + 1 FROM test")
+		require.Equal(t, 2, attempts)
+		require.Equal(t, 1, countBundles("SELECT x + _ FROM test"))
+		require.False(t, isCompleted(reqID))
+		require.NoError(t, registry.CancelRequest(ctx, reqID))
+
+		// The bundles collected without a request insert a completed request
+		// along with them.
+		attempts = 0
+		diagID, err := registry.InsertStatementDiagnostics(ctx, 0 /* requestID */, stmtdiagnostics.Request{},
+			"SELECT x - _ FROM test", "SELECT x - 1 FROM test", []byte("bundle"),
+			nil /* cpuProfile */, nil /* execErr */, nil /* collectionErr */)
+		require.NoError(t, err)
+		require.NotZero(t, diagID)
+		require.Equal(t, 2, attempts)
+		require.Equal(t, 1, countBundles("SELECT x - _ FROM test"))
+		var n int
+		runner.QueryRow(t,
+			"SELECT count(*) FROM system.statement_diagnostics_requests WHERE statement_diagnostics_id = $1",
+			diagID,
+		).Scan(&n)
+		require.Equal(t, 1, n)
+	})
+
+	t.Run("non-retryable", func(t *testing.T) {
+		retries := metrics.BundleRetries.Count()
+		var attempts int
+		defer registry.TestingSetBeforeBundleInsert(func() error {
+			attempts++
+			return errors.New("injected")
+		})()
+
+		reqID, err := registry.InsertRequestInternal(ctx, "SELECT x FROM test WHERE x = _", 0 /* samplingProbability */, 0 /* minExecutionLatency */, 0 /* expiresAfter */)
+		require.NoError(t, err)
+		runner.Exec(t, "SELECT x FROM test WHERE x = 1")
+		require.Equal(t, 1, attempts)
+		require.False(t, isCompleted(reqID))
+		require.Equal(t, retries, metrics.BundleRetries.Count())
+	})
+}
+
+// TestInsertRequestIdempotency ensures that retrying the insertion of a request
+// after an ambiguous commit doesn't insert a duplicate request.
+func TestInsertRequestIdempotency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	registry := s.ExecutorConfig().(sql.ExecutorConfig).StmtDiagnosticsRecorder
+	runner := sqlutils.MakeSQLRunner(db)
+
+	var attempts int
+	defer registry.TestingSetAfterRequestInsert(func() error {
+		attempts++
+		if attempts == 1 {
+			// The request was inserted, but its response was lost.
+			return roachpb.NewAmbiguousResultErrorf("injected")
+		}
+		return nil
+	})()
+	countRequests := func(fprint string) int {
+		var count int
+		runner.QueryRow(t,
+			"SELECT count(*) FROM system.statement_diagnostics_requests WHERE statement_fingerprint = $1",
+			fprint,
+		).Scan(&count)
+		return count
+	}
+
+	reqID, err := registry.InsertRequestInternal(ctx, "SELECT x FROM test", 0 /* samplingProbability */, 0 /* minExecutionLatency */, 0 /* expiresAfter */)
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+	require.Equal(t, 1, countRequests("SELECT x FROM test"))
+	require.True(t, registry.TestingFindRequest(reqID))
+
+	// The retry isn't refused because of the request capturing a CPU profile
+	// that the first attempt inserted.
+	attempts = 0
+	require.NoError(t, registry.InsertRequestWithOptions(ctx, "SELECT x FROM test WHERE x = _",
+		stmtdiagnostics.StmtDiagRequestOptions{CaptureCPUProfile: true}))
+	require.Equal(t, 2, attempts)
+	require.Equal(t, 1, countRequests("SELECT x FROM test WHERE x = _"))
+}
+
+// TestDeleteExpiredRequests ensures that the requests that expired without
+// collecting a bundle are deleted once their retention has passed, and that
+// the other requests are kept.
+func TestDeleteExpiredRequests(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	registry := s.ExecutorConfig().(sql.ExecutorConfig).StmtDiagnosticsRecorder
+	runner := sqlutils.MakeSQLRunner(db)
+	runner.Exec(t, "CREATE TABLE test (x int PRIMARY KEY)")
+
+	insert := func(fprint string, expiresAfter time.Duration) int64 {
+		id, err := registry.InsertRequestInternal(
+			ctx, fprint, 0 /* samplingProbability */, 0 /* minExecutionLatency */, expiresAfter,
+		)
+		require.NoError(t, err)
+		return id
+	}
+	// A pending request, a pending request that never expires, a request that
+	// expired just now, and requests that expired long ago with and without a
+	// bundle.
+	pending := insert("SELECT x FROM test", time.Hour)
+	noExpiry := insert("SELECT x FROM test WHERE x = _", 0)
+	justExpired := insert("SELECT x FROM test WHERE x > _", time.Nanosecond)
+	expired := insert("SELECT x FROM test WHERE x < _", time.Nanosecond)
+	expiredWithBundle := insert("INSERT INTO test VALUES (_)", time.Hour)
+	runner.Exec(t, "INSERT INTO test VALUES (1)")
+	runner.Exec(t, `UPDATE system.statement_diagnostics_requests
+SET expires_at = now() - '2h'::INTERVAL, completed = false WHERE id IN ($1, $2)`, expired, expiredWithBundle)
+
+	require.NoError(t, registry.TestingDeleteExpiredRequests(ctx))
+	var ids []int64
+	rows := runner.Query(t, "SELECT id FROM system.statement_diagnostics_requests ORDER BY id")
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		require.NoError(t, rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []int64{pending, noExpiry, justExpired, expiredWithBundle}, ids)
+
+	// A canceled request is kept for the retention as well, so that the
+	// statements that were being traced for it when it was canceled can still
+	// write their bundles.
+	canceled := insert("SELECT x FROM test WHERE x != _", time.Hour)
+	require.NoError(t, registry.CancelRequest(ctx, canceled))
+	require.NoError(t, registry.TestingDeleteExpiredRequests(ctx))
+	diagID, err := registry.InsertStatementDiagnostics(ctx, stmtdiagnostics.RequestID(canceled),
+		stmtdiagnostics.Request{}, "SELECT x FROM test WHERE x != _", "SELECT x FROM test WHERE x != 1",
+		[]byte("bundle"), nil /* cpuProfile */, nil /* execErr */, nil /* collectionErr */)
+	require.NoError(t, err)
+	require.NotZero(t, diagID)
+	var completed bool
+	runner.QueryRow(t, "SELECT completed FROM system.statement_diagnostics_requests WHERE id = $1",
+		canceled).Scan(&completed)
+	require.True(t, completed)
+}
+
+// TestInsertStatementDiagnosticsCompletedRequest ensures that the bundle
+// reserved for a request is released when the request turns out to be
+// completed already.
+func TestInsertStatementDiagnosticsCompletedRequest(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	registry := s.ExecutorConfig().(sql.ExecutorConfig).StmtDiagnosticsRecorder
+
+	reqID, err := registry.InsertRequestInternal(ctx, "SELECT _", 0 /* samplingProbability */, 0 /* minExecutionLatency */, 0 /* expiresAfter */)
+	require.NoError(t, err)
+	insert := func() stmtdiagnostics.CollectedInstanceID {
+		diagID, err := registry.InsertStatementDiagnostics(ctx, stmtdiagnostics.RequestID(reqID),
+			stmtdiagnostics.Request{}, "SELECT _", "SELECT 1", []byte("bundle"),
+			nil /* cpuProfile */, nil /* execErr */, nil /* collectionErr */)
+		require.NoError(t, err)
+		return diagID
+	}
+	require.NotZero(t, insert())
+	require.Equal(t, 1, registry.TestingCollectedBundles(reqID))
+	// The request is completed, so the second bundle isn't inserted and
+	// doesn't count.
+	require.Zero(t, insert())
+	require.Equal(t, 1, registry.TestingCollectedBundles(reqID))
+}
+
+func TestListRequestsAndGetDiagnostics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	registry := s.ExecutorConfig().(sql.ExecutorConfig).StmtDiagnosticsRecorder
+	runner := sqlutils.MakeSQLRunner(db)
+	runner.Exec(t, "CREATE TABLE test (x int PRIMARY KEY)")
+	// Split the bundle into several chunks.
+	runner.Exec(t, "SET CLUSTER SETTING sql.stmt_diagnostics.bundle_chunk_size = '4KiB'")
+
+	insert := func(fprint string, minExecutionLatency, expiresAfter time.Duration) int64 {
+		id, err := registry.InsertRequestInternal(
+			ctx, fprint, 0 /* samplingProbability */, minExecutionLatency, expiresAfter,
+		)
+		require.NoError(t, err)
+		return id
+	}
+	// A pending request, a pending conditional request that never expires, an
+	// expired request and a completed request.
+	pending := insert("SELECT x FROM test", 0, time.Hour)
+	noExpiry := insert("SELECT x FROM test WHERE x = _", time.Hour, 0)
+	expired := insert("SELECT x FROM test WHERE x > _", 0, time.Hour)
+	completed := insert("INSERT INTO test VALUES (_)", 0, 0)
+	runner.Exec(t, `UPDATE system.statement_diagnostics_requests
+SET expires_at = now() - '1h'::INTERVAL WHERE id = $1`, expired)
+	runner.Exec(t, "INSERT INTO test VALUES (1)")
+
+	requests, err := registry.ListRequests(ctx)
+	require.NoError(t, err)
+	var ids []int64
+	for _, req := range requests {
+		ids = append(ids, int64(req.ID))
+	}
+	require.Equal(t, []int64{pending, noExpiry, completed}, ids)
+	require.Equal(t, "SELECT x FROM test", requests[0].Fingerprint)
+	require.False(t, requests[0].Completed)
+	require.Zero(t, requests[0].DiagnosticsID)
+	require.False(t, requests[0].ExpiresAt.IsZero())
+	require.Equal(t, time.Hour, requests[1].MinExecutionLatency)
+	require.True(t, requests[1].ExpiresAt.IsZero())
+	require.True(t, requests[2].Completed)
+	require.NotZero(t, requests[2].DiagnosticsID)
+
+	b, err := registry.GetDiagnostics(ctx, int64(requests[2].DiagnosticsID))
+	require.NoError(t, err)
+	require.Equal(t, requests[2].DiagnosticsID, b.ID)
+	require.Equal(t, "INSERT INTO test VALUES (_)", b.Fingerprint)
+	require.Equal(t, "INSERT INTO test VALUES (1)", b.Statement)
+	require.False(t, b.CollectedAt.IsZero())
+	require.Empty(t, b.Error)
+	require.Greater(t, len(b.Zip), 4096)
+	unzip, err := zip.NewReader(bytes.NewReader(b.Zip), int64(len(b.Zip)))
+	require.NoError(t, err)
+	var files []string
+	for _, f := range unzip.File {
+		files = append(files, f.Name)
+	}
+	require.Contains(t, files, "trace.json")
+	require.Contains(t, files, "opt-v.txt")
+
+	_, err = registry.GetDiagnostics(ctx, 12345)
+	require.EqualError(t, err, "no statement diagnostics found with id 12345")
+}
+
+// TestBundleCollectedHooks ensures that the functions registered with
+// OnBundleCollected are called for the bundles collected for requests, but not
+// for the ones of EXPLAIN ANALYZE (DEBUG), and that bundles are posted to Slack
+// when the external connection of a webhook is configured and the requester
+// has the USAGE privilege on it.
+func TestBundleCollectedHooks(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	slackMsgs := make(chan map[string]interface{}, 1)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Error(err)
+		}
+		slackMsgs <- msg
+	}))
+	defer slack.Close()
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	registry := s.ExecutorConfig().(sql.ExecutorConfig).StmtDiagnosticsRecorder
+	bundles := make(chan *stmtdiagnostics.Bundle, 1)
+	registry.OnBundleCollected(func(ctx context.Context, b *stmtdiagnostics.Bundle) {
+		bundles <- b
+	})
+
+	// CREATE EXTERNAL CONNECTION only accepts http URIs with CCL, so the
+	// connection is created directly.
+	ec := externalconn.NewMutableExternalConnection()
+	ec.SetConnectionName("slack")
+	ec.SetConnectionType(connectionpb.TypeStorage)
+	ec.SetConnectionDetails(connectionpb.ConnectionDetails{
+		Provider: connectionpb.ConnectionProvider_http,
+		Details: &connectionpb.ConnectionDetails_SimpleURI{
+			SimpleURI: &connectionpb.SimpleURI{URI: slack.URL},
+		},
+	})
+	ec.SetOwner(username.RootUserName())
+	execCfg := s.ExecutorConfig().(sql.ExecutorConfig)
+	require.NoError(t, execCfg.InternalDB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		return ec.Create(ctx, txn, username.RootUserName())
+	}))
+
+	runner := sqlutils.MakeSQLRunner(db)
+	runner.Exec(t, "CREATE TABLE test (x int PRIMARY KEY)")
+	runner.Exec(t, "CREATE USER testuser")
+	runner.Exec(t, "SET CLUSTER SETTING sql.stmt_diagnostics.slack.external_connection = 'slack'")
+	runner.Exec(t, "SET CLUSTER SETTING sql.stmt_diagnostics.slack.channel = '#oncall'")
+	// The bundle of EXPLAIN ANALYZE (DEBUG) isn't passed to the hooks, so the
+	// first bundle that they get is the one collected for the request.
+	runner.Exec(t, "EXPLAIN ANALYZE (DEBUG) SELECT * FROM test WHERE x = 1")
+	requestBundle := func() int64 {
+		reqID, err := registry.InsertRequestWithOptionsInternal(ctx, "SELECT * FROM test WHERE x = _",
+			stmtdiagnostics.StmtDiagRequestOptions{RequestedBy: username.TestUserName()})
+		require.NoError(t, err)
+		runner.Exec(t, "SELECT * FROM test WHERE x = 1")
+		return reqID
+	}
+
+	// The sinks are registered by the server before the hook of the test, and
+	// the hooks run one after the other, so the Slack message, if any, has been
+	// posted once the test gets the bundle. testuser doesn't have the USAGE
+	// privilege on the connection yet.
+	requestBundle()
+	<-bundles
+	require.Len(t, slackMsgs, 0)
+
+	runner.Exec(t, "GRANT USAGE ON EXTERNAL CONNECTION slack TO testuser")
+	reqID := requestBundle()
+
+	b := <-bundles
+	require.NotZero(t, b.ID)
+	require.Equal(t, stmtdiagnostics.RequestID(reqID), b.RequestID)
+	require.Equal(t, "SELECT * FROM test WHERE x = 1", b.Statement)
+	require.NoError(t, b.Err)
+	require.NotEmpty(t, b.Plan)
+	require.NotEmpty(t, b.Trace)
+	require.NotEmpty(t, b.Zip)
+	require.Contains(t, b.URL(), fmt.Sprintf("/_admin/v1/stmtbundle/%d", b.ID))
+
+	msg := <-slackMsgs
+	require.Equal(t, "#oncall", msg["channel"])
+	require.Equal(t, fmt.Sprintf("Collected statement diagnostics bundle %d", b.ID), msg["text"])
+}
@@ -0,0 +1,321 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// This file contains exporters that add the spans of a recording to
+// spreadsheets, databases and documents of productivity applications, for
+// analysis without writing code.
+
+// sheetsAPIURL is the base URL of the Google Sheets API v4. It is overridden
+// in tests.
+var sheetsAPIURL = "https://sheets.googleapis.com/v4"
+
+// sheetsMaxTagColumns is the number of tag keys exported as columns by
+// TraceToGoogleSheets.
+const sheetsMaxTagColumns = 10
+
+// TraceToGoogleSheets appends the spans of the recording to the first sheet of
+// the given Google Sheets spreadsheet, one row per span, after a header row.
+// The columns are trace_id, operation, duration_ms and depth (0 for root
+// spans), followed by one column for each of the 10 tag keys that appear in
+// the most spans, in decreasing number of spans. The tags of named tag groups
+// are prefixed with the name of the group.
+//
+// credentialsJSON contains the JSON key of a service account that the
+// spreadsheet has been shared with.
+func TraceToGoogleSheets(
+	ctx context.Context, r tracingpb.Recording, spreadsheetID, credentialsJSON string,
+) error {
+	if len(r) == 0 {
+		return nil
+	}
+	// Fetch the access token using exportClient.
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, exportClient.Client)
+	creds, err := google.CredentialsFromJSON(
+		ctx, []byte(credentialsJSON), "https://www.googleapis.com/auth/spreadsheets",
+	)
+	if err != nil {
+		return errors.Wrap(err, "parsing Google credentials")
+	}
+	tok, err := creds.TokenSource.Token()
+	if err != nil {
+		return errors.Wrap(err, "obtaining Google access token")
+	}
+
+	tagsBySpan := make([]map[string]string, len(r))
+	counts := make(map[string]int)
+	for i := range r {
+		tagsBySpan[i] = SpanTags(&r[i])
+		for k := range tagsBySpan[i] {
+			counts[k]++
+		}
+	}
+	tagKeys := make([]string, 0, len(counts))
+	for k := range counts {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Slice(tagKeys, func(i, j int) bool {
+		if counts[tagKeys[i]] != counts[tagKeys[j]] {
+			return counts[tagKeys[i]] > counts[tagKeys[j]]
+		}
+		return tagKeys[i] < tagKeys[j]
+	})
+	if len(tagKeys) > sheetsMaxTagColumns {
+		tagKeys = tagKeys[:sheetsMaxTagColumns]
+	}
+
+	depths := make(map[*tracingpb.RecordedSpan]int, len(r))
+	var walk func(n *spanNode, depth int)
+	walk = func(n *spanNode, depth int) {
+		depths[n.sp] = depth
+		for _, c := range n.children {
+			walk(c, depth+1)
+		}
+	}
+	for _, root := range spanForest(r) {
+		walk(root, 0)
+	}
+
+	columns := []interface{}{"trace_id", "operation", "duration_ms", "depth"}
+	for _, k := range tagKeys {
+		columns = append(columns, k)
+	}
+	values := [][]interface{}{columns}
+	for i := range r {
+		sp := &r[i]
+		row := []interface{}{
+			HexID(uint64(sp.TraceID)),
+			sp.Operation,
+			float64(sp.Duration.Microseconds()) / 1000,
+			depths[sp],
+		}
+		for _, k := range tagKeys {
+			row = append(row, tagsBySpan[i][k])
+		}
+		values = append(values, row)
+	}
+
+	// Appending to the range A1 appends after the last row of the table
+	// starting at A1 in the first sheet.
+	u := fmt.Sprintf("%s/spreadsheets/%s/values/A1:append?valueInputOption=RAW&insertDataOption=INSERT_ROWS",
+		sheetsAPIURL, url.PathEscape(spreadsheetID))
+	header := http.Header{"Authorization": {tok.Type() + " " + tok.AccessToken}}
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, u, header,
+			map[string]interface{}{"majorDimension": "ROWS", "values": values}, nil /* resp */),
+		"appending trace to Google Sheets")
+}
+
+// airtableAPIURL is the base URL of the Airtable REST API. It is overridden in
+// tests.
+var airtableAPIURL = "https://api.airtable.com/v0"
+
+// airtableMaxRecordsPerRequest is the maximum number of records that can be
+// created with a single request to the Airtable API.
+const airtableMaxRecordsPerRequest = 10
+
+type airtableRecord struct {
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// TraceToAirtable creates one record per span of the recording in the given
+// table of an Airtable base, in batches of 10 records, the maximum allowed by
+// the API. The table must have the following fields:
+//   - operation: the primary field, a single line text.
+//   - duration_ms: a number, with the precision of the field.
+//   - tags: a long text with one key=value line per tag, sorted by key.
+//
+// apiKey is a personal access token with the data.records:write scope.
+func TraceToAirtable(
+	ctx context.Context, r tracingpb.Recording, baseID, tableID, apiKey string,
+) error {
+	u := fmt.Sprintf("%s/%s/%s", airtableAPIURL, url.PathEscape(baseID), url.PathEscape(tableID))
+	header := http.Header{"Authorization": {"Bearer " + apiKey}}
+	for start := 0; start < len(r); start += airtableMaxRecordsPerRequest {
+		end := start + airtableMaxRecordsPerRequest
+		if end > len(r) {
+			end = len(r)
+		}
+		records := make([]airtableRecord, 0, end-start)
+		for i := start; i < end; i++ {
+			sp := &r[i]
+			tags := SpanTags(sp)
+			lines := make([]string, 0, len(tags))
+			for k, v := range tags {
+				lines = append(lines, k+"="+v)
+			}
+			sort.Strings(lines)
+			records = append(records, airtableRecord{Fields: map[string]interface{}{
+				"operation":   sp.Operation,
+				"duration_ms": float64(sp.Duration.Microseconds()) / 1000,
+				"tags":        strings.Join(lines, "\n"),
+			}})
+		}
+		if err := DoJSONRequest(ctx, http.MethodPost, u, header,
+			map[string]interface{}{"records": records}, nil /* resp */); err != nil {
+			return errors.Wrap(err, "creating Airtable records")
+		}
+	}
+	return nil
+}
+
+// notionAPIURL is the base URL of the Notion API. It is overridden in tests.
+var notionAPIURL = "https://api.notion.com/v1"
+
+// notionVersion is the version of the Notion API used by TraceToNotion.
+const notionVersion = "2022-06-28"
+
+// notionMaxTextLength is the maximum length of a rich text object.
+const notionMaxTextLength = 2000
+
+// notionMaxBlocks is the maximum number of blocks in the content of a page
+// created with a single request.
+const notionMaxBlocks = 100
+
+// notionText returns a rich text array containing s, truncated to the
+// maximum length accepted by Notion.
+func notionText(s string) []interface{} {
+	if len(s) > notionMaxTextLength {
+		s = s[:notionMaxTextLength]
+		// Don't split a multi-byte character.
+		s = strings.ToValidUTF8(s, "")
+	}
+	return []interface{}{map[string]interface{}{"text": map[string]string{"content": s}}}
+}
+
+// TraceToNotion adds one page per span of the recording to the given Notion
+// database. The database must have the following properties:
+//   - operation: the title property.
+//   - trace_id, span_id, parent_span_id: text properties containing the
+//     hex-encoded IDs of the span; parent_span_id is empty for root spans.
+//   - start_time: a date property.
+//   - duration_ms: a number property.
+//   - tags: a text property with one key=value line per tag, sorted by key.
+//
+// The page of every root span is a summary of its trace: its content lists
+// the number of spans and the duration of the trace, followed by links to the
+// pages of the direct children of the root span, which are created first (at
+// most 99 of them).
+//
+// integrationToken is the secret of an internal integration that the
+// database has been shared with.
+func TraceToNotion(
+	ctx context.Context, r tracingpb.Recording, databaseID, integrationToken string,
+) error {
+	header := http.Header{
+		"Authorization":  {"Bearer " + integrationToken},
+		"Notion-Version": {notionVersion},
+	}
+	createPage := func(sp *tracingpb.RecordedSpan, children []interface{}) (string, error) {
+		tags := SpanTags(sp)
+		lines := make([]string, 0, len(tags))
+		for k, v := range tags {
+			lines = append(lines, k+"="+v)
+		}
+		sort.Strings(lines)
+		var parentSpanID string
+		if sp.ParentSpanID != 0 {
+			parentSpanID = HexID(uint64(sp.ParentSpanID))
+		}
+		page := map[string]interface{}{
+			"parent": map[string]string{"database_id": databaseID},
+			"properties": map[string]interface{}{
+				"operation":      map[string]interface{}{"title": notionText(sp.Operation)},
+				"trace_id":       map[string]interface{}{"rich_text": notionText(HexID(uint64(sp.TraceID)))},
+				"span_id":        map[string]interface{}{"rich_text": notionText(HexID(uint64(sp.SpanID)))},
+				"parent_span_id": map[string]interface{}{"rich_text": notionText(parentSpanID)},
+				"start_time": map[string]interface{}{
+					"date": map[string]string{"start": sp.StartTime.UTC().Format(time.RFC3339Nano)},
+				},
+				"duration_ms": map[string]interface{}{
+					"number": float64(sp.Duration.Microseconds()) / 1000,
+				},
+				"tags": map[string]interface{}{"rich_text": notionText(strings.Join(lines, "\n"))},
+			},
+		}
+		if len(children) > 0 {
+			page["children"] = children
+		}
+		var resp struct {
+			ID string `json:"id"`
+		}
+		if err := DoJSONRequest(
+			ctx, http.MethodPost, notionAPIURL+"/pages", header, page, &resp,
+		); err != nil {
+			return "", errors.Wrapf(err, "creating Notion page for span %d", sp.SpanID)
+		}
+		return resp.ID, nil
+	}
+
+	for _, root := range spanForest(r) {
+		// Create the pages of all the spans in the tree except the root,
+		// remembering the pages of the root's children.
+		numSpans := 1
+		var childPages []string
+		var visit func(n *spanNode, depth int) error
+		visit = func(n *spanNode, depth int) error {
+			for _, c := range n.children {
+				numSpans++
+				id, err := createPage(c.sp, nil /* children */)
+				if err != nil {
+					return err
+				}
+				if depth == 0 {
+					childPages = append(childPages, id)
+				}
+				if err := visit(c, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := visit(root, 0); err != nil {
+			return err
+		}
+
+		summary := fmt.Sprintf("Trace %s: %d spans, %s.",
+			HexID(uint64(root.sp.TraceID)), numSpans, root.sp.Duration)
+		blocks := []interface{}{map[string]interface{}{
+			"object":    "block",
+			"type":      "paragraph",
+			"paragraph": map[string]interface{}{"rich_text": notionText(summary)},
+		}}
+		for _, id := range childPages {
+			if len(blocks) == notionMaxBlocks {
+				break
+			}
+			blocks = append(blocks, map[string]interface{}{
+				"object":       "block",
+				"type":         "link_to_page",
+				"link_to_page": map[string]string{"type": "page_id", "page_id": id},
+			})
+		}
+		if _, err := createPage(root.sp, blocks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
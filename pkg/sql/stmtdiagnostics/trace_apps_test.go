@@ -0,0 +1,190 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+// testServiceAccountJSON returns the JSON key of a Google service account
+// whose tokens are issued by the given token endpoint.
+func testServiceAccountJSON(t *testing.T, tokenURL string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "test@test.iam.gserviceaccount.com",
+		"token_uri":      tokenURL,
+	})
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestTraceToGoogleSheets(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var body struct {
+		MajorDimension string          `json:"majorDimension"`
+		Values         [][]interface{} `json:"values"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.Form.Get("grant_type"))
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte(`{"access_token":"tok","token_type":"Bearer","expires_in":3600}`))
+		require.NoError(t, err)
+	})
+	mux.HandleFunc("/v4/spreadsheets/sheet1/values/A1:append", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "Bearer tok", r.Header.Get("Authorization"))
+		require.Equal(t, "RAW", r.URL.Query().Get("valueInputOption"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		_, err := w.Write([]byte(`{}`))
+		require.NoError(t, err)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetSheetsAPIURL(srv.URL + "/v4")()
+
+	require.NoError(t, stmtdiagnostics.TraceToGoogleSheets(
+		context.Background(), makeTestRecording(), "sheet1", testServiceAccountJSON(t, srv.URL+"/token"),
+	))
+	require.Equal(t, "ROWS", body.MajorDimension)
+	require.Equal(t, [][]interface{}{
+		{"trace_id", "operation", "duration_ms", "depth", "cpu-time", "node"},
+		{"0000000000000abc", "sql query", float64(10), float64(0), "", "1"},
+		{"0000000000000abc", "flow", float64(5), float64(1), "3ms", ""},
+		{"0000000000000abc", "kv.Get", float64(2), float64(2), "", ""},
+	}, body.Values)
+
+	require.Regexp(t, "parsing Google credentials", stmtdiagnostics.TraceToGoogleSheets(
+		context.Background(), makeTestRecording(), "sheet1", "not json",
+	))
+}
+
+func TestTraceToAirtable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	type record struct {
+		Fields map[string]interface{} `json:"fields"`
+	}
+	var batches [][]record
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/v0/app1/tbl1", r.URL.Path)
+		require.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		var body struct {
+			Records []record `json:"records"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		batches = append(batches, body.Records)
+		_, err := w.Write([]byte(`{"records":[]}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetAirtableAPIURL(srv.URL + "/v0")()
+
+	// Repeat the spans to check that the records are batched.
+	var rec tracingpb.Recording
+	for i := 0; i < 4; i++ {
+		rec = append(rec, makeTestRecording()...)
+	}
+	require.NoError(t, stmtdiagnostics.TraceToAirtable(context.Background(), rec, "app1", "tbl1", "key"))
+	require.Len(t, batches, 2)
+	require.Len(t, batches[0], 10)
+	require.Len(t, batches[1], 2)
+	require.Equal(t, map[string]interface{}{
+		"operation": "sql query", "duration_ms": float64(10), "tags": "node=1",
+	}, batches[0][0].Fields)
+	require.Equal(t, map[string]interface{}{
+		"operation": "flow", "duration_ms": float64(5), "tags": "cpu-time=3ms",
+	}, batches[0][1].Fields)
+}
+
+func TestTraceToNotion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	type page struct {
+		Parent     map[string]string `json:"parent"`
+		Properties map[string]struct {
+			Title    []struct{ Text struct{ Content string } } `json:"title"`
+			RichText []struct{ Text struct{ Content string } } `json:"rich_text"`
+			Number   float64                                   `json:"number"`
+			Date     struct{ Start string }                    `json:"date"`
+		} `json:"properties"`
+		Children []map[string]interface{} `json:"children"`
+	}
+	var pages []page
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/v1/pages", r.URL.Path)
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		require.NotEmpty(t, r.Header.Get("Notion-Version"))
+		var p page
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		pages = append(pages, p)
+		_, err := fmt.Fprintf(w, `{"object":"page","id":"page%d"}`, len(pages))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	defer stmtdiagnostics.TestingSetNotionAPIURL(srv.URL + "/v1")()
+
+	require.NoError(t, stmtdiagnostics.TraceToNotion(
+		context.Background(), makeTestRecording(), "db1", "secret",
+	))
+	// The children of the root span are created before it.
+	require.Len(t, pages, 3)
+	var ops []string
+	for _, p := range pages {
+		require.Equal(t, map[string]string{"database_id": "db1"}, p.Parent)
+		ops = append(ops, p.Properties["operation"].Title[0].Text.Content)
+	}
+	require.Equal(t, []string{"flow", "kv.Get", "sql query"}, ops)
+
+	root := pages[2]
+	require.Equal(t, "0000000000000abc", root.Properties["trace_id"].RichText[0].Text.Content)
+	require.Equal(t, "0000000000000001", root.Properties["span_id"].RichText[0].Text.Content)
+	require.Equal(t, "", root.Properties["parent_span_id"].RichText[0].Text.Content)
+	require.Equal(t, "2023-01-02T03:04:05Z", root.Properties["start_time"].Date.Start)
+	require.Equal(t, float64(10), root.Properties["duration_ms"].Number)
+	require.Equal(t, "node=1", root.Properties["tags"].RichText[0].Text.Content)
+	require.Len(t, root.Children, 2)
+	require.Equal(t, "paragraph", root.Children[0]["type"])
+	require.Equal(t, map[string]interface{}{"type": "page_id", "page_id": "page1"},
+		root.Children[1]["link_to_page"])
+	require.Equal(t, "0000000000000001",
+		pages[0].Properties["parent_span_id"].RichText[0].Text.Content)
+	require.Empty(t, pages[0].Children)
+}
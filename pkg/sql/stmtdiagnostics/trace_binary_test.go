@@ -0,0 +1,95 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics/tracefb"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToMsgPack(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	b, err := stmtdiagnostics.TraceToMsgPack(tracingpb.Recording{{
+		TraceID:   1,
+		SpanID:    2,
+		Operation: "op",
+		StartTime: time.Unix(1, 5),
+		Duration:  3,
+	}})
+	require.NoError(t, err)
+	var expected []byte
+	expected = append(expected, 0x91, 0x89)
+	expected = append(expected, "\xa8trace_id\x01"...)
+	expected = append(expected, "\xa7span_id\x02"...)
+	expected = append(expected, "\xaeparent_span_id\x00"...)
+	expected = append(expected, "\xa9operation\xa2op"...)
+	expected = append(expected, "\xaastart_time\xc7\x0c\xff\x00\x00\x00\x05\x00\x00\x00\x00\x00\x00\x00\x01"...)
+	expected = append(expected, "\xabduration_ns\x03"...)
+	expected = append(expected, "\xa4tags\x80"...)
+	expected = append(expected, "\xa4logs\x90"...)
+	expected = append(expected, "\xa8children\x90"...)
+	require.Equal(t, expected, b)
+
+	// The spans of a larger recording are nested under a single root.
+	b, err = stmtdiagnostics.TraceToMsgPack(makeTestRecording())
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x91, 0x89}, b[:2])
+	require.Equal(t, 2, bytes.Count(b, []byte("\xa8children\x91")))
+	require.Equal(t, 1, bytes.Count(b, []byte("\xa8children\x90")))
+	require.True(t, bytes.Contains(b, []byte("\xa8cpu-time\xa33ms")))
+}
+
+func TestTraceToFlatBuffers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	// Reverse the recording to check that the spans are sorted by ID.
+	rec[0], rec[2] = rec[2], rec[0]
+	trace := tracefb.GetRootAsTrace(stmtdiagnostics.TraceToFlatBuffers(rec), 0)
+	require.Equal(t, uint64(0xabc), trace.TraceId())
+	require.Equal(t, 3, trace.SpansLength())
+	var sp tracefb.Span
+	for i := 0; i < trace.SpansLength(); i++ {
+		require.True(t, trace.Spans(&sp, i))
+		require.Equal(t, uint64(i+1), sp.SpanId())
+	}
+
+	require.True(t, trace.FindSpan(&sp, 2))
+	require.Equal(t, "flow", string(sp.Operation()))
+	require.Equal(t, uint64(1), sp.ParentSpanId())
+	require.Equal(t, rec[1].StartTime.UnixNano(), sp.StartTimeUnixNanos())
+	require.Equal(t, (5 * time.Millisecond).Nanoseconds(), sp.DurationNanos())
+	var tag tracefb.Tag
+	require.Equal(t, 1, sp.TagsLength())
+	require.True(t, sp.Tags(&tag, 0))
+	require.Equal(t, "cpu-time", string(tag.Key()))
+	require.Equal(t, "3ms", string(tag.Value()))
+
+	require.True(t, trace.FindSpan(&sp, 1))
+	var l tracefb.Log
+	require.Equal(t, 1, sp.LogsLength())
+	require.True(t, sp.Logs(&l, 0))
+	require.Equal(t, "planning", string(l.Message()))
+
+	require.False(t, trace.FindSpan(&sp, 4))
+	require.False(t, trace.FindSpan(&sp, 0))
+}
@@ -0,0 +1,235 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+)
+
+// This file contains exporters that store the spans of a recording in
+// external databases, one row or document per span.
+
+// MongoCollection is the subset of a MongoDB collection used to store traces.
+// It is a thin layer over the official driver's *mongo.Collection:
+//   - InsertMany corresponds to Collection.InsertMany with unordered inserts.
+//   - Find corresponds to Collection.Find followed by Cursor.All.
+type MongoCollection interface {
+	// InsertMany inserts the given documents using a bulk write.
+	InsertMany(ctx context.Context, documents []interface{}) error
+	// Find decodes all the documents matching filter into results, which is a
+	// pointer to a slice.
+	Find(ctx context.Context, filter map[string]interface{}, results interface{}) error
+}
+
+// mongoSpan is the document stored in MongoDB for every span. The field names
+// of the nested tag groups and logs default to the lower-cased Go field names.
+type mongoSpan struct {
+	TraceID      string    `bson:"trace_id"`
+	SpanID       string    `bson:"span_id"`
+	ParentSpanID string    `bson:"parent_span_id,omitempty"`
+	Operation    string    `bson:"operation"`
+	StartTime    time.Time `bson:"start_time"`
+	Duration     int64     `bson:"duration_ns"`
+	// Tags contains the flattened tags of the span (see SpanTags), which
+	// allows querying spans by tag, e.g. {"tags.node": "1"}.
+	Tags      map[string]string `bson:"tags,omitempty"`
+	TagGroups []textTagGroup    `bson:"tag_groups,omitempty"`
+	Logs      []textLog         `bson:"logs,omitempty"`
+}
+
+// TraceToMongoDB inserts one document per span of the recording into the given
+// collection, with a single bulk write. Every document has the following
+// fields:
+//   - trace_id, span_id, parent_span_id: the hex-encoded IDs of the span;
+//     parent_span_id is omitted for root spans. An index on trace_id makes
+//     TraceFromMongoDB efficient.
+//   - operation, start_time, duration_ns.
+//   - tags: the tags of the span, with the tags in named tag groups prefixed
+//     with the name of the group.
+//   - tag_groups: the tag groups of the span, each with a name and a list of
+//     tags with a key and a value.
+//   - logs: the log messages of the span, each with a time and a message.
+//
+// The IDs are stored as strings since BSON has no unsigned 64-bit integers.
+func TraceToMongoDB(ctx context.Context, r tracingpb.Recording, collection MongoCollection) error {
+	if len(r) == 0 {
+		return nil
+	}
+	spans := toTextSpans(r)
+	docs := make([]interface{}, len(r))
+	for i := range r {
+		s := &spans[i]
+		doc := mongoSpan{
+			TraceID:   HexID(s.TraceID),
+			SpanID:    HexID(s.SpanID),
+			Operation: s.Operation,
+			StartTime: s.StartTime,
+			Duration:  r[i].Duration.Nanoseconds(),
+			Tags:      SpanTags(&r[i]),
+			TagGroups: s.TagGroups,
+			Logs:      s.Logs,
+		}
+		if s.ParentSpanID != 0 {
+			doc.ParentSpanID = HexID(s.ParentSpanID)
+		}
+		docs[i] = doc
+	}
+	return errors.Wrap(collection.InsertMany(ctx, docs), "inserting trace into MongoDB")
+}
+
+// TraceFromMongoDB retrieves the trace with the given hex-encoded ID stored
+// by TraceToMongoDB. The spans are ordered by start time. Only the fields
+// stored by TraceToMongoDB are populated.
+func TraceFromMongoDB(
+	ctx context.Context, traceID string, collection MongoCollection,
+) (tracingpb.Recording, error) {
+	var docs []mongoSpan
+	if err := collection.Find(ctx, map[string]interface{}{"trace_id": traceID}, &docs); err != nil {
+		return nil, errors.Wrap(err, "querying trace from MongoDB")
+	}
+	if len(docs) == 0 {
+		return nil, errors.Newf("trace %s not found", traceID)
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].StartTime.Before(docs[j].StartTime)
+	})
+	parseID := func(id string) (uint64, error) {
+		if id == "" {
+			return 0, nil
+		}
+		return strconv.ParseUint(id, 16, 64)
+	}
+	spans := make([]textSpan, len(docs))
+	for i := range docs {
+		doc := &docs[i]
+		var ids [3]uint64
+		for j, id := range []string{doc.TraceID, doc.SpanID, doc.ParentSpanID} {
+			var err error
+			if ids[j], err = parseID(id); err != nil {
+				return nil, errors.Wrapf(err, "span %s", doc.SpanID)
+			}
+		}
+		spans[i] = textSpan{
+			TraceID:      ids[0],
+			SpanID:       ids[1],
+			ParentSpanID: ids[2],
+			Operation:    doc.Operation,
+			StartTime:    doc.StartTime,
+			Duration:     time.Duration(doc.Duration).String(),
+			TagGroups:    doc.TagGroups,
+			Logs:         doc.Logs,
+		}
+	}
+	return fromTextSpans(spans)
+}
+
+// CassandraSession is the subset of a Cassandra session used to store traces.
+// It corresponds to gocql's Session.Query followed by Query.WithContext and
+// Query.Exec; gocql transparently prepares and caches the statements.
+type CassandraSession interface {
+	// Exec executes the CQL statement with the given bind values.
+	Exec(ctx context.Context, stmt string, values ...interface{}) error
+}
+
+// cqlIdentifierRE matches the unquoted CQL identifiers accepted as keyspace
+// names.
+var cqlIdentifierRE = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,47}$`)
+
+// TraceToCassandra inserts every span of the recording as a row of the spans
+// table of the given keyspace, which must have been created with:
+//
+//	CREATE TABLE <keyspace>.spans (
+//	    trace_id bigint,
+//	    span_id bigint,
+//	    parent_span_id bigint,
+//	    operation text,
+//	    start_time timestamp,
+//	    duration_ns bigint,
+//	    tags map<text, text>,
+//	    PRIMARY KEY ((trace_id), span_id)
+//	);
+//
+// The IDs are stored as signed integers with the same bits as the unsigned
+// IDs, as CQL has no unsigned integer types. The start time is truncated to
+// milliseconds, the precision of CQL timestamps. The tags of named tag groups
+// are prefixed with the name of the group.
+//
+// All the spans of a trace belong to the same partition, and a single
+// statement is used for all the inserts so that it is only prepared once.
+func TraceToCassandra(
+	ctx context.Context, r tracingpb.Recording, session CassandraSession, keyspace string,
+) error {
+	if !cqlIdentifierRE.MatchString(keyspace) {
+		return errors.Newf("invalid keyspace name %q", keyspace)
+	}
+	stmt := "INSERT INTO " + keyspace + ".spans " +
+		"(trace_id, span_id, parent_span_id, operation, start_time, duration_ns, tags) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?)"
+	for i := range r {
+		sp := &r[i]
+		if err := session.Exec(ctx, stmt,
+			int64(sp.TraceID),
+			int64(sp.SpanID),
+			int64(sp.ParentSpanID),
+			sp.Operation,
+			sp.StartTime.UTC(),
+			sp.Duration.Nanoseconds(),
+			SpanTags(sp),
+		); err != nil {
+			return errors.Wrapf(err, "inserting span %d", sp.SpanID)
+		}
+	}
+	return nil
+}
+
+// ScyllaSession is a session to a ScyllaDB cluster.
+type ScyllaSession interface {
+	CassandraSession
+	// Close closes the session.
+	Close()
+}
+
+// ScyllaCluster is the configuration of a ScyllaDB cluster. It corresponds to
+// the ClusterConfig of ScyllaDB's fork of gocql, which should use a
+// token-aware host selection policy, e.g.:
+//
+//	cluster.PoolConfig.HostSelectionPolicy =
+//	    gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy())
+type ScyllaCluster interface {
+	// CreateSession opens a session to the cluster.
+	CreateSession() (ScyllaSession, error)
+}
+
+// TraceToScyllaDB inserts every span of the recording into the spans table of
+// the given keyspace in a ScyllaDB cluster, using a new session. The table and
+// the inserted rows are the same as with TraceToCassandra.
+//
+// The inserts are prepared statements in which the partition key, the trace
+// ID, is a bind marker. This allows a token-aware driver to compute the token
+// of every insert and, with ScyllaDB's shard-aware driver, to send it directly
+// to the shard owning the partition, avoiding the hop through a coordinator.
+func TraceToScyllaDB(
+	ctx context.Context, r tracingpb.Recording, cluster ScyllaCluster, keyspace string,
+) error {
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return errors.Wrap(err, "connecting to ScyllaDB")
+	}
+	defer session.Close()
+	return TraceToCassandra(ctx, r, session, keyspace)
+}
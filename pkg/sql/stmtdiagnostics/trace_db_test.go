@@ -0,0 +1,162 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMongoCollection is an in-memory MongoCollection that supports equality
+// filters on the fields of the documents, identified by their bson tags.
+type fakeMongoCollection struct {
+	docs []interface{}
+}
+
+func (c *fakeMongoCollection) InsertMany(ctx context.Context, documents []interface{}) error {
+	c.docs = append(c.docs, documents...)
+	return nil
+}
+
+func (c *fakeMongoCollection) Find(
+	ctx context.Context, filter map[string]interface{}, results interface{},
+) error {
+	out := reflect.ValueOf(results).Elem()
+	for _, doc := range c.docs {
+		v := reflect.ValueOf(doc)
+		matches := true
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("bson"), ",")
+			if want, ok := filter[name]; ok && v.Field(i).Interface() != want {
+				matches = false
+			}
+		}
+		if matches {
+			out.Set(reflect.Append(out, v))
+		}
+	}
+	return nil
+}
+
+func TestTraceToMongoDB(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var c fakeMongoCollection
+	rec := makeTestRecording()
+	require.NoError(t, stmtdiagnostics.TraceToMongoDB(ctx, rec, &c))
+	require.Len(t, c.docs, len(rec))
+
+	// Store a second trace in the same collection.
+	other := makeTestRecording()
+	for i := range other {
+		other[i].TraceID = 0xdef
+	}
+	require.NoError(t, stmtdiagnostics.TraceToMongoDB(ctx, other, &c))
+
+	got, err := stmtdiagnostics.TraceFromMongoDB(ctx, "0000000000000abc", &c)
+	require.NoError(t, err)
+	require.Len(t, got, len(rec))
+	for i := range rec {
+		require.Equal(t, rec[i].TraceID, got[i].TraceID)
+		require.Equal(t, rec[i].SpanID, got[i].SpanID)
+		require.Equal(t, rec[i].ParentSpanID, got[i].ParentSpanID)
+		require.Equal(t, rec[i].Operation, got[i].Operation)
+		require.True(t, rec[i].StartTime.Equal(got[i].StartTime))
+		require.Equal(t, rec[i].Duration, got[i].Duration)
+		require.Equal(t, rec[i].TagGroups, got[i].TagGroups)
+		require.Equal(t, len(rec[i].Logs), len(got[i].Logs))
+	}
+	require.Equal(t, rec[0].Logs[0].Message, got[0].Logs[0].Message)
+
+	_, err = stmtdiagnostics.TraceFromMongoDB(ctx, "0000000000000123", &c)
+	require.EqualError(t, err, "trace 0000000000000123 not found")
+}
+
+// fakeCassandraSession is a CassandraSession that records the statements
+// executed with it.
+type fakeCassandraSession struct {
+	stmts  []string
+	values [][]interface{}
+}
+
+func (s *fakeCassandraSession) Exec(ctx context.Context, stmt string, values ...interface{}) error {
+	s.stmts = append(s.stmts, stmt)
+	s.values = append(s.values, values)
+	return nil
+}
+
+func TestTraceToCassandra(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	rec := makeTestRecording()
+	var s fakeCassandraSession
+	require.NoError(t, stmtdiagnostics.TraceToCassandra(ctx, rec, &s, "crdb_traces"))
+	require.Len(t, s.stmts, len(rec))
+	for i, stmt := range s.stmts {
+		require.Equal(t, "INSERT INTO crdb_traces.spans "+
+			"(trace_id, span_id, parent_span_id, operation, start_time, duration_ns, tags) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?)", stmt)
+		sp := &rec[i]
+		require.Equal(t, []interface{}{
+			int64(0xabc), int64(sp.SpanID), int64(sp.ParentSpanID), sp.Operation,
+			sp.StartTime, sp.Duration.Nanoseconds(), s.values[i][6],
+		}, s.values[i])
+	}
+	require.Equal(t, map[string]string{"node": "1"}, s.values[0][6])
+	require.Equal(t, map[string]string{"cpu-time": "3ms"}, s.values[1][6])
+
+	require.EqualError(t,
+		stmtdiagnostics.TraceToCassandra(ctx, rec, &s, "traces; DROP TABLE x"),
+		`invalid keyspace name "traces; DROP TABLE x"`)
+}
+
+type fakeScyllaSession struct {
+	fakeCassandraSession
+	closed bool
+}
+
+func (s *fakeScyllaSession) Close() {
+	s.closed = true
+}
+
+type fakeScyllaCluster struct {
+	session *fakeScyllaSession
+}
+
+func (c *fakeScyllaCluster) CreateSession() (stmtdiagnostics.ScyllaSession, error) {
+	return c.session, nil
+}
+
+func TestTraceToScyllaDB(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	c := fakeScyllaCluster{session: &fakeScyllaSession{}}
+	require.NoError(t, stmtdiagnostics.TraceToScyllaDB(context.Background(), rec, &c, "crdb_traces"))
+	require.True(t, c.session.closed)
+	require.Len(t, c.session.stmts, len(rec))
+	for _, values := range c.session.values {
+		// The partition key is bound as the first value.
+		require.Equal(t, int64(0xabc), values[0])
+	}
+}
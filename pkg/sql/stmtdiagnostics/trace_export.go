@@ -0,0 +1,249 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/httputil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+)
+
+// exportTimeout bounds the time spent shipping a trace to an external system.
+const exportTimeout = 10 * time.Second
+
+// exportClient is the HTTP client used to ship traces and bundles to external
+// systems.
+var exportClient = httputil.NewClientWithTimeout(exportTimeout)
+
+// SpanTags flattens the tag groups of a span into a single map. Tags in named
+// groups are prefixed with the group name, matching the convention used by
+// Recording.ToJaegerJSON.
+func SpanTags(sp *tracingpb.RecordedSpan) map[string]string {
+	tags := make(map[string]string)
+	for _, tg := range sp.TagGroups {
+		var prefix string
+		if tg.Name != tracingpb.AnonymousTagGroupName {
+			prefix = tg.Name + "-"
+		}
+		for _, tag := range tg.Tags {
+			tags[prefix+tag.Key] = tag.Value
+		}
+	}
+	return tags
+}
+
+// serviceName returns the name of the service that produced a span with the
+// given tags: the node that recorded the span if the span has a "node" tag, and
+// def otherwise. This mirrors the way Recording.ToJaegerJSON maps nodes to
+// processes.
+func serviceName(tags map[string]string, def string) string {
+	if node, ok := tags["node"]; ok {
+		return "node " + node
+	}
+	return def
+}
+
+// HexID formats a trace or span ID as a 16 character, zero-padded hex string,
+// which is the representation expected by most tracing backends.
+func HexID(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+// spanNode is a span of a recording along with its children.
+type spanNode struct {
+	sp       *tracingpb.RecordedSpan
+	children []*spanNode
+}
+
+// spanForest arranges the spans of the recording into trees according to their
+// parent span IDs, and returns the roots of the trees. Spans whose parent is
+// missing from the recording are roots. Siblings appear in recording order.
+// Every span appears exactly once, even in malformed recordings containing
+// cycles: a cycle is broken at the first of its spans in the recording.
+func spanForest(r tracingpb.Recording) []*spanNode {
+	ids := make(map[tracingpb.SpanID]struct{}, len(r))
+	children := make(map[tracingpb.SpanID][]int)
+	for i := range r {
+		ids[r[i].SpanID] = struct{}{}
+		children[r[i].ParentSpanID] = append(children[r[i].ParentSpanID], i)
+	}
+
+	visited := make([]bool, len(r))
+	var build func(i int) *spanNode
+	build = func(i int) *spanNode {
+		visited[i] = true
+		n := &spanNode{sp: &r[i]}
+		for _, c := range children[r[i].SpanID] {
+			if !visited[c] {
+				n.children = append(n.children, build(c))
+			}
+		}
+		return n
+	}
+
+	var roots []*spanNode
+	for i := range r {
+		if _, ok := ids[r[i].ParentSpanID]; !ok && !visited[i] {
+			roots = append(roots, build(i))
+		}
+	}
+	for i := range r {
+		if !visited[i] {
+			roots = append(roots, build(i))
+		}
+	}
+	return roots
+}
+
+// DoJSONRequest marshals req as JSON and sends it to url using the given
+// method. If resp is not nil, the response body is decoded into it. Responses
+// with a non-2xx status code are turned into errors.
+func DoJSONRequest(
+	ctx context.Context, method, url string, header http.Header, req, resp interface{},
+) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		httpReq.Header[k] = v
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	return DoRequest(httpReq, resp)
+}
+
+// DoRequest sends the given request using exportClient. If resp is not nil,
+// the response body is decoded into it as JSON.
+func DoRequest(req *http.Request, resp interface{}) error {
+	httpResp, err := exportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return errors.Newf("%s %s: unexpected status %s: %s",
+			req.Method, req.URL.Redacted(), httpResp.Status, bytes.TrimSpace(msg))
+	}
+	if resp == nil {
+		return nil
+	}
+	return errors.Wrapf(json.NewDecoder(httpResp.Body).Decode(resp),
+		"decoding response from %s", req.URL.Redacted())
+}
+
+// doGraphQL sends a GraphQL request with the given query and variables to
+// url. If resp is not nil, the data of the response is decoded into it. GraphQL
+// errors in the response are turned into errors.
+func doGraphQL(
+	ctx context.Context,
+	url string,
+	header http.Header,
+	query string,
+	variables map[string]interface{},
+	resp interface{},
+) error {
+	var gqlResp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := DoJSONRequest(ctx, http.MethodPost, url, header, map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	}, &gqlResp); err != nil {
+		return err
+	}
+	if len(gqlResp.Errors) > 0 {
+		msgs := make([]string, len(gqlResp.Errors))
+		for i, e := range gqlResp.Errors {
+			msgs[i] = e.Message
+		}
+		return errors.Newf("GraphQL errors: %s", strings.Join(msgs, "; "))
+	}
+	if resp == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(gqlResp.Data, resp), "decoding GraphQL response")
+}
+
+// instanaSpan is a span in the format accepted by the Instana agent's trace
+// SDK web service.
+type instanaSpan struct {
+	TraceID   string          `json:"traceId"`
+	SpanID    string          `json:"spanId"`
+	ParentID  string          `json:"parentId,omitempty"`
+	Timestamp int64           `json:"timestamp"`
+	Duration  int64           `json:"duration"`
+	Type      string          `json:"type"`
+	Data      instanaSpanData `json:"data"`
+}
+
+type instanaSpanData struct {
+	SDK struct {
+		Name   string `json:"name"`
+		Type   string `json:"type"`
+		Custom struct {
+			Tags map[string]string `json:"tags,omitempty"`
+		} `json:"custom"`
+	} `json:"sdk"`
+}
+
+// TraceToInstana submits all the spans in the recording, in a single batch, to
+// the Instana agent listening on agentHost:agentPort. Every span is reported as
+// an intermediate SDK span named after its operation, with the span's tags
+// attached as custom tags.
+//
+// See https://www.ibm.com/docs/en/instana-observability/current?topic=tracing-trace-sdk-rest-web-service.
+func TraceToInstana(
+	ctx context.Context, r tracingpb.Recording, agentHost string, agentPort int,
+) error {
+	if len(r) == 0 {
+		return nil
+	}
+	spans := make([]instanaSpan, len(r))
+	for i := range r {
+		sp := &r[i]
+		s := &spans[i]
+		s.TraceID = HexID(uint64(sp.TraceID))
+		s.SpanID = HexID(uint64(sp.SpanID))
+		if sp.ParentSpanID != 0 {
+			s.ParentID = HexID(uint64(sp.ParentSpanID))
+		}
+		s.Timestamp = sp.StartTime.UnixMilli()
+		s.Duration = sp.Duration.Milliseconds()
+		s.Type = "sdk"
+		s.Data.SDK.Name = sp.Operation
+		s.Data.SDK.Type = "intermediate"
+		s.Data.SDK.Custom.Tags = SpanTags(sp)
+	}
+	url := fmt.Sprintf("http://%s/com.instana.plugin.generic.trace",
+		net.JoinHostPort(agentHost, strconv.Itoa(agentPort)))
+	return errors.Wrap(
+		DoJSONRequest(ctx, http.MethodPost, url, nil /* header */, spans, nil /* resp */),
+		"submitting trace to Instana")
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestRecording returns a small recording with a root span, a child span
+// and a grandchild span.
+func makeTestRecording() tracingpb.Recording {
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	return tracingpb.Recording{
+		{
+			TraceID:   0xabc,
+			SpanID:    1,
+			Operation: "sql query",
+			StartTime: start,
+			Duration:  10 * time.Millisecond,
+			TagGroups: []tracingpb.TagGroup{
+				{Tags: []tracingpb.Tag{{Key: "node", Value: "1"}}},
+			},
+			Logs: []tracingpb.LogRecord{
+				{Time: start.Add(time.Millisecond), Message: "planning"},
+			},
+		},
+		{
+			TraceID:      0xabc,
+			SpanID:       2,
+			ParentSpanID: 1,
+			Operation:    "flow",
+			StartTime:    start.Add(2 * time.Millisecond),
+			Duration:     5 * time.Millisecond,
+			TagGroups: []tracingpb.TagGroup{
+				{Name: "cpu", Tags: []tracingpb.Tag{{Key: "time", Value: "3ms"}}},
+			},
+		},
+		{
+			TraceID:      0xabc,
+			SpanID:       3,
+			ParentSpanID: 2,
+			Operation:    "kv.Get",
+			StartTime:    start.Add(3 * time.Millisecond),
+			Duration:     2 * time.Millisecond,
+		},
+	}
+}
+
+func TestTraceToInstana(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var path string
+	var spans []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &spans))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	host, portStr, err := net.SplitHostPort(u.Host)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, stmtdiagnostics.TraceToInstana(ctx, makeTestRecording(), host, port))
+	require.Equal(t, "/com.instana.plugin.generic.trace", path)
+	require.Len(t, spans, 3)
+
+	root := spans[0]
+	require.Equal(t, "0000000000000abc", root["traceId"])
+	require.Equal(t, "0000000000000001", root["spanId"])
+	require.NotContains(t, root, "parentId")
+	require.Equal(t, "sdk", root["type"])
+	require.EqualValues(t, 10, root["duration"])
+	sdk := root["data"].(map[string]interface{})["sdk"].(map[string]interface{})
+	require.Equal(t, "sql query", sdk["name"])
+	require.Equal(t, "intermediate", sdk["type"])
+	require.Equal(t, map[string]interface{}{"node": "1"},
+		sdk["custom"].(map[string]interface{})["tags"])
+
+	child := spans[1]
+	require.Equal(t, "0000000000000001", child["parentId"])
+	sdk = child["data"].(map[string]interface{})["sdk"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"cpu-time": "3ms"},
+		sdk["custom"].(map[string]interface{})["tags"])
+}
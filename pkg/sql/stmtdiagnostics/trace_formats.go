@@ -0,0 +1,586 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"google.golang.org/grpc/codes"
+)
+
+// This file contains converters from a tracingpb.Recording to various trace
+// formats understood by third-party tooling. The converters do not perform any
+// I/O other than writing to the provided io.Writer (if any).
+
+// wavefrontUUID formats a trace or span ID as the UUID expected by Wavefront.
+func wavefrontUUID(id uint64) string {
+	return fmt.Sprintf("00000000-0000-0000-%04x-%012x", id>>48, id&(1<<48-1))
+}
+
+// wavefrontQuote quotes s according to the Wavefront data format.
+func wavefrontQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// wavefrontTagKey replaces the characters not allowed in Wavefront point tag
+// keys with underscores.
+func wavefrontTagKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, k)
+}
+
+// TraceToWavefront returns the recording in the Wavefront span data format,
+// with one span per line. See TraceToWavefrontWriter.
+func TraceToWavefront(r tracingpb.Recording, source, application string) string {
+	var buf strings.Builder
+	// Writing to a strings.Builder cannot fail.
+	_ = TraceToWavefrontWriter(r, source, application, &buf)
+	return buf.String()
+}
+
+// TraceToWavefrontWriter writes the recording to w in the Wavefront span data
+// format, with one span per line:
+//
+//	<operation> source=<source> traceId=<uuid> spanId=<uuid> [parent=<uuid>]
+//	  application=<application> service=<service> [<tag>=<value> ...]
+//	  <start millis> <duration millis>
+//
+// The service of a span is the node that produced it, if known.
+//
+// w is typically the body of a request to a Wavefront proxy.
+//
+// See https://docs.wavefront.com/trace_data_details.html#wavefront-span-format.
+func TraceToWavefrontWriter(
+	r tracingpb.Recording, source, application string, w io.Writer,
+) error {
+	bw := bufio.NewWriter(w)
+	for i := range r {
+		sp := &r[i]
+		fmt.Fprintf(bw, "%s source=%s traceId=%s spanId=%s",
+			wavefrontQuote(sp.Operation), wavefrontQuote(source),
+			wavefrontUUID(uint64(sp.TraceID)), wavefrontUUID(uint64(sp.SpanID)))
+		if sp.ParentSpanID != 0 {
+			fmt.Fprintf(bw, " parent=%s", wavefrontUUID(uint64(sp.ParentSpanID)))
+		}
+		tags := SpanTags(sp)
+		fmt.Fprintf(bw, " application=%s service=%s",
+			wavefrontQuote(application), wavefrontQuote(serviceName(tags, application)))
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(bw, " %s=%s", wavefrontTagKey(k), wavefrontQuote(tags[k]))
+		}
+		fmt.Fprintf(bw, " %d %d\n", sp.StartTime.UnixMilli(), sp.Duration.Milliseconds())
+	}
+	return bw.Flush()
+}
+
+// zipkinSpan is a span in the Zipkin v2 JSON format.
+type zipkinSpan struct {
+	TraceID       string             `json:"traceId"`
+	ID            string             `json:"id"`
+	ParentID      string             `json:"parentId,omitempty"`
+	Name          string             `json:"name"`
+	Timestamp     int64              `json:"timestamp"`
+	Duration      int64              `json:"duration"`
+	LocalEndpoint zipkinEndpoint     `json:"localEndpoint"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+	Annotations   []zipkinAnnotation `json:"annotations,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// TraceToZipkin returns the recording as a Zipkin v2 JSON array of spans, as
+// accepted by the POST /api/v2/spans endpoint of a Zipkin server. Span tags
+// become Zipkin tags and log messages become annotations. Timestamps and
+// durations are in microseconds.
+//
+// See https://zipkin.io/zipkin-api/#/default/post_spans.
+func TraceToZipkin(r tracingpb.Recording) ([]byte, error) {
+	spans := make([]zipkinSpan, len(r))
+	for i := range r {
+		sp := &r[i]
+		s := &spans[i]
+		s.TraceID = HexID(uint64(sp.TraceID))
+		s.ID = HexID(uint64(sp.SpanID))
+		if sp.ParentSpanID != 0 {
+			s.ParentID = HexID(uint64(sp.ParentSpanID))
+		}
+		s.Name = sp.Operation
+		s.Timestamp = sp.StartTime.UnixMicro()
+		s.Duration = sp.Duration.Microseconds()
+		s.Tags = SpanTags(sp)
+		s.LocalEndpoint.ServiceName = serviceName(s.Tags, "cockroachdb")
+		for _, l := range sp.Logs {
+			s.Annotations = append(s.Annotations, zipkinAnnotation{
+				Timestamp: l.Time.UnixMicro(),
+				Value:     l.Msg().StripMarkers(),
+			})
+		}
+	}
+	return json.Marshal(spans)
+}
+
+// TraceToB3Headers returns the B3 multi-header propagation headers identifying
+// the root span of the recording. An external system propagating B3 context
+// can use them to correlate its own traces with the recording. nil is returned
+// for an empty recording.
+//
+// See https://github.com/openzipkin/b3-propagation.
+func TraceToB3Headers(r tracingpb.Recording) map[string]string {
+	if len(r) == 0 {
+		return nil
+	}
+	return map[string]string{
+		"X-B3-TraceId": HexID(uint64(r[0].TraceID)),
+		"X-B3-SpanId":  HexID(uint64(r[0].SpanID)),
+		"X-B3-Sampled": "1",
+	}
+}
+
+// TraceToW3CTraceContext returns the value of a W3C traceparent header
+// identifying the root span of the recording, marked as sampled:
+//
+//	00-<trace-id>-<span-id>-01
+//
+// The 64-bit trace ID is zero-extended to the 128 bits required by the
+// specification. An empty string is returned for an empty recording or a
+// recording with a zero trace ID, which W3C considers invalid.
+//
+// See https://www.w3.org/TR/trace-context/#traceparent-header.
+func TraceToW3CTraceContext(r tracingpb.Recording) string {
+	if len(r) == 0 || r[0].TraceID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("00-%032x-%016x-01", uint64(r[0].TraceID), uint64(r[0].SpanID))
+}
+
+// TraceToW3CTraceState returns the value of a W3C tracestate header carrying
+// CockroachDB-specific state to accompany the traceparent returned by
+// TraceToW3CTraceContext. The state identifies the node that recorded the root
+// span, if known. An empty string is returned if there is no state to
+// propagate.
+//
+// See https://www.w3.org/TR/trace-context/#tracestate-header.
+func TraceToW3CTraceState(r tracingpb.Recording) string {
+	if len(r) == 0 {
+		return ""
+	}
+	node, ok := SpanTags(&r[0])["node"]
+	if !ok {
+		return ""
+	}
+	// List member values can't contain commas or equal signs.
+	return "crdb=n" + strings.NewReplacer(",", "_", "=", "_").Replace(node)
+}
+
+// EnrichWithGRPCStatus returns a copy of the recording in which every span
+// carrying a numeric grpc.status_code tag also carries a
+// grpc.status_description tag with the name of the corresponding gRPC status
+// code (e.g. "Unavailable"), making gRPC errors in the trace interpretable
+// without looking the codes up. The description is added to the tag group
+// containing the status code. The input recording is not modified.
+func EnrichWithGRPCStatus(r tracingpb.Recording) tracingpb.Recording {
+	const codeKey, descriptionKey = "grpc.status_code", "grpc.status_description"
+	cpy := make(tracingpb.Recording, len(r))
+	copy(cpy, r)
+	for i := range cpy {
+		sp := &cpy[i]
+		copied := false
+		for j := range sp.TagGroups {
+			v, ok := sp.TagGroups[j].FindTag(codeKey)
+			if !ok {
+				continue
+			}
+			code, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				continue
+			}
+			// Copy the tag groups before modifying them so that we don't
+			// modify the input recording.
+			if !copied {
+				sp.TagGroups = append([]tracingpb.TagGroup(nil), sp.TagGroups...)
+				copied = true
+			}
+			tg := &sp.TagGroups[j]
+			tg.Tags = append([]tracingpb.Tag(nil), tg.Tags...)
+			tg.AddTag(descriptionKey, codes.Code(code).String())
+		}
+	}
+	return cpy
+}
+
+// TraceToNetTrace returns the recording in the format used by Go's
+// golang.org/x/net/trace package to render a request's events (as shown on
+// /debug/requests). Every span is rendered as a line carrying its start time,
+// its duration in seconds, its operation and its tags, followed by a line for
+// each of its log messages carrying the time elapsed since the previous event
+// of the span, in microseconds. Spans are indented according to their depth in
+// the trace:
+//
+//	2023/01/02 03:04:05.000000	   0.010000	sql query node=1
+//	03:04:05.001000	 .  1000	... planning
+//	03:04:05.002000	   0.005000	    flow
+//
+// Spans whose parent is missing from the recording are rendered at the end,
+// with no indentation.
+func TraceToNetTrace(r tracingpb.Recording) string {
+	if len(r) == 0 {
+		return ""
+	}
+	children := make(map[tracingpb.SpanID][]int)
+	for i := range r {
+		children[r[i].ParentSpanID] = append(children[r[i].ParentSpanID], i)
+	}
+
+	var buf strings.Builder
+	visited := make(map[tracingpb.SpanID]struct{}, len(r))
+	var visit func(i, depth int)
+	visit = func(i, depth int) {
+		sp := &r[i]
+		if _, ok := visited[sp.SpanID]; ok {
+			return
+		}
+		visited[sp.SpanID] = struct{}{}
+
+		indent := strings.Repeat("    ", depth)
+		layout := "15:04:05.000000"
+		if len(visited) == 1 {
+			layout = "2006/01/02 15:04:05.000000"
+		}
+		fmt.Fprintf(&buf, "%s\t%11.6f\t%s%s",
+			sp.StartTime.Format(layout), sp.Duration.Seconds(), indent, sp.Operation)
+		tags := SpanTags(sp)
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %s=%s", k, tags[k])
+		}
+		buf.WriteByte('\n')
+
+		prev := sp.StartTime
+		for _, l := range sp.Logs {
+			fmt.Fprintf(&buf, "%s\t .%6d\t%s... %s\n",
+				l.Time.Format("15:04:05.000000"), l.Time.Sub(prev).Microseconds(),
+				indent, l.Msg().StripMarkers())
+			prev = l.Time
+		}
+		for _, c := range children[sp.SpanID] {
+			visit(c, depth+1)
+		}
+	}
+	visit(0, 0 /* depth */)
+	for i := range r {
+		visit(i, 0 /* depth */)
+	}
+	return buf.String()
+}
+
+// TraceToFlamegraphCollapsed returns the recording in the collapsed stack
+// format consumed by flamegraph.pl and compatible tools (e.g. inferno). Every
+// line consists of the semicolon-separated operations from the root of the
+// trace down to a span, followed by the time spent in that span but not in any
+// of its children, in microseconds:
+//
+//	sql query;flow;kv.Get 2000
+//
+// For leaf spans this is the duration of the span. Lines for identical stacks
+// are merged, and the lines are sorted.
+//
+// See https://www.brendangregg.com/flamegraphs.html.
+func TraceToFlamegraphCollapsed(r tracingpb.Recording) string {
+	spans := make(map[tracingpb.SpanID]*tracingpb.RecordedSpan, len(r))
+	childDurations := make(map[tracingpb.SpanID]time.Duration, len(r))
+	for i := range r {
+		spans[r[i].SpanID] = &r[i]
+		childDurations[r[i].ParentSpanID] += r[i].Duration
+	}
+	frame := strings.NewReplacer(";", ":", "\n", " ")
+
+	weights := make(map[string]int64)
+	for i := range r {
+		sp := &r[i]
+		self := sp.Duration - childDurations[sp.SpanID]
+		if self <= 0 {
+			continue
+		}
+		// Walk up to the root, guarding against malformed recordings with
+		// cycles.
+		var stack []string
+		seen := make(map[tracingpb.SpanID]struct{})
+		for s := sp; s != nil; s = spans[s.ParentSpanID] {
+			if _, ok := seen[s.SpanID]; ok {
+				break
+			}
+			seen[s.SpanID] = struct{}{}
+			stack = append(stack, frame.Replace(s.Operation))
+		}
+		for a, b := 0, len(stack)-1; a < b; a, b = a+1, b-1 {
+			stack[a], stack[b] = stack[b], stack[a]
+		}
+		weights[strings.Join(stack, ";")] += self.Microseconds()
+	}
+
+	lines := make([]string, 0, len(weights))
+	for stack, w := range weights {
+		lines = append(lines, fmt.Sprintf("%s %d\n", stack, w))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
+
+// Dimensions of the flame charts rendered by TraceToFlameChartSVG, in pixels.
+const (
+	flameChartWidth     = 1200
+	flameChartRowHeight = 18
+	flameChartCharWidth = 7
+)
+
+// TraceToFlameChartSVG renders the recording as a flame chart in an SVG
+// image. Unlike a flame graph, a flame chart preserves the timing of the
+// spans: every span is a bar whose horizontal position and width are given by
+// its start time and duration, and whose row is its depth in the trace, with
+// the roots at the top. Bars are labeled with the operation of the span when
+// there is room for it, and every bar has a tooltip with the operation and the
+// duration of the span.
+func TraceToFlameChartSVG(r tracingpb.Recording) []byte {
+	var start, end time.Time
+	for i := range r {
+		sp := &r[i]
+		if start.IsZero() || sp.StartTime.Before(start) {
+			start = sp.StartTime
+		}
+		if spEnd := sp.StartTime.Add(sp.Duration); spEnd.After(end) {
+			end = spEnd
+		}
+	}
+	total := end.Sub(start)
+	if total <= 0 {
+		total = 1
+	}
+
+	type bar struct {
+		sp    *tracingpb.RecordedSpan
+		depth int
+	}
+	var bars []bar
+	maxDepth := -1
+	var visit func(n *spanNode, depth int)
+	visit = func(n *spanNode, depth int) {
+		bars = append(bars, bar{sp: n.sp, depth: depth})
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		for _, c := range n.children {
+			visit(c, depth+1)
+		}
+	}
+	for _, root := range spanForest(r) {
+		visit(root, 0 /* depth */)
+	}
+
+	var buf strings.Builder
+	escape := func(s string) string {
+		var b strings.Builder
+		_ = xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	height := (maxDepth + 1) * flameChartRowHeight
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" `+
+		`viewBox="0 0 %d %d" font-family="monospace" font-size="12">`+"\n",
+		flameChartWidth, height, flameChartWidth, height)
+	for _, b := range bars {
+		x := float64(b.sp.StartTime.Sub(start)) / float64(total) * flameChartWidth
+		w := float64(b.sp.Duration) / float64(total) * flameChartWidth
+		if w < 1 {
+			w = 1
+		}
+		y := b.depth * flameChartRowHeight
+		// Vary the color of the bars with the depth so that adjacent rows are
+		// easy to tell apart.
+		fill := fmt.Sprintf("hsl(%d,80%%,60%%)", (30+b.depth*15)%60)
+		op := escape(b.sp.Operation)
+		fmt.Fprintf(&buf, `<g><title>%s (%s)</title>`, op, b.sp.Duration)
+		fmt.Fprintf(&buf, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s" stroke="white"/>`,
+			x, y, w, flameChartRowHeight-1, fill)
+		if maxChars := int(w-6) / flameChartCharWidth; maxChars >= 3 {
+			label := b.sp.Operation
+			if len(label) > maxChars {
+				label = strings.ToValidUTF8(label[:maxChars-2], "") + ".."
+			}
+			fmt.Fprintf(&buf, `<text x="%.1f" y="%d">%s</text>`,
+				x+3, y+flameChartRowHeight-5, escape(label))
+		}
+		buf.WriteString("</g>\n")
+	}
+	buf.WriteString("</svg>\n")
+	return []byte(buf.String())
+}
+
+// TraceXMLSchema is the XML Schema (XSD) of the documents produced by
+// TraceToXML.
+const TraceXMLSchema = `<?xml version="1.0" encoding="UTF-8"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" elementFormDefault="qualified">
+  <xs:element name="trace">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="span" type="spanType" minOccurs="0" maxOccurs="unbounded"/>
+      </xs:sequence>
+      <xs:attribute name="id" type="hexID" use="required"/>
+    </xs:complexType>
+  </xs:element>
+  <xs:complexType name="spanType">
+    <xs:sequence>
+      <xs:element name="tag" type="tagType" minOccurs="0" maxOccurs="unbounded"/>
+      <xs:element name="log" type="logType" minOccurs="0" maxOccurs="unbounded"/>
+      <xs:element name="span" type="spanType" minOccurs="0" maxOccurs="unbounded"/>
+    </xs:sequence>
+    <xs:attribute name="id" type="hexID" use="required"/>
+    <xs:attribute name="parent" type="hexID"/>
+    <xs:attribute name="operation" type="xs:string" use="required"/>
+    <xs:attribute name="start" type="xs:dateTime" use="required"/>
+    <xs:attribute name="duration_ns" type="xs:long" use="required"/>
+  </xs:complexType>
+  <xs:complexType name="tagType">
+    <xs:simpleContent>
+      <xs:extension base="xs:string">
+        <xs:attribute name="key" type="xs:string" use="required"/>
+        <xs:attribute name="group" type="xs:string"/>
+      </xs:extension>
+    </xs:simpleContent>
+  </xs:complexType>
+  <xs:complexType name="logType">
+    <xs:simpleContent>
+      <xs:extension base="xs:string">
+        <xs:attribute name="time" type="xs:dateTime" use="required"/>
+      </xs:extension>
+    </xs:simpleContent>
+  </xs:complexType>
+  <xs:simpleType name="hexID">
+    <xs:restriction base="xs:string">
+      <xs:pattern value="[0-9a-f]{16}"/>
+    </xs:restriction>
+  </xs:simpleType>
+</xs:schema>
+`
+
+// xmlTrace is the root element of the XML representation of a trace.
+type xmlTrace struct {
+	XMLName xml.Name  `xml:"trace"`
+	ID      string    `xml:"id,attr"`
+	Spans   []xmlSpan `xml:"span"`
+}
+
+type xmlSpan struct {
+	ID         string    `xml:"id,attr"`
+	Parent     string    `xml:"parent,attr,omitempty"`
+	Operation  string    `xml:"operation,attr"`
+	Start      string    `xml:"start,attr"`
+	DurationNs int64     `xml:"duration_ns,attr"`
+	Tags       []xmlTag  `xml:"tag"`
+	Logs       []xmlLog  `xml:"log"`
+	Children   []xmlSpan `xml:"span"`
+}
+
+type xmlTag struct {
+	Key   string `xml:"key,attr"`
+	Group string `xml:"group,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type xmlLog struct {
+	Time    string `xml:"time,attr"`
+	Message string `xml:",chardata"`
+}
+
+func toXMLSpan(n *spanNode) xmlSpan {
+	sp := n.sp
+	s := xmlSpan{
+		ID:         HexID(uint64(sp.SpanID)),
+		Operation:  sp.Operation,
+		Start:      sp.StartTime.UTC().Format(time.RFC3339Nano),
+		DurationNs: sp.Duration.Nanoseconds(),
+	}
+	if sp.ParentSpanID != 0 {
+		s.Parent = HexID(uint64(sp.ParentSpanID))
+	}
+	for _, tg := range sp.TagGroups {
+		for _, tag := range tg.Tags {
+			s.Tags = append(s.Tags, xmlTag{Key: tag.Key, Group: tg.Name, Value: tag.Value})
+		}
+	}
+	for _, l := range sp.Logs {
+		s.Logs = append(s.Logs, xmlLog{
+			Time:    l.Time.UTC().Format(time.RFC3339Nano),
+			Message: l.Msg().StripMarkers(),
+		})
+	}
+	for _, c := range n.children {
+		s.Children = append(s.Children, toXMLSpan(c))
+	}
+	return s
+}
+
+// TraceToXML returns the recording as an XML document in which every span is
+// a span element nested in the element of its parent, containing a tag element
+// per tag and a log element per log message:
+//
+//	<trace id="0000000000000abc">
+//	  <span id="0000000000000001" operation="sql query" start="..." duration_ns="...">
+//	    <tag key="node">1</tag>
+//	    <log time="...">planning</log>
+//	    <span id="0000000000000002" parent="0000000000000001" ...>
+//
+// Spans whose parent is missing from the recording are children of the trace
+// element. The documents conform to TraceXMLSchema.
+func TraceToXML(r tracingpb.Recording) ([]byte, error) {
+	var traceID tracingpb.TraceID
+	if len(r) > 0 {
+		traceID = r[0].TraceID
+	}
+	t := xmlTrace{ID: HexID(uint64(traceID))}
+	for _, n := range spanForest(r) {
+		t.Spans = append(t.Spans, toXMLSpan(n))
+	}
+	b, err := xml.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	zipkinmodel "github.com/openzipkin/zipkin-go/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToWavefront(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	const expected = `"sql query" source="host1" ` +
+		`traceId=00000000-0000-0000-0000-000000000abc spanId=00000000-0000-0000-0000-000000000001 ` +
+		`application="app" service="node 1" node="1" 1672628645000 10
+"flow" source="host1" ` +
+		`traceId=00000000-0000-0000-0000-000000000abc spanId=00000000-0000-0000-0000-000000000002 ` +
+		`parent=00000000-0000-0000-0000-000000000001 application="app" service="app" cpu-time="3ms" 1672628645002 5
+"kv.Get" source="host1" ` +
+		`traceId=00000000-0000-0000-0000-000000000abc spanId=00000000-0000-0000-0000-000000000003 ` +
+		`parent=00000000-0000-0000-0000-000000000002 application="app" service="app" 1672628645003 2
+`
+	require.Equal(t, expected, stmtdiagnostics.TraceToWavefront(makeTestRecording(), "host1", "app"))
+}
+
+func TestTraceToZipkin(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	b, err := stmtdiagnostics.TraceToZipkin(makeTestRecording())
+	require.NoError(t, err)
+	const expected = `[
+  {
+    "traceId": "0000000000000abc",
+    "id": "0000000000000001",
+    "name": "sql query",
+    "timestamp": 1672628645000000,
+    "duration": 10000,
+    "localEndpoint": {"serviceName": "node 1"},
+    "tags": {"node": "1"},
+    "annotations": [{"timestamp": 1672628645001000, "value": "planning"}]
+  },
+  {
+    "traceId": "0000000000000abc",
+    "id": "0000000000000002",
+    "parentId": "0000000000000001",
+    "name": "flow",
+    "timestamp": 1672628645002000,
+    "duration": 5000,
+    "localEndpoint": {"serviceName": "cockroachdb"},
+    "tags": {"cpu-time": "3ms"}
+  },
+  {
+    "traceId": "0000000000000abc",
+    "id": "0000000000000003",
+    "parentId": "0000000000000002",
+    "name": "kv.Get",
+    "timestamp": 1672628645003000,
+    "duration": 2000,
+    "localEndpoint": {"serviceName": "cockroachdb"}
+  }
+]`
+	require.JSONEq(t, expected, string(b))
+
+	// The spans can be read by the Zipkin Go library.
+	rec := makeTestRecording()
+	var spans []zipkinmodel.SpanModel
+	require.NoError(t, json.Unmarshal(b, &spans))
+	require.Len(t, spans, len(rec))
+	for i, sp := range spans {
+		require.Equal(t, zipkinmodel.TraceID{Low: uint64(rec[i].TraceID)}, sp.TraceID)
+		require.Equal(t, zipkinmodel.ID(rec[i].SpanID), sp.ID)
+		if rec[i].ParentSpanID == 0 {
+			require.Nil(t, sp.ParentID)
+		} else {
+			require.Equal(t, zipkinmodel.ID(rec[i].ParentSpanID), *sp.ParentID)
+		}
+		require.Equal(t, rec[i].Operation, sp.Name)
+		require.True(t, rec[i].StartTime.Equal(sp.Timestamp))
+		require.Equal(t, rec[i].Duration, sp.Duration)
+	}
+}
+
+func TestTraceToB3Headers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	require.Equal(t, map[string]string{
+		"X-B3-TraceId": "0000000000000abc",
+		"X-B3-SpanId":  "0000000000000001",
+		"X-B3-Sampled": "1",
+	}, stmtdiagnostics.TraceToB3Headers(makeTestRecording()))
+	require.Nil(t, stmtdiagnostics.TraceToB3Headers(nil))
+}
+
+func TestTraceToW3CTraceContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	require.Equal(t, "00-00000000000000000000000000000abc-0000000000000001-01",
+		stmtdiagnostics.TraceToW3CTraceContext(rec))
+	require.Equal(t, "crdb=n1", stmtdiagnostics.TraceToW3CTraceState(rec))
+
+	// The trace state is empty if the root span doesn't know its node.
+	require.Equal(t, "", stmtdiagnostics.TraceToW3CTraceState(rec[1:]))
+	require.Equal(t, "", stmtdiagnostics.TraceToW3CTraceContext(nil))
+}
+
+func TestEnrichWithGRPCStatus(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	rec[2].TagGroups = []tracingpb.TagGroup{
+		{Tags: []tracingpb.Tag{{Key: "grpc.status_code", Value: "14"}}},
+	}
+	rec[1].TagGroups[0].Tags = append(rec[1].TagGroups[0].Tags,
+		tracingpb.Tag{Key: "grpc.status_code", Value: "not a code"})
+
+	enriched := stmtdiagnostics.EnrichWithGRPCStatus(rec)
+	require.Equal(t, []tracingpb.Tag{
+		{Key: "grpc.status_code", Value: "14"},
+		{Key: "grpc.status_description", Value: "Unavailable"},
+	}, enriched[2].TagGroups[0].Tags)
+	// Malformed codes are left alone.
+	require.Equal(t, rec[1].TagGroups, enriched[1].TagGroups)
+	// The input recording is not modified.
+	require.Len(t, rec[2].TagGroups[0].Tags, 1)
+}
+
+func TestTraceToNetTrace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	// Add an orphan span.
+	rec = append(rec, tracingpb.RecordedSpan{
+		TraceID:      0xabc,
+		SpanID:       5,
+		ParentSpanID: 4,
+		Operation:    "orphan",
+		StartTime:    rec[0].StartTime.Add(4 * time.Millisecond),
+		Duration:     time.Millisecond,
+	})
+	const expected = `2023/01/02 03:04:05.000000	   0.010000	sql query node=1
+03:04:05.001000	 .  1000	... planning
+03:04:05.002000	   0.005000	    flow cpu-time=3ms
+03:04:05.003000	   0.002000	        kv.Get
+03:04:05.004000	   0.001000	orphan
+`
+	require.Equal(t, expected, stmtdiagnostics.TraceToNetTrace(rec))
+}
+
+func TestTraceToFlamegraphCollapsed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	// Add a second kv.Get under the flow, which is merged with the first one.
+	rec = append(rec, rec[2])
+	rec[3].SpanID = 4
+	const expected = `sql query 5000
+sql query;flow 1000
+sql query;flow;kv.Get 4000
+`
+	require.Equal(t, expected, stmtdiagnostics.TraceToFlamegraphCollapsed(rec))
+}
+
+func TestTraceToXML(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	b, err := stmtdiagnostics.TraceToXML(makeTestRecording())
+	require.NoError(t, err)
+	const expected = `<?xml version="1.0" encoding="UTF-8"?>
+<trace id="0000000000000abc">
+  <span id="0000000000000001" operation="sql query" start="2023-01-02T03:04:05Z" duration_ns="10000000">
+    <tag key="node">1</tag>
+    <log time="2023-01-02T03:04:05.001Z">planning</log>
+    <span id="0000000000000002" parent="0000000000000001" operation="flow" start="2023-01-02T03:04:05.002Z" duration_ns="5000000">
+      <tag key="time" group="cpu">3ms</tag>
+      <span id="0000000000000003" parent="0000000000000002" operation="kv.Get" start="2023-01-02T03:04:05.003Z" duration_ns="2000000"></span>
+    </span>
+  </span>
+</trace>`
+	require.Equal(t, expected, string(b))
+
+	// The schema is a well-formed XML document.
+	d := xml.NewDecoder(bytes.NewReader([]byte(stmtdiagnostics.TraceXMLSchema)))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+}
+
+func TestTraceToFlameChartSVG(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var svg struct {
+		Width  int `xml:"width,attr"`
+		Height int `xml:"height,attr"`
+		Groups []struct {
+			Title string `xml:"title"`
+			Rect  struct {
+				X     float64 `xml:"x,attr"`
+				Y     int     `xml:"y,attr"`
+				Width float64 `xml:"width,attr"`
+			} `xml:"rect"`
+			Text string `xml:"text"`
+		} `xml:"g"`
+	}
+	require.NoError(t, xml.Unmarshal(stmtdiagnostics.TraceToFlameChartSVG(makeTestRecording()), &svg))
+	require.Equal(t, 1200, svg.Width)
+	require.Equal(t, 3*18, svg.Height)
+	require.Len(t, svg.Groups, 3)
+	for i, exp := range []struct {
+		title, text string
+		x, width    float64
+		y           int
+	}{
+		{"sql query (10ms)", "sql query", 0, 1200, 0},
+		{"flow (5ms)", "flow", 240, 600, 18},
+		{"kv.Get (2ms)", "kv.Get", 360, 240, 36},
+	} {
+		g := svg.Groups[i]
+		require.Equal(t, exp.title, g.Title)
+		require.Equal(t, exp.text, g.Text)
+		require.Equal(t, exp.x, g.Rect.X)
+		require.Equal(t, exp.width, g.Rect.Width)
+		require.Equal(t, exp.y, g.Rect.Y)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+)
+
+// OperationStats aggregates the spans of a recording that have the same
+// operation.
+type OperationStats struct {
+	Operation string
+	// Count is the number of spans.
+	Count int
+	// Total is the sum of the durations of the spans.
+	Total time.Duration
+	// Max is the duration of the longest span.
+	Max time.Duration
+}
+
+// RecordingStats summarizes a recording.
+type RecordingStats struct {
+	// NumSpans is the number of spans in the recording.
+	NumSpans int
+	// Duration is the time between the start of the first span and the end of
+	// the last one.
+	Duration time.Duration
+	// Operations contains the statistics of every operation in the recording,
+	// from the slowest to the fastest, i.e. sorted by decreasing Max, then by
+	// decreasing Total and then by operation.
+	Operations []OperationStats
+}
+
+// ComputeRecordingStats computes the statistics of the recording.
+func ComputeRecordingStats(r tracingpb.Recording) RecordingStats {
+	s := RecordingStats{NumSpans: len(r)}
+	var start, end time.Time
+	ops := make(map[string]*OperationStats)
+	for i := range r {
+		sp := &r[i]
+		if start.IsZero() || sp.StartTime.Before(start) {
+			start = sp.StartTime
+		}
+		if spEnd := sp.StartTime.Add(sp.Duration); spEnd.After(end) {
+			end = spEnd
+		}
+		op, ok := ops[sp.Operation]
+		if !ok {
+			op = &OperationStats{Operation: sp.Operation}
+			ops[sp.Operation] = op
+		}
+		op.Count++
+		op.Total += sp.Duration
+		if sp.Duration > op.Max {
+			op.Max = sp.Duration
+		}
+	}
+	s.Duration = end.Sub(start)
+	s.Operations = make([]OperationStats, 0, len(ops))
+	for _, op := range ops {
+		s.Operations = append(s.Operations, *op)
+	}
+	sort.Slice(s.Operations, func(i, j int) bool {
+		a, b := &s.Operations[i], &s.Operations[j]
+		if a.Max != b.Max {
+			return a.Max > b.Max
+		}
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		return a.Operation < b.Operation
+	})
+	return s
+}
+
+// Slowest returns the statistics of the n slowest operations.
+func (s *RecordingStats) Slowest(n int) []OperationStats {
+	if n > len(s.Operations) {
+		n = len(s.Operations)
+	}
+	return s.Operations[:n]
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeRecordingStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	// Add two more kv.Get spans, one of which ends after the root.
+	for i, d := range []time.Duration{time.Millisecond, 9 * time.Millisecond} {
+		sp := rec[2]
+		sp.SpanID = tracingpb.SpanID(4 + i)
+		sp.StartTime = sp.StartTime.Add(time.Duration(i+1) * time.Millisecond)
+		sp.Duration = d
+		rec = append(rec, sp)
+	}
+
+	s := stmtdiagnostics.ComputeRecordingStats(rec)
+	require.Equal(t, 5, s.NumSpans)
+	require.Equal(t, 14*time.Millisecond, s.Duration)
+	require.Equal(t, []stmtdiagnostics.OperationStats{
+		{Operation: "sql query", Count: 1, Total: 10 * time.Millisecond, Max: 10 * time.Millisecond},
+		{Operation: "kv.Get", Count: 3, Total: 12 * time.Millisecond, Max: 9 * time.Millisecond},
+		{Operation: "flow", Count: 1, Total: 5 * time.Millisecond, Max: 5 * time.Millisecond},
+	}, s.Operations)
+	require.Equal(t, s.Operations[:2], s.Slowest(2))
+	require.Equal(t, s.Operations, s.Slowest(5))
+
+	require.Equal(t, stmtdiagnostics.RecordingStats{
+		Operations: []stmtdiagnostics.OperationStats{},
+	}, stmtdiagnostics.ComputeRecordingStats(nil))
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+	gogoproto "github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// This file contains exporters that stream the spans of a recording to message
+// brokers, one message per span.
+
+// streamSpan is the JSON representation of a span used by the streaming
+// exporters.
+type streamSpan struct {
+	TraceID       string            `json:"trace_id"`
+	SpanID        string            `json:"span_id"`
+	ParentSpanID  string            `json:"parent_span_id,omitempty"`
+	Operation     string            `json:"operation"`
+	StartTime     time.Time         `json:"start_time"`
+	DurationNanos int64             `json:"duration_ns"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+func toStreamSpan(sp *tracingpb.RecordedSpan) streamSpan {
+	s := streamSpan{
+		TraceID:       HexID(uint64(sp.TraceID)),
+		SpanID:        HexID(uint64(sp.SpanID)),
+		Operation:     sp.Operation,
+		StartTime:     sp.StartTime.UTC(),
+		DurationNanos: sp.Duration.Nanoseconds(),
+		Tags:          SpanTags(sp),
+	}
+	if sp.ParentSpanID != 0 {
+		s.ParentSpanID = HexID(uint64(sp.ParentSpanID))
+	}
+	return s
+}
+
+// RedisClient is the subset of a Redis client used to export traces. It
+// matches the generic command interface of the common Go clients (e.g.
+// go-redis' Client.Do followed by Cmd.Result), so any of them can be used
+// with a one-line adapter.
+type RedisClient interface {
+	// Do runs the command made of args and returns its reply.
+	Do(ctx context.Context, args ...interface{}) (interface{}, error)
+}
+
+// TraceToRedis appends every span of the recording, in the order of the
+// recording, as an entry of the Redis stream streamKey, using:
+//
+//	XADD <streamKey> * span_id <id> trace_id <id> parent_span_id <id>
+//	  operation <op> start_time <time> duration_ns <dur> tags <json>
+//
+// The IDs are hex-encoded, parent_span_id is omitted for root spans, the start
+// time is in RFC 3339 format and the tags are a JSON object. The entry IDs are
+// generated by the server, so entries of concurrently exported traces may be
+// interleaved; consumers can group them by trace_id.
+func TraceToRedis(
+	ctx context.Context, r tracingpb.Recording, redisClient RedisClient, streamKey string,
+) error {
+	for i := range r {
+		s := toStreamSpan(&r[i])
+		args := []interface{}{"XADD", streamKey, "*", "span_id", s.SpanID, "trace_id", s.TraceID}
+		if s.ParentSpanID != "" {
+			args = append(args, "parent_span_id", s.ParentSpanID)
+		}
+		tags, err := json.Marshal(s.Tags)
+		if err != nil {
+			return err
+		}
+		args = append(args,
+			"operation", s.Operation,
+			"start_time", s.StartTime.Format(time.RFC3339Nano),
+			"duration_ns", strconv.FormatInt(s.DurationNanos, 10),
+			"tags", string(tags),
+		)
+		if _, err := redisClient.Do(ctx, args...); err != nil {
+			return errors.Wrapf(err, "appending span %s to Redis stream %s", s.SpanID, streamKey)
+		}
+	}
+	return nil
+}
+
+// grpcSpanCodec is the codec of the streams opened by TraceToGRPC. The spans
+// are marshaled with their gogoproto Marshal method, and the response, whose
+// type is only known by the server, is kept as raw bytes.
+type grpcSpanCodec struct{}
+
+var _ encoding.Codec = grpcSpanCodec{}
+
+func (grpcSpanCodec) Marshal(v interface{}) ([]byte, error) {
+	return protoutil.Marshal(v.(*tracingpb.RecordedSpan))
+}
+
+func (grpcSpanCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+// Name is part of the encoding.Codec interface. The name is the one of the
+// default codec, so that the content type is application/grpc+proto.
+func (grpcSpanCodec) Name() string {
+	return "proto"
+}
+
+// grpcCheckMethod uses the reflection service of the server to check that
+// method of service exists and takes a stream of RecordedSpans.
+func grpcCheckMethod(ctx context.Context, conn *grpc.ClientConn, service, method string) error {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service},
+	}); err != nil {
+		return err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	_ = stream.CloseSend()
+	if errResp := resp.GetErrorResponse(); errResp != nil {
+		return errors.Newf("looking up service %s: %s", service, errResp.ErrorMessage)
+	}
+	spanType := "." + gogoproto.MessageName(&tracingpb.RecordedSpan{})
+	for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		var fd descriptorpb.FileDescriptorProto
+		if err := proto.Unmarshal(b, &fd); err != nil {
+			return errors.Wrap(err, "parsing file descriptor")
+		}
+		for _, svc := range fd.Service {
+			name := svc.GetName()
+			if pkg := fd.GetPackage(); pkg != "" {
+				name = pkg + "." + name
+			}
+			if name != service {
+				continue
+			}
+			for _, m := range svc.Method {
+				if m.GetName() != method {
+					continue
+				}
+				if !m.GetClientStreaming() {
+					return errors.Newf("method %s/%s does not take a stream", service, method)
+				}
+				if m.GetInputType() != spanType {
+					return errors.Newf("method %s/%s takes %s, not %s",
+						service, method, strings.TrimPrefix(m.GetInputType(), "."), spanType[1:])
+				}
+				return nil
+			}
+			return errors.Newf("service %s has no method %s", service, method)
+		}
+	}
+	return errors.Newf("service %s not found", service)
+}
+
+// TraceToGRPC streams every span of the recording, in the order of the
+// recording, as a cockroach.util.tracing.tracingpb.RecordedSpan message to the
+// client-streaming method serviceMethod (package.Service/Method) of the gRPC
+// server at endpoint (host:port). The method is looked up with the server
+// reflection service, which the server must therefore enable, and its
+// response is ignored. The connection uses TLS with tlsConfig, or is in
+// plaintext if tlsConfig is nil.
+//
+// This is the gRPC counterpart of TraceToHTTP: any service that declares
+//
+//	rpc Method(stream cockroach.util.tracing.tracingpb.RecordedSpan) returns (...)
+//
+// can receive traces.
+func TraceToGRPC(
+	ctx context.Context, r tracingpb.Recording, endpoint, serviceMethod string, tlsConfig *tls.Config,
+) error {
+	service, method, ok := strings.Cut(strings.TrimPrefix(serviceMethod, "/"), "/")
+	if !ok || service == "" || method == "" {
+		return errors.Newf("invalid gRPC method %q, expected package.Service/Method", serviceMethod)
+	}
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return errors.Wrapf(err, "connecting to %s", endpoint)
+	}
+	defer func() { _ = conn.Close() }()
+	if err := grpcCheckMethod(ctx, conn, service, method); err != nil {
+		return errors.Wrap(err, "resolving gRPC method")
+	}
+
+	stream, err := conn.NewStream(ctx,
+		&grpc.StreamDesc{StreamName: method, ClientStreams: true},
+		"/"+service+"/"+method, grpc.ForceCodec(grpcSpanCodec{}))
+	if err != nil {
+		return errors.Wrapf(err, "calling %s", serviceMethod)
+	}
+	for i := range r {
+		// An io.EOF means that the server ended the stream, in which case the
+		// status is returned by RecvMsg below.
+		if err := stream.SendMsg(&r[i]); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "sending span to %s", serviceMethod)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return errors.Wrapf(err, "sending trace to %s", serviceMethod)
+	}
+	var resp []byte
+	return errors.Wrapf(stream.RecvMsg(&resp), "sending trace to %s", serviceMethod)
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// fakeRedisClient is a RedisClient that records the commands run with it.
+type fakeRedisClient struct {
+	cmds [][]interface{}
+}
+
+func (c *fakeRedisClient) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	c.cmds = append(c.cmds, args)
+	return fmt.Sprintf("1672628645000-%d", len(c.cmds)-1), nil
+}
+
+func TestTraceToRedis(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var c fakeRedisClient
+	rec := makeTestRecording()
+	require.NoError(t, stmtdiagnostics.TraceToRedis(context.Background(), rec, &c, "traces"))
+	require.Equal(t, [][]interface{}{
+		{
+			"XADD", "traces", "*",
+			"span_id", "0000000000000001", "trace_id", "0000000000000abc",
+			"operation", "sql query", "start_time", "2023-01-02T03:04:05Z",
+			"duration_ns", "10000000", "tags", `{"node":"1"}`,
+		},
+		{
+			"XADD", "traces", "*",
+			"span_id", "0000000000000002", "trace_id", "0000000000000abc",
+			"parent_span_id", "0000000000000001",
+			"operation", "flow", "start_time", "2023-01-02T03:04:05.002Z",
+			"duration_ns", "5000000", "tags", `{"cpu-time":"3ms"}`,
+		},
+		{
+			"XADD", "traces", "*",
+			"span_id", "0000000000000003", "trace_id", "0000000000000abc",
+			"parent_span_id", "0000000000000002",
+			"operation", "kv.Get", "start_time", "2023-01-02T03:04:05.003Z",
+			"duration_ns", "2000000", "tags", `{}`,
+		},
+	}, c.cmds)
+}
+
+// fakeReflectionServer is a gRPC reflection service that knows about a single
+// file, which declares the service crdb.test.Traces.
+type fakeReflectionServer struct{}
+
+var _ rpb.ServerReflectionServer = fakeReflectionServer{}
+
+func (fakeReflectionServer) ServerReflectionInfo(
+	stream rpb.ServerReflection_ServerReflectionInfoServer,
+) error {
+	const spanType = ".cockroach.util.tracing.tracingpb.RecordedSpan"
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("traces.proto"),
+		Package: proto.String("crdb.test"),
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Traces"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{
+					Name:            proto.String("Send"),
+					InputType:       proto.String(spanType),
+					OutputType:      proto.String(".google.protobuf.Empty"),
+					ClientStreaming: proto.Bool(true),
+				},
+				{
+					Name:       proto.String("Unary"),
+					InputType:  proto.String(spanType),
+					OutputType: proto.String(".google.protobuf.Empty"),
+				},
+				{
+					Name:            proto.String("Other"),
+					InputType:       proto.String(".google.protobuf.Empty"),
+					OutputType:      proto.String(".google.protobuf.Empty"),
+					ClientStreaming: proto.Bool(true),
+				},
+			},
+		}},
+	}
+	fdBytes, err := proto.Marshal(fd)
+	if err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		resp := &rpb.ServerReflectionResponse{OriginalRequest: req}
+		if req.GetFileContainingSymbol() == "crdb.test.Traces" {
+			resp.MessageResponse = &rpb.ServerReflectionResponse_FileDescriptorResponse{
+				FileDescriptorResponse: &rpb.FileDescriptorResponse{FileDescriptorProto: [][]byte{fdBytes}},
+			}
+		} else {
+			resp.MessageResponse = &rpb.ServerReflectionResponse_ErrorResponse{
+				ErrorResponse: &rpb.ErrorResponse{ErrorCode: 5, ErrorMessage: "symbol not found"},
+			}
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func TestTraceToGRPC(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var spans []tracingpb.RecordedSpan
+	s := grpc.NewServer()
+	rpb.RegisterServerReflectionServer(s, fakeReflectionServer{})
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "crdb.test.Traces",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Send",
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				for {
+					var sp tracingpb.RecordedSpan
+					if err := stream.RecvMsg(&sp); err == io.EOF {
+						return stream.SendMsg(&types.Empty{})
+					} else if err != nil {
+						return err
+					}
+					spans = append(spans, sp)
+				}
+			},
+		}},
+	}, struct{}{})
+	go func() { _ = s.Serve(ln) }()
+	defer s.Stop()
+
+	rec := makeTestRecording()
+	require.NoError(t, stmtdiagnostics.TraceToGRPC(
+		ctx, rec, ln.Addr().String(), "crdb.test.Traces/Send", nil, /* tlsConfig */
+	))
+	require.Len(t, spans, len(rec))
+	for i := range rec {
+		require.Equal(t, rec[i].SpanID, spans[i].SpanID)
+		require.Equal(t, rec[i].Operation, spans[i].Operation)
+		require.True(t, rec[i].StartTime.Equal(spans[i].StartTime))
+		require.Equal(t, rec[i].Duration, spans[i].Duration)
+	}
+
+	for _, tc := range []struct {
+		method string
+		err    string
+	}{
+		{"/crdb.test.Traces/Send", ""},
+		{"crdb.test.Traces", `invalid gRPC method "crdb.test.Traces"`},
+		{"crdb.test.Missing/Send", "looking up service crdb.test.Missing: symbol not found"},
+		{"crdb.test.Traces/Missing", "service crdb.test.Traces has no method Missing"},
+		{"crdb.test.Traces/Unary", "method crdb.test.Traces/Unary does not take a stream"},
+		{"crdb.test.Traces/Other",
+			"method crdb.test.Traces/Other takes google.protobuf.Empty, not cockroach.util.tracing.tracingpb.RecordedSpan"},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			err := stmtdiagnostics.TraceToGRPC(ctx, rec, ln.Addr().String(), tc.method, nil /* tlsConfig */)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/redact"
+	"gopkg.in/yaml.v2"
+)
+
+// This file contains round-trippable, human-editable text representations of
+// a tracingpb.Recording, suitable for checking traces in as test fixtures.
+// The following fields of every span are preserved: the IDs, the operation,
+// the start time and duration, the tag groups, the log messages (including
+// their redaction markers), the goroutine ID and whether the span is verbose
+// and finished. Structured records and children metadata are not preserved.
+
+// textSpan is the representation of a span shared by the text formats.
+type textSpan struct {
+	TraceID      uint64         `yaml:"trace_id" toml:"trace_id"`
+	SpanID       uint64         `yaml:"span_id" toml:"span_id"`
+	ParentSpanID uint64         `yaml:"parent_span_id,omitempty" toml:"parent_span_id,omitzero"`
+	Operation    string         `yaml:"operation" toml:"operation"`
+	StartTime    time.Time      `yaml:"start_time" toml:"start_time"`
+	Duration     string         `yaml:"duration" toml:"duration"`
+	GoroutineID  uint64         `yaml:"goroutine_id,omitempty" toml:"goroutine_id,omitzero"`
+	Verbose      bool           `yaml:"verbose,omitempty" toml:"verbose,omitempty"`
+	Finished     bool           `yaml:"finished,omitempty" toml:"finished,omitempty"`
+	TagGroups    []textTagGroup `yaml:"tag_groups,omitempty" toml:"tag_groups,omitempty"`
+	Logs         []textLog      `yaml:"logs,omitempty" toml:"logs,omitempty"`
+}
+
+type textTagGroup struct {
+	Name string    `yaml:"name,omitempty" toml:"name,omitempty"`
+	Tags []textTag `yaml:"tags" toml:"tags"`
+}
+
+type textTag struct {
+	Key   string `yaml:"key" toml:"key"`
+	Value string `yaml:"value" toml:"value"`
+}
+
+type textLog struct {
+	Time    time.Time `yaml:"time" toml:"time"`
+	Message string    `yaml:"message" toml:"message"`
+}
+
+// toTextSpans converts the recording to its text representation.
+func toTextSpans(r tracingpb.Recording) []textSpan {
+	spans := make([]textSpan, len(r))
+	for i := range r {
+		sp := &r[i]
+		s := &spans[i]
+		*s = textSpan{
+			TraceID:      uint64(sp.TraceID),
+			SpanID:       uint64(sp.SpanID),
+			ParentSpanID: uint64(sp.ParentSpanID),
+			Operation:    sp.Operation,
+			StartTime:    sp.StartTime.UTC(),
+			Duration:     sp.Duration.String(),
+			GoroutineID:  sp.GoroutineID,
+			Verbose:      sp.Verbose,
+			Finished:     sp.Finished,
+		}
+		for _, tg := range sp.TagGroups {
+			g := textTagGroup{Name: tg.Name, Tags: make([]textTag, len(tg.Tags))}
+			for j, tag := range tg.Tags {
+				g.Tags[j] = textTag{Key: tag.Key, Value: tag.Value}
+			}
+			s.TagGroups = append(s.TagGroups, g)
+		}
+		for _, l := range sp.Logs {
+			s.Logs = append(s.Logs, textLog{Time: l.Time.UTC(), Message: string(l.Message)})
+		}
+	}
+	return spans
+}
+
+// fromTextSpans converts the text representation of a recording back to a
+// recording.
+func fromTextSpans(spans []textSpan) (tracingpb.Recording, error) {
+	r := make(tracingpb.Recording, len(spans))
+	for i := range spans {
+		s := &spans[i]
+		d, err := time.ParseDuration(s.Duration)
+		if err != nil {
+			return nil, errors.Wrapf(err, "span %d", s.SpanID)
+		}
+		sp := &r[i]
+		*sp = tracingpb.RecordedSpan{
+			TraceID:      tracingpb.TraceID(s.TraceID),
+			SpanID:       tracingpb.SpanID(s.SpanID),
+			ParentSpanID: tracingpb.SpanID(s.ParentSpanID),
+			Operation:    s.Operation,
+			StartTime:    s.StartTime.UTC(),
+			Duration:     d,
+			GoroutineID:  s.GoroutineID,
+			Verbose:      s.Verbose,
+			Finished:     s.Finished,
+		}
+		for _, g := range s.TagGroups {
+			tg := tracingpb.TagGroup{Name: g.Name, Tags: make([]tracingpb.Tag, len(g.Tags))}
+			for j, tag := range g.Tags {
+				tg.Tags[j] = tracingpb.Tag{Key: tag.Key, Value: tag.Value}
+			}
+			sp.TagGroups = append(sp.TagGroups, tg)
+		}
+		for _, l := range s.Logs {
+			sp.Logs = append(sp.Logs, tracingpb.LogRecord{
+				Time:    l.Time.UTC(),
+				Message: redact.RedactableString(l.Message),
+			})
+		}
+	}
+	return r, nil
+}
+
+// TraceToYAML returns the recording as a YAML list of spans. Unlike the JSON
+// produced by tracing.TraceToJSON, the YAML can be parsed back into a
+// recording using ParseYAMLTrace, which makes it convenient for golden files
+// and hand-edited test fixtures.
+func TraceToYAML(r tracingpb.Recording) ([]byte, error) {
+	return yaml.Marshal(toTextSpans(r))
+}
+
+// ParseYAMLTrace parses a recording produced by TraceToYAML.
+func ParseYAMLTrace(b []byte) (tracingpb.Recording, error) {
+	var spans []textSpan
+	if err := yaml.UnmarshalStrict(b, &spans); err != nil {
+		return nil, errors.Wrap(err, "parsing YAML trace")
+	}
+	return fromTextSpans(spans)
+}
+
+// tomlTrace is the top-level table of the TOML representation of a trace.
+type tomlTrace struct {
+	Spans []textSpan `toml:"spans"`
+}
+
+// TraceToTOML returns the recording as a TOML document containing an array of
+// span tables. Like the YAML representation, the TOML can be parsed back into
+// a recording (using ParseTOMLTrace) and is meant for test fixtures.
+func TraceToTOML(r tracingpb.Recording) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(tomlTrace{Spans: toTextSpans(r)}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseTOMLTrace parses a recording produced by TraceToTOML.
+func ParseTOMLTrace(b []byte) (tracingpb.Recording, error) {
+	var t tomlTrace
+	md, err := toml.Decode(string(b), &t)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing TOML trace")
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, errors.Newf("parsing TOML trace: unknown key %s", undecoded[0])
+	}
+	return fromTextSpans(t.Spans)
+}
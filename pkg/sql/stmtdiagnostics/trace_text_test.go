@@ -0,0 +1,95 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package stmtdiagnostics_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/testutils/datapathutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToYAML(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	rec[0].Logs[0].Message = "planning ‹secret›"
+	rec[0].Finished = true
+	b, err := stmtdiagnostics.TraceToYAML(rec)
+	require.NoError(t, err)
+	const expected = `- trace_id: 2748
+  span_id: 1
+  operation: sql query
+  start_time: 2023-01-02T03:04:05Z
+  duration: 10ms
+  finished: true
+  tag_groups:
+  - tags:
+    - key: node
+      value: "1"
+  logs:
+  - time: 2023-01-02T03:04:05.001Z
+    message: planning ‹secret›
+- trace_id: 2748
+  span_id: 2
+  parent_span_id: 1
+  operation: flow
+  start_time: 2023-01-02T03:04:05.002Z
+  duration: 5ms
+  tag_groups:
+  - name: cpu
+    tags:
+    - key: time
+      value: 3ms
+- trace_id: 2748
+  span_id: 3
+  parent_span_id: 2
+  operation: kv.Get
+  start_time: 2023-01-02T03:04:05.003Z
+  duration: 2ms
+`
+	require.Equal(t, expected, string(b))
+
+	parsed, err := stmtdiagnostics.ParseYAMLTrace(b)
+	require.NoError(t, err)
+	require.Equal(t, rec, parsed)
+
+	_, err = stmtdiagnostics.ParseYAMLTrace([]byte("- span_id: 1\n  duration: forever\n"))
+	require.Error(t, err)
+	_, err = stmtdiagnostics.ParseYAMLTrace([]byte("- span_idd: 1\n"))
+	require.Error(t, err)
+}
+
+func TestTraceToTOML(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	// testdata/trace.toml is the TOML representation of makeTestRecording().
+	expected, err := os.ReadFile(datapathutils.TestDataPath(t, "trace.toml"))
+	require.NoError(t, err)
+
+	rec := makeTestRecording()
+	b, err := stmtdiagnostics.TraceToTOML(rec)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(b))
+
+	parsed, err := stmtdiagnostics.ParseTOMLTrace(expected)
+	require.NoError(t, err)
+	require.Equal(t, rec, parsed)
+
+	_, err = stmtdiagnostics.ParseTOMLTrace([]byte("[[spans]]\nspan_idd = 1\n"))
+	require.Error(t, err)
+}
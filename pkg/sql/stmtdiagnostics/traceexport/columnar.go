@@ -0,0 +1,277 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquet"
+	"github.com/fraugster/parquet-go/parquetschema"
+	"github.com/linkedin/goavro/v2"
+)
+
+// This file contains converters from a tracingpb.Recording to columnar file
+// formats, in which every span is a row.
+
+// SpansParquetSchema is the schema of the Parquet files produced by
+// TraceToParquet. Every span of the recording is a row:
+//   - trace_id, span_id, parent_span_id: the IDs of the span, as unsigned
+//     integers. parent_span_id is zero for the root span.
+//   - operation: the operation of the span.
+//   - start_time: the start time of the span, in nanoseconds since the Unix
+//     epoch.
+//   - duration_ns: the duration of the span, in nanoseconds.
+//   - tags: the tags of the span, as a JSON object. Tags in named tag groups
+//     are prefixed with the name of the group.
+//
+// This schema is part of the public API: columns may be added to it, but the
+// existing columns are not changed.
+const SpansParquetSchema = `message span {
+	required int64 trace_id (INT(64, false));
+	required int64 span_id (INT(64, false));
+	required int64 parent_span_id (INT(64, false));
+	required binary operation (STRING);
+	required int64 start_time (TIMESTAMP(NANOS, true));
+	required int64 duration_ns;
+	required binary tags (JSON);
+}`
+
+var spansParquetSchemaDef = func() *parquetschema.SchemaDefinition {
+	sd, err := parquetschema.ParseSchemaDefinition(SpansParquetSchema)
+	if err != nil {
+		panic(err)
+	}
+	return sd
+}()
+
+// TraceToParquet writes the spans of the recording to w as a Snappy-compressed
+// Parquet file with the schema described by SpansParquetSchema.
+func TraceToParquet(r tracingpb.Recording, w io.Writer) error {
+	fw := goparquet.NewFileWriter(w,
+		goparquet.WithSchemaDefinition(spansParquetSchemaDef),
+		goparquet.WithCompressionCodec(parquet.CompressionCodec_SNAPPY),
+		goparquet.WithCreator("cockroachdb"),
+	)
+	for i := range r {
+		sp := &r[i]
+		tags, err := json.Marshal(stmtdiagnostics.SpanTags(sp))
+		if err != nil {
+			return err
+		}
+		if err := fw.AddData(map[string]interface{}{
+			"trace_id":       int64(sp.TraceID),
+			"span_id":        int64(sp.SpanID),
+			"parent_span_id": int64(sp.ParentSpanID),
+			"operation":      []byte(sp.Operation),
+			"start_time":     sp.StartTime.UnixNano(),
+			"duration_ns":    sp.Duration.Nanoseconds(),
+			"tags":           tags,
+		}); err != nil {
+			return errors.Wrapf(err, "writing span %d", sp.SpanID)
+		}
+	}
+	return fw.Close()
+}
+
+// SpansAvroSchema is the Avro schema of the records produced by TraceToAvro.
+// It has the same fields as SpansParquetSchema, except that the tags are an
+// Avro map instead of a JSON object.
+const SpansAvroSchema = `{
+	"type": "record",
+	"name": "span",
+	"namespace": "cockroachdb.stmtdiagnostics",
+	"fields": [
+		{"name": "trace_id", "type": "long"},
+		{"name": "span_id", "type": "long"},
+		{"name": "parent_span_id", "type": "long"},
+		{"name": "operation", "type": "string"},
+		{"name": "start_time", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "duration_ns", "type": "long"},
+		{"name": "tags", "type": {"type": "map", "values": "string"}}
+	]
+}`
+
+// SpansAvroSubject is the Schema Registry subject under which TraceToAvro
+// registers SpansAvroSchema.
+const SpansAvroSubject = "cockroachdb-statement-trace-spans-value"
+
+var spansAvroCodec = func() *goavro.Codec {
+	codec, err := goavro.NewCodec(SpansAvroSchema)
+	if err != nil {
+		panic(err)
+	}
+	return codec
+}()
+
+// avroSchemaIDs caches the ID assigned to SpansAvroSchema by each Schema
+// Registry, keyed by the registry's URL.
+var avroSchemaIDs struct {
+	syncutil.Mutex
+	m map[string]int32
+}
+
+// registerSpansAvroSchema registers SpansAvroSchema with the Confluent Schema
+// Registry at registryURL and returns its ID. The ID is cached, so the schema
+// is only posted the first time a given registry is used.
+//
+// See https://docs.confluent.io/platform/current/schema-registry/develop/api.html#post--subjects-(string-%20subject)-versions.
+func registerSpansAvroSchema(ctx context.Context, registryURL string) (int32, error) {
+	avroSchemaIDs.Lock()
+	id, ok := avroSchemaIDs.m[registryURL]
+	avroSchemaIDs.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	url := strings.TrimSuffix(registryURL, "/") + "/subjects/" + SpansAvroSubject + "/versions"
+	req := struct {
+		Schema string `json:"schema"`
+	}{Schema: SpansAvroSchema}
+	var resp struct {
+		ID int32 `json:"id"`
+	}
+	if err := stmtdiagnostics.DoJSONRequest(ctx, http.MethodPost, url, nil /* header */, req, &resp); err != nil {
+		return 0, errors.Wrap(err, "registering Avro schema")
+	}
+
+	avroSchemaIDs.Lock()
+	defer avroSchemaIDs.Unlock()
+	if avroSchemaIDs.m == nil {
+		avroSchemaIDs.m = make(map[string]int32)
+	}
+	avroSchemaIDs.m[registryURL] = resp.ID
+	return resp.ID, nil
+}
+
+// TraceToAvro converts every span of the recording to a record with the schema
+// SpansAvroSchema, encoded in the Confluent wire format: a zero magic byte, the
+// 4-byte big-endian ID of the schema in the Schema Registry at
+// schemaRegistryURL, and the Avro binary encoding of the record. One message
+// is returned per span, in the order of the recording.
+//
+// The schema is registered on the first call for a given registry and its ID
+// is cached for subsequent calls.
+func TraceToAvro(
+	ctx context.Context, r tracingpb.Recording, schemaRegistryURL string,
+) ([][]byte, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	id, err := registerSpansAvroSchema(ctx, schemaRegistryURL)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([][]byte, len(r))
+	for i := range r {
+		sp := &r[i]
+		tags := make(map[string]interface{})
+		for k, v := range stmtdiagnostics.SpanTags(sp) {
+			tags[k] = v
+		}
+		header := make([]byte, 5)
+		binary.BigEndian.PutUint32(header[1:], uint32(id))
+		msg, err := spansAvroCodec.BinaryFromNative(header, map[string]interface{}{
+			"trace_id":       int64(sp.TraceID),
+			"span_id":        int64(sp.SpanID),
+			"parent_span_id": int64(sp.ParentSpanID),
+			"operation":      sp.Operation,
+			"start_time":     sp.StartTime,
+			"duration_ns":    sp.Duration.Nanoseconds(),
+			"tags":           tags,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "encoding span %d", sp.SpanID)
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+// spansArrowSchema is the Arrow schema of the files produced by TraceToFeather.
+// It has the same columns as SpansParquetSchema.
+var spansArrowSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "trace_id", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "span_id", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "parent_span_id", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "operation", Type: arrow.BinaryTypes.String},
+	{Name: "start_time", Type: &arrow.TimestampType{Unit: arrow.Nanosecond, TimeZone: "UTC"}},
+	{Name: "duration_ns", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "tags", Type: arrow.BinaryTypes.String},
+}, nil /* metadata */)
+
+// positionWriter wraps an io.Writer to implement io.WriteSeeker, as required by
+// ipc.NewFileWriter, which only ever seeks to find the current position.
+type positionWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (w *positionWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.pos += int64(n)
+	return n, err
+}
+
+func (w *positionWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		return 0, errors.AssertionFailedf("unsupported seek to %d (whence %d)", offset, whence)
+	}
+	return w.pos, nil
+}
+
+// TraceToFeather writes the spans of the recording to w as an Arrow IPC file
+// (also known as Feather V2), with the same columns as the Parquet files
+// produced by TraceToParquet; the tags are a JSON string. The
+// file can be read directly by pandas.read_feather and R's arrow::read_feather.
+func TraceToFeather(r tracingpb.Recording, w io.Writer) error {
+	mem := memory.NewGoAllocator()
+	b := array.NewRecordBuilder(mem, spansArrowSchema)
+	defer b.Release()
+	for i := range r {
+		sp := &r[i]
+		tags, err := json.Marshal(stmtdiagnostics.SpanTags(sp))
+		if err != nil {
+			return err
+		}
+		b.Field(0).(*array.Uint64Builder).Append(uint64(sp.TraceID))
+		b.Field(1).(*array.Uint64Builder).Append(uint64(sp.SpanID))
+		b.Field(2).(*array.Uint64Builder).Append(uint64(sp.ParentSpanID))
+		b.Field(3).(*array.StringBuilder).Append(sp.Operation)
+		b.Field(4).(*array.TimestampBuilder).Append(arrow.Timestamp(sp.StartTime.UnixNano()))
+		b.Field(5).(*array.Int64Builder).Append(sp.Duration.Nanoseconds())
+		b.Field(6).(*array.StringBuilder).Append(string(tags))
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+
+	fw, err := ipc.NewFileWriter(&positionWriter{w: w}, ipc.WithSchema(spansArrowSchema), ipc.WithAllocator(mem))
+	if err != nil {
+		return err
+	}
+	if err := fw.Write(rec); err != nil {
+		return errors.CombineErrors(err, fw.Close())
+	}
+	return fw.Close()
+}
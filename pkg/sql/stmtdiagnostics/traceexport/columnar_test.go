@@ -0,0 +1,130 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics/traceexport"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToParquet(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	var buf bytes.Buffer
+	require.NoError(t, traceexport.TraceToParquet(rec, &buf))
+
+	fr, err := goparquet.NewFileReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(rec)), fr.NumRows())
+	for i := range rec {
+		row, err := fr.NextRow()
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"trace_id":       int64(rec[i].TraceID),
+			"span_id":        int64(rec[i].SpanID),
+			"parent_span_id": int64(rec[i].ParentSpanID),
+			"operation":      []byte(rec[i].Operation),
+			"start_time":     rec[i].StartTime.UnixNano(),
+			"duration_ns":    rec[i].Duration.Nanoseconds(),
+			"tags":           row["tags"],
+		}, row)
+	}
+}
+
+func TestTraceToAvro(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var registrations int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registrations++
+		require.Equal(t, "/subjects/"+traceexport.SpansAvroSubject+"/versions", r.URL.Path)
+		var req struct {
+			Schema string `json:"schema"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, traceexport.SpansAvroSchema, req.Schema)
+		_, err := w.Write([]byte(`{"id": 42}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	codec, err := goavro.NewCodec(traceexport.SpansAvroSchema)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	rec := makeTestRecording()
+	for i := 0; i < 2; i++ {
+		msgs, err := traceexport.TraceToAvro(ctx, rec, srv.URL)
+		require.NoError(t, err)
+		require.Len(t, msgs, len(rec))
+		for j, msg := range msgs {
+			require.Equal(t, byte(0), msg[0])
+			require.Equal(t, uint32(42), binary.BigEndian.Uint32(msg[1:5]))
+			native, rest, err := codec.NativeFromBinary(msg[5:])
+			require.NoError(t, err)
+			require.Empty(t, rest)
+			fields := native.(map[string]interface{})
+			require.Equal(t, int64(rec[j].SpanID), fields["span_id"])
+			require.Equal(t, rec[j].Operation, fields["operation"])
+			require.True(t, rec[j].StartTime.Equal(fields["start_time"].(time.Time)))
+		}
+	}
+	// The schema is only registered once.
+	require.Equal(t, 1, registrations)
+}
+
+func TestTraceToFeather(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rec := makeTestRecording()
+	var buf bytes.Buffer
+	require.NoError(t, traceexport.TraceToFeather(rec, &buf))
+
+	fr, err := ipc.NewFileReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	defer fr.Close()
+	require.Equal(t, 1, fr.NumRecords())
+	batch, err := fr.Record(0)
+	require.NoError(t, err)
+	defer batch.Release()
+	require.Equal(t, int64(len(rec)), batch.NumRows())
+
+	spanIDs := batch.Column(1).(*array.Uint64)
+	operations := batch.Column(3).(*array.String)
+	startTimes := batch.Column(4).(*array.Timestamp)
+	tags := batch.Column(6).(*array.String)
+	for i := range rec {
+		require.Equal(t, uint64(rec[i].SpanID), spanIDs.Value(i))
+		require.Equal(t, rec[i].Operation, operations.Value(i))
+		require.Equal(t, arrow.Timestamp(rec[i].StartTime.UnixNano()), startTimes.Value(i))
+	}
+	require.Equal(t, `{"cpu-time":"3ms"}`, tags.Value(1))
+}
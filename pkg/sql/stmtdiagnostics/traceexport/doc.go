@@ -0,0 +1,21 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package traceexport contains exporters of statement traces whose client
+// libraries are too heavy, or have side effects too wide, to be linked into
+// the SQL server: e.g. database drivers that register themselves with
+// database/sql, a Sentry client beside the crash reporter's own, or columnar
+// file format libraries. The server doesn't import this package; the
+// exporters are meant to be used by tools and tests that process the traces of
+// statement bundles offline.
+//
+// The exporters that the server uses, e.g. the ones that ship collected
+// bundles to external systems, are in package stmtdiagnostics.
+package traceexport
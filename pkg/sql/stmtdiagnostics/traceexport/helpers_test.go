@@ -0,0 +1,78 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport_test
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+)
+
+// makeTestRecording returns a small recording with a root span, a child span
+// and a grandchild span.
+func makeTestRecording() tracingpb.Recording {
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	return tracingpb.Recording{
+		{
+			TraceID:   0xabc,
+			SpanID:    1,
+			Operation: "sql query",
+			StartTime: start,
+			Duration:  10 * time.Millisecond,
+			TagGroups: []tracingpb.TagGroup{
+				{Tags: []tracingpb.Tag{{Key: "node", Value: "1"}}},
+			},
+			Logs: []tracingpb.LogRecord{
+				{Time: start.Add(time.Millisecond), Message: "planning"},
+			},
+		},
+		{
+			TraceID:      0xabc,
+			SpanID:       2,
+			ParentSpanID: 1,
+			Operation:    "flow",
+			StartTime:    start.Add(2 * time.Millisecond),
+			Duration:     5 * time.Millisecond,
+			TagGroups: []tracingpb.TagGroup{
+				{Name: "cpu", Tags: []tracingpb.Tag{{Key: "time", Value: "3ms"}}},
+			},
+		},
+		{
+			TraceID:      0xabc,
+			SpanID:       3,
+			ParentSpanID: 2,
+			Operation:    "kv.Get",
+			StartTime:    start.Add(3 * time.Millisecond),
+			Duration:     2 * time.Millisecond,
+		},
+	}
+}
+
+// makeTestBundle returns a bundle whose trace is makeTestRecording. The DB
+// Console is served at adminURL.
+func makeTestBundle(adminURL string) *stmtdiagnostics.Bundle {
+	return &stmtdiagnostics.Bundle{
+		ID:          42,
+		RequestID:   7,
+		Fingerprint: "SELECT * FROM t WHERE k = _",
+		Statement:   "SELECT * FROM t WHERE k = 1",
+		InstanceID:  1,
+		CollectedAt: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:    10 * time.Millisecond,
+		Err:         errors.New("boom"),
+		Plan:        "• scan\n  table: t@t_pkey",
+		Trace:       makeTestRecording(),
+		Zip:         []byte("PK\x03\x04bundle"),
+		AdminURL:    adminURL,
+	}
+}
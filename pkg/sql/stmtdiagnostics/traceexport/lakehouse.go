@@ -0,0 +1,746 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/oserror"
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquet"
+	"github.com/fraugster/parquet-go/parquetschema"
+	"github.com/linkedin/goavro/v2"
+)
+
+// This file contains writers appending the spans of a tracingpb.Recording to
+// tables in data lakehouse formats. The tables are stored in a directory of the
+// local filesystem, which can be synced to object storage.
+
+// lakehouseParquetSchema is the schema of the Parquet data files written to
+// lakehouse tables. It has the same columns as SpansParquetSchema but only
+// uses types supported by all the table formats: the IDs are signed,
+// timestamps have microsecond precision and the tags are a plain string
+// (containing a JSON object). The columns carry the field IDs of the Iceberg
+// schema.
+const lakehouseParquetSchema = `message span {
+	required int64 trace_id = 1;
+	required int64 span_id = 2;
+	required int64 parent_span_id = 3;
+	required binary operation (STRING) = 4;
+	required int64 start_time (TIMESTAMP(MICROS, true)) = 5;
+	required int64 duration_ns = 6;
+	required binary tags (STRING) = 7;
+}`
+
+var lakehouseParquetSchemaDef = func() *parquetschema.SchemaDefinition {
+	sd, err := parquetschema.ParseSchemaDefinition(lakehouseParquetSchema)
+	if err != nil {
+		panic(err)
+	}
+	return sd
+}()
+
+// writeLakehouseDataFile writes the spans of the recording to a new Parquet
+// file at path and returns the size of the file. The schema of the file is sd,
+// which must contain the columns of lakehouseParquetSchema; if it has other
+// columns, addColumns is called to add their values to the row of every span.
+func writeLakehouseDataFile(
+	path string,
+	sd *parquetschema.SchemaDefinition,
+	r tracingpb.Recording,
+	addColumns func(i int, row map[string]interface{}),
+) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	fw := goparquet.NewFileWriter(f,
+		goparquet.WithSchemaDefinition(sd),
+		goparquet.WithCompressionCodec(parquet.CompressionCodec_SNAPPY),
+		goparquet.WithCreator("cockroachdb"),
+	)
+	for i := range r {
+		sp := &r[i]
+		tags, err := json.Marshal(stmtdiagnostics.SpanTags(sp))
+		if err != nil {
+			return 0, errors.CombineErrors(err, f.Close())
+		}
+		row := map[string]interface{}{
+			"trace_id":       int64(sp.TraceID),
+			"span_id":        int64(sp.SpanID),
+			"parent_span_id": int64(sp.ParentSpanID),
+			"operation":      []byte(sp.Operation),
+			"start_time":     sp.StartTime.UnixMicro(),
+			"duration_ns":    sp.Duration.Nanoseconds(),
+			"tags":           tags,
+		}
+		if addColumns != nil {
+			addColumns(i, row)
+		}
+		if err := fw.AddData(row); err != nil {
+			err = errors.Wrapf(err, "writing span %d", sp.SpanID)
+			return 0, errors.CombineErrors(err, f.Close())
+		}
+	}
+	if err := fw.Close(); err != nil {
+		return 0, errors.CombineErrors(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// writeFileExclusive atomically creates a file at path with the given
+// contents. It fails if the file already exists, which lets concurrent writers
+// detect conflicting commits.
+func writeFileExclusive(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.%s.tmp", path, uuid.MakeV4())
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp) }()
+	if err := os.Link(tmp, path); err != nil {
+		if oserror.IsExist(err) {
+			return errors.Newf("%s already exists: concurrent commit", path)
+		}
+		return err
+	}
+	return nil
+}
+
+// localPath converts a path written in table metadata to a local path.
+func localPath(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, "file://"), "file:")
+}
+
+// icebergSchemaJSON is the schema of the Iceberg tables written by
+// TraceToIceberg, matching lakehouseParquetSchema.
+const icebergSchemaJSON = `{
+  "type": "struct",
+  "schema-id": 0,
+  "fields": [
+    {"id": 1, "name": "trace_id", "required": true, "type": "long"},
+    {"id": 2, "name": "span_id", "required": true, "type": "long"},
+    {"id": 3, "name": "parent_span_id", "required": true, "type": "long"},
+    {"id": 4, "name": "operation", "required": true, "type": "string"},
+    {"id": 5, "name": "start_time", "required": true, "type": "timestamptz"},
+    {"id": 6, "name": "duration_ns", "required": true, "type": "long"},
+    {"id": 7, "name": "tags", "required": true, "type": "string"}
+  ]
+}`
+
+// icebergManifestListSchema is the Avro schema of Iceberg v1 manifest lists.
+const icebergManifestListSchema = `{
+  "type": "record",
+  "name": "manifest_file",
+  "fields": [
+    {"name": "manifest_path", "type": "string", "field-id": 500},
+    {"name": "manifest_length", "type": "long", "field-id": 501},
+    {"name": "partition_spec_id", "type": "int", "field-id": 502},
+    {"name": "added_snapshot_id", "type": ["null", "long"], "default": null, "field-id": 503},
+    {"name": "added_data_files_count", "type": ["null", "int"], "default": null, "field-id": 504},
+    {"name": "existing_data_files_count", "type": ["null", "int"], "default": null, "field-id": 505},
+    {"name": "deleted_data_files_count", "type": ["null", "int"], "default": null, "field-id": 506},
+    {"name": "added_rows_count", "type": ["null", "long"], "default": null, "field-id": 512},
+    {"name": "existing_rows_count", "type": ["null", "long"], "default": null, "field-id": 513},
+    {"name": "deleted_rows_count", "type": ["null", "long"], "default": null, "field-id": 514}
+  ]
+}`
+
+// icebergManifestSchema is the Avro schema of Iceberg v1 manifests, for an
+// unpartitioned table.
+const icebergManifestSchema = `{
+  "type": "record",
+  "name": "manifest_entry",
+  "fields": [
+    {"name": "status", "type": "int", "field-id": 0},
+    {"name": "snapshot_id", "type": "long", "field-id": 1},
+    {"name": "data_file", "field-id": 2, "type": {
+      "type": "record",
+      "name": "r2",
+      "fields": [
+        {"name": "file_path", "type": "string", "field-id": 100},
+        {"name": "file_format", "type": "string", "field-id": 101},
+        {"name": "partition", "field-id": 102, "type": {"type": "record", "name": "r102", "fields": []}},
+        {"name": "record_count", "type": "long", "field-id": 103},
+        {"name": "file_size_in_bytes", "type": "long", "field-id": 104},
+        {"name": "block_size_in_bytes", "type": "long", "field-id": 105}
+      ]
+    }}
+  ]
+}`
+
+// writeAvroFile writes the given records to a new Avro object container file
+// at path and returns the size of the file.
+func writeAvroFile(
+	path, schema string, metadata map[string][]byte, records []interface{},
+) (int64, error) {
+	var buf bytes.Buffer
+	w, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               &buf,
+		Schema:          schema,
+		CompressionName: goavro.CompressionDeflateLabel,
+		MetaData:        metadata,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Append(records); err != nil {
+		return 0, err
+	}
+	return int64(buf.Len()), writeFileExclusive(path, buf.Bytes())
+}
+
+// readAvroFile reads all the records of the Avro object container file at
+// path.
+func readAvroFile(path string) ([]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := goavro.NewOCFReader(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	var records []interface{}
+	for r.Scan() {
+		rec, err := r.Read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", path)
+		}
+		records = append(records, rec)
+	}
+	return records, errors.Wrapf(r.Err(), "reading %s", path)
+}
+
+// readIcebergMetadata reads the current metadata of the Iceberg table whose
+// metadata directory is metadataDir, as indicated by version-hint.text. It
+// returns a zero version and nil metadata if the table doesn't exist yet.
+func readIcebergMetadata(metadataDir string) (int, map[string]interface{}, error) {
+	hint, err := os.ReadFile(filepath.Join(metadataDir, "version-hint.text"))
+	if oserror.IsNotExist(err) {
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(hint)))
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "parsing Iceberg version hint")
+	}
+	b, err := os.ReadFile(filepath.Join(metadataDir, icebergMetadataFile(version)))
+	if err != nil {
+		return 0, nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var md map[string]interface{}
+	if err := d.Decode(&md); err != nil {
+		return 0, nil, errors.Wrap(err, "parsing Iceberg table metadata")
+	}
+	if v := fmt.Sprint(md["format-version"]); v != "1" {
+		return 0, nil, errors.Newf("unsupported Iceberg format version %s", v)
+	}
+	return version, md, nil
+}
+
+func icebergMetadataFile(version int) string {
+	return fmt.Sprintf("v%d.metadata.json", version)
+}
+
+// icebergCurrentSnapshot returns the current snapshot of the table, or nil if
+// the table has no snapshots.
+func icebergCurrentSnapshot(md map[string]interface{}) map[string]interface{} {
+	current := fmt.Sprint(md["current-snapshot-id"])
+	snapshots, _ := md["snapshots"].([]interface{})
+	for _, s := range snapshots {
+		if s, ok := s.(map[string]interface{}); ok && fmt.Sprint(s["snapshot-id"]) == current {
+			return s
+		}
+	}
+	return nil
+}
+
+// TraceToIceberg appends the spans of the recording to the Apache Iceberg
+// table at tableLocation, a directory of the local filesystem, creating the
+// table if needed. The table uses format version 1 and the layout of Iceberg's
+// Hadoop catalog (metadata/vN.metadata.json and metadata/version-hint.text),
+// so the directory can be registered as a table in Trino, Spark SQL or Flink.
+//
+// Every call writes the spans to a new Parquet data file (see
+// lakehouseParquetSchema) and commits a new snapshot adding it to the table.
+// Commits fail, rather than overwrite each other, if the table is modified
+// concurrently.
+//
+// See https://iceberg.apache.org/spec/.
+func TraceToIceberg(r tracingpb.Recording, tableLocation string) error {
+	loc, err := filepath.Abs(tableLocation)
+	if err != nil {
+		return err
+	}
+	metadataDir := filepath.Join(loc, "metadata")
+	dataDir := filepath.Join(loc, "data")
+	for _, dir := range []string{metadataDir, dataDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	version, md, err := readIcebergMetadata(metadataDir)
+	if err != nil {
+		return err
+	}
+
+	now := timeutil.Now()
+	id := uuid.MakeV4()
+	snapshotID := int64(binary.BigEndian.Uint64(id.GetBytes()) &^ (1 << 63))
+
+	// Write the data file and a manifest listing it.
+	dataPath := filepath.Join(dataDir, id.String()+".parquet")
+	dataSize, err := writeLakehouseDataFile(dataPath, lakehouseParquetSchemaDef, r, nil /* addColumns */)
+	if err != nil {
+		return errors.Wrap(err, "writing Iceberg data file")
+	}
+	manifestPath := filepath.Join(metadataDir, id.String()+"-m0.avro")
+	manifestSize, err := writeAvroFile(manifestPath, icebergManifestSchema,
+		map[string][]byte{
+			"schema":            []byte(icebergSchemaJSON),
+			"schema-id":         []byte("0"),
+			"partition-spec":    []byte("[]"),
+			"partition-spec-id": []byte("0"),
+			"format-version":    []byte("1"),
+		},
+		[]interface{}{map[string]interface{}{
+			"status":      1, // ADDED
+			"snapshot_id": snapshotID,
+			"data_file": map[string]interface{}{
+				"file_path":           dataPath,
+				"file_format":         "PARQUET",
+				"partition":           map[string]interface{}{},
+				"record_count":        int64(len(r)),
+				"file_size_in_bytes":  dataSize,
+				"block_size_in_bytes": int64(64 << 20),
+			},
+		}},
+	)
+	if err != nil {
+		return errors.Wrap(err, "writing Iceberg manifest")
+	}
+
+	// Write the manifest list of the new snapshot, which contains the manifests
+	// of the current snapshot along with the new one.
+	var manifests []interface{}
+	var parent map[string]interface{}
+	if md != nil {
+		parent = icebergCurrentSnapshot(md)
+	}
+	if parent != nil {
+		manifestList, _ := parent["manifest-list"].(string)
+		if manifests, err = readAvroFile(localPath(manifestList)); err != nil {
+			return err
+		}
+	}
+	manifests = append(manifests, map[string]interface{}{
+		"manifest_path":             manifestPath,
+		"manifest_length":           manifestSize,
+		"partition_spec_id":         0,
+		"added_snapshot_id":         goavro.Union("long", snapshotID),
+		"added_data_files_count":    goavro.Union("int", 1),
+		"existing_data_files_count": goavro.Union("int", 0),
+		"deleted_data_files_count":  goavro.Union("int", 0),
+		"added_rows_count":          goavro.Union("long", int64(len(r))),
+		"existing_rows_count":       goavro.Union("long", 0),
+		"deleted_rows_count":        goavro.Union("long", 0),
+	})
+	listMetadata := map[string][]byte{
+		"snapshot-id":    []byte(strconv.FormatInt(snapshotID, 10)),
+		"format-version": []byte("1"),
+	}
+	if parent != nil {
+		listMetadata["parent-snapshot-id"] = []byte(fmt.Sprint(parent["snapshot-id"]))
+	}
+	manifestListPath := filepath.Join(metadataDir,
+		fmt.Sprintf("snap-%d-1-%s.avro", snapshotID, id))
+	if _, err := writeAvroFile(
+		manifestListPath, icebergManifestListSchema, listMetadata, manifests,
+	); err != nil {
+		return errors.Wrap(err, "writing Iceberg manifest list")
+	}
+
+	// Commit the new snapshot by writing the next version of the metadata.
+	if md == nil {
+		var schema interface{}
+		if err := json.Unmarshal([]byte(icebergSchemaJSON), &schema); err != nil {
+			return err
+		}
+		md = map[string]interface{}{
+			"format-version":        1,
+			"table-uuid":            uuid.MakeV4().String(),
+			"location":              loc,
+			"last-column-id":        7,
+			"schema":                schema,
+			"schemas":               []interface{}{schema},
+			"current-schema-id":     0,
+			"partition-spec":        []interface{}{},
+			"partition-specs":       []interface{}{map[string]interface{}{"spec-id": 0, "fields": []interface{}{}}},
+			"default-spec-id":       0,
+			"last-partition-id":     999,
+			"sort-orders":           []interface{}{map[string]interface{}{"order-id": 0, "fields": []interface{}{}}},
+			"default-sort-order-id": 0,
+			"properties":            map[string]interface{}{},
+		}
+	} else {
+		metadataLog, _ := md["metadata-log"].([]interface{})
+		md["metadata-log"] = append(metadataLog, map[string]interface{}{
+			"timestamp-ms":  md["last-updated-ms"],
+			"metadata-file": filepath.Join(metadataDir, icebergMetadataFile(version)),
+		})
+	}
+	snapshot := map[string]interface{}{
+		"snapshot-id":   snapshotID,
+		"timestamp-ms":  now.UnixMilli(),
+		"manifest-list": manifestListPath,
+		"schema-id":     0,
+		"summary": map[string]interface{}{
+			"operation":        "append",
+			"added-data-files": "1",
+			"added-records":    strconv.Itoa(len(r)),
+			"added-files-size": strconv.FormatInt(dataSize, 10),
+		},
+	}
+	if parent != nil {
+		snapshot["parent-snapshot-id"] = parent["snapshot-id"]
+	}
+	snapshots, _ := md["snapshots"].([]interface{})
+	snapshotLog, _ := md["snapshot-log"].([]interface{})
+	md["snapshots"] = append(snapshots, snapshot)
+	md["snapshot-log"] = append(snapshotLog, map[string]interface{}{
+		"timestamp-ms": now.UnixMilli(),
+		"snapshot-id":  snapshotID,
+	})
+	md["current-snapshot-id"] = snapshotID
+	md["last-updated-ms"] = now.UnixMilli()
+
+	b, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	version++
+	if err := writeFileExclusive(
+		filepath.Join(metadataDir, icebergMetadataFile(version)), b,
+	); err != nil {
+		return errors.Wrap(err, "committing Iceberg snapshot")
+	}
+	// The version hint is only an optimization for readers: they look for later
+	// versions of the metadata anyway.
+	hintPath := filepath.Join(metadataDir, "version-hint.text")
+	tmp := hintPath + "." + id.String() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(version)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, hintPath)
+}
+
+// deltaSchemaString is the schema of the Delta Lake tables written by
+// TraceToDeltalake, in the Spark SQL JSON format used by Delta Lake's metaData
+// action. It matches lakehouseParquetSchema.
+const deltaSchemaString = `{"type":"struct","fields":[` +
+	`{"name":"trace_id","type":"long","nullable":false,"metadata":{}},` +
+	`{"name":"span_id","type":"long","nullable":false,"metadata":{}},` +
+	`{"name":"parent_span_id","type":"long","nullable":false,"metadata":{}},` +
+	`{"name":"operation","type":"string","nullable":false,"metadata":{}},` +
+	`{"name":"start_time","type":"timestamp","nullable":false,"metadata":{}},` +
+	`{"name":"duration_ns","type":"long","nullable":false,"metadata":{}},` +
+	`{"name":"tags","type":"string","nullable":false,"metadata":{}}]}`
+
+// deltaNextVersion returns the version of the next commit to the Delta Lake
+// table whose transaction log is in logDir.
+func deltaNextVersion(logDir string) (int64, error) {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		return 0, err
+	}
+	next := int64(0)
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		v, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if v >= next {
+			next = v + 1
+		}
+	}
+	return next, nil
+}
+
+// TraceToDeltalake appends the spans of the recording to the Delta Lake table
+// at tablePath, a directory of the local filesystem, creating the table if
+// needed. Every call writes the spans to a new Parquet part file (see
+// lakehouseParquetSchema) and commits a new version of the table whose
+// transaction log entry (_delta_log/NNNNNNNNNNNNNNNNNNNN.json) adds it. The
+// first commit also records the protocol and the table's metadata. Commits
+// fail, rather than overwrite each other, if the table is modified
+// concurrently.
+//
+// See https://github.com/delta-io/delta/blob/master/PROTOCOL.md.
+func TraceToDeltalake(r tracingpb.Recording, tablePath string) error {
+	logDir := filepath.Join(tablePath, "_delta_log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	version, err := deltaNextVersion(logDir)
+	if err != nil {
+		return err
+	}
+
+	now := timeutil.Now()
+	id := uuid.MakeV4()
+	partFile := fmt.Sprintf("part-00000-%s-c000.snappy.parquet", id)
+	size, err := writeLakehouseDataFile(
+		filepath.Join(tablePath, partFile), lakehouseParquetSchemaDef, r, nil, /* addColumns */
+	)
+	if err != nil {
+		return errors.Wrap(err, "writing Delta Lake part file")
+	}
+
+	var actions []interface{}
+	if version == 0 {
+		actions = append(actions,
+			map[string]interface{}{"protocol": map[string]interface{}{
+				"minReaderVersion": 1,
+				"minWriterVersion": 2,
+			}},
+			map[string]interface{}{"metaData": map[string]interface{}{
+				"id":               uuid.MakeV4().String(),
+				"format":           map[string]interface{}{"provider": "parquet", "options": map[string]string{}},
+				"schemaString":     deltaSchemaString,
+				"partitionColumns": []string{},
+				"configuration":    map[string]string{},
+				"createdTime":      now.UnixMilli(),
+			}},
+		)
+	}
+	actions = append(actions,
+		map[string]interface{}{"add": map[string]interface{}{
+			"path":             partFile,
+			"partitionValues":  map[string]string{},
+			"size":             size,
+			"modificationTime": now.UnixMilli(),
+			"dataChange":       true,
+		}},
+		map[string]interface{}{"commitInfo": map[string]interface{}{
+			"timestamp":           now.UnixMilli(),
+			"operation":           "WRITE",
+			"operationParameters": map[string]string{"mode": "Append"},
+			"engineInfo":          "cockroachdb",
+		}},
+	)
+	var buf bytes.Buffer
+	for _, a := range actions {
+		b, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return errors.Wrap(
+		writeFileExclusive(filepath.Join(logDir, fmt.Sprintf("%020d.json", version)), buf.Bytes()),
+		"committing to Delta Lake table",
+	)
+}
+
+// hudiParquetSchema is the schema of the base files of the Hudi tables written
+// by TraceToHudi: lakehouseParquetSchema preceded by Hudi's metadata columns.
+const hudiParquetSchema = `message span {
+	optional binary _hoodie_commit_time (STRING);
+	optional binary _hoodie_commit_seqno (STRING);
+	optional binary _hoodie_record_key (STRING);
+	optional binary _hoodie_partition_path (STRING);
+	optional binary _hoodie_file_name (STRING);
+	required int64 trace_id = 1;
+	required int64 span_id = 2;
+	required int64 parent_span_id = 3;
+	required binary operation (STRING) = 4;
+	required int64 start_time (TIMESTAMP(MICROS, true)) = 5;
+	required int64 duration_ns = 6;
+	required binary tags (STRING) = 7;
+}`
+
+var hudiParquetSchemaDef = func() *parquetschema.SchemaDefinition {
+	sd, err := parquetschema.ParseSchemaDefinition(hudiParquetSchema)
+	if err != nil {
+		panic(err)
+	}
+	return sd
+}()
+
+// hudiAvroSchema is the Avro equivalent of hudiParquetSchema, which Hudi
+// records in the metadata of every commit.
+const hudiAvroSchema = `{"type":"record","name":"span_record","namespace":"hoodie.span","fields":[` +
+	`{"name":"_hoodie_commit_time","type":["null","string"],"default":null},` +
+	`{"name":"_hoodie_commit_seqno","type":["null","string"],"default":null},` +
+	`{"name":"_hoodie_record_key","type":["null","string"],"default":null},` +
+	`{"name":"_hoodie_partition_path","type":["null","string"],"default":null},` +
+	`{"name":"_hoodie_file_name","type":["null","string"],"default":null},` +
+	`{"name":"trace_id","type":"long"},` +
+	`{"name":"span_id","type":"long"},` +
+	`{"name":"parent_span_id","type":"long"},` +
+	`{"name":"operation","type":"string"},` +
+	`{"name":"start_time","type":{"type":"long","logicalType":"timestamp-micros"}},` +
+	`{"name":"duration_ns","type":"long"},` +
+	`{"name":"tags","type":"string"}]}`
+
+// hudiInstantTimeRE matches the instant times of Hudi commits.
+var hudiInstantTimeRE = regexp.MustCompile(`^[0-9]{14}([0-9]{3})?$`)
+
+// hudiWriteStat describes a file written by a Hudi commit.
+type hudiWriteStat struct {
+	FileID           string `json:"fileId"`
+	Path             string `json:"path"`
+	PrevCommit       string `json:"prevCommit"`
+	NumWrites        int    `json:"numWrites"`
+	NumDeletes       int    `json:"numDeletes"`
+	NumUpdateWrites  int    `json:"numUpdateWrites"`
+	NumInserts       int    `json:"numInserts"`
+	TotalWriteBytes  int64  `json:"totalWriteBytes"`
+	TotalWriteErrors int    `json:"totalWriteErrors"`
+	PartitionPath    string `json:"partitionPath"`
+	FileSizeInBytes  int64  `json:"fileSizeInBytes"`
+}
+
+// hudiCommitMetadata is the content of a completed Hudi commit.
+type hudiCommitMetadata struct {
+	PartitionToWriteStats map[string][]hudiWriteStat `json:"partitionToWriteStats"`
+	Compacted             bool                       `json:"compacted"`
+	ExtraMetadata         map[string]string          `json:"extraMetadata"`
+	OperationType         string                     `json:"operationType"`
+}
+
+// hudiInitTable creates the .hoodie directory of a non-partitioned
+// Copy-On-Write Hudi table at basePath, unless it already exists.
+func hudiInitTable(basePath string) error {
+	metaDir := filepath.Join(basePath, ".hoodie")
+	if err := os.MkdirAll(metaDir, 0755); err != nil {
+		return err
+	}
+	propsPath := filepath.Join(metaDir, "hoodie.properties")
+	if _, err := os.Stat(propsPath); err == nil {
+		return nil
+	} else if !oserror.IsNotExist(err) {
+		return err
+	}
+	props := fmt.Sprintf(`hoodie.table.name=%s
+hoodie.table.type=COPY_ON_WRITE
+hoodie.table.version=5
+hoodie.timeline.layout.version=1
+hoodie.table.base.file.format=PARQUET
+hoodie.table.recordkey.fields=span_id
+hoodie.table.precombine.field=start_time
+hoodie.table.keygenerator.class=org.apache.hudi.keygen.NonpartitionedKeyGenerator
+hoodie.populate.meta.fields=true
+hoodie.archivelog.folder=archived
+`, filepath.Base(basePath))
+	return writeFileExclusive(propsPath, []byte(props))
+}
+
+// TraceToHudi appends the spans of the recording to the non-partitioned Apache
+// Hudi Copy-On-Write table at basePath, a directory of the local filesystem,
+// creating the table (the .hoodie directory) if needed. The spans are written
+// as a new base file, with the span ID as the record key, and committed at the
+// given instant, in Hudi's yyyyMMddHHmmss[SSS] format, which must be later
+// than the instants of the table's existing commits. Incremental queries on
+// the table then return the spans of every trace as a separate commit.
+//
+// See https://hudi.apache.org/tech-specs.
+func TraceToHudi(r tracingpb.Recording, basePath string, commitTime string) error {
+	if !hudiInstantTimeRE.MatchString(commitTime) {
+		return errors.Newf("invalid Hudi commit time %q", commitTime)
+	}
+	if err := hudiInitTable(basePath); err != nil {
+		return errors.Wrap(err, "creating Hudi table")
+	}
+	metaDir := filepath.Join(basePath, ".hoodie")
+	entries, err := os.ReadDir(metaDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		instant := strings.SplitN(e.Name(), ".", 2)[0]
+		if hudiInstantTimeRE.MatchString(instant) && instant >= commitTime {
+			return errors.Newf("Hudi commit time %s is not later than existing instant %s",
+				commitTime, instant)
+		}
+	}
+
+	// Mark the commit as requested and then inflight, as Hudi writers do.
+	for _, state := range []string{".commit.requested", ".inflight"} {
+		if err := writeFileExclusive(filepath.Join(metaDir, commitTime+state), nil); err != nil {
+			return errors.Wrap(err, "starting Hudi commit")
+		}
+	}
+
+	fileID := uuid.MakeV4().String() + "-0"
+	fileName := fmt.Sprintf("%s_0-0-0_%s.parquet", fileID, commitTime)
+	size, err := writeLakehouseDataFile(filepath.Join(basePath, fileName), hudiParquetSchemaDef, r,
+		func(i int, row map[string]interface{}) {
+			row["_hoodie_commit_time"] = []byte(commitTime)
+			row["_hoodie_commit_seqno"] = []byte(fmt.Sprintf("%s_0_%d", commitTime, i))
+			row["_hoodie_record_key"] = []byte(strconv.FormatUint(uint64(r[i].SpanID), 10))
+			row["_hoodie_partition_path"] = []byte("")
+			row["_hoodie_file_name"] = []byte(fileName)
+		})
+	if err != nil {
+		return errors.Wrap(err, "writing Hudi base file")
+	}
+
+	b, err := json.MarshalIndent(hudiCommitMetadata{
+		PartitionToWriteStats: map[string][]hudiWriteStat{"": {{
+			FileID:          fileID,
+			Path:            fileName,
+			PrevCommit:      "null",
+			NumWrites:       len(r),
+			NumInserts:      len(r),
+			TotalWriteBytes: size,
+			FileSizeInBytes: size,
+		}}},
+		ExtraMetadata: map[string]string{"schema": hudiAvroSchema},
+		OperationType: "INSERT",
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(
+		writeFileExclusive(filepath.Join(metaDir, commitTime+".commit"), b),
+		"completing Hudi commit",
+	)
+}
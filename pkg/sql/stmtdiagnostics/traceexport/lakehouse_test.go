@@ -0,0 +1,213 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics/traceexport"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// readAvroRecords reads all the records of an Avro object container file.
+func readAvroRecords(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := goavro.NewOCFReader(f)
+	require.NoError(t, err)
+	var records []map[string]interface{}
+	for r.Scan() {
+		rec, err := r.Read()
+		require.NoError(t, err)
+		records = append(records, rec.(map[string]interface{}))
+	}
+	require.NoError(t, r.Err())
+	return records
+}
+
+// checkParquetRows checks that the Parquet file at path has the given number
+// of rows.
+func checkParquetRows(t *testing.T, path string, expected int) {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	fr, err := goparquet.NewFileReader(f)
+	require.NoError(t, err)
+	require.Equal(t, int64(expected), fr.NumRows())
+}
+
+func TestTraceToIceberg(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	dir := filepath.Join(t.TempDir(), "traces")
+	rec := makeTestRecording()
+	require.NoError(t, traceexport.TraceToIceberg(rec, dir))
+	require.NoError(t, traceexport.TraceToIceberg(rec[:1], dir))
+
+	hint, err := os.ReadFile(filepath.Join(dir, "metadata", "version-hint.text"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(hint))
+
+	b, err := os.ReadFile(filepath.Join(dir, "metadata", "v2.metadata.json"))
+	require.NoError(t, err)
+	var md struct {
+		FormatVersion     int    `json:"format-version"`
+		Location          string `json:"location"`
+		CurrentSnapshotID int64  `json:"current-snapshot-id"`
+		Snapshots         []struct {
+			SnapshotID       int64  `json:"snapshot-id"`
+			ParentSnapshotID int64  `json:"parent-snapshot-id"`
+			ManifestList     string `json:"manifest-list"`
+		} `json:"snapshots"`
+		MetadataLog []struct {
+			MetadataFile string `json:"metadata-file"`
+		} `json:"metadata-log"`
+	}
+	require.NoError(t, json.Unmarshal(b, &md))
+	require.Equal(t, 1, md.FormatVersion)
+	require.Equal(t, dir, md.Location)
+	require.Len(t, md.Snapshots, 2)
+	require.Equal(t, md.Snapshots[0].SnapshotID, md.Snapshots[1].ParentSnapshotID)
+	require.Equal(t, md.Snapshots[1].SnapshotID, md.CurrentSnapshotID)
+	require.Len(t, md.MetadataLog, 1)
+	require.Equal(t, filepath.Join(dir, "metadata", "v1.metadata.json"), md.MetadataLog[0].MetadataFile)
+
+	// The current snapshot contains the data files of both appends.
+	manifests := readAvroRecords(t, md.Snapshots[1].ManifestList)
+	require.Len(t, manifests, 2)
+	for i, expectedRows := range []int{len(rec), 1} {
+		entries := readAvroRecords(t, manifests[i]["manifest_path"].(string))
+		require.Len(t, entries, 1)
+		require.Equal(t, md.Snapshots[i].SnapshotID, entries[0]["snapshot_id"])
+		dataFile := entries[0]["data_file"].(map[string]interface{})
+		require.Equal(t, int64(expectedRows), dataFile["record_count"])
+		checkParquetRows(t, dataFile["file_path"].(string), expectedRows)
+	}
+}
+
+func TestTraceToDeltalake(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	dir := t.TempDir()
+	rec := makeTestRecording()
+	require.NoError(t, traceexport.TraceToDeltalake(rec, dir))
+	require.NoError(t, traceexport.TraceToDeltalake(rec[:1], dir))
+
+	readLog := func(name string) []map[string]json.RawMessage {
+		f, err := os.Open(filepath.Join(dir, "_delta_log", name))
+		require.NoError(t, err)
+		defer f.Close()
+		var actions []map[string]json.RawMessage
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var a map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal(s.Bytes(), &a))
+			require.Len(t, a, 1)
+			actions = append(actions, a)
+		}
+		require.NoError(t, s.Err())
+		return actions
+	}
+
+	for i, tc := range []struct {
+		name    string
+		actions []string
+		rows    int
+	}{
+		{"00000000000000000000.json", []string{"protocol", "metaData", "add", "commitInfo"}, len(rec)},
+		{"00000000000000000001.json", []string{"add", "commitInfo"}, 1},
+	} {
+		actions := readLog(tc.name)
+		require.Len(t, actions, len(tc.actions), "commit %d", i)
+		var add struct {
+			Path       string `json:"path"`
+			Size       int64  `json:"size"`
+			DataChange bool   `json:"dataChange"`
+		}
+		for j, name := range tc.actions {
+			require.Contains(t, actions[j], name)
+			if name == "add" {
+				require.NoError(t, json.Unmarshal(actions[j][name], &add))
+			}
+		}
+		require.True(t, add.DataChange)
+		info, err := os.Stat(filepath.Join(dir, add.Path))
+		require.NoError(t, err)
+		require.Equal(t, info.Size(), add.Size)
+		checkParquetRows(t, filepath.Join(dir, add.Path), tc.rows)
+	}
+}
+
+func TestTraceToHudi(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	dir := filepath.Join(t.TempDir(), "traces")
+	rec := makeTestRecording()
+	require.NoError(t, traceexport.TraceToHudi(rec, dir, "20230102030405000"))
+	require.NoError(t, traceexport.TraceToHudi(rec[:1], dir, "20230102030406000"))
+
+	// Commits must be later than the existing ones and well-formed.
+	require.Error(t, traceexport.TraceToHudi(rec, dir, "20230102030405500"))
+	require.Error(t, traceexport.TraceToHudi(rec, dir, "2023-01-02"))
+
+	props, err := os.ReadFile(filepath.Join(dir, ".hoodie", "hoodie.properties"))
+	require.NoError(t, err)
+	require.Contains(t, string(props), "hoodie.table.name=traces\n")
+	require.Contains(t, string(props), "hoodie.table.type=COPY_ON_WRITE\n")
+
+	for _, tc := range []struct {
+		commitTime string
+		rows       int
+	}{
+		{"20230102030405000", len(rec)},
+		{"20230102030406000", 1},
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, ".hoodie", tc.commitTime+".commit"))
+		require.NoError(t, err)
+		var md struct {
+			PartitionToWriteStats map[string][]struct {
+				Path       string `json:"path"`
+				NumInserts int    `json:"numInserts"`
+			} `json:"partitionToWriteStats"`
+			ExtraMetadata map[string]string `json:"extraMetadata"`
+		}
+		require.NoError(t, json.Unmarshal(b, &md))
+		require.Contains(t, md.ExtraMetadata, "schema")
+		stats := md.PartitionToWriteStats[""]
+		require.Len(t, stats, 1)
+		require.Equal(t, tc.rows, stats[0].NumInserts)
+		require.Contains(t, stats[0].Path, "_"+tc.commitTime+".parquet")
+
+		f, err := os.Open(filepath.Join(dir, stats[0].Path))
+		require.NoError(t, err)
+		fr, err := goparquet.NewFileReader(f)
+		require.NoError(t, err)
+		require.Equal(t, int64(tc.rows), fr.NumRows())
+		row, err := fr.NextRow()
+		require.NoError(t, err)
+		require.Equal(t, []byte(tc.commitTime), row["_hoodie_commit_time"])
+		require.Equal(t, []byte("1"), row["_hoodie_record_key"])
+		require.Equal(t, []byte(stats[0].Path), row["_hoodie_file_name"])
+		require.NoError(t, f.Close())
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/errors"
+	"github.com/getsentry/sentry-go"
+)
+
+// sentryMaxBreadcrumbs is the maximum number of spans of the trace that are
+// reported as breadcrumbs.
+const sentryMaxBreadcrumbs = 100
+
+// sentryMaxTagLength is the maximum length of the value of a Sentry tag.
+// Sentry drops tags with longer values.
+const sentryMaxTagLength = 200
+
+// sentryTransport is a sentry.Transport that sends a single event
+// synchronously with stmtdiagnostics.DoRequest and keeps the error, which the
+// transports of the Sentry SDK only log.
+type sentryTransport struct {
+	ctx context.Context
+	dsn *sentry.Dsn
+	err error
+}
+
+var _ sentry.Transport = (*sentryTransport)(nil)
+
+// Configure is part of the sentry.Transport interface.
+func (t *sentryTransport) Configure(options sentry.ClientOptions) {
+	t.dsn, t.err = sentry.NewDsn(options.Dsn)
+}
+
+// SendEvent is part of the sentry.Transport interface.
+func (t *sentryTransport) SendEvent(event *sentry.Event) {
+	if t.err != nil {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.err = err
+		return
+	}
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodPost,
+		t.dsn.StoreAPIURL().String(), bytes.NewReader(body))
+	if err != nil {
+		t.err = err
+		return
+	}
+	for k, v := range t.dsn.RequestHeaders() {
+		req.Header.Set(k, v)
+	}
+	t.err = stmtdiagnostics.DoRequest(req, nil /* resp */)
+}
+
+// Flush is part of the sentry.Transport interface. Events are sent
+// synchronously, so there is nothing to flush.
+func (t *sentryTransport) Flush(time.Duration) bool {
+	return true
+}
+
+// truncateSentryTag truncates s to the maximum length of a Sentry tag value.
+func truncateSentryTag(s string) string {
+	if len(s) <= sentryMaxTagLength {
+		return s
+	}
+	return s[:sentryMaxTagLength-3] + "..."
+}
+
+// TraceToSentry reports the bundle as an event to the Sentry project of the
+// given DSN and returns the ID of the event. The message of the event is the
+// fingerprint of the statement and its exception is the redacted error of the
+// statement, if any (see stmtdiagnostics.RedactedError); the event has the
+// "error" level if the statement failed, and the "warning" level otherwise.
+// The spans of the trace, up to 100, are reported as breadcrumbs in the order
+// in which they started. The event is tagged with the fingerprint of the
+// statement, the node that collected the bundle and the duration of the
+// statement in milliseconds, and it is grouped with the events of the other
+// bundles of the statement.
+//
+// The event is built by a client of the Sentry SDK that is only used for this
+// event, so it doesn't share the scope or the DSN of the crash reporter.
+func TraceToSentry(
+	ctx context.Context, b *stmtdiagnostics.Bundle, dsn string,
+) (eventID string, err error) {
+	if dsn == "" {
+		return "", errors.New("reporting Sentry event: no DSN")
+	}
+	transport := &sentryTransport{ctx: ctx}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:       dsn,
+		Transport: transport,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "reporting Sentry event")
+	}
+
+	level := sentry.LevelWarning
+	var exception []sentry.Exception
+	if b.Err != nil {
+		level = sentry.LevelError
+		exception = []sentry.Exception{{
+			Type:  "SQL error",
+			Value: stmtdiagnostics.RedactedError(b.Err),
+		}}
+	}
+	spans := stmtdiagnostics.SpansByStartTime(b.Trace)
+	if len(spans) > sentryMaxBreadcrumbs {
+		spans = spans[:sentryMaxBreadcrumbs]
+	}
+	breadcrumbs := make([]*sentry.Breadcrumb, 0, len(spans))
+	for _, sp := range spans {
+		data := map[string]interface{}{
+			"span_id":     stmtdiagnostics.HexID(uint64(sp.SpanID)),
+			"duration_ms": sp.Duration.Milliseconds(),
+		}
+		if sp.ParentSpanID != 0 {
+			data["parent_span_id"] = stmtdiagnostics.HexID(uint64(sp.ParentSpanID))
+		}
+		for k, v := range stmtdiagnostics.SpanTags(sp) {
+			data[k] = v
+		}
+		breadcrumbs = append(breadcrumbs, &sentry.Breadcrumb{
+			Type:      "default",
+			Category:  "span",
+			Message:   sp.Operation,
+			Data:      data,
+			Level:     sentry.LevelInfo,
+			Timestamp: sp.StartTime,
+		})
+	}
+	extra := map[string]interface{}{
+		"bundle_id": strconv.FormatInt(int64(b.ID), 10),
+	}
+	if u := b.URL(); u != "" {
+		extra["bundle_url"] = u
+	}
+
+	event := sentry.NewEvent()
+	event.Message = b.Fingerprint
+	event.Level = level
+	event.Exception = exception
+	event.Breadcrumbs = breadcrumbs
+	event.Fingerprint = []string{b.FingerprintHash()}
+	event.Tags = map[string]string{
+		"fingerprint": truncateSentryTag(b.Fingerprint),
+		"node_id":     strconv.Itoa(int(b.InstanceID)),
+		"duration_ms": strconv.FormatInt(b.Duration.Milliseconds(), 10),
+	}
+	event.Extra = extra
+	event.Timestamp = b.CollectedAt
+
+	id := client.CaptureEvent(event, nil /* hint */, nil /* scope */)
+	if transport.err != nil {
+		return "", errors.Wrap(transport.err, "reporting Sentry event")
+	}
+	if id == nil {
+		return "", errors.New("reporting Sentry event: event was dropped")
+	}
+	return string(*id), nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics/traceexport"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToSentry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var events []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/api/1/store/", r.URL.Path)
+		if !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=public") {
+			http.Error(w, `{"detail":"invalid api key"}`, http.StatusUnauthorized)
+			return
+		}
+		var event map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+		_, err := w.Write([]byte(`{"id":"` + event["event_id"].(string) + `"}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+	dsn := strings.Replace(srv.URL, "://", "://public@", 1) + "/1"
+
+	ctx := context.Background()
+	b := makeTestBundle("https://node1:8080")
+	eventID, err := traceexport.TraceToSentry(ctx, b, dsn)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	event := events[0]
+	require.Equal(t, eventID, event["event_id"])
+	require.Equal(t, "SELECT * FROM t WHERE k = _", event["message"])
+	require.Equal(t, "error", event["level"])
+	require.Equal(t, "SQL error", event["exception"].([]interface{})[0].(map[string]interface{})["type"])
+	require.Equal(t, "boom", event["exception"].([]interface{})[0].(map[string]interface{})["value"])
+	require.Equal(t, []interface{}{b.FingerprintHash()}, event["fingerprint"])
+	require.Equal(t, map[string]interface{}{
+		"fingerprint": "SELECT * FROM t WHERE k = _",
+		"node_id":     "1",
+		"duration_ms": "10",
+	}, event["tags"])
+	require.Equal(t, map[string]interface{}{
+		"bundle_id":  "42",
+		"bundle_url": "https://node1:8080/_admin/v1/stmtbundle/42",
+	}, event["extra"])
+
+	breadcrumbs := event["breadcrumbs"].([]interface{})
+	require.Len(t, breadcrumbs, 3)
+	var ops []string
+	for _, bc := range breadcrumbs {
+		bc := bc.(map[string]interface{})
+		require.Equal(t, "span", bc["category"])
+		ops = append(ops, bc["message"].(string))
+	}
+	require.Equal(t, []string{"sql query", "flow", "kv.Get"}, ops)
+	require.Equal(t, map[string]interface{}{
+		"span_id":        "0000000000000002",
+		"parent_span_id": "0000000000000001",
+		"duration_ms":    float64(5),
+		"cpu-time":       "3ms",
+	}, breadcrumbs[1].(map[string]interface{})["data"])
+
+	// The sensitive details of the error are redacted.
+	b.Err = pgerror.Newf(pgcode.UniqueViolation, "duplicate key value k = %s", "1")
+	_, err = traceexport.TraceToSentry(ctx, b, dsn)
+	require.NoError(t, err)
+	require.Equal(t, "duplicate key value k = ×",
+		events[1]["exception"].([]interface{})[0].(map[string]interface{})["value"])
+
+	// A successful statement is reported as a warning without an exception.
+	b.Err = nil
+	_, err = traceexport.TraceToSentry(ctx, b, dsn)
+	require.NoError(t, err)
+	require.Equal(t, "warning", events[2]["level"])
+	require.NotContains(t, events[2], "exception")
+
+	_, err = traceexport.TraceToSentry(ctx, b, strings.Replace(dsn, "public", "other", 1))
+	require.ErrorContains(t, err, "reporting Sentry event")
+	require.ErrorContains(t, err, "invalid api key")
+
+	_, err = traceexport.TraceToSentry(ctx, b, "not a dsn")
+	require.ErrorContains(t, err, "reporting Sentry event")
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport
+
+import (
+	"context"
+	gosql "database/sql"
+	"encoding/json"
+
+	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgx"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+	// Register the MySQL driver used by TraceToMySQL.
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v4"
+)
+
+// This file contains exporters that store the spans of a recording in
+// external SQL databases. The tables have the same columns as
+// SpansParquetSchema, so traces can be analyzed in the same way regardless of
+// where they are stored.
+
+// spanRow returns the values of the columns of the spans tables for the given
+// span: trace_id, span_id, parent_span_id, operation, start_time, duration_ns
+// and tags. The IDs are converted to signed integers with the same bits, and
+// the tags are returned as a JSON object.
+func spanRow(sp *tracingpb.RecordedSpan) ([]interface{}, error) {
+	tags, err := json.Marshal(stmtdiagnostics.SpanTags(sp))
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		int64(sp.TraceID),
+		int64(sp.SpanID),
+		int64(sp.ParentSpanID),
+		sp.Operation,
+		sp.StartTime.UTC(),
+		sp.Duration.Nanoseconds(),
+		string(tags),
+	}, nil
+}
+
+// insertSpansPGWire inserts the spans of the recording into the given table,
+// using a single batch within tx.
+func insertSpansPGWire(
+	ctx context.Context, tx pgx.Tx, table string, r tracingpb.Recording,
+) error {
+	stmt := "INSERT INTO " + table +
+		" (trace_id, span_id, parent_span_id, operation, start_time, duration_ns, tags)" +
+		" VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	var b pgx.Batch
+	for i := range r {
+		row, err := spanRow(&r[i])
+		if err != nil {
+			return err
+		}
+		b.Queue(stmt, row...)
+	}
+	// Errors of any of the statements are returned by Close.
+	return tx.SendBatch(ctx, &b).Close()
+}
+
+// TraceToCockroachDB inserts the spans of the recording, in a single
+// transaction, into the tracing.spans table of the CockroachDB cluster at dsn
+// (a postgres:// connection URL). This allows a dedicated cluster to store the
+// traces of other clusters. The table must have been created with:
+//
+//	CREATE TABLE tracing.spans (
+//	    trace_id INT8 NOT NULL,
+//	    span_id INT8 NOT NULL,
+//	    parent_span_id INT8 NOT NULL,
+//	    operation STRING NOT NULL,
+//	    start_time TIMESTAMPTZ NOT NULL,
+//	    duration_ns INT8 NOT NULL,
+//	    tags JSONB NOT NULL,
+//	    PRIMARY KEY (trace_id, span_id)
+//	);
+//
+// The columns are the same as the ones of SpansParquetSchema; the IDs are
+// stored as signed integers with the same bits as the unsigned IDs.
+func TraceToCockroachDB(ctx context.Context, r tracingpb.Recording, dsn string) error {
+	if len(r) == 0 {
+		return nil
+	}
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return errors.Wrap(err, "connecting to CockroachDB")
+	}
+	defer func() { _ = conn.Close(ctx) }()
+	return errors.Wrap(
+		crdbpgx.ExecuteTx(ctx, conn, pgx.TxOptions{}, func(tx pgx.Tx) error {
+			return insertSpansPGWire(ctx, tx, "tracing.spans", r)
+		}),
+		"inserting trace into CockroachDB",
+	)
+}
+
+// TraceToPostgres inserts the spans of the recording, in a single transaction,
+// into the crdb_traces.spans table of the PostgreSQL database at dsn (a
+// postgres:// connection URL). The table must have been created with:
+//
+//	CREATE SCHEMA crdb_traces;
+//	CREATE TABLE crdb_traces.spans (
+//	    trace_id BIGINT NOT NULL,
+//	    span_id BIGINT NOT NULL,
+//	    parent_span_id BIGINT NOT NULL,
+//	    operation TEXT NOT NULL,
+//	    start_time TIMESTAMPTZ NOT NULL,
+//	    duration_ns BIGINT NOT NULL,
+//	    tags JSONB NOT NULL,
+//	    PRIMARY KEY (trace_id, span_id)
+//	);
+//
+// The columns are the same as the ones of the table used by
+// TraceToCockroachDB. Note that PostgreSQL timestamps have a microsecond
+// precision.
+func TraceToPostgres(ctx context.Context, r tracingpb.Recording, dsn string) error {
+	if len(r) == 0 {
+		return nil
+	}
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return errors.Wrap(err, "connecting to PostgreSQL")
+	}
+	defer func() { _ = conn.Close(ctx) }()
+	return errors.Wrap(
+		conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+			return insertSpansPGWire(ctx, tx, "crdb_traces.spans", r)
+		}),
+		"inserting trace into PostgreSQL",
+	)
+}
+
+// TraceToMySQL inserts the spans of the recording, in a single transaction,
+// into the crdb_traces.spans table of the MySQL database at dsn (in the format
+// of the go-sql-driver/mysql driver, e.g. user:password@tcp(host:3306)/). The
+// table must have been created with:
+//
+//	CREATE DATABASE crdb_traces;
+//	CREATE TABLE crdb_traces.spans (
+//	    trace_id BIGINT NOT NULL,
+//	    span_id BIGINT NOT NULL,
+//	    parent_span_id BIGINT NOT NULL,
+//	    operation TEXT NOT NULL,
+//	    start_time DATETIME(6) NOT NULL,
+//	    duration_ns BIGINT NOT NULL,
+//	    tags JSON NOT NULL,
+//	    PRIMARY KEY (trace_id, span_id)
+//	);
+//
+// The columns are the same as the ones of the table used by
+// TraceToCockroachDB. The start times are stored in UTC, unless the DSN
+// specifies another location with the loc parameter.
+func TraceToMySQL(ctx context.Context, r tracingpb.Recording, dsn string) error {
+	if len(r) == 0 {
+		return nil
+	}
+	db, err := gosql.Open("mysql", dsn)
+	if err != nil {
+		return errors.Wrap(err, "connecting to MySQL")
+	}
+	defer func() { _ = db.Close() }()
+	tx, err := db.BeginTx(ctx, nil /* opts */)
+	if err != nil {
+		return errors.Wrap(err, "connecting to MySQL")
+	}
+	if err := func() error {
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO crdb_traces.spans "+
+			"(trace_id, span_id, parent_span_id, operation, start_time, duration_ns, tags) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = stmt.Close() }()
+		for i := range r {
+			row, err := spanRow(&r[i])
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.ExecContext(ctx, row...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}(); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrap(err, "inserting trace into MySQL")
+	}
+	return errors.Wrap(tx.Commit(), "inserting trace into MySQL")
+}
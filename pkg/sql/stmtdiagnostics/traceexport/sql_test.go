@@ -0,0 +1,112 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics/traceexport"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToCockroachDB(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(db)
+	sqlDB.Exec(t, `CREATE DATABASE tracing`)
+	sqlDB.Exec(t, `CREATE TABLE tracing.spans (
+		trace_id INT8 NOT NULL,
+		span_id INT8 NOT NULL,
+		parent_span_id INT8 NOT NULL,
+		operation STRING NOT NULL,
+		start_time TIMESTAMPTZ NOT NULL,
+		duration_ns INT8 NOT NULL,
+		tags JSONB NOT NULL,
+		PRIMARY KEY (trace_id, span_id)
+	)`)
+
+	pgURL, cleanup := sqlutils.PGUrl(
+		t, s.ServingSQLAddr(), "TestTraceToCockroachDB", url.User(username.RootUser),
+	)
+	defer cleanup()
+	require.NoError(t, traceexport.TraceToCockroachDB(ctx, makeTestRecording(), pgURL.String()))
+
+	sqlDB.CheckQueryResults(t, `
+SELECT trace_id, span_id, parent_span_id, operation,
+       (extract(epoch FROM start_time) * 1000)::INT8, duration_ns, tags::STRING
+  FROM tracing.spans ORDER BY span_id`, [][]string{
+		{"2748", "1", "0", "sql query", "1672628645000", "10000000", `{"node": "1"}`},
+		{"2748", "2", "1", "flow", "1672628645002", "5000000", `{"cpu-time": "3ms"}`},
+		{"2748", "3", "2", "kv.Get", "1672628645003", "2000000", `{}`},
+	})
+}
+
+// TestTraceToPostgres runs against CockroachDB, which speaks the PostgreSQL
+// wire protocol and supports the DDL of the PostgreSQL table.
+func TestTraceToPostgres(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(db)
+	sqlDB.Exec(t, `CREATE SCHEMA crdb_traces`)
+	sqlDB.Exec(t, `CREATE TABLE crdb_traces.spans (
+		trace_id BIGINT NOT NULL,
+		span_id BIGINT NOT NULL,
+		parent_span_id BIGINT NOT NULL,
+		operation TEXT NOT NULL,
+		start_time TIMESTAMPTZ NOT NULL,
+		duration_ns BIGINT NOT NULL,
+		tags JSONB NOT NULL,
+		PRIMARY KEY (trace_id, span_id)
+	)`)
+
+	pgURL, cleanup := sqlutils.PGUrl(
+		t, s.ServingSQLAddr(), "TestTraceToPostgres", url.User(username.RootUser),
+	)
+	defer cleanup()
+	pgURL.Path = "defaultdb"
+	require.NoError(t, traceexport.TraceToPostgres(ctx, makeTestRecording(), pgURL.String()))
+
+	sqlDB.CheckQueryResults(t, `
+SELECT span_id, operation, duration_ns, tags->>'node' FROM crdb_traces.spans ORDER BY span_id`,
+		[][]string{
+			{"1", "sql query", "10000000", "1"},
+			{"2", "flow", "5000000", "NULL"},
+			{"3", "kv.Get", "2000000", "NULL"},
+		})
+}
+
+func TestTraceToMySQL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	// There is no MySQL server to test against; check that invalid DSNs are
+	// rejected before connecting and that empty traces are a no-op.
+	ctx := context.Background()
+	err := traceexport.TraceToMySQL(ctx, makeTestRecording(), "tcp(localhost:3306")
+	require.Regexp(t, "invalid DSN", err)
+	require.NoError(t, traceexport.TraceToMySQL(ctx, nil, "tcp(localhost:3306"))
+}
@@ -0,0 +1,278 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgx/v4"
+)
+
+// This file contains exporters that load the spans of a recording into data
+// warehouses, one row per span.
+
+// newAWSSession returns an AWS session using the implicit credentials: the
+// region and the credentials are taken from the environment, the shared
+// configuration and credentials files or the instance metadata, as for
+// implicit credentials in cloud storage.
+func newAWSSession() (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	return sess, errors.Wrap(err, "creating AWS session")
+}
+
+// warehouseTableRE matches the unquoted, optionally qualified, table names
+// accepted by the exporters to data warehouses.
+var warehouseTableRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_$]*(\.[a-zA-Z_][a-zA-Z0-9_$]*){0,2}$`)
+
+// writeTempParquet writes the spans of the recording to a Parquet file in a
+// new temporary directory, and returns its path and a function that removes
+// the directory.
+func writeTempParquet(r tracingpb.Recording) (path string, cleanup func(), _ error) {
+	dir, err := os.MkdirTemp("", "stmt-diag-parquet")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { _ = os.RemoveAll(dir) }
+	path = filepath.Join(dir,
+		fmt.Sprintf("spans-%s.parquet", stmtdiagnostics.HexID(uint64(r[0].TraceID))))
+	f, err := os.Create(path)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := errors.CombineErrors(TraceToParquet(r, f), f.Close()); err != nil {
+		cleanup()
+		return "", nil, errors.Wrap(err, "writing Parquet file")
+	}
+	return path, cleanup, nil
+}
+
+// uploadToS3 uploads the contents of body to the given key of the S3 bucket,
+// with the implicit AWS credentials.
+func uploadToS3(ctx context.Context, bucket, key string, body io.Reader) error {
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		region, err := s3manager.GetBucketRegion(ctx, sess, bucket, "us-east-1")
+		if err != nil {
+			return errors.Wrapf(err, "finding the region of S3 bucket %s", bucket)
+		}
+		sess.Config.Region = aws.String(region)
+	}
+	_, err = s3manager.NewUploader(sess).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	return errors.Wrapf(err, "uploading s3://%s/%s", bucket, key)
+}
+
+// sqlStringLiteral returns s as a single-quoted SQL string literal.
+func sqlStringLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// TraceToRedshift loads the spans of the recording into the given table of
+// the Amazon Redshift cluster at dsn (a postgres:// connection URL). The spans
+// are written to a Parquet file (see TraceToParquet), which is uploaded to
+// the S3 bucket under the crdb_traces/ prefix and loaded with:
+//
+//	COPY <table> FROM 's3://<bucket>/crdb_traces/spans-<trace_id>.parquet'
+//	IAM_ROLE '<iamRole>' FORMAT AS PARQUET
+//
+// The IAM role must be associated with the cluster and allowed to read the
+// bucket. The table must have the columns of SpansParquetSchema, in order:
+//
+//	CREATE TABLE crdb_spans (
+//	    trace_id BIGINT NOT NULL,
+//	    span_id BIGINT NOT NULL,
+//	    parent_span_id BIGINT NOT NULL,
+//	    operation VARCHAR(65535) NOT NULL,
+//	    start_time TIMESTAMP NOT NULL,
+//	    duration_ns BIGINT NOT NULL,
+//	    tags VARCHAR(65535) NOT NULL,
+//	    PRIMARY KEY (trace_id, span_id)
+//	);
+//
+// The Parquet file is left in the bucket once loaded, so that it can be
+// loaded again (e.g. into another cluster). It is uploaded with the implicit
+// AWS credentials.
+func TraceToRedshift(
+	ctx context.Context, r tracingpb.Recording, dsn, s3Bucket, table, iamRole string,
+) error {
+	if len(r) == 0 {
+		return nil
+	}
+	if !warehouseTableRE.MatchString(table) {
+		return errors.Newf("invalid table name %q", table)
+	}
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return errors.Wrap(err, "connecting to Redshift")
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	path, cleanup, err := writeTempParquet(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	key := "crdb_traces/" + filepath.Base(path)
+	if err := uploadToS3(ctx, s3Bucket, key, f); err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(ctx, fmt.Sprintf("COPY %s FROM %s IAM_ROLE %s FORMAT AS PARQUET",
+		table, sqlStringLiteral(fmt.Sprintf("s3://%s/%s", s3Bucket, key)), sqlStringLiteral(iamRole)))
+	return errors.Wrap(err, "loading trace into Redshift")
+}
+
+// databricksSpansPerStatement is the number of spans inserted by each
+// statement executed by TraceToDatabricks.
+const databricksSpansPerStatement = 50
+
+// databricksWarehousePathRE matches the HTTP path of a Databricks SQL
+// warehouse.
+var databricksWarehousePathRE = regexp.MustCompile(`^(.*)/sql/1\.0/warehouses/([a-zA-Z0-9]+)/?$`)
+
+// TraceToDatabricks appends the spans of the recording to the given Unity
+// Catalog table (catalog.schema.table) with the Databricks SQL Statement
+// Execution API, using statements of the form:
+//
+//	INSERT INTO <catalogTable>
+//	SELECT trace_id, ..., from_json(tags, 'MAP<STRING, STRING>')
+//	FROM VALUES (...), ... AS spans(trace_id, ..., tags)
+//
+// with the values of the spans passed as parameters. workspaceURL is the URL
+// of the workspace followed by the HTTP path of the SQL warehouse running the
+// statements, as shown in its connection details (e.g.
+// https://example.cloud.databricks.com/sql/1.0/warehouses/abc123), and token
+// is a personal access token. The table must have been created with:
+//
+//	CREATE TABLE <catalogTable> (
+//	    trace_id BIGINT NOT NULL,
+//	    span_id BIGINT NOT NULL,
+//	    parent_span_id BIGINT NOT NULL,
+//	    operation STRING NOT NULL,
+//	    start_time TIMESTAMP NOT NULL,
+//	    duration_ns BIGINT NOT NULL,
+//	    tags MAP<STRING, STRING> NOT NULL
+//	);
+//
+// The IDs are stored as signed integers with the same bits as the unsigned
+// IDs, as in TraceToCockroachDB.
+func TraceToDatabricks(
+	ctx context.Context, r tracingpb.Recording, workspaceURL, token, catalogTable string,
+) error {
+	m := databricksWarehousePathRE.FindStringSubmatch(workspaceURL)
+	if m == nil {
+		return errors.Newf("%q is not the HTTP path of a SQL warehouse", workspaceURL)
+	}
+	statementsURL, warehouseID := m[1]+"/api/2.0/sql/statements", m[2]
+	if !warehouseTableRE.MatchString(catalogTable) {
+		return errors.Newf("invalid table name %q", catalogTable)
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	type parameter struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+		Type  string `json:"type"`
+	}
+	for start := 0; start < len(r); start += databricksSpansPerStatement {
+		end := start + databricksSpansPerStatement
+		if end > len(r) {
+			end = len(r)
+		}
+		var rows []string
+		var params []parameter
+		for i := start; i < end; i++ {
+			sp := &r[i]
+			tags, err := json.Marshal(stmtdiagnostics.SpanTags(sp))
+			if err != nil {
+				return err
+			}
+			var markers []string
+			for _, p := range []parameter{
+				{Name: "trace_id", Value: fmt.Sprint(int64(sp.TraceID)), Type: "BIGINT"},
+				{Name: "span_id", Value: fmt.Sprint(int64(sp.SpanID)), Type: "BIGINT"},
+				{Name: "parent_span_id", Value: fmt.Sprint(int64(sp.ParentSpanID)), Type: "BIGINT"},
+				{Name: "operation", Value: sp.Operation, Type: "STRING"},
+				{Name: "start_time", Value: sp.StartTime.UTC().Format(time.RFC3339Nano), Type: "TIMESTAMP"},
+				{Name: "duration_ns", Value: fmt.Sprint(sp.Duration.Nanoseconds()), Type: "BIGINT"},
+				{Name: "tags", Value: string(tags), Type: "STRING"},
+			} {
+				p.Name = fmt.Sprintf("%s_%d", p.Name, i)
+				markers = append(markers, ":"+p.Name)
+				params = append(params, p)
+			}
+			rows = append(rows, "("+strings.Join(markers, ", ")+")")
+		}
+		stmt := "INSERT INTO " + catalogTable +
+			" SELECT trace_id, span_id, parent_span_id, operation, start_time, duration_ns," +
+			" from_json(tags, 'MAP<STRING, STRING>')" +
+			" FROM VALUES " + strings.Join(rows, ", ") +
+			" AS spans(trace_id, span_id, parent_span_id, operation, start_time, duration_ns, tags)"
+
+		var resp struct {
+			StatementID string `json:"statement_id"`
+			Status      struct {
+				State string `json:"state"`
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			} `json:"status"`
+		}
+		// The statement is canceled if it doesn't complete within the wait
+		// timeout, so that there is no need to poll for its completion.
+		req := map[string]interface{}{
+			"warehouse_id":    warehouseID,
+			"statement":       stmt,
+			"parameters":      params,
+			"wait_timeout":    "50s",
+			"on_wait_timeout": "CANCEL",
+		}
+		if err := stmtdiagnostics.DoJSONRequest(
+			ctx, http.MethodPost, statementsURL, header, req, &resp,
+		); err != nil {
+			return errors.Wrap(err, "inserting trace into Databricks")
+		}
+		if resp.Status.State != "SUCCEEDED" {
+			return errors.Newf("inserting trace into Databricks: statement %s %s: %s",
+				resp.StatementID, resp.Status.State, resp.Status.Error.Message)
+		}
+	}
+	return nil
+}
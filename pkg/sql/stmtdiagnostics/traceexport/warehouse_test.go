@@ -0,0 +1,115 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package traceexport_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/stmtdiagnostics/traceexport"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToRedshift(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	// There is no Redshift cluster to test against; check that invalid table
+	// names and DSNs are rejected before uploading to S3, and that empty traces
+	// are a no-op.
+	ctx := context.Background()
+	rec := makeTestRecording()
+	const role = "arn:aws:iam::123456789012:role/redshift"
+	require.Regexp(t, "invalid table name", traceexport.TraceToRedshift(
+		ctx, rec, "postgres://localhost:5439/dev", "bucket", "spans; DROP TABLE users", role))
+	require.Regexp(t, "connecting to Redshift", traceexport.TraceToRedshift(
+		ctx, rec, "postgres://localhost:5439/dev?sslmode=invalid", "bucket", "crdb_spans", role))
+	require.NoError(t, traceexport.TraceToRedshift(
+		ctx, nil, "postgres://localhost:5439/dev?sslmode=invalid", "bucket", "crdb_spans", role))
+}
+
+func TestTraceToDatabricks(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	type parameter struct{ Name, Value, Type string }
+	type request struct {
+		WarehouseID string `json:"warehouse_id"`
+		Statement   string
+		Parameters  []parameter
+	}
+	var reqs []request
+	state := "SUCCEEDED"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/2.0/sql/statements", r.URL.Path)
+		require.Equal(t, "Bearer tok", r.Header.Get("Authorization"))
+		var req request
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		reqs = append(reqs, req)
+		_, err := w.Write([]byte(`{"statement_id":"s1","status":{"state":"` + state +
+			`","error":{"message":"TABLE_OR_VIEW_NOT_FOUND"}}}`))
+		require.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	workspaceURL := srv.URL + "/sql/1.0/warehouses/abc123"
+	rec := makeTestRecording()
+	require.NoError(t, traceexport.TraceToDatabricks(ctx, rec, workspaceURL, "tok", "main.crdb.spans"))
+	require.Len(t, reqs, 1)
+	require.Equal(t, "abc123", reqs[0].WarehouseID)
+	require.Equal(t, "INSERT INTO main.crdb.spans "+
+		"SELECT trace_id, span_id, parent_span_id, operation, start_time, duration_ns, "+
+		"from_json(tags, 'MAP<STRING, STRING>') FROM VALUES "+
+		"(:trace_id_0, :span_id_0, :parent_span_id_0, :operation_0, :start_time_0, :duration_ns_0, :tags_0), "+
+		"(:trace_id_1, :span_id_1, :parent_span_id_1, :operation_1, :start_time_1, :duration_ns_1, :tags_1), "+
+		"(:trace_id_2, :span_id_2, :parent_span_id_2, :operation_2, :start_time_2, :duration_ns_2, :tags_2) "+
+		"AS spans(trace_id, span_id, parent_span_id, operation, start_time, duration_ns, tags)",
+		reqs[0].Statement)
+	require.Len(t, reqs[0].Parameters, 7*len(rec))
+	require.Equal(t, []parameter{
+		{Name: "trace_id_0", Value: "2748", Type: "BIGINT"},
+		{Name: "span_id_0", Value: "1", Type: "BIGINT"},
+		{Name: "parent_span_id_0", Value: "0", Type: "BIGINT"},
+		{Name: "operation_0", Value: "sql query", Type: "STRING"},
+		{Name: "start_time_0", Value: rec[0].StartTime.UTC().Format(time.RFC3339Nano), Type: "TIMESTAMP"},
+		{Name: "duration_ns_0", Value: "10000000", Type: "BIGINT"},
+		{Name: "tags_0", Value: `{"node":"1"}`, Type: "STRING"},
+	}, reqs[0].Parameters[:7])
+
+	// Large recordings are inserted with several statements.
+	reqs = nil
+	var large tracingpb.Recording
+	for i := 0; i < 120; i++ {
+		sp := rec[2]
+		sp.SpanID = tracingpb.SpanID(4 + i)
+		large = append(large, sp)
+	}
+	require.NoError(t, traceexport.TraceToDatabricks(ctx, large, workspaceURL, "tok", "spans"))
+	require.Len(t, reqs, 3)
+	require.Len(t, reqs[2].Parameters, 7*20)
+	require.Equal(t, "trace_id_100", reqs[2].Parameters[0].Name)
+
+	state = "FAILED"
+	require.Regexp(t, "statement s1 FAILED: TABLE_OR_VIEW_NOT_FOUND",
+		traceexport.TraceToDatabricks(ctx, rec, workspaceURL, "tok", "spans"))
+	require.Regexp(t, "not the HTTP path of a SQL warehouse",
+		traceexport.TraceToDatabricks(ctx, rec, srv.URL, "tok", "spans"))
+	require.Regexp(t, "invalid table name",
+		traceexport.TraceToDatabricks(ctx, rec, workspaceURL, "tok", "spans WHERE"))
+}
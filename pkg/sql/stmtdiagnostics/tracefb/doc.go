@@ -0,0 +1,31 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package tracefb contains the flatbuffer generated code used for the
+// FlatBuffers representation of statement traces (and some small helpers
+// associated with the generated code).
+//
+// Generated by: flatc --go --gen-onefile --go-namespace tracefb -o . trace.fbs
+package tracefb
+
+import "sort"
+
+// FindSpan looks up the span with the given ID in the trace, without decoding
+// any of the other spans, and initializes obj with it. It returns false if the
+// trace doesn't contain such a span. The spans of the trace must be sorted by
+// span ID.
+func (rcv *Trace) FindSpan(obj *Span, spanID uint64) bool {
+	n := rcv.SpansLength()
+	i := sort.Search(n, func(i int) bool {
+		rcv.Spans(obj, i)
+		return obj.SpanId() >= spanID
+	})
+	return i < n && rcv.Spans(obj, i) && obj.SpanId() == spanID
+}
@@ -2401,6 +2401,34 @@ var charts = []sectionDescription{
 			},
 		},
 	},
+	{
+		Organization: [][]string{{SQLLayer, "Statement Diagnostics"}},
+		Charts: []chartDescription{
+			{
+				Title:   "Pending Requests",
+				Metrics: []string{"sql.stmt_diag.requests_pending"},
+			},
+			{
+				Title:   "Inserted Requests",
+				Metrics: []string{"sql.stmt_diag.requests_total"},
+			},
+			{
+				Title: "Collected Bundles",
+				Metrics: []string{
+					"sql.stmt_diag.bundles_collected",
+					"sql.stmt_diag.collection_errors",
+				},
+			},
+			{
+				Title:   "Bundle Insertion Retries",
+				Metrics: []string{"sql.stmt_diag.bundle_retries"},
+			},
+			{
+				Title:   "Polls",
+				Metrics: []string{"sql.stmt_diag.poll_iterations"},
+			},
+		},
+	},
 	{
 		Organization: [][]string{{SQLLayer, "Contention"}},
 		Charts: []chartDescription{
@@ -0,0 +1,41 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/upgrade"
+)
+
+const addBundleSizeColToStmtDiags = `
+ALTER TABLE system.statement_diagnostics
+ADD COLUMN IF NOT EXISTS bundle_size INT8 NULL
+FAMILY "primary"
+`
+
+// alterSystemStatementDiagnosticsAddBundleSize adds the bundle_size column,
+// which stores the size of a bundle, to the system.statement_diagnostics table.
+func alterSystemStatementDiagnosticsAddBundleSize(
+	ctx context.Context, cs clusterversion.ClusterVersion, d upgrade.TenantDeps,
+) error {
+	op := operation{
+		name:           "add-stmt-diags-bundle-size-col",
+		schemaList:     []string{"bundle_size"},
+		query:          addBundleSizeColToStmtDiags,
+		schemaExistsFn: hasColumn,
+	}
+	return migrateTable(ctx, cs, d, op, keys.StatementDiagnosticsTableID,
+		systemschema.StatementDiagnosticsTable)
+}
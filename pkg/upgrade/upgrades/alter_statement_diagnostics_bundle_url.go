@@ -0,0 +1,42 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/upgrade"
+)
+
+const addBundleURLColToStmtDiags = `
+ALTER TABLE system.statement_diagnostics
+ADD COLUMN IF NOT EXISTS bundle_url STRING NULL
+FAMILY "primary"
+`
+
+// alterSystemStatementDiagnosticsAddBundleURL adds the bundle_url column,
+// which stores the location of bundles copied to external storage, to the
+// system.statement_diagnostics table.
+func alterSystemStatementDiagnosticsAddBundleURL(
+	ctx context.Context, cs clusterversion.ClusterVersion, d upgrade.TenantDeps,
+) error {
+	op := operation{
+		name:           "add-stmt-diags-bundle-url-col",
+		schemaList:     []string{"bundle_url"},
+		query:          addBundleURLColToStmtDiags,
+		schemaExistsFn: hasColumn,
+	}
+	return migrateTable(ctx, cs, d, op, keys.StatementDiagnosticsTableID,
+		systemschema.StatementDiagnosticsTable)
+}
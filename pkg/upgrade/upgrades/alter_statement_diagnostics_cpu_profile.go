@@ -0,0 +1,60 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/upgrade"
+)
+
+const addCaptureCPUProfileColToStmtDiagReqs = `
+ALTER TABLE system.statement_diagnostics_requests
+ADD COLUMN IF NOT EXISTS capture_cpu_profile BOOL NULL
+FAMILY "primary"
+`
+
+const addCPUProfileColToStmtDiags = `
+ALTER TABLE system.statement_diagnostics
+ADD COLUMN IF NOT EXISTS cpu_profile BYTES NULL
+FAMILY "primary"
+`
+
+// alterSystemStatementDiagnosticsAddCPUProfile adds the capture_cpu_profile
+// column, which marks the requests that capture a CPU profile along with their
+// bundles, to the system.statement_diagnostics_requests table, and the
+// cpu_profile column, which stores these profiles, to the
+// system.statement_diagnostics table.
+func alterSystemStatementDiagnosticsAddCPUProfile(
+	ctx context.Context, cs clusterversion.ClusterVersion, d upgrade.TenantDeps,
+) error {
+	reqsOp := operation{
+		name:           "add-stmt-diag-reqs-capture-cpu-profile-col",
+		schemaList:     []string{"capture_cpu_profile"},
+		query:          addCaptureCPUProfileColToStmtDiagReqs,
+		schemaExistsFn: hasColumn,
+	}
+	if err := migrateTable(ctx, cs, d, reqsOp, keys.StatementDiagnosticsRequestsTableID,
+		systemschema.StatementDiagnosticsRequestsTable); err != nil {
+		return err
+	}
+	diagsOp := operation{
+		name:           "add-stmt-diags-cpu-profile-col",
+		schemaList:     []string{"cpu_profile"},
+		query:          addCPUProfileColToStmtDiags,
+		schemaExistsFn: hasColumn,
+	}
+	return migrateTable(ctx, cs, d, diagsOp, keys.StatementDiagnosticsTableID,
+		systemschema.StatementDiagnosticsTable)
+}
@@ -0,0 +1,226 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/server"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/catenumpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/catpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/descpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/tabledesc"
+	"github.com/cockroachdb/cockroach/pkg/sql/privilege"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/catconstants"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
+	"github.com/cockroachdb/cockroach/pkg/upgrade/upgrades"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+func TestAlterSystemStatementDiagnosticsAddCPUProfile(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	clusterArgs := base.TestClusterArgs{
+		ServerArgs: base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				Server: &server.TestingKnobs{
+					DisableAutomaticVersionUpgrade: make(chan struct{}),
+					BinaryVersionOverride: clusterversion.ByKey(
+						clusterversion.V23_1AlterSystemStatementDiagnosticsAddCPUProfile - 1),
+				},
+			},
+		},
+	}
+
+	var (
+		ctx   = context.Background()
+		tc    = testcluster.StartTestCluster(t, 1, clusterArgs)
+		s     = tc.Server(0)
+		sqlDB = tc.ServerConn(0)
+	)
+	defer tc.Stopper().Stop(ctx)
+
+	// Inject the old copies of the descriptors.
+	upgrades.InjectLegacyTable(ctx, t, s, systemschema.StatementDiagnosticsRequestsTable,
+		getDeprecatedStmtDiagReqsDescriptorWithoutCaptureCPUProfile)
+	upgrades.InjectLegacyTable(ctx, t, s, systemschema.StatementDiagnosticsTable,
+		getDeprecatedStmtDiagsDescriptorWithoutCPUProfile)
+	validateSchemaExists := func(expectExists bool) {
+		upgrades.ValidateSchemaExists(
+			ctx,
+			t,
+			s,
+			sqlDB,
+			keys.StatementDiagnosticsRequestsTableID,
+			systemschema.StatementDiagnosticsRequestsTable,
+			[]string{
+				`SELECT capture_cpu_profile FROM system.statement_diagnostics_requests LIMIT 0`,
+			},
+			[]upgrades.Schema{
+				{Name: "capture_cpu_profile", ValidationFn: upgrades.HasColumn},
+				{Name: "primary", ValidationFn: upgrades.HasColumnFamily},
+			},
+			expectExists,
+		)
+		upgrades.ValidateSchemaExists(
+			ctx,
+			t,
+			s,
+			sqlDB,
+			keys.StatementDiagnosticsTableID,
+			systemschema.StatementDiagnosticsTable,
+			[]string{
+				`SELECT cpu_profile FROM system.statement_diagnostics LIMIT 0`,
+			},
+			[]upgrades.Schema{
+				{Name: "cpu_profile", ValidationFn: upgrades.HasColumn},
+				{Name: "primary", ValidationFn: upgrades.HasColumnFamily},
+			},
+			expectExists,
+		)
+	}
+	// Validate that the tables have the old schemas.
+	validateSchemaExists(false)
+	// Run the upgrade.
+	upgrades.Upgrade(
+		t,
+		sqlDB,
+		clusterversion.V23_1AlterSystemStatementDiagnosticsAddCPUProfile,
+		nil,   /* done */
+		false, /* expectError */
+	)
+	// Validate that the tables have the new schemas.
+	validateSchemaExists(true)
+}
+
+// getDeprecatedStmtDiagReqsDescriptorWithoutCaptureCPUProfile returns the
+// system.statement_diagnostics_requests table descriptor that was being used
+// before adding the capture_cpu_profile column in the current version.
+func getDeprecatedStmtDiagReqsDescriptorWithoutCaptureCPUProfile() *descpb.TableDescriptor {
+	uniqueRowIDString := "unique_rowid()"
+	falseBoolString := "false"
+
+	return &descpb.TableDescriptor{
+		Name:                    string(catconstants.StatementDiagnosticsRequestsTableName),
+		ID:                      keys.StatementDiagnosticsRequestsTableID,
+		ParentID:                keys.SystemDatabaseID,
+		UnexposedParentSchemaID: keys.PublicSchemaID,
+		Version:                 1,
+		Columns: []descpb.ColumnDescriptor{
+			{Name: "id", ID: 1, Type: types.Int, DefaultExpr: &uniqueRowIDString, Nullable: false},
+			{Name: "completed", ID: 2, Type: types.Bool, Nullable: false, DefaultExpr: &falseBoolString},
+			{Name: "statement_fingerprint", ID: 3, Type: types.String, Nullable: false},
+			{Name: "statement_diagnostics_id", ID: 4, Type: types.Int, Nullable: true},
+			{Name: "requested_at", ID: 5, Type: types.TimestampTZ, Nullable: false},
+			{Name: "min_execution_latency", ID: 6, Type: types.Interval, Nullable: true},
+			{Name: "expires_at", ID: 7, Type: types.TimestampTZ, Nullable: true},
+			{Name: "sampling_probability", ID: 8, Type: types.Float, Nullable: true},
+			{Name: "pattern_type", ID: 9, Type: types.String, Nullable: true},
+		},
+		NextColumnID: 10,
+		Families: []descpb.ColumnFamilyDescriptor{
+			{
+				Name: "primary",
+				ColumnNames: []string{"id", "completed", "statement_fingerprint",
+					"statement_diagnostics_id", "requested_at", "min_execution_latency",
+					"expires_at", "sampling_probability", "pattern_type"},
+				ColumnIDs: []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7, 8, 9},
+			},
+		},
+		NextFamilyID: 1,
+		PrimaryIndex: descpb.IndexDescriptor{
+			Name:                tabledesc.LegacyPrimaryKeyIndexName,
+			ID:                  1,
+			Unique:              true,
+			KeyColumnNames:      []string{"id"},
+			KeyColumnDirections: []catenumpb.IndexColumn_Direction{catenumpb.IndexColumn_ASC},
+			KeyColumnIDs:        []descpb.ColumnID{1},
+		},
+		Indexes: []descpb.IndexDescriptor{
+			{
+				Name:                "completed_idx",
+				ID:                  2,
+				Unique:              false,
+				KeyColumnNames:      []string{"completed", "id"},
+				StoreColumnNames:    []string{"statement_fingerprint", "min_execution_latency", "expires_at", "sampling_probability"},
+				KeyColumnIDs:        []descpb.ColumnID{2, 1},
+				KeyColumnDirections: []catenumpb.IndexColumn_Direction{catenumpb.IndexColumn_ASC, catenumpb.IndexColumn_ASC},
+				StoreColumnIDs:      []descpb.ColumnID{3, 6, 7, 8},
+				Version:             descpb.StrictIndexColumnIDGuaranteesVersion,
+			},
+		},
+		NextIndexID: 3,
+		Checks: []*descpb.TableDescriptor_CheckConstraint{{
+			Name:      "check_sampling_probability",
+			Expr:      "sampling_probability BETWEEN 0.0:::FLOAT8 AND 1.0:::FLOAT8",
+			ColumnIDs: []descpb.ColumnID{8},
+		}},
+		Privileges:     catpb.NewCustomSuperuserPrivilegeDescriptor(privilege.ReadWriteData, username.NodeUserName()),
+		NextMutationID: 1,
+		FormatVersion:  3,
+	}
+}
+
+// getDeprecatedStmtDiagsDescriptorWithoutCPUProfile returns the
+// system.statement_diagnostics table descriptor that was being used before
+// adding the cpu_profile column in the current version.
+func getDeprecatedStmtDiagsDescriptorWithoutCPUProfile() *descpb.TableDescriptor {
+	uniqueRowIDString := "unique_rowid()"
+
+	return &descpb.TableDescriptor{
+		Name:                    string(catconstants.StatementDiagnosticsTableName),
+		ID:                      keys.StatementDiagnosticsTableID,
+		ParentID:                keys.SystemDatabaseID,
+		UnexposedParentSchemaID: keys.PublicSchemaID,
+		Version:                 1,
+		Columns: []descpb.ColumnDescriptor{
+			{Name: "id", ID: 1, Type: types.Int, DefaultExpr: &uniqueRowIDString, Nullable: false},
+			{Name: "statement_fingerprint", ID: 2, Type: types.String, Nullable: false},
+			{Name: "statement", ID: 3, Type: types.String, Nullable: false},
+			{Name: "collected_at", ID: 4, Type: types.TimestampTZ, Nullable: false},
+			{Name: "trace", ID: 5, Type: types.Jsonb, Nullable: true},
+			{Name: "bundle_chunks", ID: 6, Type: types.IntArray, Nullable: true},
+			{Name: "error", ID: 7, Type: types.String, Nullable: true},
+			{Name: "bundle_url", ID: 8, Type: types.String, Nullable: true},
+		},
+		NextColumnID: 9,
+		Families: []descpb.ColumnFamilyDescriptor{
+			{
+				Name: "primary",
+				ColumnNames: []string{"id", "statement_fingerprint", "statement",
+					"collected_at", "trace", "bundle_chunks", "error", "bundle_url"},
+				ColumnIDs: []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7, 8},
+			},
+		},
+		NextFamilyID: 1,
+		PrimaryIndex: descpb.IndexDescriptor{
+			Name:                tabledesc.LegacyPrimaryKeyIndexName,
+			ID:                  1,
+			Unique:              true,
+			KeyColumnNames:      []string{"id"},
+			KeyColumnDirections: []catenumpb.IndexColumn_Direction{catenumpb.IndexColumn_ASC},
+			KeyColumnIDs:        []descpb.ColumnID{1},
+		},
+		NextIndexID:    2,
+		Privileges:     catpb.NewCustomSuperuserPrivilegeDescriptor(privilege.ReadWriteData, username.NodeUserName()),
+		NextMutationID: 1,
+		FormatVersion:  3,
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/server"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/catenumpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/catpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/descpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/tabledesc"
+	"github.com/cockroachdb/cockroach/pkg/sql/privilege"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/catconstants"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
+	"github.com/cockroachdb/cockroach/pkg/upgrade/upgrades"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+func TestAlterSystemStatementDiagnosticsAddErrorMessage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	clusterArgs := base.TestClusterArgs{
+		ServerArgs: base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				Server: &server.TestingKnobs{
+					DisableAutomaticVersionUpgrade: make(chan struct{}),
+					BinaryVersionOverride: clusterversion.ByKey(
+						clusterversion.V23_1AlterSystemStatementDiagnosticsAddErrorMessage - 1),
+				},
+			},
+		},
+	}
+
+	var (
+		ctx   = context.Background()
+		tc    = testcluster.StartTestCluster(t, 1, clusterArgs)
+		s     = tc.Server(0)
+		sqlDB = tc.ServerConn(0)
+	)
+	defer tc.Stopper().Stop(ctx)
+
+	var (
+		validationStmts = []string{
+			`SELECT error_message FROM system.statement_diagnostics LIMIT 0`,
+		}
+		validationSchemas = []upgrades.Schema{
+			{Name: "error_message", ValidationFn: upgrades.HasColumn},
+			{Name: "primary", ValidationFn: upgrades.HasColumnFamily},
+		}
+	)
+
+	// Inject the old copy of the descriptor.
+	upgrades.InjectLegacyTable(ctx, t, s, systemschema.StatementDiagnosticsTable,
+		getDeprecatedStmtDiagsDescriptorWithoutErrorMessage)
+	validateSchemaExists := func(expectExists bool) {
+		upgrades.ValidateSchemaExists(
+			ctx,
+			t,
+			s,
+			sqlDB,
+			keys.StatementDiagnosticsTableID,
+			systemschema.StatementDiagnosticsTable,
+			validationStmts,
+			validationSchemas,
+			expectExists,
+		)
+	}
+	// Validate that the statement_diagnostics table has the old schema.
+	validateSchemaExists(false)
+	// Run the upgrade.
+	upgrades.Upgrade(
+		t,
+		sqlDB,
+		clusterversion.V23_1AlterSystemStatementDiagnosticsAddErrorMessage,
+		nil,   /* done */
+		false, /* expectError */
+	)
+	// Validate that the table has the new schema.
+	validateSchemaExists(true)
+}
+
+// getDeprecatedStmtDiagsDescriptorWithoutErrorMessage returns the
+// system.statement_diagnostics table descriptor that was being used before
+// adding the error_message column in the current version.
+func getDeprecatedStmtDiagsDescriptorWithoutErrorMessage() *descpb.TableDescriptor {
+	uniqueRowIDString := "unique_rowid()"
+
+	return &descpb.TableDescriptor{
+		Name:                    string(catconstants.StatementDiagnosticsTableName),
+		ID:                      keys.StatementDiagnosticsTableID,
+		ParentID:                keys.SystemDatabaseID,
+		UnexposedParentSchemaID: keys.PublicSchemaID,
+		Version:                 1,
+		Columns: []descpb.ColumnDescriptor{
+			{Name: "id", ID: 1, Type: types.Int, DefaultExpr: &uniqueRowIDString, Nullable: false},
+			{Name: "statement_fingerprint", ID: 2, Type: types.String, Nullable: false},
+			{Name: "statement", ID: 3, Type: types.String, Nullable: false},
+			{Name: "collected_at", ID: 4, Type: types.TimestampTZ, Nullable: false},
+			{Name: "trace", ID: 5, Type: types.Jsonb, Nullable: true},
+			{Name: "bundle_chunks", ID: 6, Type: types.IntArray, Nullable: true},
+			{Name: "error", ID: 7, Type: types.String, Nullable: true},
+			{Name: "bundle_url", ID: 8, Type: types.String, Nullable: true},
+			{Name: "cpu_profile", ID: 9, Type: types.Bytes, Nullable: true},
+		},
+		NextColumnID: 10,
+		Families: []descpb.ColumnFamilyDescriptor{
+			{
+				Name: "primary",
+				ColumnNames: []string{"id", "statement_fingerprint", "statement",
+					"collected_at", "trace", "bundle_chunks", "error", "bundle_url", "cpu_profile"},
+				ColumnIDs: []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7, 8, 9},
+			},
+		},
+		NextFamilyID: 1,
+		PrimaryIndex: descpb.IndexDescriptor{
+			Name:                tabledesc.LegacyPrimaryKeyIndexName,
+			ID:                  1,
+			Unique:              true,
+			KeyColumnNames:      []string{"id"},
+			KeyColumnDirections: []catenumpb.IndexColumn_Direction{catenumpb.IndexColumn_ASC},
+			KeyColumnIDs:        []descpb.ColumnID{1},
+		},
+		NextIndexID:    2,
+		Privileges:     catpb.NewCustomSuperuserPrivilegeDescriptor(privilege.ReadWriteData, username.NodeUserName()),
+		NextMutationID: 1,
+		FormatVersion:  3,
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/upgrade"
+)
+
+const addCaptureOnErrorAndMaxBundlesColsToStmtDiagReqs = `
+ALTER TABLE system.statement_diagnostics_requests
+ADD COLUMN IF NOT EXISTS capture_on_error BOOL NULL
+FAMILY "primary",
+ADD COLUMN IF NOT EXISTS max_bundles INT8 NULL
+FAMILY "primary"
+`
+
+// The polling query reads the request columns from completed_idx, so the index
+// is recreated to store the columns added since it was created, including the
+// ones above.
+const (
+	dropCompletedIdxV3 = `DROP INDEX IF EXISTS system.statement_diagnostics_requests@completed_idx`
+
+	createCompletedIdxV4 = `
+CREATE INDEX completed_idx ON system.statement_diagnostics_requests (completed, ID)
+  STORING (statement_fingerprint, min_execution_latency, expires_at, sampling_probability,
+    pattern_type, capture_cpu_profile, min_span_duration, capture_on_error, max_bundles)`
+)
+
+// alterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles adds
+// the capture_on_error column, which restricts a request to the executions
+// that fail, and the max_bundles column, which bounds the number of bundles
+// that a node collects for a request, to the
+// system.statement_diagnostics_requests table, and makes completed_idx store
+// all the columns read when polling for requests.
+func alterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles(
+	ctx context.Context, cs clusterversion.ClusterVersion, d upgrade.TenantDeps,
+) error {
+	for _, op := range []operation{
+		{
+			name:           "add-stmt-diag-reqs-capture-on-error-max-bundles-cols",
+			schemaList:     []string{"capture_on_error", "max_bundles"},
+			query:          addCaptureOnErrorAndMaxBundlesColsToStmtDiagReqs,
+			schemaExistsFn: hasColumn,
+		},
+		{
+			name:       "drop-stmt-diag-reqs-v3-index",
+			schemaList: []string{"completed_idx"},
+			query:      dropCompletedIdxV3,
+			schemaExistsFn: func(existing, _ catalog.TableDescriptor, _ string) (bool, error) {
+				// We want to determine whether the index created by
+				// sampledStmtDiagReqsMigration exists. That index has four stored
+				// columns. The index we introduce below has nine.
+				idx := catalog.FindIndexByName(existing, "completed_idx")
+				// If the index does not exist, we're good to proceed.
+				if idx == nil {
+					return true, nil
+				}
+				return idx.NumSecondaryStoredColumns() != 4, nil
+			},
+		},
+		{
+			name:           "create-stmt-diag-reqs-v4-index",
+			schemaList:     []string{"completed_idx"},
+			query:          createCompletedIdxV4,
+			schemaExistsFn: hasIndex,
+		},
+	} {
+		if err := migrateTable(ctx, cs, d, op, keys.StatementDiagnosticsRequestsTableID,
+			systemschema.StatementDiagnosticsRequestsTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
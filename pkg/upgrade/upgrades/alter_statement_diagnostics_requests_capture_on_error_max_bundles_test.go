@@ -0,0 +1,193 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/server"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/catenumpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/catpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/descpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/tabledesc"
+	"github.com/cockroachdb/cockroach/pkg/sql/privilege"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/catconstants"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
+	"github.com/cockroachdb/cockroach/pkg/upgrade/upgrades"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+func TestAlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	clusterArgs := base.TestClusterArgs{
+		ServerArgs: base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				Server: &server.TestingKnobs{
+					DisableAutomaticVersionUpgrade: make(chan struct{}),
+					BinaryVersionOverride: clusterversion.ByKey(
+						clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles - 1),
+				},
+			},
+		},
+	}
+
+	var (
+		ctx   = context.Background()
+		tc    = testcluster.StartTestCluster(t, 1, clusterArgs)
+		s     = tc.Server(0)
+		sqlDB = tc.ServerConn(0)
+	)
+	defer tc.Stopper().Stop(ctx)
+
+	var (
+		validationStmts = []string{
+			`SELECT capture_on_error, max_bundles FROM system.statement_diagnostics_requests LIMIT 0`,
+			`SELECT pattern_type, capture_cpu_profile, min_span_duration, capture_on_error, max_bundles
+			FROM system.statement_diagnostics_requests@completed_idx LIMIT 0`,
+		}
+		validationSchemas = []upgrades.Schema{
+			{Name: "capture_on_error", ValidationFn: upgrades.HasColumn},
+			{Name: "max_bundles", ValidationFn: upgrades.HasColumn},
+			{Name: "primary", ValidationFn: upgrades.HasColumnFamily},
+			{Name: "completed_idx", ValidationFn: storesAllRequestColumns},
+		}
+	)
+
+	// Inject the old copy of the descriptor.
+	upgrades.InjectLegacyTable(ctx, t, s, systemschema.StatementDiagnosticsRequestsTable,
+		getDeprecatedStmtDiagReqsDescriptorWithoutCaptureOnErrorAndMaxBundles)
+	validateSchemaExists := func(expectExists bool) {
+		upgrades.ValidateSchemaExists(
+			ctx,
+			t,
+			s,
+			sqlDB,
+			keys.StatementDiagnosticsRequestsTableID,
+			systemschema.StatementDiagnosticsRequestsTable,
+			validationStmts,
+			validationSchemas,
+			expectExists,
+		)
+	}
+	// Validate that the statement_diagnostics_requests table has the old
+	// schema.
+	validateSchemaExists(false)
+	// Run the upgrade.
+	upgrades.Upgrade(
+		t,
+		sqlDB,
+		clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles,
+		nil,   /* done */
+		false, /* expectError */
+	)
+	// Validate that the table has the new schema.
+	validateSchemaExists(true)
+}
+
+// storesAllRequestColumns returns whether the index with the given name stores
+// all the columns that it stores in the expected table, which the legacy
+// completed_idx doesn't.
+func storesAllRequestColumns(
+	storedTable, expectedTable catalog.TableDescriptor, name string,
+) (bool, error) {
+	storedIdx := catalog.FindIndexByName(storedTable, name)
+	if storedIdx == nil {
+		return false, nil
+	}
+	expectedIdx, err := catalog.MustFindIndexByName(expectedTable, name)
+	if err != nil {
+		return false, err
+	}
+	return storedIdx.NumSecondaryStoredColumns() == expectedIdx.NumSecondaryStoredColumns(), nil
+}
+
+// getDeprecatedStmtDiagReqsDescriptorWithoutCaptureOnErrorAndMaxBundles
+// returns the system.statement_diagnostics_requests table descriptor that was
+// being used before adding the capture_on_error and max_bundles columns in the
+// current version.
+func getDeprecatedStmtDiagReqsDescriptorWithoutCaptureOnErrorAndMaxBundles() *descpb.TableDescriptor {
+	uniqueRowIDString := "unique_rowid()"
+	falseBoolString := "false"
+
+	return &descpb.TableDescriptor{
+		Name:                    string(catconstants.StatementDiagnosticsRequestsTableName),
+		ID:                      keys.StatementDiagnosticsRequestsTableID,
+		ParentID:                keys.SystemDatabaseID,
+		UnexposedParentSchemaID: keys.PublicSchemaID,
+		Version:                 1,
+		Columns: []descpb.ColumnDescriptor{
+			{Name: "id", ID: 1, Type: types.Int, DefaultExpr: &uniqueRowIDString, Nullable: false},
+			{Name: "completed", ID: 2, Type: types.Bool, Nullable: false, DefaultExpr: &falseBoolString},
+			{Name: "statement_fingerprint", ID: 3, Type: types.String, Nullable: false},
+			{Name: "statement_diagnostics_id", ID: 4, Type: types.Int, Nullable: true},
+			{Name: "requested_at", ID: 5, Type: types.TimestampTZ, Nullable: false},
+			{Name: "min_execution_latency", ID: 6, Type: types.Interval, Nullable: true},
+			{Name: "expires_at", ID: 7, Type: types.TimestampTZ, Nullable: true},
+			{Name: "sampling_probability", ID: 8, Type: types.Float, Nullable: true},
+			{Name: "pattern_type", ID: 9, Type: types.String, Nullable: true},
+			{Name: "capture_cpu_profile", ID: 10, Type: types.Bool, Nullable: true},
+			{Name: "min_span_duration", ID: 11, Type: types.Interval, Nullable: true},
+		},
+		NextColumnID: 12,
+		Families: []descpb.ColumnFamilyDescriptor{
+			{
+				Name: "primary",
+				ColumnNames: []string{"id", "completed", "statement_fingerprint",
+					"statement_diagnostics_id", "requested_at", "min_execution_latency",
+					"expires_at", "sampling_probability", "pattern_type", "capture_cpu_profile",
+					"min_span_duration"},
+				ColumnIDs: []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+			},
+		},
+		NextFamilyID: 1,
+		PrimaryIndex: descpb.IndexDescriptor{
+			Name:                tabledesc.LegacyPrimaryKeyIndexName,
+			ID:                  1,
+			Unique:              true,
+			KeyColumnNames:      []string{"id"},
+			KeyColumnDirections: []catenumpb.IndexColumn_Direction{catenumpb.IndexColumn_ASC},
+			KeyColumnIDs:        []descpb.ColumnID{1},
+		},
+		Indexes: []descpb.IndexDescriptor{
+			{
+				Name:                "completed_idx",
+				ID:                  2,
+				Unique:              false,
+				KeyColumnNames:      []string{"completed", "id"},
+				StoreColumnNames:    []string{"statement_fingerprint", "min_execution_latency", "expires_at", "sampling_probability"},
+				KeyColumnIDs:        []descpb.ColumnID{2, 1},
+				KeyColumnDirections: []catenumpb.IndexColumn_Direction{catenumpb.IndexColumn_ASC, catenumpb.IndexColumn_ASC},
+				StoreColumnIDs:      []descpb.ColumnID{3, 6, 7, 8},
+				Version:             descpb.StrictIndexColumnIDGuaranteesVersion,
+			},
+		},
+		NextIndexID: 3,
+		Checks: []*descpb.TableDescriptor_CheckConstraint{{
+			Name:      "check_sampling_probability",
+			Expr:      "sampling_probability BETWEEN 0.0:::FLOAT8 AND 1.0:::FLOAT8",
+			ColumnIDs: []descpb.ColumnID{8},
+		}},
+		Privileges:     catpb.NewCustomSuperuserPrivilegeDescriptor(privilege.ReadWriteData, username.NodeUserName()),
+		NextMutationID: 1,
+		FormatVersion:  3,
+	}
+}
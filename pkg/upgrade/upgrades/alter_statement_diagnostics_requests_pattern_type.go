@@ -0,0 +1,43 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/upgrade"
+)
+
+const addPatternTypeColToStmtDiagReqs = `
+ALTER TABLE system.statement_diagnostics_requests
+ADD COLUMN IF NOT EXISTS pattern_type STRING NULL
+FAMILY "primary"
+`
+
+// alterSystemStatementDiagnosticsRequestsAddPatternType adds the pattern_type
+// column, which determines how the fingerprint of a request is matched against
+// the fingerprints of statements, to the system.statement_diagnostics_requests
+// table.
+func alterSystemStatementDiagnosticsRequestsAddPatternType(
+	ctx context.Context, cs clusterversion.ClusterVersion, d upgrade.TenantDeps,
+) error {
+	op := operation{
+		name:           "add-stmt-diag-reqs-pattern-type-col",
+		schemaList:     []string{"pattern_type"},
+		query:          addPatternTypeColToStmtDiagReqs,
+		schemaExistsFn: hasColumn,
+	}
+	return migrateTable(ctx, cs, d, op, keys.StatementDiagnosticsRequestsTableID,
+		systemschema.StatementDiagnosticsRequestsTable)
+}
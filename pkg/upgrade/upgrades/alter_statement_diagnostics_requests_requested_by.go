@@ -0,0 +1,42 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/upgrade"
+)
+
+const addRequestedByColToStmtDiagReqs = `
+ALTER TABLE system.statement_diagnostics_requests
+ADD COLUMN IF NOT EXISTS requested_by STRING NULL
+FAMILY "primary"
+`
+
+// alterSystemStatementDiagnosticsRequestsAddRequestedBy adds the requested_by
+// column, which stores the user that inserted a request, to the
+// system.statement_diagnostics_requests table.
+func alterSystemStatementDiagnosticsRequestsAddRequestedBy(
+	ctx context.Context, cs clusterversion.ClusterVersion, d upgrade.TenantDeps,
+) error {
+	op := operation{
+		name:           "add-stmt-diag-reqs-requested-by-col",
+		schemaList:     []string{"requested_by"},
+		query:          addRequestedByColToStmtDiagReqs,
+		schemaExistsFn: hasColumn,
+	}
+	return migrateTable(ctx, cs, d, op, keys.StatementDiagnosticsRequestsTableID,
+		systemschema.StatementDiagnosticsRequestsTable)
+}
@@ -258,6 +258,54 @@ var upgrades = []upgradebase.Upgrade{
 		keyVisualizerTablesMigration,
 		"initialize key visualizer tables and jobs",
 	),
+	upgrade.NewTenantUpgrade(
+		"add column bundle_url to table system.statement_diagnostics",
+		toCV(clusterversion.V23_1AlterSystemStatementDiagnosticsAddBundleURL),
+		upgrade.NoPrecondition,
+		alterSystemStatementDiagnosticsAddBundleURL,
+	),
+	upgrade.NewTenantUpgrade(
+		"add column pattern_type to table system.statement_diagnostics_requests",
+		toCV(clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddPatternType),
+		upgrade.NoPrecondition,
+		alterSystemStatementDiagnosticsRequestsAddPatternType,
+	),
+	upgrade.NewTenantUpgrade(
+		"add cpu profile columns to statement diagnostics system tables",
+		toCV(clusterversion.V23_1AlterSystemStatementDiagnosticsAddCPUProfile),
+		upgrade.NoPrecondition,
+		alterSystemStatementDiagnosticsAddCPUProfile,
+	),
+	upgrade.NewTenantUpgrade(
+		"add min_span_duration column to system.statement_diagnostics_requests",
+		toCV(clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddMinSpanDuration),
+		upgrade.NoPrecondition,
+		alterSystemStatementDiagnosticsRequestsAddMinSpanDuration,
+	),
+	upgrade.NewTenantUpgrade(
+		"add error_message column to system.statement_diagnostics",
+		toCV(clusterversion.V23_1AlterSystemStatementDiagnosticsAddErrorMessage),
+		upgrade.NoPrecondition,
+		alterSystemStatementDiagnosticsAddErrorMessage,
+	),
+	upgrade.NewTenantUpgrade(
+		"add capture_on_error and max_bundles columns to system.statement_diagnostics_requests",
+		toCV(clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles),
+		upgrade.NoPrecondition,
+		alterSystemStatementDiagnosticsRequestsAddCaptureOnErrorAndMaxBundles,
+	),
+	upgrade.NewTenantUpgrade(
+		"add bundle_size column to system.statement_diagnostics",
+		toCV(clusterversion.V23_1AlterSystemStatementDiagnosticsAddBundleSize),
+		upgrade.NoPrecondition,
+		alterSystemStatementDiagnosticsAddBundleSize,
+	),
+	upgrade.NewTenantUpgrade(
+		"add requested_by column to system.statement_diagnostics_requests",
+		toCV(clusterversion.V23_1AlterSystemStatementDiagnosticsRequestsAddRequestedBy),
+		upgrade.NoPrecondition,
+		alterSystemStatementDiagnosticsRequestsAddRequestedBy,
+	),
 }
 
 func init() {
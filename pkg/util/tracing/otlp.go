@@ -0,0 +1,116 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tracing
+
+import (
+	"encoding/binary"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// otlpStringAttribute returns an OTLP attribute with a string value.
+func otlpStringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key: key,
+		Value: &commonpb.AnyValue{
+			Value: &commonpb.AnyValue_StringValue{StringValue: value},
+		},
+	}
+}
+
+// otlpID returns the 8 big-endian bytes of an ID, which is how OTLP represents
+// span IDs and each half of trace IDs.
+func otlpID(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// TraceToOTLPJSON returns the representation of the trace in the OTLP/JSON
+// format, as an ExportTraceServiceRequest, which can be imported by most
+// tracing backends and OpenTelemetry collectors. The request is encoded by
+// protojson, so the IDs are base64-encoded and the enums are numbers.
+//
+// OTLP trace IDs are 128 bits long, so the trace ID of every span is derived
+// from the trace ID and the span ID of the root span, which is assumed to be
+// the first span in the recording. The tags of the spans become attributes,
+// prefixed by the name of their group if any, and their log messages, stripped
+// of redaction markers, become events.
+func TraceToOTLPJSON(trace tracingpb.Recording) (string, error) {
+	var traceID []byte
+	if len(trace) > 0 {
+		traceID = append(otlpID(uint64(trace[0].TraceID)), otlpID(uint64(trace[0].SpanID))...)
+	}
+	spans := make([]*tracepb.Span, 0, len(trace))
+	for _, sp := range trace {
+		s := &tracepb.Span{
+			TraceId:           traceID,
+			SpanId:            otlpID(uint64(sp.SpanID)),
+			Name:              sp.Operation,
+			Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+			StartTimeUnixNano: uint64(sp.StartTime.UnixNano()),
+			EndTimeUnixNano:   uint64(sp.StartTime.Add(sp.Duration).UnixNano()),
+			// Spans that didn't finish have the default STATUS_CODE_UNSET.
+			Status: &tracepb.Status{},
+		}
+		if sp.ParentSpanID != 0 {
+			s.ParentSpanId = otlpID(uint64(sp.ParentSpanID))
+		}
+		if sp.Finished {
+			s.Status.Code = tracepb.Status_STATUS_CODE_OK
+		}
+		for _, tagGroup := range sp.TagGroups {
+			for _, tag := range tagGroup.Tags {
+				key := tag.Key
+				if tagGroup.Name != tracingpb.AnonymousTagGroupName {
+					key = tagGroup.Name + "-" + key
+				}
+				s.Attributes = append(s.Attributes, otlpStringAttribute(key, tag.Value))
+			}
+		}
+		for _, l := range sp.Logs {
+			s.Events = append(s.Events, &tracepb.Span_Event{
+				TimeUnixNano: uint64(l.Time.UnixNano()),
+				Name:         l.Msg().StripMarkers(),
+			})
+		}
+		spans = append(spans, s)
+	}
+	req := &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{
+				Attributes: []*commonpb.KeyValue{
+					otlpStringAttribute("service.name", "cockroachdb"),
+				},
+			},
+			InstrumentationLibrarySpans: []*tracepb.InstrumentationLibrarySpans{{
+				InstrumentationLibrary: &commonpb.InstrumentationLibrary{
+					Name: "github.com/cockroachdb/cockroach/pkg/util/tracing",
+				},
+				Spans: spans,
+			}},
+		}},
+	}
+	res, err := protojson.MarshalOptions{
+		Multiline:      true,
+		Indent:         "\t",
+		UseEnumNumbers: true,
+	}.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
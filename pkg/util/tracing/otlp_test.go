@@ -0,0 +1,86 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tracing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceToOTLPJSON(t *testing.T) {
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec := tracingpb.Recording{
+		{
+			TraceID:   0x10,
+			SpanID:    0x1,
+			Operation: "root",
+			StartTime: start,
+			Duration:  10 * time.Millisecond,
+			Finished:  true,
+			TagGroups: []tracingpb.TagGroup{
+				{Tags: []tracingpb.Tag{{Key: "node", Value: "1"}}},
+				{Name: "txn", Tags: []tracingpb.Tag{{Key: "id", Value: "abc"}}},
+			},
+		},
+		{
+			TraceID:      0x10,
+			SpanID:       0xab,
+			ParentSpanID: 0x1,
+			Operation:    "child",
+			StartTime:    start.Add(time.Millisecond),
+			Duration:     2 * time.Millisecond,
+			Logs: []tracingpb.LogRecord{
+				{Time: start.Add(2 * time.Millisecond), Message: "hello ‹world›"},
+			},
+		},
+	}
+	res, err := TraceToOTLPJSON(rec)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+	"resourceSpans": [{
+		"resource": {
+			"attributes": [{"key": "service.name", "value": {"stringValue": "cockroachdb"}}]
+		},
+		"instrumentationLibrarySpans": [{
+			"instrumentationLibrary": {"name": "github.com/cockroachdb/cockroach/pkg/util/tracing"},
+			"spans": [
+				{
+					"traceId": "AAAAAAAAABAAAAAAAAAAAQ==",
+					"spanId": "AAAAAAAAAAE=",
+					"name": "root",
+					"kind": 1,
+					"startTimeUnixNano": "1672628645000000000",
+					"endTimeUnixNano": "1672628645010000000",
+					"attributes": [
+						{"key": "node", "value": {"stringValue": "1"}},
+						{"key": "txn-id", "value": {"stringValue": "abc"}}
+					],
+					"status": {"code": 1}
+				},
+				{
+					"traceId": "AAAAAAAAABAAAAAAAAAAAQ==",
+					"spanId": "AAAAAAAAAKs=",
+					"parentSpanId": "AAAAAAAAAAE=",
+					"name": "child",
+					"kind": 1,
+					"startTimeUnixNano": "1672628645001000000",
+					"endTimeUnixNano": "1672628645003000000",
+					"events": [{"timeUnixNano": "1672628645002000000", "name": "hello world"}],
+					"status": {}
+				}
+			]
+		}]
+	}]
+}`, res)
+}
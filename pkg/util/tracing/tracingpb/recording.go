@@ -226,6 +226,39 @@ func (r Recording) FindSpan(operation string) (RecordedSpan, bool) {
 	return RecordedSpan{}, false
 }
 
+// FilterByMinDuration returns a new recording with the spans of r that lasted
+// at least d, along with all of their ancestors so that the spans that are kept
+// remain connected to the root. The first Span, which is the root, is always
+// kept. The spans keep their order in r.
+func (r Recording) FilterByMinDuration(d time.Duration) Recording {
+	if len(r) == 0 {
+		return nil
+	}
+	idx := make(map[SpanID]int, len(r))
+	for i, sp := range r {
+		idx[sp.SpanID] = i
+	}
+	keep := make([]bool, len(r))
+	keep[0] = true
+	for i, sp := range r {
+		if sp.Duration < d {
+			continue
+		}
+		// Keep the span and its ancestors, stopping at the first one that is
+		// already kept.
+		for j, ok := i, true; ok && !keep[j]; j, ok = idx[r[j].ParentSpanID] {
+			keep[j] = true
+		}
+	}
+	res := make(Recording, 0, len(r))
+	for i, sp := range r {
+		if keep[i] {
+			res = append(res, sp)
+		}
+	}
+	return res
+}
+
 // OperationAndMetadata contains information about a tracing span operation and
 // its corresponding metadata.
 type OperationAndMetadata struct {
@@ -0,0 +1,62 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tracingpb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingFilterByMinDuration(t *testing.T) {
+	// root (10ms)
+	//   a (1ms)
+	//     a1 (5ms)
+	//   b (3ms)
+	//     b1 (1ms)
+	//   c (2ms)
+	rec := Recording{
+		{SpanID: 1, Operation: "root", Duration: 10 * time.Millisecond},
+		{SpanID: 2, ParentSpanID: 1, Operation: "a", Duration: time.Millisecond},
+		{SpanID: 3, ParentSpanID: 2, Operation: "a1", Duration: 5 * time.Millisecond},
+		{SpanID: 4, ParentSpanID: 1, Operation: "b", Duration: 3 * time.Millisecond},
+		{SpanID: 5, ParentSpanID: 4, Operation: "b1", Duration: time.Millisecond},
+		{SpanID: 6, ParentSpanID: 1, Operation: "c", Duration: 2 * time.Millisecond},
+	}
+	operations := func(r Recording) []string {
+		var ops []string
+		for _, sp := range r {
+			ops = append(ops, sp.Operation)
+		}
+		return ops
+	}
+
+	for _, tc := range []struct {
+		minDuration time.Duration
+		expected    []string
+	}{
+		{0, []string{"root", "a", "a1", "b", "b1", "c"}},
+		{time.Millisecond, []string{"root", "a", "a1", "b", "b1", "c"}},
+		// a is kept as the parent of a1.
+		{2 * time.Millisecond, []string{"root", "a", "a1", "b", "c"}},
+		{4 * time.Millisecond, []string{"root", "a", "a1"}},
+		{6 * time.Millisecond, []string{"root"}},
+		// The root is kept even if it is shorter than the minimum duration.
+		{time.Hour, []string{"root"}},
+	} {
+		t.Run(tc.minDuration.String(), func(t *testing.T) {
+			require.Equal(t, tc.expected, operations(rec.FilterByMinDuration(tc.minDuration)))
+		})
+	}
+	require.Len(t, rec, 6)
+	require.Empty(t, Recording(nil).FilterByMinDuration(time.Millisecond))
+}
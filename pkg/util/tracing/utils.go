@@ -11,6 +11,8 @@
 package tracing
 
 import (
+	"fmt"
+
 	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
 	"github.com/cockroachdb/redact"
 	"github.com/gogo/protobuf/jsonpb"
@@ -19,20 +21,34 @@ import (
 // TraceToJSON returns the string representation of the trace in JSON format.
 //
 // TraceToJSON assumes that the first span in the recording contains all the
-// other spans.
-func TraceToJSON(trace tracingpb.Recording) (string, error) {
-	root := normalizeSpan(trace[0], trace)
+// other spans. If the parent-child relationships of the recording have cycles,
+// the IDs of the spans at which they were broken are returned in cycles so that
+// the caller can report the malformed recording (this package can't log).
+func TraceToJSON(trace tracingpb.Recording) (_ string, cycles []tracingpb.SpanID, _ error) {
+	root := normalizeSpan(trace[0], trace, make(map[tracingpb.SpanID]struct{}), &cycles)
 	marshaller := jsonpb.Marshaler{
 		Indent: "\t",
 	}
 	str, err := marshaller.MarshalToString(&root)
 	if err != nil {
-		return "", err
+		return "", cycles, err
 	}
-	return str, nil
+	return str, cycles, nil
 }
 
-func normalizeSpan(s tracingpb.RecordedSpan, trace tracingpb.Recording) tracingpb.NormalizedSpan {
+// normalizeSpan returns the tree of spans rooted at s. visited is the set of
+// spans that were already added to the tree: a malformed recording can have
+// cycles in its parent-child relationships (e.g. a span that is its own
+// parent), so a span that was already visited is replaced by a sentinel span
+// rather than recursed into again. The IDs of such spans are appended to
+// cycles.
+func normalizeSpan(
+	s tracingpb.RecordedSpan,
+	trace tracingpb.Recording,
+	visited map[tracingpb.SpanID]struct{},
+	cycles *[]tracingpb.SpanID,
+) tracingpb.NormalizedSpan {
+	visited[s.SpanID] = struct{}{}
 	var n tracingpb.NormalizedSpan
 	n.Operation = s.Operation
 	n.StartTime = s.StartTime
@@ -46,7 +62,14 @@ func normalizeSpan(s tracingpb.RecordedSpan, trace tracingpb.Recording) tracingp
 		if ss.ParentSpanID != s.SpanID {
 			continue
 		}
-		n.Children = append(n.Children, normalizeSpan(ss, trace))
+		if _, ok := visited[ss.SpanID]; ok {
+			n.Children = append(n.Children, tracingpb.NormalizedSpan{
+				Operation: fmt.Sprintf("<cycle: span %d already visited>", ss.SpanID),
+			})
+			*cycles = append(*cycles, ss.SpanID)
+			continue
+		}
+		n.Children = append(n.Children, normalizeSpan(ss, trace, visited, cycles))
 	}
 	return n
 }
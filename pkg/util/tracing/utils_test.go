@@ -0,0 +1,88 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tracing
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTraceToJSONCycle checks that malformed recordings whose parent-child
+// relationships have cycles are converted to JSON instead of recursing
+// infinitely, and that the spans at which the cycles were broken are reported.
+func TestTraceToJSONCycle(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rec      tracingpb.Recording
+		expected tracingpb.NormalizedSpan
+		cycles   []tracingpb.SpanID
+	}{
+		{
+			name: "own parent",
+			rec: tracingpb.Recording{
+				{SpanID: 1, ParentSpanID: 1, Operation: "root"},
+				{SpanID: 2, ParentSpanID: 1, Operation: "a"},
+			},
+			expected: tracingpb.NormalizedSpan{
+				Operation: "root",
+				Children: []tracingpb.NormalizedSpan{
+					{Operation: "<cycle: span 1 already visited>"},
+					{Operation: "a"},
+				},
+			},
+			cycles: []tracingpb.SpanID{1},
+		},
+		{
+			name: "descendant is parent",
+			rec: tracingpb.Recording{
+				{SpanID: 1, ParentSpanID: 3, Operation: "root"},
+				{SpanID: 2, ParentSpanID: 1, Operation: "a"},
+				{SpanID: 3, ParentSpanID: 2, Operation: "b"},
+			},
+			expected: tracingpb.NormalizedSpan{
+				Operation: "root",
+				Children: []tracingpb.NormalizedSpan{{
+					Operation: "a",
+					Children: []tracingpb.NormalizedSpan{{
+						Operation: "b",
+						Children: []tracingpb.NormalizedSpan{
+							{Operation: "<cycle: span 1 already visited>"},
+						},
+					}},
+				}},
+			},
+			cycles: []tracingpb.SpanID{1},
+		},
+		{
+			name: "no cycle",
+			rec: tracingpb.Recording{
+				{SpanID: 1, Operation: "root"},
+				{SpanID: 2, ParentSpanID: 1, Operation: "a"},
+			},
+			expected: tracingpb.NormalizedSpan{
+				Operation: "root",
+				Children:  []tracingpb.NormalizedSpan{{Operation: "a"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cycles []tracingpb.SpanID
+			n := normalizeSpan(tc.rec[0], tc.rec, make(map[tracingpb.SpanID]struct{}), &cycles)
+			require.Equal(t, tc.expected, n)
+			require.Equal(t, tc.cycles, cycles)
+			_, cycles, err := TraceToJSON(tc.rec)
+			require.NoError(t, err)
+			require.Equal(t, tc.cycles, cycles)
+		})
+	}
+}